@@ -0,0 +1,132 @@
+package guac
+
+import "strings"
+
+// ArgType is the kind of value a connection parameter takes
+type ArgType int
+
+const (
+	// ArgString is free text, and the type of any parameter that isn't known
+	ArgString ArgType = iota
+	// ArgBoolean is "true" or "false"
+	ArgBoolean
+	// ArgNumber is a decimal integer
+	ArgNumber
+)
+
+// String returns the name of the type
+func (t ArgType) String() string {
+	switch t {
+	case ArgBoolean:
+		return "boolean"
+	case ArgNumber:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// ArgSpec describes a connection parameter guacd requested in its args instruction
+type ArgSpec struct {
+	// Name is the parameter name, the key used in Config.Parameters
+	Name string
+	// Type is the kind of value the parameter takes
+	Type ArgType
+	// Sensitive is true for parameters holding secrets, which forms should mask
+	Sensitive bool
+}
+
+// argVersionPrefix starts the protocol version guacd 1.1.0 and later send as the first argument
+const argVersionPrefix = "VERSION_"
+
+// knownArgTypes are the types of the guacd parameters that aren't free text
+var knownArgTypes = map[string]ArgType{
+	"port":                       ArgNumber,
+	"width":                      ArgNumber,
+	"height":                     ArgNumber,
+	"dpi":                        ArgNumber,
+	"color-depth":                ArgNumber,
+	"font-size":                  ArgNumber,
+	"scrollback":                 ArgNumber,
+	"timeout":                    ArgNumber,
+	"autoretry":                  ArgNumber,
+	"dest-port":                  ArgNumber,
+	"gateway-port":               ArgNumber,
+	"sftp-port":                  ArgNumber,
+	"server-alive-interval":      ArgNumber,
+	"wol-udp-port":               ArgNumber,
+	"wol-wait-time":              ArgNumber,
+	"read-only":                  ArgBoolean,
+	"swap-red-blue":              ArgBoolean,
+	"ignore-cert":                ArgBoolean,
+	"console":                    ArgBoolean,
+	"console-audio":              ArgBoolean,
+	"disable-audio":              ArgBoolean,
+	"disable-copy":               ArgBoolean,
+	"disable-paste":              ArgBoolean,
+	"disable-auth":               ArgBoolean,
+	"disable-bitmap-caching":     ArgBoolean,
+	"disable-offscreen-caching":  ArgBoolean,
+	"disable-glyph-caching":      ArgBoolean,
+	"enable-audio":               ArgBoolean,
+	"enable-audio-input":         ArgBoolean,
+	"enable-printing":            ArgBoolean,
+	"enable-drive":               ArgBoolean,
+	"enable-sftp":                ArgBoolean,
+	"enable-touch":               ArgBoolean,
+	"enable-wallpaper":           ArgBoolean,
+	"enable-theming":             ArgBoolean,
+	"enable-font-smoothing":      ArgBoolean,
+	"enable-full-window-drag":    ArgBoolean,
+	"enable-desktop-composition": ArgBoolean,
+	"enable-menu-animations":     ArgBoolean,
+	"create-drive-path":          ArgBoolean,
+	"create-recording-path":      ArgBoolean,
+	"recording-exclude-output":   ArgBoolean,
+	"recording-exclude-mouse":    ArgBoolean,
+	"recording-include-keys":     ArgBoolean,
+	"wol-send-packet":            ArgBoolean,
+}
+
+// sensitiveArgs are the guacd parameters holding secrets
+var sensitiveArgs = map[string]bool{
+	"password":         true,
+	"passphrase":       true,
+	"private-key":      true,
+	"gateway-password": true,
+	"sftp-password":    true,
+	"sftp-passphrase":  true,
+	"sftp-private-key": true,
+	"ca-cert":          false,
+}
+
+// ParseArgs describes the parameters requested by a guacd args instruction, so a form for a new
+// connection can be built from what guacd actually wants. The protocol version guacd sends ahead
+// of the parameters, if any, is returned separately.
+func ParseArgs(args *Instruction) (version string, specs []ArgSpec, err error) {
+	if args == nil || args.Opcode != "args" {
+		return "", nil, ErrServer.NewError("Expected an args instruction.")
+	}
+
+	names := args.Args
+	if len(names) > 0 && strings.HasPrefix(names[0], argVersionPrefix) {
+		version = names[0]
+		names = names[1:]
+	}
+
+	specs = make([]ArgSpec, 0, len(names))
+	for _, name := range names {
+		specs = append(specs, ArgSpec{
+			Name:      name,
+			Type:      knownArgTypes[name],
+			Sensitive: sensitiveArgs[name],
+		})
+	}
+	return version, specs, nil
+}
+
+// ArgSpecs describes the parameters guacd requested during the handshake
+func (s *Stream) ArgSpecs() []ArgSpec {
+	_, specs, _ := ParseArgs(NewInstruction("args", s.HandshakeArgs...))
+	return specs
+}
@@ -0,0 +1,39 @@
+package guac
+
+import "testing"
+
+func TestParseArgs(t *testing.T) {
+	ins, err := Parse([]byte("4.args,13.VERSION_1_5_0,8.hostname,4.port,8.username,8.password,9.read-only,11.color-depth;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, specs, err := ParseArgs(ins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "VERSION_1_5_0" {
+		t.Error("Unexpected version", version)
+	}
+
+	expected := []ArgSpec{
+		{Name: "hostname", Type: ArgString},
+		{Name: "port", Type: ArgNumber},
+		{Name: "username", Type: ArgString},
+		{Name: "password", Type: ArgString, Sensitive: true},
+		{Name: "read-only", Type: ArgBoolean},
+		{Name: "color-depth", Type: ArgNumber},
+	}
+	if len(specs) != len(expected) {
+		t.Fatal("Unexpected specs", specs)
+	}
+	for i := range expected {
+		if specs[i] != expected[i] {
+			t.Error("Expected", expected[i], "got", specs[i])
+		}
+	}
+
+	if _, _, err = ParseArgs(NewInstruction("ready", "$id")); err == nil {
+		t.Error("Expected an error for a non-args instruction")
+	}
+}
@@ -0,0 +1,42 @@
+package guac
+
+// Decision is what an Authorizer decides to do with an instruction
+type Decision int
+
+const (
+	// Allow forwards the instruction
+	Allow Decision = iota
+	// Drop discards the instruction and keeps the session
+	Drop
+	// Terminate discards the instruction and disconnects the session
+	Terminate
+)
+
+// String returns the name of the decision
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "allow"
+	case Drop:
+		return "drop"
+	case Terminate:
+		return "terminate"
+	}
+	return "unknown"
+}
+
+// Authorizer decides, instruction by instruction, what a session may send in either direction.
+// Unlike filters it can keep state across instructions and sessions, for example only allowing
+// the clipboard once a request has been approved. It is called from the pumps of every session,
+// so it must be safe for concurrent use and fast.
+type Authorizer interface {
+	Authorize(connectionID string, ins *Instruction) Decision
+}
+
+// AuthorizerFunc adapts a function to an Authorizer
+type AuthorizerFunc func(connectionID string, ins *Instruction) Decision
+
+// Authorize implements Authorizer
+func (f AuthorizerFunc) Authorize(connectionID string, ins *Instruction) Decision {
+	return f(connectionID, ins)
+}
@@ -0,0 +1,102 @@
+package guac
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// clipboardApproval only allows the clipboard once approved, and ends sessions sending files
+type clipboardApproval struct {
+	approved int32
+}
+
+func (a *clipboardApproval) Authorize(connectionID string, ins *Instruction) Decision {
+	switch ins.Opcode {
+	case "clipboard":
+		if atomic.LoadInt32(&a.approved) == 0 {
+			return Drop
+		}
+	case "file":
+		return Terminate
+	}
+	return Allow
+}
+
+func TestWebsocketServer_Authorizer(t *testing.T) {
+	guacds := make(chan *fakeGuacd, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		guacds <- guacd
+		return tunnel, nil
+	}, nopLogger())
+	authorizer := &clipboardApproval{}
+	var lock sync.Mutex
+	var connectionIDs []string
+	wsServer.Authorizer = AuthorizerFunc(func(connectionID string, ins *Instruction) Decision {
+		lock.Lock()
+		connectionIDs = append(connectionIDs, connectionID)
+		lock.Unlock()
+		return authorizer.Authorize(connectionID, ins)
+	})
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	guacd := <-guacds
+
+	send := func(instruction string) {
+		t.Helper()
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(instruction)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clipboard := "9.clipboard,1.0,10.text/plain;"
+	key := "3.key,2.65,1.1;"
+
+	// the clipboard is dropped until approved
+	send(clipboard + key)
+	if received := <-guacd.Received; received != key {
+		t.Error("Expected only the key, got", received)
+	}
+	atomic.StoreInt32(&authorizer.approved, 1)
+	send(clipboard + key)
+	if received := <-guacd.Received; received != clipboard+key {
+		t.Error("Expected the clipboard once approved, got", received)
+	}
+
+	// the authorizer sees instructions from guacd too
+	atomic.StoreInt32(&authorizer.approved, 0)
+	if _, err = guacd.Write([]byte(clipboard + "4.sync,3.100;")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := ws.ReadMessage()
+	if err != nil || string(msg) != "4.sync,3.100;" {
+		t.Error("Expected the clipboard from guacd to be dropped, got", string(msg), err)
+	}
+
+	send("4.file,1.1,10.text/plain,5.a.txt;")
+	_, msg, err = ws.ReadMessage()
+	if err != nil || !strings.HasPrefix(string(msg), "5.error,27.Instruction not authorized.,") {
+		t.Error("Expected an error instruction, got", string(msg), err)
+	}
+	if _, _, err = ws.ReadMessage(); !websocket.IsCloseError(err, ClientForbidden.GetWebSocketCode()) {
+		t.Error("Expected close frame, got", err)
+	}
+	waitDone(t, done)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, id := range connectionIDs {
+		if id != "$fake" {
+			t.Error("Unexpected connection ID", id)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package guac
+
+import (
+	"bytes"
+	"sync"
+)
+
+// BufferPool reuses the buffers sessions batch instructions from guacd in, so a server with
+// many short sessions doesn't allocate and collect one for each of them. It is safe for
+// concurrent use.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// DefaultBufferPool is used by WebsocketServers that don't set their own BufferPool
+var DefaultBufferPool = NewBufferPool(MaxGuacMessage * 2)
+
+// maxPooledBufferGrowth is how many times its size a buffer may grow to and still be pooled
+const maxPooledBufferGrowth = 4
+
+// NewBufferPool creates a pool of buffers with a capacity of size bytes
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() any {
+		return bytes.NewBuffer(make([]byte, 0, size))
+	}
+	return p
+}
+
+// Get returns an empty buffer, which belongs to the caller until it is given to Put
+func (p *BufferPool) Get() *bytes.Buffer {
+	buf := p.pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Put returns a buffer to the pool, after which the caller must not use it or any slice of
+// its contents. A buffer that grew far beyond the pool's size is dropped instead, so one huge
+// message doesn't keep its memory alive.
+func (p *BufferPool) Put(buf *bytes.Buffer) {
+	if buf.Cap() > p.size*maxPooledBufferGrowth {
+		return
+	}
+	buf.Reset()
+	p.pool.Put(buf)
+}
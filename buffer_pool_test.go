@@ -0,0 +1,89 @@
+package guac
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(64)
+	buf := pool.Get()
+	if buf.Cap() < 64 {
+		t.Error("Expected the pool's capacity, got", buf.Cap())
+	}
+	buf.WriteString("4.sync,1.1;")
+	pool.Put(buf)
+
+	for i := 0; i < 10; i++ {
+		if buf = pool.Get(); buf.Len() != 0 {
+			t.Fatal("Expected an empty buffer, got", buf.String())
+		}
+		buf.WriteString("4.sync,1.2;")
+		pool.Put(buf)
+	}
+}
+
+// unfinishedReader returns an instruction and claims more is coming, then fails, so the
+// instruction is left in the buffer unsent
+type unfinishedReader struct {
+	ins  string
+	read bool
+}
+
+func (r *unfinishedReader) ReadSome() ([]byte, error) {
+	if r.read {
+		return nil, io.EOF
+	}
+	r.read = true
+	return []byte(r.ins), nil
+}
+
+func (r *unfinishedReader) Available() bool {
+	return true
+}
+
+func (r *unfinishedReader) Flush() {}
+
+func TestGuacdToWs_BufferPoolNoBleed(t *testing.T) {
+	pool := NewBufferPool(MaxGuacMessage * 2)
+	opts := pumpOptions{buffers: pool}
+
+	first := &fakeMessageWriter{}
+	guacdToWs(context.Background(), nopLogger(), first, &unfinishedReader{ins: "4.name,5.alice;"}, opts)
+	if len(first.Messages) != 0 {
+		t.Fatal("Expected nothing to be sent, got", len(first.Messages))
+	}
+
+	second := &fakeMessageWriter{}
+	guacdToWs(context.Background(), nopLogger(), second, &sliceReader{instructions: []string{"4.sync,1.1;"}}, opts)
+	if len(second.Messages) != 1 || string(second.Messages[0]) != "4.sync,1.1;" {
+		t.Errorf("Expected only the second session's data, got %q", second.Messages)
+	}
+}
+
+// BenchmarkGuacdToWs_Churn runs many short sessions, as a server does when clients connect and
+// leave often, with and without a buffer pool
+func BenchmarkGuacdToWs_Churn(b *testing.B) {
+	instructions := []string{"4.size,1.0,4.1024,3.768;", "4.sync,3.100;"}
+	pools := map[string]*BufferPool{
+		"Unpooled": nil,
+		"Pooled":   NewBufferPool(MaxGuacMessage * 2),
+	}
+	for name, pool := range pools {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			opts := pumpOptions{buffers: pool}
+			for i := 0; i < b.N; i++ {
+				guacdToWs(context.Background(), nopLogger(), discardWriter{}, &sliceReader{instructions: instructions}, opts)
+			}
+		})
+	}
+}
+
+// discardWriter is a MessageWriter that drops every message
+type discardWriter struct{}
+
+func (discardWriter) WriteMessage(int, []byte) error {
+	return nil
+}
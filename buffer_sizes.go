@@ -0,0 +1,61 @@
+package guac
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// BufferSizes are the buffers of one connection. Zero values keep those of the server.
+type BufferSizes struct {
+	// Read and Write are the sizes of the websocket buffers, see WebsocketServer.ReadBufferSize
+	Read  int
+	Write int
+	// Pool supplies the buffer instructions from guacd are batched in
+	Pool *BufferPool
+}
+
+// ResolutionBuffers returns a WebsocketServer.SizeBuffers that gives large buffers to the
+// connections requesting a screen of at least minPixels with their width and height
+// parameters, the ones PrepareConfig reads, so only 4K and multi-monitor sessions pay for them
+func ResolutionBuffers(minPixels int, large BufferSizes) func(*http.Request) BufferSizes {
+	return func(r *http.Request) BufferSizes {
+		query := r.URL.Query()
+		width, err := strconv.Atoi(query.Get("width"))
+		if err != nil {
+			return BufferSizes{}
+		}
+		height, err := strconv.Atoi(query.Get("height"))
+		if err != nil || width*height < minPixels {
+			return BufferSizes{}
+		}
+		return large
+	}
+}
+
+// bufferSizes returns the buffers of a connection: those SizeBuffers chose for it, and the
+// server's for the rest
+func (s *WebsocketServer) bufferSizes(config *ServerConfig, r *http.Request) BufferSizes {
+	upgrader := config.upgrader()
+	sizes := BufferSizes{
+		Read:  upgrader.ReadBufferSize,
+		Write: upgrader.WriteBufferSize,
+		Pool:  s.BufferPool,
+	}
+	if sizes.Pool == nil {
+		sizes.Pool = DefaultBufferPool
+	}
+	if s.SizeBuffers == nil {
+		return sizes
+	}
+	custom := s.SizeBuffers(r)
+	if custom.Read > 0 {
+		sizes.Read = custom.Read
+	}
+	if custom.Write > 0 {
+		sizes.Write = custom.Write
+	}
+	if custom.Pool != nil {
+		sizes.Pool = custom.Pool
+	}
+	return sizes
+}
@@ -0,0 +1,63 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_SizeBuffers(t *testing.T) {
+	large := BufferSizes{Read: 64 << 10, Write: 256 << 10, Pool: NewBufferPool(256 << 10)}
+	wsServer := NewWebsocketServer(nil, nopLogger())
+	wsServer.SizeBuffers = ResolutionBuffers(3840*2160, large)
+
+	tests := []struct {
+		query  string
+		expect BufferSizes
+	}{
+		{"?width=3840&height=2160", large},
+		{"?width=7680&height=1080", large},
+		{"?width=1280&height=720", BufferSizes{Read: websocketReadBufferSize, Write: websocketWriteBufferSize, Pool: DefaultBufferPool}},
+		{"", BufferSizes{Read: websocketReadBufferSize, Write: websocketWriteBufferSize, Pool: DefaultBufferPool}},
+	}
+	for _, tt := range tests {
+		config := wsServer.Config()
+		sizes := wsServer.bufferSizes(&config, httptest.NewRequest(http.MethodGet, "/websocket-tunnel"+tt.query, nil))
+		if sizes != tt.expect {
+			t.Errorf("%q: expected %+v, got %+v", tt.query, tt.expect, sizes)
+		}
+	}
+
+	// server settings are the defaults SizeBuffers overrides
+	wsServer.WriteBufferSize = 32 << 10
+	config := wsServer.Config()
+	sizes := wsServer.bufferSizes(&config, httptest.NewRequest(http.MethodGet, "/websocket-tunnel?width=800&height=600", nil))
+	if sizes.Write != 32<<10 || sizes.Read != websocketReadBufferSize {
+		t.Errorf("Expected the server's buffer sizes, got %+v", sizes)
+	}
+}
+
+func TestWebsocketServer_ConnectResultBufferPool(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		return &ConnectResult{Tunnel: tunnel, BufferPool: NewBufferPool(MaxGuacMessage * 8)}, nil
+	}, nopLogger())
+	wsServer.SizeBuffers = ResolutionBuffers(3840*2160, BufferSizes{Read: 64 << 10, Write: 256 << 10})
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url+"?width=3840&height=2160", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if _, err = guacd.Write([]byte("4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "4.sync,1.1;" {
+		t.Errorf("Expected the sync, got %q %v", msg, err)
+	}
+	_ = ws.Close()
+	waitDone(t, done)
+}
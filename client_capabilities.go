@@ -0,0 +1,94 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ClientCapabilities are what a client announces it supports when it connects. The Guacamole
+// JS client is usually given them as connect parameters: "audio", "video" and "image" are
+// repeated for each mimetype it can play or draw and "timezone" is the user's IANA timezone.
+type ClientCapabilities struct {
+	Audio    []string
+	Video    []string
+	Image    []string
+	Timezone string
+}
+
+// ParseClientCapabilities reads the capabilities a client announced in the query of its
+// connect request
+func ParseClientCapabilities(r *http.Request) *ClientCapabilities {
+	return clientCapabilities(r.URL.Query())
+}
+
+func clientCapabilities(query url.Values) *ClientCapabilities {
+	return &ClientCapabilities{
+		Audio:    query["audio"],
+		Video:    query["video"],
+		Image:    query["image"],
+		Timezone: query.Get("timezone"),
+	}
+}
+
+// Supports returns true if the client announced the mimetype. Parameters, such as the rate of
+// "audio/L16;rate=44100", are ignored.
+func (c *ClientCapabilities) Supports(mimetype string) bool {
+	mimetype = baseMimetype(mimetype)
+	for _, supported := range [][]string{c.Audio, c.Video, c.Image} {
+		for _, m := range supported {
+			if baseMimetype(m) == mimetype {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Require returns an error with the status CLIENT_BAD_TYPE naming the first mimetype the client
+// didn't announce, or nil if it supports them all
+func (c *ClientCapabilities) Require(mimetypes ...string) error {
+	for _, mimetype := range mimetypes {
+		if !c.Supports(mimetype) {
+			return ErrClientBadType.NewError("Client does not support a required format.", mimetype)
+		}
+	}
+	return nil
+}
+
+// Configure offers guacd the formats the client announced, leaving those it announced none of
+// as they are in config
+func (c *ClientCapabilities) Configure(config *Config) {
+	if len(c.Audio) > 0 {
+		config.AudioMimetypes = append([]string(nil), c.Audio...)
+	}
+	if len(c.Video) > 0 {
+		config.VideoMimetypes = append([]string(nil), c.Video...)
+	}
+	if len(c.Image) > 0 {
+		config.ImageMimetypes = append([]string(nil), c.Image...)
+	}
+}
+
+// baseMimetype returns the mimetype without its parameters, in lower case
+func baseMimetype(mimetype string) string {
+	if i := strings.IndexByte(mimetype, ';'); i >= 0 {
+		mimetype = mimetype[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(mimetype))
+}
+
+type clientCapabilitiesKey struct{}
+
+// ContextWithClientCapabilities returns a context that carries the client's capabilities
+func ContextWithClientCapabilities(ctx context.Context, capabilities *ClientCapabilities) context.Context {
+	return context.WithValue(ctx, clientCapabilitiesKey{}, capabilities)
+}
+
+// ClientCapabilitiesFromContext returns the capabilities in ctx. The WebsocketServer puts them
+// in the context of the request given to the connect function, as AcceptClient left them.
+func ClientCapabilitiesFromContext(ctx context.Context) (*ClientCapabilities, bool) {
+	capabilities, ok := ctx.Value(clientCapabilitiesKey{}).(*ClientCapabilities)
+	return capabilities, ok && capabilities != nil
+}
@@ -0,0 +1,109 @@
+package guac
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientCapabilities_Supports(t *testing.T) {
+	capabilities := ParseClientCapabilities(prepareRequest("audio=audio/L16%3Brate%3D44100,channels%3D2&image=image/png&image=image/jpeg&timezone=Europe/London"))
+	if capabilities.Timezone != "Europe/London" {
+		t.Error("Expected the timezone, got", capabilities.Timezone)
+	}
+	for mimetype, supported := range map[string]bool{
+		"image/png":  true,
+		"IMAGE/JPEG": true,
+		"audio/L16":  true,
+		"image/webp": false,
+		"video/webm": false,
+	} {
+		if capabilities.Supports(mimetype) != supported {
+			t.Errorf("Expected support for %s to be %v", mimetype, supported)
+		}
+	}
+	if err := capabilities.Require("image/png", "image/webp"); errorStatus(err) != ClientBadType {
+		t.Error("Expected the missing format to be refused, got", err)
+	}
+}
+
+func TestPrepareConfig_ClientCapabilities(t *testing.T) {
+	config, err := PrepareConfig(prepareRequest("scheme=rdp&hostname=desktop.internal&image=image/png&image=image/webp&timezone=UTC"), testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.ImageMimetypes, []string{"image/png", "image/webp"}) || len(config.AudioMimetypes) != 0 {
+		t.Error("Expected the client's image formats, got", config.ImageMimetypes, config.AudioMimetypes)
+	}
+	if _, ok := config.Parameters["timezone"]; ok {
+		t.Error("Expected the timezone not to be a guacd parameter")
+	}
+}
+
+func TestWebsocketServer_AcceptClient(t *testing.T) {
+	tunnel, _ := newFakeGuacd(t)
+	connected := make(chan *ClientCapabilities, 2)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		capabilities, _ := ClientCapabilitiesFromContext(r.Context())
+		connected <- capabilities
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.AcceptClient = func(capabilities *ClientCapabilities, r *http.Request) error {
+		// JPEG is never used, but clients must be able to draw WebP
+		capabilities.Image = removeMimetype(capabilities.Image, "image/jpeg")
+		return capabilities.Require("image/webp")
+	}
+	refused := make(chan error, 1)
+	wsServer.OnError = func(r *http.Request, err error) {
+		refused <- err
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	// a client without WebP is refused before guacd is connected
+	ws, _, err := websocket.DefaultDialer.Dial(url+"?image=image/png&image=image/jpeg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := Parse(msg)
+	if err != nil || ins.Opcode != "error" || ins.Args[1] != strconv.Itoa(ClientBadType.GetGuacamoleStatusCode()) {
+		t.Errorf("Expected CLIENT_BAD_TYPE, got %q", msg)
+	}
+	_ = ws.Close()
+	waitDone(t, done)
+	var sessionErr *SessionError
+	if err := <-refused; !errors.As(err, &sessionErr) || sessionErr.Stage != StageConnect {
+		t.Error("Expected the refusal to be reported, got", err)
+	}
+
+	// one with it connects, with the capabilities as AcceptClient left them
+	ws, _, err = websocket.DefaultDialer.Dial(url+"?image=image/webp&image=image/jpeg&timezone=UTC", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	capabilities := <-connected
+	if capabilities == nil || !reflect.DeepEqual(capabilities.Image, []string{"image/webp"}) || capabilities.Timezone != "UTC" {
+		t.Errorf("Expected the adjusted capabilities, got %+v", capabilities)
+	}
+	if len(connected) != 0 {
+		t.Error("Expected the refused client not to connect")
+	}
+}
+
+func removeMimetype(mimetypes []string, remove string) []string {
+	var kept []string
+	for _, mimetype := range mimetypes {
+		if mimetype != remove {
+			kept = append(kept, mimetype)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,99 @@
+package guac
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// CertIdentity is the identity in a verified mTLS client certificate
+type CertIdentity struct {
+	// Name is the first URI SAN, email SAN or DNS SAN, falling back to the subject common name
+	Name string
+	// CommonName is the subject common name
+	CommonName     string
+	URIs           []string
+	EmailAddresses []string
+	DNSNames       []string
+	// Certificate is the client's leaf certificate
+	Certificate *x509.Certificate
+}
+
+// CertTarget is a remote a client certificate allows connecting to
+type CertTarget struct {
+	// Protocol is the guacd protocol, such as rdp or ssh
+	Protocol string
+	// Host is the hostname or address of the remote
+	Host string
+}
+
+// CertPolicy maps a client certificate identity to the remote it may connect to. It returns
+// false to reject the identity.
+type CertPolicy func(identity *CertIdentity) (CertTarget, bool)
+
+// NewCertIdentity extracts the identity from a client certificate
+func NewCertIdentity(cert *x509.Certificate) *CertIdentity {
+	identity := &CertIdentity{
+		CommonName:     cert.Subject.CommonName,
+		EmailAddresses: cert.EmailAddresses,
+		DNSNames:       cert.DNSNames,
+		Certificate:    cert,
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+
+	switch {
+	case len(identity.URIs) > 0:
+		identity.Name = identity.URIs[0]
+	case len(identity.EmailAddresses) > 0:
+		identity.Name = identity.EmailAddresses[0]
+	case len(identity.DNSNames) > 0:
+		identity.Name = identity.DNSNames[0]
+	default:
+		identity.Name = identity.CommonName
+	}
+	return identity
+}
+
+// requestCertIdentity returns the identity of the client certificate the TLS server verified.
+// Certificates that were presented but not verified, as with tls.RequestClientCert, are not
+// trusted.
+func requestCertIdentity(r *http.Request) (*CertIdentity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrUnauthorized.NewError("No client certificate provided.")
+	}
+	if len(r.TLS.VerifiedChains) == 0 {
+		return nil, ErrUnauthorized.NewError("Client certificate not verified.")
+	}
+	return NewCertIdentity(r.TLS.PeerCertificates[0]), nil
+}
+
+// ClientCertConnect wraps a connect function so that the remote is chosen from the client's mTLS
+// certificate by policy, rather than from anything the client sends. The TLS server must verify
+// client certificates, for example with tls.RequireAndVerifyClientCert. Connections without a
+// verified certificate are unauthorized, and identities the policy rejects are forbidden.
+//
+// The identity's Name is set as the "identity" label of the session.
+func ClientCertConnect(policy CertPolicy, connect func(*websocket.Conn, *http.Request, *CertIdentity, CertTarget) (Tunnel, error)) func(*websocket.Conn, *http.Request) (*ConnectResult, error) {
+	return func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		identity, err := requestCertIdentity(r)
+		if err != nil {
+			return nil, err
+		}
+		target, ok := policy(identity)
+		if !ok {
+			return nil, ErrSecurity.NewError("Client certificate not permitted.", identity.Name)
+		}
+
+		tunnel, err := connect(ws, r, identity, target)
+		if err != nil {
+			return nil, err
+		}
+		return &ConnectResult{
+			Tunnel: tunnel,
+			Labels: map[string]string{"identity": identity.Name},
+		}, nil
+	}
+}
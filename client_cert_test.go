@@ -0,0 +1,112 @@
+package guac
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// clientCert creates a self signed client certificate
+func clientCert(t *testing.T, template *x509.Certificate) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestNewCertIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/user/alice")
+	identity := NewCertIdentity(clientCert(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "Alice"},
+		URIs:           []*url.URL{spiffe},
+		EmailAddresses: []string{"alice@example.org"},
+	}))
+	if identity.Name != "spiffe://example.org/user/alice" || identity.CommonName != "Alice" {
+		t.Error("Unexpected identity", identity.Name, identity.CommonName)
+	}
+
+	identity = NewCertIdentity(clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}}))
+	if identity.Name != "bob" {
+		t.Error("Expected the common name, got", identity.Name)
+	}
+}
+
+func TestClientCertConnect(t *testing.T) {
+	policy := func(identity *CertIdentity) (CertTarget, bool) {
+		if identity.Name == "alice@example.org" {
+			return CertTarget{Protocol: "rdp", Host: "10.0.0.1"}, true
+		}
+		return CertTarget{}, false
+	}
+	var got CertTarget
+	connect := ClientCertConnect(policy, func(ws *websocket.Conn, r *http.Request, identity *CertIdentity, target CertTarget) (Tunnel, error) {
+		got = target
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	})
+
+	request := func(cert *x509.Certificate, verified bool) *http.Request {
+		// client supplied parameters must not affect the target
+		r := httptest.NewRequest(http.MethodGet, "https://guac/websocket-tunnel?hostname=10.9.9.9", nil)
+		r.TLS = &tls.ConnectionState{}
+		if cert != nil {
+			r.TLS.PeerCertificates = []*x509.Certificate{cert}
+			if verified {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+			}
+		}
+		return r
+	}
+	alice := clientCert(t, &x509.Certificate{EmailAddresses: []string{"alice@example.org"}})
+	mallory := clientCert(t, &x509.Certificate{EmailAddresses: []string{"mallory@example.org"}})
+
+	result, err := connect(nil, request(alice, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Protocol != "rdp" || got.Host != "10.0.0.1" {
+		t.Error("Unexpected target", got)
+	}
+	if result.Labels["identity"] != "alice@example.org" {
+		t.Error("Unexpected labels", result.Labels)
+	}
+
+	for name, test := range map[string]struct {
+		r    *http.Request
+		kind ErrKind
+	}{
+		"NoCertificate": {request(nil, false), ErrUnauthorized},
+		"Unverified":    {request(alice, false), ErrUnauthorized},
+		"NotPermitted":  {request(mallory, true), ErrSecurity},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := connect(nil, test.r); err == nil || err.(*ErrGuac).Kind != test.kind {
+				t.Error("Expected", test.kind, "got", err)
+			}
+		})
+	}
+}
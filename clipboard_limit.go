@@ -0,0 +1,186 @@
+package guac
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ClipboardPolicy decides what happens to a clipboard from guacd larger than
+// WebsocketServer.MaxOutboundClipboard
+type ClipboardPolicy int
+
+const (
+	// ClipboardTruncate sends the client the clipboard up to the limit. Text is cut at a
+	// character boundary.
+	ClipboardTruncate ClipboardPolicy = iota
+	// ClipboardDrop doesn't send the client any of the clipboard. Each clipboard is held until
+	// it ends, so up to the limit is kept in memory for every clipboard in progress.
+	ClipboardDrop
+)
+
+// String returns the name of the policy
+func (p ClipboardPolicy) String() string {
+	if p == ClipboardDrop {
+		return "drop"
+	}
+	return "truncate"
+}
+
+// clipboardLimit caps the clipboard streams guacd sends to the client, when the remote copies
+// something huge. Clipboard streams are told apart by index, and several may be in progress.
+// It is only used by the guacd to websocket pump.
+type clipboardLimit struct {
+	max    int
+	policy ClipboardPolicy
+	// oversized is called with the mimetype and size so far of each clipboard over the limit
+	oversized func(mimetype string, size int)
+	streams   map[int]*clipboardStream
+}
+
+// clipboardStream is an outbound clipboard in progress
+type clipboardStream struct {
+	mimetype string
+	// size is the number of decoded bytes sent, or held, so far
+	size int
+	over bool
+	// held are the instructions of the stream held until it ends under ClipboardDrop
+	held []byte
+}
+
+func newClipboardLimit(max int, policy ClipboardPolicy, oversized func(string, int)) *clipboardLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &clipboardLimit{
+		max:       max,
+		policy:    policy,
+		oversized: oversized,
+		streams:   map[int]*clipboardStream{},
+	}
+}
+
+// apply returns data with the clipboard instructions the limit lets through now. A nil limit
+// lets everything through.
+func (l *clipboardLimit) apply(data []byte) []byte {
+	if l == nil {
+		return data
+	}
+	var out []byte
+	changed := false
+	for rest := data; len(rest) > 0; {
+		n, err := scanInstruction(rest)
+		if err != nil {
+			// the filters have already rejected anything malformed, so this is the remainder of
+			// a message and is left as it is
+			if changed {
+				out = append(out, rest...)
+			}
+			break
+		}
+		raw := rest[:n]
+		rest = rest[n:]
+
+		kept, same := l.instruction(raw)
+		if !same && !changed {
+			changed = true
+			out = append(make([]byte, 0, len(data)), data[:len(data)-len(rest)-n]...)
+		}
+		if changed {
+			out = append(out, kept...)
+		}
+	}
+	if !changed {
+		return data
+	}
+	return out
+}
+
+// instruction returns what to send for one instruction, and whether it is raw as it is
+func (l *clipboardLimit) instruction(raw []byte) ([]byte, bool) {
+	elements, err := peekElements(raw, 2)
+	if err != nil || len(elements) < 2 {
+		return raw, true
+	}
+	switch elements[0] {
+	case "clipboard", "blob", "end":
+	default:
+		return raw, true
+	}
+	index, err := strconv.Atoi(elements[1])
+	if err != nil {
+		return raw, true
+	}
+
+	if elements[0] == "clipboard" {
+		stream := &clipboardStream{}
+		if ins, err := Parse(raw); err == nil && len(ins.Args) > 1 {
+			stream.mimetype = ins.Args[1]
+		}
+		l.streams[index] = stream
+		if l.policy == ClipboardDrop {
+			stream.held = append(stream.held, raw...)
+			return nil, false
+		}
+		return raw, true
+	}
+
+	stream, ok := l.streams[index]
+	if !ok {
+		// the blobs of images and audio
+		return raw, true
+	}
+	if elements[0] == "end" {
+		delete(l.streams, index)
+		if l.policy == ClipboardDrop {
+			if stream.over {
+				return nil, false
+			}
+			return append(stream.held, raw...), false
+		}
+		return raw, true
+	}
+
+	if stream.over {
+		return nil, false
+	}
+	ins, err := Parse(raw)
+	if err != nil || len(ins.Args) < 2 {
+		return raw, true
+	}
+	size := decodedLen(ins.Args[1])
+	if stream.size+size <= l.max {
+		stream.size += size
+		if l.policy == ClipboardDrop {
+			stream.held = append(stream.held, raw...)
+			return nil, false
+		}
+		return raw, true
+	}
+
+	stream.over = true
+	if l.oversized != nil {
+		l.oversized(stream.mimetype, stream.size+size)
+	}
+	if l.policy == ClipboardDrop {
+		stream.held = nil
+		return nil, false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(ins.Args[1])
+	if err != nil {
+		return nil, false
+	}
+	keep := min(l.max-stream.size, len(decoded))
+	if strings.HasPrefix(stream.mimetype, "text/") {
+		for keep > 0 && keep < len(decoded) && !utf8.RuneStart(decoded[keep]) {
+			keep--
+		}
+	}
+	if keep <= 0 {
+		return nil, false
+	}
+	stream.size += keep
+	return NewInstruction("blob", ins.Args[0], base64.StdEncoding.EncodeToString(decoded[:keep])).Bytes(), false
+}
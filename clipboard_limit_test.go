@@ -0,0 +1,124 @@
+package guac
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// clipboardBlob returns a blob instruction carrying data on stream 1
+func clipboardBlob(data string) string {
+	return NewInstruction("blob", "1", base64.StdEncoding.EncodeToString([]byte(data))).String()
+}
+
+func TestClipboardLimit(t *testing.T) {
+	start := "9.clipboard,1.1,10.text/plain;"
+	end := "3.end,1.1;"
+	image := "3.img,1.2,2.14,1.0,9.image/png,1.0,1.0;" + clipboardBlob("0123456789") + "3.end,1.2;"
+	tests := []struct {
+		name     string
+		policy   ClipboardPolicy
+		messages []string
+		expect   string
+	}{
+		{"within the limit", ClipboardTruncate,
+			[]string{start, clipboardBlob("hello"), end},
+			start + clipboardBlob("hello") + end},
+		{"truncated", ClipboardTruncate,
+			[]string{start + clipboardBlob("hello"), clipboardBlob(" world") + clipboardBlob("!") + end},
+			start + clipboardBlob("hello") + clipboardBlob(" wor") + end},
+		{"truncated at a character", ClipboardTruncate,
+			[]string{start, clipboardBlob("héllo wörld"), end},
+			start + clipboardBlob("héllo w") + end},
+		{"held until it ends", ClipboardDrop,
+			[]string{start, clipboardBlob("hello"), "4.sync,1.1;" + end},
+			"4.sync,1.1;" + start + clipboardBlob("hello") + end},
+		{"dropped", ClipboardDrop,
+			[]string{start, clipboardBlob("hello"), clipboardBlob(" world") + "4.sync,1.1;", end},
+			"4.sync,1.1;"},
+		{"other streams", ClipboardDrop,
+			[]string{image},
+			image},
+	}
+	for _, tt := range tests {
+		var oversized []int
+		limit := newClipboardLimit(9, tt.policy, func(mimetype string, size int) {
+			if mimetype != "text/plain" {
+				t.Errorf("%s: expected the mimetype, got %q", tt.name, mimetype)
+			}
+			oversized = append(oversized, size)
+		})
+		var out strings.Builder
+		for _, msg := range tt.messages {
+			out.Write(limit.apply([]byte(msg)))
+		}
+		if out.String() != tt.expect {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expect, out.String())
+		}
+		over := strings.Contains(tt.name, "truncated") || tt.name == "dropped"
+		if over != (len(oversized) == 1) {
+			t.Errorf("%s: expected oversized %v, got %v", tt.name, over, oversized)
+		}
+		if len(limit.streams) != 0 {
+			t.Errorf("%s: expected the streams to be forgotten once they ended", tt.name)
+		}
+	}
+
+	if limit := newClipboardLimit(0, ClipboardDrop, nil); limit.apply([]byte(start)) == nil {
+		t.Error("Expected no limit to let everything through")
+	}
+}
+
+func TestWebsocketServer_MaxOutboundClipboard(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.MaxOutboundClipboard = 1024
+	oversized := make(chan int, 1)
+	wsServer.OnOversizedClipboard = func(id, mimetype string, size int) {
+		if id != "$fake" || mimetype != "text/plain" {
+			t.Errorf("Expected the connection and mimetype, got %q %q", id, mimetype)
+		}
+		oversized <- size
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	// the remote copies 64KB, sent in 4KB blobs
+	chunk := strings.Repeat("a", 4096)
+	go func() {
+		_, _ = guacd.Write([]byte("9.clipboard,1.1,10.text/plain;"))
+		for i := 0; i < 16; i++ {
+			_, _ = guacd.Write([]byte(clipboardBlob(chunk)))
+		}
+		_, _ = guacd.Write([]byte("3.end,1.1;4.sync,1.1;"))
+	}()
+
+	var received []byte
+	for !strings.HasSuffix(string(received), "4.sync,1.1;") {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, msg...)
+	}
+	expect := "9.clipboard,1.1,10.text/plain;" + clipboardBlob(chunk[:1024]) + "3.end,1.1;4.sync,1.1;"
+	if string(received) != expect {
+		t.Errorf("Expected the clipboard truncated to 1024 bytes, got %d bytes", len(received))
+	}
+	if size := <-oversized; size != 4096 {
+		t.Error("Expected the size when the limit was reached, got", size)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+}
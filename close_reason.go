@@ -0,0 +1,53 @@
+package guac
+
+// CloseReason is why a websocket session ended
+type CloseReason int
+
+const (
+	// CloseReasonUnknown is used when the session ended without a recorded reason
+	CloseReasonUnknown CloseReason = iota
+	// CloseReasonClient means the client disconnected or its websocket failed
+	CloseReasonClient
+	// CloseReasonGuacd means guacd ended the session or the connection to it failed
+	CloseReasonGuacd
+	// CloseReasonTimeout means the session reached its deadline, the client stopped answering
+	// keepalive pings, or the user was idle for WebsocketServer.IdleTimeout
+	CloseReasonTimeout
+	// CloseReasonAdmin means the session was disconnected through the server, such as by DisconnectByLabel
+	CloseReasonAdmin
+	// CloseReasonError means the server ended the session after an error, such as a failing filter
+	CloseReasonError
+)
+
+// String returns the name of the reason
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonClient:
+		return "client"
+	case CloseReasonGuacd:
+		return "guacd"
+	case CloseReasonTimeout:
+		return "timeout"
+	case CloseReasonAdmin:
+		return "admin"
+	case CloseReasonError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// DisconnectReason describes how a session ended, for WebsocketServer.OnDisconnectWsReason
+type DisconnectReason struct {
+	Reason CloseReason
+	// Code and Text are from the websocket close frame that ended the session, whether the
+	// client or the server sent it. Code is websocket.CloseAbnormalClosure when the client's
+	// connection dropped without one, and zero when the session ended without a close frame, such
+	// as when guacd closed the connection.
+	Code int
+	Text string
+	// Err is the error that stopped the session, such as the websocket.CloseError the client
+	// closed with or the error reading from guacd. When the server ended the session, such as
+	// for an expired deadline, it is an *ErrGuac with the status and message sent to the client.
+	Err error
+}
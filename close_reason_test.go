@@ -0,0 +1,212 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_OnDisconnectReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		filters  []InstructionFilter
+		// end ends the session once the client is connected
+		end    func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd)
+		expect CloseReason
+	}{
+		{
+			name: "client",
+			end: func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd) {
+				// the tunnel is closed too, without waiting for guacd
+				_ = ws.Close()
+			},
+			expect: CloseReasonClient,
+		},
+		{
+			name: "guacd",
+			end: func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd) {
+				_ = guacd.Close()
+			},
+			expect: CloseReasonGuacd,
+		},
+		{
+			name: "admin",
+			end: func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd) {
+				if n := s.DisconnectByLabel("user", "alice"); n != 1 {
+					t.Error("Expected 1 session, got", n)
+				}
+			},
+			expect: CloseReasonAdmin,
+		},
+		{
+			name:     "timeout",
+			deadline: 50 * time.Millisecond,
+			end:      func(*testing.T, *WebsocketServer, *websocket.Conn, *fakeGuacd) {},
+			expect:   CloseReasonTimeout,
+		},
+		{
+			name:    "filter error",
+			filters: []InstructionFilter{failingFilter},
+			end: func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd) {
+				if err := ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expect: CloseReasonError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guacds := make(chan *fakeGuacd, 1)
+			wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+				tunnel, guacd := newFakeGuacd(t)
+				guacds <- guacd
+				result := &ConnectResult{
+					Tunnel: tunnel,
+					Labels: map[string]string{"user": "alice"},
+				}
+				if tt.deadline > 0 {
+					result.Deadline = time.Now().Add(tt.deadline)
+				}
+				return result, nil
+			}, nopLogger())
+			wsServer.Filters = tt.filters
+			connected := make(chan struct{}, 1)
+			wsServer.OnConnectWs = func(string, *websocket.Conn, *http.Request) {
+				connected <- struct{}{}
+			}
+			reasons := make(chan CloseReason, 1)
+			wsServer.OnDisconnectReason = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, reason CloseReason) {
+				reasons <- reason
+			}
+			url, done := serveWebsocket(t, wsServer)
+
+			ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = ws.Close() }()
+			guacd := <-guacds
+			<-connected
+
+			tt.end(t, wsServer, ws, guacd)
+			select {
+			case reason := <-reasons:
+				if reason != tt.expect {
+					t.Errorf("Expected reason %v, got %v", tt.expect, reason)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for OnDisconnectReason")
+			}
+			waitDone(t, done)
+		})
+	}
+}
+
+func TestWebsocketServer_OnDisconnectWsReason(t *testing.T) {
+	tests := []struct {
+		name string
+		end  func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd)
+		// reason, code and text are expected, and check checks the error
+		reason CloseReason
+		code   int
+		text   string
+		check  func(t *testing.T, err error)
+	}{
+		{
+			name: "client close",
+			end: func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd) {
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+				_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			},
+			reason: CloseReasonClient,
+			code:   websocket.CloseNormalClosure,
+			text:   "bye",
+			check: func(t *testing.T, err error) {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					t.Error("Expected the client's close error, got", err)
+				}
+			},
+		},
+		{
+			name: "client dropped",
+			end: func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd) {
+				_ = ws.NetConn().Close()
+			},
+			reason: CloseReasonClient,
+			code:   websocket.CloseAbnormalClosure,
+			text:   "unexpected EOF",
+			check: func(t *testing.T, err error) {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+			},
+		},
+		{
+			name: "guacd closed",
+			end: func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd) {
+				_ = guacd.Close()
+			},
+			reason: CloseReasonGuacd,
+			check: func(t *testing.T, err error) {
+				if !guacdClosed(err) {
+					t.Error("Expected guacd to have closed the connection, got", err)
+				}
+			},
+		},
+		{
+			name: "admin",
+			end: func(t *testing.T, s *WebsocketServer, ws *websocket.Conn, guacd *fakeGuacd) {
+				s.DisconnectByLabel("user", "alice")
+			},
+			reason: CloseReasonAdmin,
+			code:   SessionClosed.GetWebSocketCode(),
+			text:   "Session closed by administrator.",
+			check: func(t *testing.T, err error) {
+				if errorStatus(err) != SessionClosed {
+					t.Error("Expected the status sent to the client, got", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guacds := make(chan *fakeGuacd, 1)
+			wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+				tunnel, guacd := newFakeGuacd(t)
+				guacds <- guacd
+				return &ConnectResult{Tunnel: tunnel, Labels: map[string]string{"user": "alice"}}, nil
+			}, nopLogger())
+			connected := make(chan struct{}, 1)
+			wsServer.OnConnectWs = func(string, *websocket.Conn, *http.Request) {
+				connected <- struct{}{}
+			}
+			reasons := make(chan DisconnectReason, 1)
+			wsServer.OnDisconnectWsReason = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, reason DisconnectReason) {
+				reasons <- reason
+			}
+			url, done := serveWebsocket(t, wsServer)
+
+			ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = ws.Close() }()
+			guacd := <-guacds
+			<-connected
+
+			tt.end(t, wsServer, ws, guacd)
+			waitDone(t, done)
+			reason := <-reasons
+			if reason.Reason != tt.reason || reason.Code != tt.code || reason.Text != tt.text {
+				t.Errorf("Expected %v %v %q, got %v %v %q", tt.reason, tt.code, tt.text, reason.Reason, reason.Code, reason.Text)
+			}
+			tt.check(t, reason.Err)
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package guac
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClusterLabel is the session label ClusterRouter sets to the cluster a session was routed to,
+// so DisconnectByLabel and SessionRecord can tell the clusters apart
+const ClusterLabel = "cluster"
+
+// Cluster is one guacd fleet behind a ClusterRouter
+type Cluster struct {
+	// Connect connects a session to the cluster, typically by picking a guacd in it
+	Connect func(*websocket.Conn, *http.Request) (*ConnectResult, error)
+	// Metrics optionally receives the measurements of the cluster's sessions instead of the
+	// server's Metrics, to keep them apart
+	Metrics MetricsCollector
+}
+
+// ClusterRouter lets one WebsocketServer front several isolated guacd clusters. It takes the
+// cluster from the path segment after Prefix, so with the prefix "/tunnel/" a websocket opened on
+// "/tunnel/east/..." is connected by the cluster added as "east". Pass Connect to
+// NewWebsocketServerResult.
+type ClusterRouter struct {
+	prefix string
+
+	lock     sync.RWMutex
+	clusters map[string]Cluster
+}
+
+// NewClusterRouter creates a router for paths starting with prefix
+func NewClusterRouter(prefix string) *ClusterRouter {
+	return &ClusterRouter{
+		prefix:   prefix,
+		clusters: map[string]Cluster{},
+	}
+}
+
+// AddCluster routes the paths with the given key to cluster, replacing any cluster already
+// added with that key. It can be called while the server is running.
+func (c *ClusterRouter) AddCluster(key string, cluster Cluster) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clusters[key] = cluster
+}
+
+// RemoveCluster stops routing new sessions to the cluster with the given key. Its sessions stay
+// connected, see DisconnectByLabel with ClusterLabel to end them.
+func (c *ClusterRouter) RemoveCluster(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.clusters, key)
+}
+
+// ClusterKey returns the cluster key in the request path, or false if the path doesn't start
+// with the prefix
+func (c *ClusterRouter) ClusterKey(r *http.Request) (string, bool) {
+	rest, ok := strings.CutPrefix(r.URL.Path, c.prefix)
+	if !ok {
+		return "", false
+	}
+	key, _, _ := strings.Cut(rest, "/")
+	return key, key != ""
+}
+
+// Connect connects the session with the cluster its path is routed to, labelling it with the
+// cluster's key
+func (c *ClusterRouter) Connect(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+	key, ok := c.ClusterKey(r)
+	if !ok {
+		return nil, ErrResourceNotFound.NewError("No cluster in the tunnel path.", r.URL.Path)
+	}
+	c.lock.RLock()
+	cluster, ok := c.clusters[key]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, ErrResourceNotFound.NewError("No such cluster.", key)
+	}
+
+	result, err := cluster.Connect(ws, r)
+	if err != nil {
+		if cluster.Metrics != nil {
+			cluster.Metrics.ObserveConnectFailure(errorStatus(err))
+		}
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(result.Labels)+1)
+	for k, v := range result.Labels {
+		labels[k] = v
+	}
+	labels[ClusterLabel] = key
+	result.Labels = labels
+	if result.Metrics == nil {
+		result.Metrics = cluster.Metrics
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClusterRouter(t *testing.T) {
+	router := NewClusterRouter("/tunnel/")
+	guacds := map[string]chan *fakeGuacd{}
+	metrics := map[string]*Metrics{}
+	for _, key := range []string{"east", "west"} {
+		guacds[key] = make(chan *fakeGuacd, 1)
+		metrics[key] = NewMetrics()
+		connected := guacds[key]
+		router.AddCluster(key, Cluster{
+			Connect: func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+				tunnel, guacd := newFakeGuacd(t)
+				connected <- guacd
+				return &ConnectResult{Tunnel: tunnel, Labels: map[string]string{"user": "alice"}}, nil
+			},
+			Metrics: metrics[key],
+		})
+	}
+
+	records := make(chan SessionRecord, 2)
+	wsServer := NewWebsocketServerResult(router.Connect, nopLogger())
+	wsServer.OnSessionRecord = ChannelSink(records)
+	url, done := serveWebsocket(t, wsServer)
+
+	for _, key := range []string{"west", "east"} {
+		ws, _, err := websocket.DefaultDialer.Dial(url+"/tunnel/"+key+"/websocket-tunnel", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		guacd := <-guacds[key]
+		if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+			t.Fatal(err)
+		}
+		if received := <-guacd.Received; received != "3.key,2.65,1.1;" {
+			t.Error("Unexpected instruction", received)
+		}
+		_ = ws.Close()
+		_ = guacd.Close()
+		waitDone(t, done)
+
+		record := <-records
+		if record.Labels[ClusterLabel] != key || record.Labels["user"] != "alice" {
+			t.Error("Expected the session to be labelled with its cluster, got", record.Labels)
+		}
+		if n := metrics[key].InboundSizes.Snapshot().Count; n != 1 {
+			t.Errorf("Expected 1 instruction in the metrics of %v, got %v", key, n)
+		}
+	}
+}
+
+func TestClusterRouter_Unknown(t *testing.T) {
+	router := NewClusterRouter("/tunnel/")
+	router.AddCluster("east", Cluster{
+		Connect: func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+			t.Error("Expected no connect")
+			return nil, ErrServer.NewError("unexpected")
+		},
+	})
+
+	for _, path := range []string{"/tunnel/north/websocket-tunnel", "/tunnel/", "/other/east"} {
+		r, err := http.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = router.Connect(nil, r)
+		if err == nil || err.(*ErrGuac).Kind != ErrResourceNotFound {
+			t.Errorf("%v: expected resource not found, got %v", path, err)
+		}
+	}
+}
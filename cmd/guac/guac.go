@@ -2,13 +2,9 @@ package main
 
 import (
 	"crypto/tls"
-	"encoding/json"
-	"io"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"time"
 
 	"github.com/codecademy-engineering/guac"
 	"github.com/rs/zerolog"
@@ -19,6 +15,7 @@ var (
 	certPath    string
 	certKeyPath string
 	guacdAddr   = "127.0.0.1:4822"
+	guacdNet    = "tcp"
 )
 
 func main() {
@@ -52,42 +49,27 @@ func main() {
 		guacdAddr = os.Getenv("GUACD_ADDRESS")
 	}
 
+	if os.Getenv("GUACD_NETWORK") != "" {
+		guacdNet = os.Getenv("GUACD_NETWORK")
+	}
+
 	servlet := guac.NewServer(DemoDoConnect)
+	// the long polls of the HTTP tunnel outlast the server's WriteTimeout
+	servlet.ReadRequestTimeout = guac.SocketTimeout
+	servlet.WriteRequestTimeout = guac.SocketTimeout
 	wsServer := guac.NewWebsocketServer(DemoDoConnect, nil)
+	wsServer.Health = guac.NewGuacdHealthChecker(guacdNet, guacdAddr, guac.HealthCheckInterval)
+	wsServer.MaxHandshakeDuration = 30 * time.Second
 
-	sessions := guac.NewMemorySessionStore()
-	wsServer.OnConnect = sessions.Add
-	wsServer.OnDisconnect = sessions.Delete
+	// with several replicas, guac.NewRedisSessionStore shares the sessions between them
+	var sessions guac.SessionStore = guac.NewMemorySessionStore()
+	wsServer.SessionStore = sessions
 
 	mux := http.NewServeMux()
 	mux.Handle("/tunnel", servlet)
 	mux.Handle("/tunnel/", servlet)
 	mux.Handle("/websocket-tunnel", wsServer)
-	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		sessions.RLock()
-		defer sessions.RUnlock()
-
-		type ConnIds struct {
-			Uuid string `json:"uuid"`
-			Num  int    `json:"num"`
-		}
-
-		connIds := make([]*ConnIds, len(sessions.ConnIds))
-
-		i := 0
-		for id, num := range sessions.ConnIds {
-			connIds[i] = &ConnIds{
-				Uuid: id,
-				Num:  num,
-			}
-		}
-
-		if err := json.NewEncoder(w).Encode(connIds); err != nil {
-			log.Error().Err(err).Msg("error encoding sessions")
-		}
-	})
+	mux.Handle("/sessions/", sessions)
 
 	tlsCfg := tls.Config{}
 	if certPath != "" {
@@ -131,78 +113,39 @@ func main() {
 	}
 }
 
+// connectPolicy is what clients may ask guacd to connect to, swap in guac.JSONParamDecoder as the
+// Decoder to accept JSON bodies
+var connectPolicy = guac.Policy{
+	Schema: guac.ParameterSchema{
+		"rdp": {"hostname", "port", "username", "password", "domain", "security", "ignore-cert"},
+		"vnc": {"hostname", "port", "password"},
+		"ssh": {"hostname", "port", "username", "password", "private-key", "passphrase"},
+	},
+}
+
 // DemoDoConnect creates the tunnel to the remote machine (via guacd)
 func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
-	config := guac.NewGuacamoleConfiguration()
-
-	var query url.Values
-	if request.URL.RawQuery == "connect" {
-		// http tunnel uses the body to pass parameters
-		data, err := io.ReadAll(request.Body)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to read body")
-			return nil, err
-		}
-		_ = request.Body.Close()
-		queryString := string(data)
-		query, err = url.ParseQuery(queryString)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to parse body query")
-			return nil, err
-		}
-		log.Debug().Str("body", queryString).Interface("query", query).Msg("parsed request body")
-	} else {
-		query = request.URL.Query()
-	}
-
-	config.Protocol = query.Get("scheme")
-	config.Parameters = map[string]string{}
-	for k, v := range query {
-		config.Parameters[k] = v[0]
-	}
-
-	var err error
-	if query.Get("width") != "" {
-		config.OptimalScreenHeight, err = strconv.Atoi(query.Get("width"))
-		if err != nil || config.OptimalScreenHeight == 0 {
-			log.Error().Msg("invalid height")
-			config.OptimalScreenHeight = 600
-		}
-	}
-	if query.Get("height") != "" {
-		config.OptimalScreenWidth, err = strconv.Atoi(query.Get("height"))
-		if err != nil || config.OptimalScreenWidth == 0 {
-			log.Error().Msg("invalid width")
-			config.OptimalScreenWidth = 800
-		}
-	}
-	config.AudioMimetypes = []string{"audio/L16", "rate=44100", "channels=2"}
-
-	log.Debug().Msg("connecting to guacd")
-	addr, err := net.ResolveTCPAddr("tcp", guacdAddr)
+	config, err := guac.PrepareConfig(request, connectPolicy)
 	if err != nil {
-		log.Error().Err(err).Msg("error resolving guacd address")
+		log.Error().Err(err).Msg("rejected connect request")
 		return nil, err
 	}
+	if len(config.AudioMimetypes) == 0 {
+		config.AudioMimetypes = []string{"audio/L16", "rate=44100", "channels=2"}
+	}
 
-	conn, err := net.DialTCP("tcp", nil, addr)
+	log.Debug().Msg("connecting to guacd")
+	stream, err := guac.DialGuacdNetwork(request.Context(), guacdNet, guacdAddr)
 	if err != nil {
 		log.Error().Err(err).Msg("error while connecting to guacd")
 		return nil, err
 	}
 
-	stream := guac.NewStream(conn, guac.SocketTimeout)
-
 	log.Debug().Msg("connected to guacd")
-	if request.URL.Query().Get("uuid") != "" {
-		config.ConnectionID = request.URL.Query().Get("uuid")
-	}
-
-	sanitisedCfg := config
-	sanitisedCfg.Parameters["password"] = "********"
-	log.Debug().Interface("config", sanitisedCfg).Msg("starting handshake")
-	err = stream.Handshake(config)
+	log.Debug().Interface("config", config.Redacted()).Msg("starting handshake")
+	err = stream.HandshakeContext(request.Context(), config)
 	if err != nil {
+		_ = stream.Close()
 		return nil, err
 	}
 	log.Debug().Msg("socket configured")
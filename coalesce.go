@@ -0,0 +1,319 @@
+package guac
+
+import "strconv"
+
+// Composite operations, from the mask argument of drawing instructions, that leave a layer
+// opaque with the fill color whatever was drawn before
+const (
+	compositeSrc  = 0xC
+	compositeOver = 0xE
+)
+
+// layerCoalescer drops drawing instructions that a later instruction in the same websocket
+// message makes redundant: an opaque cfill of a rect covering a whole layer hides everything
+// drawn to that layer before it, so buffered copy, rect and img operations on the layer need not
+// be sent.
+//
+// It is conservative. A draw is only dropped when every instruction belonging to it is in the
+// message, nothing in between read the layer, and the layer has never had its clip or transform
+// changed, since then a rect from 0,0 may not cover the layer. Layers and path state outlive a
+// message, so it keeps them across flushes.
+type layerCoalescer struct {
+	sizes map[int][2]int
+	// unsafe layers have had their clip, transform or saved state changed
+	unsafe map[int]bool
+	paths  map[int]*layerPath
+}
+
+// layerPath is the path being built on a layer, which the next fill, stroke or clip consumes
+type layerPath struct {
+	ops []int
+	// carried is set when the path began in an earlier message, so it can't be dropped
+	carried bool
+	// covering is set when the path is a single rect covering the whole layer
+	covering bool
+}
+
+// coalesceState is the state of one message being coalesced
+type coalesceState struct {
+	// draws are, for each layer, the groups of instructions that drew to it and can be dropped
+	draws map[int][][]int
+	// streams are the img streams opened in the message, by stream index
+	streams map[int]*imageDraw
+	drop    []bool
+}
+
+type imageDraw struct {
+	layer int
+	ops   []int
+}
+
+func newLayerCoalescer() *layerCoalescer {
+	return &layerCoalescer{
+		sizes:  map[int][2]int{},
+		unsafe: map[int]bool{},
+		paths:  map[int]*layerPath{},
+	}
+}
+
+// coalesce returns data without the instructions that later ones in it make redundant. Data that
+// can't be parsed is returned as it is.
+func (c *layerCoalescer) coalesce(data []byte) []byte {
+	var offsets []int
+	for i := 0; i < len(data); {
+		n, err := scanInstruction(data[i:])
+		if err != nil {
+			return data
+		}
+		offsets = append(offsets, i)
+		i += n
+	}
+	offsets = append(offsets, len(data))
+
+	for _, path := range c.paths {
+		if len(path.ops) > 0 {
+			path.ops = nil
+			path.carried = true
+		}
+	}
+	state := &coalesceState{
+		draws:   map[int][][]int{},
+		streams: map[int]*imageDraw{},
+		drop:    make([]bool, len(offsets)-1),
+	}
+	dropped := false
+	for i := range state.drop {
+		superseded, ok := c.observe(state, i, data[offsets[i]:offsets[i+1]])
+		if !ok {
+			return data
+		}
+		dropped = dropped || superseded
+	}
+	if !dropped {
+		return data
+	}
+
+	ret := make([]byte, 0, len(data))
+	for i, drop := range state.drop {
+		if !drop {
+			ret = append(ret, data[offsets[i]:offsets[i+1]]...)
+		}
+	}
+	return ret
+}
+
+// observe updates the state with instruction i, returning true if it superseded earlier draws
+// and false for ok if it couldn't be parsed
+func (c *layerCoalescer) observe(state *coalesceState, i int, raw []byte) (superseded bool, ok bool) {
+	elements, err := peekElements(raw, 1)
+	if err != nil || len(elements) == 0 {
+		return false, false
+	}
+	opcode := elements[0]
+	switch opcode {
+	case "blob", "end":
+		elements, err = peekElements(raw, 2)
+	case "rect", "start", "line", "arc", "curve", "close", "cfill", "cstroke", "lfill", "lstroke",
+		"clip", "push", "pop", "reset", "transform", "identity", "copy", "transfer", "img", "png",
+		"jpeg", "cursor", "dispose", "size":
+		elements, err = peekElements(raw, 10)
+	default:
+		return false, true
+	}
+	if err != nil {
+		return false, false
+	}
+	args := make([]int, 0, len(elements)-1)
+	for _, element := range elements[1:] {
+		// mimetypes and inline image data aren't numbers, and aren't needed
+		n, err := strconv.Atoi(element)
+		if err != nil {
+			break
+		}
+		args = append(args, n)
+	}
+	arg := func(n int) (int, bool) {
+		if n >= len(args) {
+			return 0, false
+		}
+		return args[n], true
+	}
+
+	switch opcode {
+	case "rect":
+		if len(args) < 5 {
+			return false, false
+		}
+		layer := args[0]
+		path := c.path(layer)
+		size, known := c.sizes[layer]
+		path.covering = len(path.ops) == 0 && !path.carried && known &&
+			args[1] <= 0 && args[2] <= 0 && args[1]+args[3] >= size[0] && args[2]+args[4] >= size[1]
+		path.ops = append(path.ops, i)
+
+	case "start", "line", "arc", "curve", "close":
+		layer, ok := arg(0)
+		if !ok {
+			return false, false
+		}
+		path := c.path(layer)
+		path.covering = false
+		path.ops = append(path.ops, i)
+
+	case "cfill":
+		// cfill,mask,layer,r,g,b,a
+		if len(args) < 6 {
+			return false, false
+		}
+		layer := args[1]
+		path := c.consumePath(layer)
+		covers := path.covering && !c.unsafe[layer] &&
+			(args[0] == compositeSrc || (args[0] == compositeOver && args[5] == 255))
+		if covers {
+			for _, draw := range state.draws[layer] {
+				for _, op := range draw {
+					state.drop[op] = true
+				}
+			}
+			superseded = len(state.draws[layer]) > 0
+			state.draws[layer] = nil
+		}
+		c.addDraw(state, layer, path, i)
+
+	case "cstroke":
+		// cstroke,mask,cap,join,thickness,layer,r,g,b,a
+		layer, ok := arg(4)
+		if !ok {
+			return false, false
+		}
+		c.addDraw(state, layer, c.consumePath(layer), i)
+
+	case "lfill", "lstroke":
+		// lfill,mask,layer,srclayer and lstroke,mask,cap,join,thickness,layer,srclayer
+		layerArg := 1
+		if opcode == "lstroke" {
+			layerArg = 4
+		}
+		layer, ok := arg(layerArg)
+		src, ok2 := arg(layerArg + 1)
+		if !ok || !ok2 {
+			return false, false
+		}
+		if src != layer {
+			state.read(src)
+		}
+		c.addDraw(state, layer, c.consumePath(layer), i)
+
+	case "clip", "push", "pop", "reset", "transform", "identity":
+		layer, ok := arg(0)
+		if !ok {
+			return false, false
+		}
+		c.unsafe[layer] = true
+		c.consumePath(layer)
+		state.read(layer)
+
+	case "copy", "transfer":
+		// copy,srclayer,x,y,w,h,mask,dstlayer,x,y and transfer,srclayer,x,y,w,h,function,dstlayer,x,y
+		src, ok := arg(0)
+		dst, ok2 := arg(6)
+		if !ok || !ok2 {
+			return false, false
+		}
+		if src != dst {
+			state.read(src)
+		}
+		state.draws[dst] = append(state.draws[dst], []int{i})
+
+	case "png", "jpeg":
+		// png,mask,layer,x,y,data
+		layer, ok := arg(1)
+		if !ok {
+			return false, false
+		}
+		state.draws[layer] = append(state.draws[layer], []int{i})
+
+	case "img":
+		// img,stream,mask,layer,mimetype,x,y
+		if len(args) < 3 {
+			return false, false
+		}
+		state.streams[args[0]] = &imageDraw{layer: args[2], ops: []int{i}}
+
+	case "blob", "end":
+		index, ok := arg(0)
+		if !ok {
+			return false, false
+		}
+		// streams opened in an earlier message, and other kinds of stream, pass through
+		if draw := state.streams[index]; draw != nil {
+			draw.ops = append(draw.ops, i)
+			if opcode == "end" {
+				delete(state.streams, index)
+				state.draws[draw.layer] = append(state.draws[draw.layer], draw.ops)
+			}
+		}
+
+	case "cursor":
+		// cursor,x,y,srclayer,srcx,srcy,w,h
+		src, ok := arg(2)
+		if !ok {
+			return false, false
+		}
+		state.read(src)
+
+	case "dispose":
+		layer, ok := arg(0)
+		if !ok {
+			return false, false
+		}
+		state.read(layer)
+		delete(c.sizes, layer)
+		delete(c.paths, layer)
+
+	case "size":
+		if len(args) < 3 {
+			return false, false
+		}
+		c.sizes[args[0]] = [2]int{args[1], args[2]}
+		c.path(args[0]).covering = false
+	}
+	return superseded, true
+}
+
+// read keeps the draws to a layer that a later instruction depends on. The client draws an img
+// stream before anything after the img instruction, so open streams to the layer are kept too.
+func (s *coalesceState) read(layer int) {
+	delete(s.draws, layer)
+	for index, draw := range s.streams {
+		if draw.layer == layer {
+			delete(s.streams, index)
+		}
+	}
+}
+
+func (c *layerCoalescer) path(layer int) *layerPath {
+	path := c.paths[layer]
+	if path == nil {
+		path = &layerPath{}
+		c.paths[layer] = path
+	}
+	return path
+}
+
+// consumePath returns the path on the layer and starts a new one
+func (c *layerCoalescer) consumePath(layer int) layerPath {
+	path := c.path(layer)
+	consumed := *path
+	*path = layerPath{}
+	return consumed
+}
+
+// addDraw records a fill or stroke, with its path, as a draw that can be dropped
+func (c *layerCoalescer) addDraw(state *coalesceState, layer int, path layerPath, i int) {
+	if path.carried {
+		// part of it has been sent, so it has to stay
+		return
+	}
+	state.draws[layer] = append(state.draws[layer], append(path.ops, i))
+}
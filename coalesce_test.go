@@ -0,0 +1,211 @@
+package guac
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func ins(opcode string, args ...string) string {
+	return NewInstruction(opcode, args...).String()
+}
+
+var (
+	fullRect    = ins("rect", "0", "0", "0", "1024", "768")
+	opaqueFill  = ins("cfill", "12", "0", "0", "0", "0", "255")
+	partialRect = ins("rect", "0", "10", "10", "100", "100")
+	layerSize   = ins("size", "0", "1024", "768")
+	syncIns     = ins("sync", "100")
+	copyIns     = ins("copy", "-1", "0", "0", "64", "64", "12", "0", "10", "10")
+	imgIns      = ins("img", "1", "12", "0", "image/png", "0", "0")
+	blobIns     = ins("blob", "1", "AAAA")
+	endIns      = ins("end", "1")
+)
+
+func TestLayerCoalescer(t *testing.T) {
+	tests := []struct {
+		name string
+		// messages are sent in order, only the last is checked
+		messages [][]string
+		expected []string
+	}{
+		{
+			name: "FullFillSupersedes",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, partialRect, opaqueFill, imgIns, blobIns, endIns, syncIns, fullRect, opaqueFill, syncIns},
+			},
+			expected: []string{syncIns, fullRect, opaqueFill, syncIns},
+		},
+		{
+			name: "OpaqueOverSupersedes",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, fullRect, ins("cfill", "14", "0", "1", "2", "3", "255")},
+			},
+			expected: []string{fullRect, ins("cfill", "14", "0", "1", "2", "3", "255")},
+		},
+		{
+			name: "PartialRectKeeps",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, partialRect, opaqueFill},
+			},
+			expected: []string{copyIns, partialRect, opaqueFill},
+		},
+		{
+			name: "TranslucentFillKeeps",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, fullRect, ins("cfill", "14", "0", "0", "0", "0", "128")},
+			},
+			expected: []string{copyIns, fullRect, ins("cfill", "14", "0", "0", "0", "0", "128")},
+		},
+		{
+			name: "CompoundPathKeeps",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, fullRect, ins("line", "0", "5", "5"), opaqueFill},
+			},
+			expected: []string{copyIns, fullRect, ins("line", "0", "5", "5"), opaqueFill},
+		},
+		{
+			name: "UnknownSizeKeeps",
+			messages: [][]string{
+				{copyIns, fullRect, opaqueFill},
+			},
+			expected: []string{copyIns, fullRect, opaqueFill},
+		},
+		{
+			name: "LayerReadKeeps",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, ins("copy", "0", "0", "0", "64", "64", "12", "-2", "0", "0"), fullRect, opaqueFill},
+			},
+			expected: []string{copyIns, ins("copy", "0", "0", "0", "64", "64", "12", "-2", "0", "0"), fullRect, opaqueFill},
+		},
+		{
+			name: "CursorReadKeeps",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, ins("cursor", "0", "0", "0", "0", "0", "16", "16"), fullRect, opaqueFill},
+			},
+			expected: []string{copyIns, ins("cursor", "0", "0", "0", "0", "0", "16", "16"), fullRect, opaqueFill},
+		},
+		{
+			name: "ReadAfterDrawsOnlyKeepsEarlier",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, ins("cursor", "0", "0", "0", "0", "0", "16", "16"), partialRect, opaqueFill, fullRect, opaqueFill},
+			},
+			expected: []string{copyIns, ins("cursor", "0", "0", "0", "0", "0", "16", "16"), fullRect, opaqueFill},
+		},
+		{
+			name: "OtherLayersKept",
+			messages: [][]string{
+				{layerSize},
+				{ins("copy", "-1", "0", "0", "64", "64", "12", "2", "0", "0"), fullRect, opaqueFill},
+			},
+			expected: []string{ins("copy", "-1", "0", "0", "64", "64", "12", "2", "0", "0"), fullRect, opaqueFill},
+		},
+		{
+			name: "TransformedLayerKeeps",
+			messages: [][]string{
+				{layerSize, ins("transform", "0", "2", "0", "0", "2", "0", "0")},
+				{copyIns, fullRect, opaqueFill},
+			},
+			expected: []string{copyIns, fullRect, opaqueFill},
+		},
+		{
+			name: "ClippedLayerKeeps",
+			messages: [][]string{
+				{layerSize, partialRect, ins("clip", "0")},
+				{copyIns, fullRect, opaqueFill},
+			},
+			expected: []string{copyIns, fullRect, opaqueFill},
+		},
+		{
+			name: "IncompleteStreamKeeps",
+			messages: [][]string{
+				{layerSize},
+				{imgIns, blobIns, fullRect, opaqueFill},
+			},
+			expected: []string{imgIns, blobIns, fullRect, opaqueFill},
+		},
+		{
+			name: "StreamFromEarlierMessageKeeps",
+			messages: [][]string{
+				{layerSize, imgIns},
+				{blobIns, endIns, fullRect, opaqueFill},
+			},
+			expected: []string{blobIns, endIns, fullRect, opaqueFill},
+		},
+		{
+			name: "StreamReadBeforeEndKeeps",
+			messages: [][]string{
+				{layerSize},
+				{imgIns, ins("copy", "0", "0", "0", "64", "64", "12", "-2", "0", "0"), blobIns, endIns, fullRect, opaqueFill},
+			},
+			expected: []string{imgIns, ins("copy", "0", "0", "0", "64", "64", "12", "-2", "0", "0"), blobIns, endIns, fullRect, opaqueFill},
+		},
+		{
+			name: "PathFromEarlierMessage",
+			messages: [][]string{
+				{layerSize, partialRect},
+				{opaqueFill, copyIns, fullRect, opaqueFill},
+			},
+			// the first fill's rect was already sent, so the fill stays
+			expected: []string{opaqueFill, fullRect, opaqueFill},
+		},
+		{
+			name: "CoveringPathFromEarlierMessage",
+			messages: [][]string{
+				{layerSize, fullRect},
+				{copyIns, opaqueFill},
+			},
+			expected: []string{opaqueFill},
+		},
+		{
+			name: "ResizedLayer",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, ins("size", "0", "2048", "768"), fullRect, opaqueFill},
+			},
+			expected: []string{copyIns, ins("size", "0", "2048", "768"), fullRect, opaqueFill},
+		},
+		{
+			name: "Malformed",
+			messages: [][]string{
+				{layerSize},
+				{copyIns, fullRect, opaqueFill, "4.sync,"},
+			},
+			expected: []string{copyIns, fullRect, opaqueFill, "4.sync,"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newLayerCoalescer()
+			var out []byte
+			for _, message := range tt.messages {
+				out = c.coalesce([]byte(strings.Join(message, "")))
+			}
+			if expected := strings.Join(tt.expected, ""); string(out) != expected {
+				t.Errorf("Expected\n%s\ngot\n%s", expected, out)
+			}
+		})
+	}
+}
+
+func TestGuacdToWs_CoalesceLayers(t *testing.T) {
+	writer := &fakeMessageWriter{}
+	reader := &sliceReader{instructions: []string{layerSize, copyIns, partialRect, opaqueFill, fullRect, opaqueFill, syncIns}}
+	guacdToWs(context.Background(), nopLogger(), writer, reader, pumpOptions{coalesceLayers: true})
+
+	if len(writer.Messages) != 1 {
+		t.Fatal("Expected 1 message, got", len(writer.Messages))
+	}
+	if expected := layerSize + fullRect + opaqueFill + syncIns; string(writer.Messages[0]) != expected {
+		t.Error("Unexpected message", string(writer.Messages[0]))
+	}
+}
@@ -0,0 +1,73 @@
+package guac
+
+import "strconv"
+
+// compressedImageTypes are image mimetypes whose data is already compressed, so deflating
+// it again costs CPU for little gain
+var compressedImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+}
+
+// compressingWriter is a MessageWriter that can decide per message whether to compress it
+type compressingWriter interface {
+	MessageWriter
+	// compressionEnabled returns true if messages are compressed by default
+	compressionEnabled() bool
+	// writeMessageCompressed writes a message, compressing it only if compress is true
+	writeMessageCompressed(messageType int, data []byte, compress bool) error
+}
+
+// imageFrameDetector measures how much of a frame is already-compressed image data. It follows
+// img streams with a compressed mimetype so their blobs can be counted.
+type imageFrameDetector struct {
+	streams    map[int]bool
+	imageBytes int
+}
+
+func newImageFrameDetector() *imageFrameDetector {
+	return &imageFrameDetector{
+		streams: map[int]bool{},
+	}
+}
+
+// observe accounts for a single instruction added to the frame
+func (d *imageFrameDetector) observe(ins []byte) {
+	elements, err := peekElements(ins, 5)
+	if err != nil || len(elements) < 2 {
+		return
+	}
+
+	switch elements[0] {
+	case "img":
+		// img,stream,mask,layer,mimetype,x,y
+		if len(elements) < 5 || !compressedImageTypes[elements[4]] {
+			return
+		}
+		if index, err := strconv.Atoi(elements[1]); err == nil {
+			d.streams[index] = true
+		}
+	case "blob":
+		if index, err := strconv.Atoi(elements[1]); err == nil && d.streams[index] {
+			d.imageBytes += len(ins)
+		}
+	case "end":
+		if index, err := strconv.Atoi(elements[1]); err == nil {
+			delete(d.streams, index)
+		}
+	case "png", "jpeg":
+		// legacy instructions carry the image data inline
+		d.imageBytes += len(ins)
+	}
+}
+
+// dominant returns true if most of a frame of the given length is compressed image data
+func (d *imageFrameDetector) dominant(frameLen int) bool {
+	return d.imageBytes*2 > frameLen
+}
+
+// reset starts measuring a new frame, image streams stay open across frames
+func (d *imageFrameDetector) reset() {
+	d.imageBytes = 0
+}
@@ -0,0 +1,189 @@
+package guac
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+type fakeCompressingWriter struct {
+	fakeMessageWriter
+	Compressed []bool
+}
+
+func (f *fakeCompressingWriter) compressionEnabled() bool {
+	return true
+}
+
+func (f *fakeCompressingWriter) writeMessageCompressed(n int, buf []byte, compress bool) error {
+	f.Compressed = append(f.Compressed, compress)
+	return f.WriteMessage(n, buf)
+}
+
+func TestGuacdToWs_SkipsCompressionForImages(t *testing.T) {
+	blob := strings.Repeat("A", 400)
+	frames := map[string]bool{
+		// an image dominated frame is already compressed
+		"3.img,1.3,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.3,400." + blob + ";3.end,1.3;4.sync,3.100;": false,
+		// text and drawing instructions compress well
+		"4.rect,1.0,1.0,1.0,3.100,3.100;5.cfill,2.14,1.0,3.255,3.255,3.255,3.255;4.sync,3.100;": true,
+		// uncompressed image formats are worth compressing
+		"3.img,1.3,2.14,1.0,9.image/bmp,1.0,1.0;4.blob,1.3,400." + blob + ";3.end,1.3;": true,
+	}
+
+	for frame, compress := range frames {
+		writer := &fakeCompressingWriter{}
+		guacdToWs(context.Background(), &globalLogger, writer, NewStream(&fakeConn{ToRead: []byte(frame)}, time.Minute), pumpOptions{})
+
+		if len(writer.Compressed) != 1 {
+			t.Fatal("Expected 1 message got", len(writer.Compressed))
+		}
+		if writer.Compressed[0] != compress {
+			t.Errorf("Expected compress=%v for %.40s...", compress, frame)
+		}
+		if string(writer.Messages[0]) != frame {
+			t.Error("Unexpected message", string(writer.Messages[0]))
+		}
+	}
+}
+
+func TestWebsocketServer_EnableCompression(t *testing.T) {
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(&fakeConn{}, time.Minute)), nil
+	}, nopLogger())
+	wsServer.EnableCompression = true
+	url, done := serveWebsocket(t, wsServer)
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	ws, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	waitDone(t, done)
+
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Error("Expected permessage-deflate to be negotiated, got", resp.Header)
+	}
+}
+
+func TestWebsocketServer_CompressionLevel(t *testing.T) {
+	for _, level := range []int{9, 42} {
+		var logs lockedBuffer
+		logger := zerolog.New(&logs)
+		tunnel, guacd := newFakeGuacd(t)
+		wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+			return tunnel, nil
+		}, &logger)
+		wsServer.EnableCompression = true
+		wsServer.CompressionLevel = level
+		url, done := serveWebsocket(t, wsServer)
+
+		dialer := websocket.Dialer{EnableCompression: true}
+		ws, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := strings.Repeat("4.rect,1.0,1.0,1.0,3.100,3.100;", 50)
+		if _, err = guacd.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		if _, received, err := ws.ReadMessage(); err != nil || string(received) != frame {
+			t.Errorf("Level %v: expected the frame to arrive intact, got %v", level, err)
+		}
+		_ = ws.Close()
+		_ = guacd.Close()
+		waitDone(t, done)
+
+		if warned := logs.count("invalid compression level") > 0; warned != (level == 42) {
+			t.Errorf("Level %v: unexpected warning %v", level, warned)
+		}
+	}
+}
+
+// BenchmarkGuacdToWs_Compression measures the cost of deflating what guacdToWs sends, for a
+// frame of drawing instructions, which compresses well, and one of PNG data, which is sent
+// uncompressed so only spotting it costs anything. The client inflates in another goroutine, so it adds to the time but not
+// to the allocations.
+func BenchmarkGuacdToWs_Compression(b *testing.B) {
+	png := make([]byte, 3000)
+	_, _ = rand.New(rand.NewSource(1)).Read(png)
+	pngData := base64.StdEncoding.EncodeToString(png)
+	frames := map[string]string{
+		"Drawing": strings.Repeat("4.copy,2.-1,1.0,1.0,2.64,2.64,2.14,1.0,3.128,2.64;5.cfill,2.14,1.0,3.255,3.255,3.255,3.255;", 40) + "4.sync,3.100;",
+		"PNG":     "3.img,1.3,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.3," + strconv.Itoa(len(pngData)) + "." + pngData + ";3.end,1.3;4.sync,3.100;",
+	}
+	for name, frame := range frames {
+		for _, level := range []int{0, 1, 6, 9} {
+			b.Run(fmt.Sprintf("%v/Level%v", name, level), func(b *testing.B) {
+				ws := benchmarkWebsocket(b, level > 0)
+				if level > 0 {
+					if err := ws.SetCompressionLevel(level); err != nil {
+						b.Fatal(err)
+					}
+				}
+				sess := &wsSession{ws: ws, logger: nopLogger(), compression: level > 0}
+				// guacd's instructions are read one at a time
+				var instructions []string
+				for i := 0; i < b.N; i++ {
+					for data := []byte(frame); len(data) > 0; {
+						n, err := scanInstruction(data)
+						if err != nil {
+							b.Fatal(err)
+						}
+						instructions = append(instructions, string(data[:n]))
+						data = data[n:]
+					}
+				}
+				b.SetBytes(int64(len(frame)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				guacdToWs(context.Background(), nopLogger(), sess, &sliceReader{instructions: instructions}, pumpOptions{})
+			})
+		}
+	}
+}
+
+// benchmarkWebsocket returns the server end of a websocket whose client discards what it reads
+func benchmarkWebsocket(b *testing.B, compress bool) *websocket.Conn {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{EnableCompression: compress}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- ws
+	}))
+	b.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{EnableCompression: compress}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, _, err := client.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	ws := <-conns
+	b.Cleanup(func() {
+		_ = ws.Close()
+		_ = client.Close()
+	})
+	return ws
+}
@@ -3,7 +3,16 @@ package guac
 // Config is the data sent to guacd to configure the session during the handshake.
 type Config struct {
 	// ConnectionID is used to reconnect to an existing session, otherwise leave blank for a new session.
+	//
+	// The handshake's select is the ConnectionID when it is set and the Protocol otherwise, as those
+	// are the only targets guacd knows. Connection groups and sharing profiles belong to
+	// Guacamole's database model and are resolved before guacd is reached: a group to the Protocol
+	// and Parameters of the connection chosen from it, and a sharing profile to the ConnectionID of
+	// the shared connection's active session, with ReadOnly for a view-only profile.
 	ConnectionID string
+	// ReadOnly connects without input, enforced by guacd through the read-only parameter. Use it to
+	// join a shared session as a viewer. The handshake fails if guacd doesn't offer the parameter.
+	ReadOnly bool
 	// Protocol is the protocol of the connection from guacd to the remote (rdp, ssh, etc).
 	Protocol     string
 	// Parameters are used to configure protocol specific options like sla for rdp or terminal color schemes.
@@ -21,6 +30,32 @@ type Config struct {
 	VideoMimetypes      []string
 	// ImageMimetypes is an array of the supported image types
 	ImageMimetypes      []string
+
+	// ParameterSchema optionally restricts the Parameters allowed for each protocol. The handshake
+	// fails before anything is sent to guacd if the Parameters don't match it. Joins, which have a
+	// ConnectionID, are checked against the entry for the empty protocol even if Protocol is set.
+	ParameterSchema ParameterSchema
+
+	// BeforeConnect is an optional hook that can inspect or replace the connect instruction just
+	// before it is sent to guacd, for example to inject a computed value. Args are in the order
+	// guacd requested them, see Stream.HandshakeArgs, and the returned instruction must keep
+	// one value per argument.
+	BeforeConnect func(ins *Instruction) *Instruction
+}
+
+// textProtocols are the guacd protocols that only render a terminal, so they don't need
+// audio, video or image formats negotiated
+var textProtocols = map[string]bool{
+	"ssh":        true,
+	"telnet":     true,
+	"kubernetes": true,
+}
+
+// negotiatesMedia returns true if the handshake should always send the audio, video and image
+// formats. For text protocols they are only sent when set. A join doesn't know the protocol,
+// so it sends them.
+func (c *Config) negotiatesMedia() bool {
+	return c.ConnectionID != "" || !textProtocols[c.Protocol]
 }
 
 // NewGuacamoleConfiguration returns a Config with sane defaults
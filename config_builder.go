@@ -0,0 +1,184 @@
+package guac
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// RequiredParameters are the parameters Config.Validate requires of each protocol, those guacd
+// can't connect without. Protocols that aren't listed require none.
+var RequiredParameters = map[string][]string{
+	"rdp":        {"hostname"},
+	"vnc":        {"hostname"},
+	"ssh":        {"hostname"},
+	"telnet":     {"hostname"},
+	"kubernetes": {"hostname", "pod"},
+}
+
+// Validate returns an error if guacd can't be sent the config: it has neither a protocol nor a
+// ConnectionID to join, a parameter required for its protocol is missing, its screen size or
+// resolution isn't positive or is beyond DefaultMaxScreenWidth and DefaultMaxScreenHeight, or its
+// Parameters don't match its ParameterSchema. The errors are *ErrGuac, ErrSecurity from the schema
+// and ErrClient otherwise. A config prepared with a Policy allowing larger screens should be
+// checked with ValidatePolicy.
+func (c *Config) Validate() error {
+	return c.ValidatePolicy(Policy{})
+}
+
+// ValidatePolicy is Validate with the screen size bounded by the policy's MaxWidth and MaxHeight,
+// as PrepareConfig bounds it, rather than always by the defaults
+func (c *Config) ValidatePolicy(policy Policy) error {
+	if c.ConnectionID == "" {
+		if c.Protocol == "" {
+			return ErrClient.NewError("No protocol provided.")
+		}
+		for _, name := range RequiredParameters[c.Protocol] {
+			if c.Parameters[name] == "" {
+				return ErrClient.NewError("Missing parameter.", c.Protocol, name)
+			}
+		}
+	}
+	maxWidth, maxHeight := policy.MaxWidth, policy.MaxHeight
+	if maxWidth <= 0 {
+		maxWidth = DefaultMaxScreenWidth
+	}
+	if maxHeight <= 0 {
+		maxHeight = DefaultMaxScreenHeight
+	}
+	for _, dimension := range []struct {
+		name       string
+		value, max int
+	}{
+		{"width", c.OptimalScreenWidth, maxWidth},
+		{"height", c.OptimalScreenHeight, maxHeight},
+		{"dpi", c.OptimalResolution, maxScreenDPI},
+	} {
+		if dimension.value <= 0 || dimension.value > dimension.max {
+			return ErrClient.NewError("Invalid screen "+dimension.name+".", strconv.Itoa(dimension.value))
+		}
+	}
+	return c.validateSchema()
+}
+
+// ConfigBuilder builds a Config, which Build validates:
+//
+//	config, err := guac.NewConfigBuilder().
+//		Protocol("rdp").
+//		Param("hostname", host).
+//		Size(width, height).
+//		Audio("audio/L16").
+//		Build()
+//
+// It starts from NewGuacamoleConfiguration's defaults.
+type ConfigBuilder struct {
+	config *Config
+	// policy bounds the screen size, see Config.ValidatePolicy
+	policy Policy
+	// err is the first mistake made while building, returned by Build
+	err error
+}
+
+// NewConfigBuilder creates a builder with the default screen and no protocol
+func NewConfigBuilder() *ConfigBuilder {
+	return &ConfigBuilder{config: NewGuacamoleConfiguration()}
+}
+
+// Protocol sets the protocol guacd connects to the remote with
+func (b *ConfigBuilder) Protocol(protocol string) *ConfigBuilder {
+	b.config.Protocol = protocol
+	return b
+}
+
+// Param sets a protocol parameter
+func (b *ConfigBuilder) Param(name, value string) *ConfigBuilder {
+	if name == "" && b.err == nil {
+		b.err = ErrClient.NewError("Parameter has no name.")
+	}
+	b.config.Parameters[name] = value
+	return b
+}
+
+// Params sets several protocol parameters
+func (b *ConfigBuilder) Params(parameters map[string]string) *ConfigBuilder {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	// so the first mistake is always the same one
+	sort.Strings(names)
+	for _, name := range names {
+		b.Param(name, parameters[name])
+	}
+	return b
+}
+
+// Size sets the optimal screen size, width first
+func (b *ConfigBuilder) Size(width, height int) *ConfigBuilder {
+	b.config.OptimalScreenWidth = width
+	b.config.OptimalScreenHeight = height
+	return b
+}
+
+// Resolution sets the optimal screen resolution in DPI
+func (b *ConfigBuilder) Resolution(dpi int) *ConfigBuilder {
+	b.config.OptimalResolution = dpi
+	return b
+}
+
+// Audio adds audio mimetypes the client supports
+func (b *ConfigBuilder) Audio(mimetypes ...string) *ConfigBuilder {
+	b.config.AudioMimetypes = append(b.config.AudioMimetypes, mimetypes...)
+	return b
+}
+
+// Video adds video mimetypes the client supports
+func (b *ConfigBuilder) Video(mimetypes ...string) *ConfigBuilder {
+	b.config.VideoMimetypes = append(b.config.VideoMimetypes, mimetypes...)
+	return b
+}
+
+// Image adds image mimetypes the client supports
+func (b *ConfigBuilder) Image(mimetypes ...string) *ConfigBuilder {
+	b.config.ImageMimetypes = append(b.config.ImageMimetypes, mimetypes...)
+	return b
+}
+
+// Join connects to the existing session with the connection ID instead of a new one, as a
+// viewer if readOnly is set
+func (b *ConfigBuilder) Join(connectionID string, readOnly bool) *ConfigBuilder {
+	b.config.ConnectionID = connectionID
+	b.config.ReadOnly = readOnly
+	return b
+}
+
+// Schema sets the ParameterSchema the parameters are checked against
+func (b *ConfigBuilder) Schema(schema ParameterSchema) *ConfigBuilder {
+	b.config.ParameterSchema = schema
+	return b
+}
+
+// Policy sets the Policy whose MaxWidth and MaxHeight bound the screen size Build accepts, the
+// defaults if it isn't set
+func (b *ConfigBuilder) Policy(policy Policy) *ConfigBuilder {
+	b.policy = policy
+	return b
+}
+
+// Build returns the config, or the first mistake made building it or found by
+// Config.ValidatePolicy. The builder can go on to build others from it.
+func (b *ConfigBuilder) Build() (*Config, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if err := b.config.ValidatePolicy(b.policy); err != nil {
+		return nil, err
+	}
+	config := *b.config
+	config.Parameters = maps.Clone(b.config.Parameters)
+	config.AudioMimetypes = slices.Clone(b.config.AudioMimetypes)
+	config.VideoMimetypes = slices.Clone(b.config.VideoMimetypes)
+	config.ImageMimetypes = slices.Clone(b.config.ImageMimetypes)
+	return &config, nil
+}
@@ -0,0 +1,96 @@
+package guac
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigBuilder(t *testing.T) {
+	builder := NewConfigBuilder().
+		Protocol("rdp").
+		Param("hostname", "10.0.0.1").
+		Size(1920, 1080).
+		Audio("audio/L16").
+		Image("image/png")
+	config, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Protocol != "rdp" || config.Parameters["hostname"] != "10.0.0.1" {
+		t.Error("Unexpected connection", config.Protocol, config.Parameters)
+	}
+	if config.OptimalScreenWidth != 1920 || config.OptimalScreenHeight != 1080 || config.OptimalResolution != 96 {
+		t.Error("Unexpected screen", config.OptimalScreenWidth, config.OptimalScreenHeight, config.OptimalResolution)
+	}
+	if strings.Join(config.AudioMimetypes, ",") != "audio/L16" || strings.Join(config.ImageMimetypes, ",") != "image/png" {
+		t.Error("Unexpected mimetypes", config.AudioMimetypes, config.ImageMimetypes)
+	}
+
+	// what is built is the builder's no longer
+	if other, err := builder.Param("port", "3389").Audio("audio/ogg").Build(); err != nil || other.Parameters["port"] != "3389" {
+		t.Fatal("Expected another config", err)
+	}
+	if _, ok := config.Parameters["port"]; ok || len(config.AudioMimetypes) != 1 {
+		t.Error("Expected the built config to be left alone", config.Parameters, config.AudioMimetypes)
+	}
+
+	join, err := NewConfigBuilder().Join("$abc", true).Build()
+	if err != nil || join.ConnectionID != "$abc" || !join.ReadOnly {
+		t.Error("Expected a read-only join", join, err)
+	}
+}
+
+func TestConfigBuilder_Errors(t *testing.T) {
+	for name, builder := range map[string]*ConfigBuilder{
+		"no protocol":      NewConfigBuilder().Param("hostname", "10.0.0.1"),
+		"no hostname":      NewConfigBuilder().Protocol("rdp"),
+		"no pod":           NewConfigBuilder().Protocol("kubernetes").Param("hostname", "k8s"),
+		"zero height":      NewConfigBuilder().Protocol("vnc").Param("hostname", "10.0.0.1").Size(1024, 0),
+		"negative width":   NewConfigBuilder().Protocol("vnc").Param("hostname", "10.0.0.1").Size(-1, 768),
+		"too wide":         NewConfigBuilder().Protocol("vnc").Param("hostname", "10.0.0.1").Size(DefaultMaxScreenWidth+1, 768),
+		"no resolution":    NewConfigBuilder().Protocol("vnc").Param("hostname", "10.0.0.1").Resolution(0),
+		"unnamed":          NewConfigBuilder().Protocol("vnc").Params(map[string]string{"hostname": "10.0.0.1", "": "x"}),
+		"schema":           NewConfigBuilder().Protocol("ssh").Param("hostname", "h").Param("recording-path", "/").Schema(ParameterSchema{"ssh": {"hostname"}}),
+		"schema protocol":  NewConfigBuilder().Protocol("rdp").Param("hostname", "h").Schema(ParameterSchema{"ssh": {"hostname"}}),
+		"join with params": NewConfigBuilder().Join("$abc", false).Param("hostname", "h").Schema(ParameterSchema{"": {}}),
+	} {
+		config, err := builder.Build()
+		if config != nil || err == nil {
+			t.Errorf("%s: expected an error, got %+v", name, config)
+			continue
+		}
+		if kind := err.(*ErrGuac).Kind; kind != ErrClient && kind != ErrSecurity {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "ssh"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "hostname") {
+		t.Error("Expected the missing hostname, got", err)
+	}
+	config.Parameters["hostname"] = "10.0.0.1"
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+	// the demo's old mistake, the width given as the height and no width at all
+	config.OptimalScreenHeight, config.OptimalScreenWidth = config.OptimalScreenWidth, 0
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "width") {
+		t.Error("Expected the missing width, got", err)
+	}
+
+	// a policy allowing wider screens than the defaults is honoured
+	config.OptimalScreenWidth, config.OptimalScreenHeight = DefaultMaxScreenWidth+1, 1080
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "width") {
+		t.Error("Expected the default bound, got", err)
+	}
+	if err := config.ValidatePolicy(Policy{MaxWidth: DefaultMaxScreenWidth * 2}); err != nil {
+		t.Error("Expected the policy's bound, got", err)
+	}
+	if _, err := NewConfigBuilder().Protocol("vnc").Param("hostname", "10.0.0.1").Size(DefaultMaxScreenWidth+1, 1080).
+		Policy(Policy{MaxWidth: DefaultMaxScreenWidth * 2}).Build(); err != nil {
+		t.Error("Expected the builder to use the policy's bound, got", err)
+	}
+}
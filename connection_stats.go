@@ -0,0 +1,43 @@
+package guac
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionStats are the traffic of one session, for billing. Bytes are counted once they are
+// written, and instructions once the message carrying them is, so a session that fails
+// part way through only counts what was delivered.
+type ConnectionStats struct {
+	BytesToGuacd         int64
+	BytesToClient        int64
+	InstructionsToGuacd  int64
+	InstructionsToClient int64
+	// StartedAt is when the session connected to guacd, and Duration how long it has lasted
+	StartedAt time.Time
+	Duration  time.Duration
+}
+
+// stats returns a snapshot of the session's traffic so far
+func (c *wsSession) stats() ConnectionStats {
+	return ConnectionStats{
+		BytesToGuacd:         atomic.LoadInt64(&c.bytesToGuacd),
+		BytesToClient:        atomic.LoadInt64(&c.bytesToClient),
+		InstructionsToGuacd:  atomic.LoadInt64(&c.counts.instructionsToGuacd),
+		InstructionsToClient: atomic.LoadInt64(&c.counts.instructionsToClient),
+		StartedAt:            c.started,
+		Duration:             time.Since(c.started),
+	}
+}
+
+// TunnelStats returns the traffic so far of the active session using tunnel, or false if no
+// session is using it
+func (s *WebsocketServer) TunnelStats(tunnel Tunnel) (ConnectionStats, bool) {
+	sessions := s.sessions.find(func(sess *wsSession) bool {
+		return sess.tunnel == tunnel
+	})
+	if len(sessions) == 0 {
+		return ConnectionStats{}, false
+	}
+	return sessions[0].stats(), true
+}
@@ -0,0 +1,106 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_ConnectionStats(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	final := make(chan ConnectionStats, 1)
+	wsServer.OnDisconnectStats = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, stats ConnectionStats) {
+		final <- stats
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	before := time.Now()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	if _, err = guacd.Write([]byte("4.sync,3.100;4.sync,3.200;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	<-guacd.Received
+
+	// the counts are made once each write returns, which may be after the other end has it
+	expected := ConnectionStats{BytesToGuacd: 15, BytesToClient: 26, InstructionsToGuacd: 1, InstructionsToClient: 2}
+	var live ConnectionStats
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		var ok bool
+		if live, ok = wsServer.TunnelStats(tunnel); !ok {
+			t.Fatal("Expected stats for the active tunnel")
+		}
+		if sameCounts(live, expected) {
+			break
+		}
+	}
+	if !sameCounts(live, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, live)
+	}
+	if live.StartedAt.Before(before) || live.Duration <= 0 {
+		t.Error("Unexpected start and duration", live.StartedAt, live.Duration)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+	stats := <-final
+	// guacd is told to disconnect as the session ends
+	expected.BytesToGuacd += int64(len("10.disconnect;"))
+	expected.InstructionsToGuacd++
+	if !sameCounts(stats, expected) {
+		t.Errorf("Expected %+v at disconnect, got %+v", expected, stats)
+	}
+	if !stats.StartedAt.Equal(live.StartedAt) || stats.Duration < live.Duration {
+		t.Error("Unexpected start and duration at disconnect", stats.StartedAt, stats.Duration)
+	}
+	if _, ok := wsServer.TunnelStats(tunnel); ok {
+		t.Error("Expected no stats once the session has ended")
+	}
+}
+
+func TestWebsocketServer_ConnectionStatsFailedWrite(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	final := make(chan ConnectionStats, 1)
+	wsServer.OnDisconnectStats = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, stats ConnectionStats) {
+		final <- stats
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	// guacd is gone, so what the client sends is never written
+	_ = guacd.Close()
+	_ = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;"))
+	waitDone(t, done)
+	if stats := <-final; stats.BytesToGuacd != 0 || stats.InstructionsToGuacd != 0 {
+		t.Errorf("Expected nothing to be counted, got %+v", stats)
+	}
+}
+
+// sameCounts compares the byte and instruction counts of stats
+func sameCounts(a, b ConnectionStats) bool {
+	return a.BytesToGuacd == b.BytesToGuacd && a.BytesToClient == b.BytesToClient &&
+		a.InstructionsToGuacd == b.InstructionsToGuacd && a.InstructionsToClient == b.InstructionsToClient
+}
@@ -0,0 +1,154 @@
+package guac
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// GuacdDialer connects to guacd when it isn't directly reachable over TCP. The zero value dials
+// directly, like DialGuacd.
+type GuacdDialer struct {
+	// Network is the network of the guacd address, "tcp" if empty. With "unix" the address is
+	// the path of a Unix domain socket, such as "/var/run/guacd.sock", which avoids the TCP stack
+	// and exposing guacd to the network when it runs on the same host. A proxy only reaches
+	// guacd over TCP.
+	Network string
+	// ProxyURL is an optional HTTP proxy to reach guacd through, with an HTTP CONNECT tunnel. A
+	// username and password in the URL are sent as Basic proxy authorization, and an https URL
+	// uses TLS to the proxy.
+	ProxyURL *url.URL
+	// TLSConfig optionally secures the connection to guacd with TLS, inside the proxy tunnel when
+	// there is one. ServerName defaults to the host of the guacd address.
+	TLSConfig *tls.Config
+}
+
+// Dial connects to guacd at the given address, giving up when ctx is done
+func (d *GuacdDialer) Dial(ctx context.Context, address string) (*Stream, error) {
+	conn, err := d.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewStream(conn, SocketTimeout), nil
+}
+
+// DialContext returns the connection to guacd, for use where a net.Conn is needed
+func (d *GuacdDialer) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	network := d.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if d.ProxyURL != nil {
+		if network != "tcp" {
+			return nil, ErrServer.NewError("A proxy can only reach guacd over TCP.", network)
+		}
+		conn, err = d.dialProxy(ctx, address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, handshakeAborted(ctx)
+		}
+		if _, ok := err.(*ErrGuac); ok {
+			return nil, err
+		}
+		return nil, ErrUpstreamUnavailable.NewError("Unable to connect to guacd.", err.Error())
+	}
+
+	if d.TLSConfig != nil {
+		config := d.TLSConfig.Clone()
+		if config.ServerName == "" {
+			if config.ServerName, _, err = net.SplitHostPort(address); err != nil {
+				config.ServerName = address
+			}
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			if ctx.Err() != nil {
+				return nil, handshakeAborted(ctx)
+			}
+			return nil, ErrUpstreamUnavailable.NewError("TLS handshake with guacd failed.", err.Error())
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// dialProxy opens an HTTP CONNECT tunnel to address through the proxy
+func (d *GuacdDialer) dialProxy(ctx context.Context, address string) (net.Conn, error) {
+	proxyAddress := d.ProxyURL.Host
+	if d.ProxyURL.Port() == "" {
+		port := "80"
+		if d.ProxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(d.ProxyURL.Hostname(), port)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, ErrUpstreamUnavailable.NewError("Unable to connect to proxy.", err.Error())
+	}
+	if d.ProxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.ProxyURL.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, ErrUpstreamUnavailable.NewError("TLS handshake with proxy failed.", err.Error())
+		}
+		conn = tlsConn
+	}
+
+	// the proxy may never answer, so bound the CONNECT by ctx
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if user := d.ProxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err = request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, ErrUpstreamUnavailable.NewError("Unable to send CONNECT to proxy.", err.Error())
+	}
+
+	// guacd sends nothing until the handshake starts, so nothing after the response is buffered
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, ErrUpstreamUnavailable.NewError("Invalid response from proxy.", err.Error())
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		if response.StatusCode == http.StatusProxyAuthRequired {
+			return nil, ErrUpstreamUnavailable.NewError("Proxy authentication failed.", response.Status)
+		}
+		return nil, ErrUpstreamUnavailable.NewError("Proxy refused the connection to guacd.", fmt.Sprintf("%v: %v", address, response.Status))
+	}
+
+	if !stop() {
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
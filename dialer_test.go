@@ -0,0 +1,266 @@
+package guac
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectProxy is a mock HTTP CONNECT proxy that requires the given Proxy-Authorization, if set
+type connectProxy struct {
+	net.Listener
+	auth string
+	// targets receives the address of each tunnel opened
+	targets chan string
+}
+
+func newConnectProxy(t *testing.T, auth string) *connectProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	proxy := &connectProxy{Listener: listener, auth: auth, targets: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.serve(conn)
+		}
+	}()
+	return proxy
+}
+
+func (p *connectProxy) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	request, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	if request.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	if p.auth != "" && request.Header.Get("Proxy-Authorization") != p.auth {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	target, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer func() { _ = target.Close() }()
+	p.targets <- request.Host
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() { _, _ = io.Copy(target, conn) }()
+	_, _ = io.Copy(conn, target)
+}
+
+func (p *connectProxy) url(userinfo *url.Userinfo) *url.URL {
+	return &url.URL{Scheme: "http", Host: p.Addr().String(), User: userinfo}
+}
+
+// echoServer echoes everything written to it
+func echoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestGuacdDialer_Proxy(t *testing.T) {
+	guacd := echoServer(t)
+	proxy := newConnectProxy(t, "Basic dXNlcjpwYXNz") // user:pass
+	dialer := GuacdDialer{ProxyURL: proxy.url(url.UserPassword("user", "pass"))}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := dialer.Dial(ctx, guacd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.Close() }()
+	if target := <-proxy.targets; target != guacd {
+		t.Error("Expected a tunnel to guacd, got", target)
+	}
+
+	if _, err = stream.Write(NewInstruction("select", "rdp").Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	ins, err := ReadOne(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.Opcode != "select" || ins.Args[0] != "rdp" {
+		t.Error("Unexpected instruction", ins)
+	}
+}
+
+func TestGuacdDialer_ProxyErrors(t *testing.T) {
+	proxy := newConnectProxy(t, "Basic dXNlcjpwYXNz")
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	for name, test := range map[string]struct {
+		proxy   *url.URL
+		target  string
+		message string
+	}{
+		"NoCredentials":    {proxy.url(nil), echoServer(t), "Proxy authentication failed."},
+		"WrongCredentials": {proxy.url(url.UserPassword("user", "wrong")), echoServer(t), "Proxy authentication failed."},
+		"Unreachable":      {proxy.url(url.UserPassword("user", "pass")), closedAddr, "Proxy refused the connection to guacd."},
+		"NoProxy":          {&url.URL{Scheme: "http", Host: closedAddr}, echoServer(t), "Unable to connect to proxy."},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dialer := GuacdDialer{ProxyURL: test.proxy}
+			_, err := dialer.Dial(context.Background(), test.target)
+			if err == nil || err.(*ErrGuac).Kind != ErrUpstreamUnavailable || !strings.HasPrefix(err.Error(), test.message) {
+				t.Error("Expected", test.message, "got", err)
+			}
+		})
+	}
+}
+
+func TestGuacdDialer_ProxyTimeout(t *testing.T) {
+	// a proxy that accepts but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer func() { _ = conn.Close() }()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	dialer := GuacdDialer{ProxyURL: &url.URL{Scheme: "http", Host: listener.Addr().String()}}
+	if _, err = dialer.Dial(ctx, "guacd:4822"); err == nil || err.(*ErrGuac).Kind != ErrUpstreamTimeout {
+		t.Error("Expected a timeout, got", err)
+	}
+}
+
+func TestGuacdDialer_ProxyTLS(t *testing.T) {
+	// guacd with TLS, here an HTTPS server, reached through the proxy
+	guacd := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "guacd")
+	}))
+	defer guacd.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(guacd.Certificate())
+
+	proxy := newConnectProxy(t, "")
+	dialer := GuacdDialer{
+		ProxyURL:  proxy.url(nil),
+		TLSConfig: &tls.Config{RootCAs: roots},
+	}
+	conn, err := dialer.DialContext(context.Background(), guacd.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Fatal("Expected a TLS connection")
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "https://guacd/", nil)
+	if err = request.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if string(body) != "guacd" {
+		t.Error("Unexpected response", string(body))
+	}
+
+	// the certificate is checked against the guacd address
+	dialer.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	if _, err = dialer.DialContext(context.Background(), guacd.Listener.Addr().String()); err == nil || err.(*ErrGuac).Kind != ErrUpstreamUnavailable {
+		t.Error("Expected an untrusted certificate to fail, got", err)
+	}
+}
+
+func TestDialGuacdNetwork_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guacd.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("Unix sockets are not supported:", err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		if _, err = serveHandshake(conn, "$unix", "hostname"); err != nil {
+			return
+		}
+		// then say nothing, so the client's read times out
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	stream, err := DialGuacdNetwork(context.Background(), "unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.Close() }()
+	if err = stream.Handshake(NewGuacamoleConfiguration()); err != nil {
+		t.Fatal(err)
+	}
+	if stream.ConnectionID != "$unix" {
+		t.Error("Expected the connection ID from the socket, got", stream.ConnectionID)
+	}
+
+	// read deadlines work as they do over TCP
+	stream.timeout = 50 * time.Millisecond
+	if _, err = stream.ReadSome(); err == nil || err.(*ErrGuac).Kind != ErrUpstreamTimeout {
+		t.Error("Expected a read timeout, got", err)
+	}
+
+	if _, err = DialGuacdNetwork(context.Background(), "unix", filepath.Join(t.TempDir(), "missing.sock")); err == nil || err.(*ErrGuac).Kind != ErrUpstreamUnavailable {
+		t.Error("Expected a missing socket to be unavailable, got", err)
+	}
+	dialer := GuacdDialer{Network: "unix", ProxyURL: &url.URL{Scheme: "http", Host: "proxy:3128"}}
+	if _, err = dialer.Dial(context.Background(), path); err == nil {
+		t.Error("Expected a proxy to be refused for a Unix socket")
+	}
+}
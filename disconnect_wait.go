@@ -0,0 +1,54 @@
+package guac
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// disconnectOpcode is the instruction either side sends to end the connection
+const disconnectOpcode = "disconnect"
+
+// hasOpcode returns true if any instruction in data has the opcode
+func hasOpcode(data []byte, opcode string) bool {
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			return false
+		}
+		if elements, err := peekElements(data[:n], 1); err == nil && len(elements) == 1 && elements[0] == opcode {
+			return true
+		}
+		data = data[n:]
+	}
+	return false
+}
+
+// awaitGuacdClose gives guacd up to wait to close the connection after the client's disconnect
+// was forwarded, so it can finish cleaning up the remote session. The tunnel is closed if guacd
+// takes longer.
+func (c *wsSession) awaitGuacdClose(wait time.Duration) {
+	atomic.StoreInt32(&c.disconnecting, 1)
+	// the client's disconnect was what guacd needed
+	atomic.StoreInt32(&c.disconnectSent, 1)
+	c.logger.Debug().Dur("wait", wait).Msg("client disconnected, waiting for guacd to close")
+	select {
+	case <-c.guacdClosed:
+	case <-time.After(wait):
+		c.logger.Warn().Dur("wait", wait).Msg("guacd did not close after disconnect, closing tunnel")
+		c.closeTunnel()
+	}
+}
+
+// drainGuacd discards what guacd sends after the client stopped reading, until guacd closes the
+// connection or the tunnel is closed, when the client's disconnect is being waited for
+func (c *wsSession) drainGuacd(guacd InstructionReader) {
+	defer close(c.guacdClosed)
+	if atomic.LoadInt32(&c.disconnecting) == 0 {
+		return
+	}
+	for {
+		if _, err := guacd.ReadSome(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_DisconnectWait(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	reasons := make(chan CloseReason, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.DisconnectWait = 5 * time.Second
+	wsServer.OnDisconnectReason = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, reason CloseReason) {
+		reasons <- reason
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("10.disconnect;")); err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	if received := <-guacd.Received; received != "10.disconnect;" {
+		t.Fatal("Expected the disconnect to be forwarded, got", received)
+	}
+
+	// guacd is still cleaning up, so the tunnel stays open
+	select {
+	case <-done:
+		t.Fatal("Expected to wait for guacd to close")
+	case received, ok := <-guacd.Received:
+		if !ok {
+			t.Fatal("Expected the tunnel to stay open")
+		}
+		t.Fatal("Unexpected instruction", received)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// once it has finished, guacd closes the connection itself
+	if _, err = guacd.Write([]byte("10.disconnect;")); err != nil {
+		t.Fatal(err)
+	}
+	_ = guacd.Close()
+	waitDone(t, done)
+	if reason := <-reasons; reason != CloseReasonClient {
+		t.Error("Expected the client to be blamed, got", reason)
+	}
+}
+
+func TestWebsocketServer_DisconnectWaitTimeout(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.DisconnectWait = 100 * time.Millisecond
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("5.mouse,1.0,1.0,1.0;10.disconnect;")); err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+
+	// guacd never closes, so the tunnel is closed once the wait is over
+	for range guacd.Received {
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("Expected to wait for guacd before closing the tunnel, closed after", elapsed)
+	}
+	waitDone(t, done)
+}
+
+func TestHasOpcode(t *testing.T) {
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{"10.disconnect;", true},
+		{"3.key,2.65,1.1;10.disconnect;", true},
+		{"4.blob,1.1,14.10.disconnect;;", false},
+		{"3.key,2.65,1.1;", false},
+		{"10.disconnect", false},
+	}
+	for _, tt := range tests {
+		if ok := hasOpcode([]byte(tt.data), disconnectOpcode); ok != tt.ok {
+			t.Errorf("%q: expected %v, got %v", tt.data, tt.ok, ok)
+		}
+	}
+}
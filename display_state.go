@@ -0,0 +1,97 @@
+package guac
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+)
+
+// displayState keeps the drawing instructions guacd has sent on a connection, so a viewer that
+// attaches late can be brought up to date by replaying them. guacd can't be asked to resend the
+// display on an existing connection, and a drawing usually depends on what was drawn before it,
+// so everything is kept in order: memory grows with the session until the limit is reached,
+// after which the state is dropped and can no longer be replayed.
+type displayState struct {
+	sync.Mutex
+	limit int
+	buf   bytes.Buffer
+	// images are the indexes of img streams, whose blobs are part of the display
+	images    map[int]bool
+	overflown bool
+}
+
+func newDisplayState(limit int) *displayState {
+	return &displayState{
+		limit:  limit,
+		images: map[int]bool{},
+	}
+}
+
+// observe records an instruction read from guacd if it changes the display
+func (d *displayState) observe(raw []byte) {
+	elements, err := peekElements(raw, 2)
+	if err != nil || len(elements) == 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.overflown {
+		return
+	}
+
+	opcode := elements[0]
+	switch {
+	case opcode == "img" && len(elements) > 1:
+		if index, err := strconv.Atoi(elements[1]); err == nil {
+			d.images[index] = true
+		}
+	case (opcode == "blob" || opcode == "end") && len(elements) > 1:
+		index, err := strconv.Atoi(elements[1])
+		if err != nil || !d.images[index] {
+			return
+		}
+		if opcode == "end" {
+			delete(d.images, index)
+		}
+	case !drawingOpcodes[opcode]:
+		return
+	}
+
+	if d.buf.Len()+len(raw) > d.limit {
+		d.overflown = true
+		d.buf = bytes.Buffer{}
+		return
+	}
+	d.buf.Write(raw)
+}
+
+// replay writes the display state to ws in messages of up to MaxGuacMessage bytes
+func (d *displayState) replay(ws MessageWriter) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.overflown {
+		return ErrResourceNotFound.NewError("Display state exceeded its limit and is no longer available.")
+	}
+
+	state := d.buf.Bytes()
+	for len(state) > 0 {
+		// split on instruction boundaries, an instruction larger than a message is sent alone
+		end := 0
+		for end < len(state) {
+			n, err := scanInstruction(state[end:])
+			if err != nil {
+				return ErrServer.NewError("Corrupt display state.", err.Error())
+			}
+			if end > 0 && end+n > MaxGuacMessage {
+				break
+			}
+			end += n
+		}
+		if err := ws.WriteMessage(1, state[:end]); err != nil {
+			return err
+		}
+		state = state[end:]
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream_ReplayDisplayState(t *testing.T) {
+	drawing := "4.size,1.0,4.1024,3.768;" +
+		"3.img,1.1,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.1,4.AAAA;3.end,1.1;" +
+		"4.rect,1.0,1.0,1.0,2.10,2.10;5.cfill,2.14,1.0,3.255,1.0,1.0,3.255;"
+	session := "4.size,1.0,4.1024,3.768;3.nop;" +
+		"3.img,1.1,2.14,1.0,9.image/png,1.0,1.0;9.clipboard,1.2,10.text/plain;4.blob,1.1,4.AAAA;" +
+		"4.blob,1.2,4.BBBB;3.end,1.1;3.end,1.2;4.sync,3.100;" +
+		"4.rect,1.0,1.0,1.0,2.10,2.10;5.cfill,2.14,1.0,3.255,1.0,1.0,3.255;4.sync,3.200;"
+
+	stream := NewStream(&fakeConn{ToRead: []byte(session)}, time.Minute)
+	stream.RetainDisplayState(1 << 20)
+	tunnel := NewSimpleTunnel(stream)
+
+	// the first viewer sees the whole session
+	first := &fakeMessageWriter{}
+	guacdToWs(context.Background(), nopLogger(), first, tunnel.AcquireReader(), pumpOptions{})
+
+	// a late viewer is sent what was drawn
+	late := &fakeMessageWriter{}
+	if err := tunnel.ReplayDisplayState(late); err != nil {
+		t.Fatal(err)
+	}
+	if replayed := string(bytes.Join(late.Messages, nil)); replayed != drawing {
+		t.Error("Unexpected display state", replayed)
+	}
+}
+
+func TestDisplayState_Limits(t *testing.T) {
+	blob := "4.blob,1.1,4000." + strings.Repeat("A", 4000) + ";"
+	state := newDisplayState(20000)
+	state.observe([]byte("3.img,1.1,2.14,1.0,9.image/png,1.0,1.0;"))
+	for i := 0; i < 3; i++ {
+		state.observe([]byte(blob))
+	}
+
+	// blobs are replayed in messages of at most MaxGuacMessage
+	viewer := &fakeMessageWriter{}
+	if err := state.replay(viewer); err != nil {
+		t.Fatal(err)
+	}
+	if len(viewer.Messages) != 2 {
+		t.Error("Expected 2 messages, got", len(viewer.Messages))
+	}
+	for _, msg := range viewer.Messages {
+		if len(msg) > MaxGuacMessage {
+			t.Error("Message larger than MaxGuacMessage", len(msg))
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		state.observe([]byte(blob))
+	}
+	if err := state.replay(&fakeMessageWriter{}); err == nil || err.(*ErrGuac).Kind != ErrResourceNotFound {
+		t.Error("Expected the state to be dropped past its limit, got", err)
+	}
+}
+
+func TestStream_ReplayDisplayState_NotRetained(t *testing.T) {
+	stream := NewStream(&fakeConn{}, time.Minute)
+	if err := stream.ReplayDisplayState(&fakeMessageWriter{}); err == nil || err.(*ErrGuac).Kind != ErrUnsupported {
+		t.Error("Expected unsupported error, got", err)
+	}
+}
@@ -1,7 +1,9 @@
 package guac
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -36,6 +38,9 @@ const (
 	ErrUpstreamNotFound
 	ErrUpstreamTimeout
 	ErrUpstreamUnavailable
+	// ErrAuthenticationFailed is guacd rejecting the credentials given for the remote host, so
+	// the user can be asked for them again. It is last to keep the values of the other kinds.
+	ErrAuthenticationFailed
 )
 
 // Status convert ErrKind to Status
@@ -85,6 +90,8 @@ func (e ErrKind) Status() (state Status) {
 		return UpstreamTimeout
 	case ErrUpstreamUnavailable:
 		return UpstreamUnavailable
+	case ErrAuthenticationFailed:
+		return ClientUnauthorized
 	}
 	return
 }
@@ -97,3 +104,59 @@ func (e ErrKind) NewError(args ...string) error {
 		Kind:   e,
 	}
 }
+
+// errorStatus returns the Status of an error, ServerError if it isn't an *ErrGuac
+func errorStatus(err error) Status {
+	if e, ok := err.(*ErrGuac); ok {
+		return e.Status
+	}
+	return ServerError
+}
+
+// IsAuthenticationFailed returns true if err, or an error it wraps, is guacd rejecting the
+// credentials for the remote host. Network errors and unreachable hosts are not.
+func IsAuthenticationFailed(err error) bool {
+	var guacErr *ErrGuac
+	return errors.As(err, &guacErr) && guacErr.Kind == ErrAuthenticationFailed
+}
+
+// guacdError converts an error instruction from guacd into an error of the matching kind
+func guacdError(instruction *Instruction) error {
+	message := "guacd sent an error."
+	if len(instruction.Args) > 0 && instruction.Args[0] != "" {
+		message = instruction.Args[0]
+	}
+	status := ServerError
+	if len(instruction.Args) > 1 {
+		if code, err := strconv.Atoi(instruction.Args[1]); err == nil && FromGuacamoleStatusCode(code) != Undefined {
+			status = FromGuacamoleStatusCode(code)
+		}
+	}
+
+	var kind ErrKind
+	switch status {
+	case ClientUnauthorized:
+		kind = ErrAuthenticationFailed
+	case ClientForbidden:
+		kind = ErrSecurity
+	case ClientBadRequest:
+		kind = ErrClient
+	case ServerBusy:
+		kind = ErrServerBusy
+	case ResourceNotFound:
+		kind = ErrResourceNotFound
+	case UpstreamTimeout:
+		kind = ErrUpstreamTimeout
+	case UpstreamNotFound:
+		kind = ErrUpstreamNotFound
+	case UpstreamUnavailable:
+		kind = ErrUpstreamUnavailable
+	case UpstreamError:
+		kind = ErrUpstream
+	case Unsupported:
+		kind = ErrUnsupported
+	default:
+		kind = ErrServer
+	}
+	return &ErrGuac{error: errors.New(message), Status: status, Kind: kind}
+}
@@ -0,0 +1,56 @@
+package guac
+
+import "context"
+
+// ProtocolFallback is a protocol to connect with when the requested one fails, such as VNC for
+// a host that refuses RDP
+type ProtocolFallback struct {
+	Protocol string
+	// Parameters replace those of the config that failed, as each protocol names its parameters
+	// differently. Nil keeps them.
+	Parameters map[string]string
+}
+
+// FallbackPolicy lists the protocols ConnectGuacdFallback tries, in order, and when it tries them
+type FallbackPolicy struct {
+	Fallbacks []ProtocolFallback
+	// ShouldFallback optionally decides whether the handshake error of one protocol is worth
+	// trying the next for. By default every handshake error is.
+	ShouldFallback func(err error) bool
+}
+
+// ConnectGuacdFallback connects to guacd like ConnectGuacd, and if the handshake fails tries the
+// fallback protocols of the policy in turn until one succeeds. guacd is reached with dialer, or
+// directly over TCP if it is nil. Each attempt uses a fresh guacd connection, and the connection
+// of a failed attempt is closed. Failing to reach guacd at all,
+// or ctx being done, isn't something another protocol can fix, so it is returned straight away.
+// When every protocol fails the error of the last one is returned.
+//
+// The Stream's config, used by Migrate, is that of the protocol that succeeded.
+func ConnectGuacdFallback(ctx context.Context, dialer *GuacdDialer, address string, config *Config, policy FallbackPolicy) (*Stream, error) {
+	if dialer == nil {
+		dialer = &GuacdDialer{}
+	}
+	for i := 0; ; i++ {
+		stream, err := dialer.Dial(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		if err = stream.HandshakeContext(ctx, config); err == nil {
+			return stream, nil
+		}
+		_ = stream.Close()
+
+		if i == len(policy.Fallbacks) || ctx.Err() != nil || (policy.ShouldFallback != nil && !policy.ShouldFallback(err)) {
+			return nil, err
+		}
+		fallback := policy.Fallbacks[i]
+		globalLogger.Warn().Err(err).Str("protocol", config.Protocol).Str("fallback", fallback.Protocol).Msg("handshake failed, connecting with fallback protocol")
+		next := *config
+		next.Protocol = fallback.Protocol
+		if fallback.Parameters != nil {
+			next.Parameters = fallback.Parameters
+		}
+		config = &next
+	}
+}
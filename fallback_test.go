@@ -0,0 +1,159 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// guacdConn is one connection accepted by protocolGuacd
+type guacdConn struct {
+	protocol string
+	args     []string
+	closed   chan struct{}
+}
+
+// protocolGuacd accepts connections, refusing the handshake of the protocols in refused with an
+// error and completing it for the others. Each connection is sent on the returned channel, and
+// its closed channel is closed once the connection is closed.
+func protocolGuacd(t *testing.T, refused map[string]bool) (string, <-chan *guacdConn) {
+	return protocolGuacdNetwork(t, "tcp", "127.0.0.1:0", refused)
+}
+
+// protocolGuacdNetwork is protocolGuacd listening on the given network
+func protocolGuacdNetwork(t *testing.T, network, address string, refused map[string]bool) (string, <-chan *guacdConn) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	conns := make(chan *guacdConn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			c := &guacdConn{closed: make(chan struct{})}
+			conns <- c
+			go func() {
+				defer close(c.closed)
+				guacd := NewStream(conn, time.Minute)
+				for {
+					ins, err := ReadOne(guacd)
+					if err != nil {
+						return
+					}
+					switch ins.Opcode {
+					case "select":
+						c.protocol = ins.Args[0]
+						if refused[c.protocol] {
+							_, _ = guacd.Write(NewInstruction("error", "Connection refused.", "519").Bytes())
+							continue
+						}
+						_, _ = guacd.Write(NewInstruction("args", "VERSION_1_1_0", "hostname", "port").Bytes())
+					case "connect":
+						c.args = ins.Args
+						_, _ = guacd.Write(NewInstruction("ready", "$"+c.protocol).Bytes())
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), conns
+}
+
+func TestConnectGuacdFallback(t *testing.T) {
+	addr, conns := protocolGuacd(t, map[string]bool{"rdp": true})
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+	config.Parameters = map[string]string{"hostname": "desktop", "port": "3389"}
+
+	stream, err := ConnectGuacdFallback(context.Background(), nil, addr, config, FallbackPolicy{
+		Fallbacks: []ProtocolFallback{{Protocol: "vnc", Parameters: map[string]string{"hostname": "desktop", "port": "5900"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.Close() }()
+	if stream.ConnectionID != "$vnc" {
+		t.Error("Expected the fallback's connection, got", stream.ConnectionID)
+	}
+
+	refused := <-conns
+	select {
+	case <-refused.closed:
+	case <-time.After(time.Second):
+		t.Error("Expected the failed connection to be closed")
+	}
+	fallback := <-conns
+	if fallback.protocol != "vnc" || len(fallback.args) < 3 || fallback.args[2] != "5900" {
+		t.Errorf("Expected the fallback's parameters, got %v %v", fallback.protocol, fallback.args)
+	}
+	if config.Protocol != "rdp" {
+		t.Error("Expected the caller's config to be left alone")
+	}
+}
+
+func TestConnectGuacdFallback_AllFail(t *testing.T) {
+	addr, conns := protocolGuacd(t, map[string]bool{"rdp": true, "vnc": true})
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+
+	_, err := ConnectGuacdFallback(context.Background(), nil, addr, config, FallbackPolicy{
+		Fallbacks: []ProtocolFallback{{Protocol: "vnc"}},
+	})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-conns:
+			<-c.closed
+		case <-time.After(time.Second):
+			t.Fatal("Expected both protocols to be tried")
+		}
+	}
+}
+
+func TestConnectGuacdFallback_ShouldFallback(t *testing.T) {
+	addr, conns := protocolGuacd(t, map[string]bool{"rdp": true})
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+
+	_, err := ConnectGuacdFallback(context.Background(), nil, addr, config, FallbackPolicy{
+		Fallbacks:      []ProtocolFallback{{Protocol: "vnc"}},
+		ShouldFallback: func(error) bool { return false },
+	})
+	if err == nil {
+		t.Fatal("Expected the primary's error")
+	}
+	<-conns
+	select {
+	case c := <-conns:
+		t.Error("Expected no fallback, got", c.protocol)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnectGuacdFallback_Dialer(t *testing.T) {
+	path, conns := protocolGuacdNetwork(t, "unix", filepath.Join(t.TempDir(), "guacd.sock"), map[string]bool{"rdp": true})
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+
+	stream, err := ConnectGuacdFallback(context.Background(), &GuacdDialer{Network: "unix"}, path, config, FallbackPolicy{
+		Fallbacks: []ProtocolFallback{{Protocol: "vnc"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.Close() }()
+	if stream.ConnectionID != "$vnc" {
+		t.Error("Expected the fallback's connection over the socket, got", stream.ConnectionID)
+	}
+	<-conns
+}
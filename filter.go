@@ -0,0 +1,256 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// InstructionFilter inspects an instruction passing between the browser and guacd. It returns the
+// instruction to forward, which may be rewritten, or nil or ErrDrop to drop it.
+type InstructionFilter func(ins *Instruction, dir Direction) (*Instruction, error)
+
+// ErrDrop is returned by an InstructionFilter to drop the instruction, the same as returning nil.
+// Unlike other errors it isn't a failure, so the FilterErrorPolicy doesn't apply.
+var ErrDrop = errors.New("guac: instruction dropped")
+
+// ContextFilter is an InstructionFilter that is also given the context of its session, which
+// carries the values set at connect in ConnectResult.Context, such as the user and their policy
+type ContextFilter func(ctx context.Context, ins *Instruction, dir Direction) (*Instruction, error)
+
+// sessionFilters returns filters followed by the context filters bound to the session's ctx and
+// then the session's own filters. The server's filters are shared, so they are never appended to.
+func sessionFilters(ctx context.Context, filters []InstructionFilter, contextFilters []ContextFilter, own []InstructionFilter) []InstructionFilter {
+	if len(contextFilters) == 0 && len(own) == 0 {
+		return filters
+	}
+	bound := make([]InstructionFilter, 0, len(filters)+len(contextFilters)+len(own))
+	bound = append(bound, filters...)
+	for _, filter := range contextFilters {
+		bound = append(bound, func(ins *Instruction, dir Direction) (*Instruction, error) {
+			return filter(ctx, ins, dir)
+		})
+	}
+	return append(bound, own...)
+}
+
+// FilterErrorPolicy decides what happens to a session when one of its filters returns an error
+type FilterErrorPolicy int
+
+const (
+	// FailClosed disconnects the session, for deployments where a filter enforces security
+	FailClosed FilterErrorPolicy = iota
+	// FailOpen logs the error and forwards the instruction as the failing filter received it,
+	// for deployments that prefer availability
+	FailOpen
+)
+
+// String returns the name of the policy
+func (p FilterErrorPolicy) String() string {
+	if p == FailOpen {
+		return "fail-open"
+	}
+	return "fail-closed"
+}
+
+// FilterBudgetPolicy decides what happens when a filter or the authorizer takes longer than
+// WebsocketServer.FilterBudget on one instruction
+type FilterBudgetPolicy int
+
+const (
+	// BudgetWarn only logs the slow call
+	BudgetWarn FilterBudgetPolicy = iota
+	// BudgetBypass logs the slow call and skips the filter for the rest of the session. The
+	// authorizer is never skipped, as that would let through what it denies.
+	BudgetBypass
+	// BudgetTerminate logs the slow call and disconnects the session
+	BudgetTerminate
+)
+
+// String returns the name of the policy
+func (p FilterBudgetPolicy) String() string {
+	switch p {
+	case BudgetBypass:
+		return "bypass"
+	case BudgetTerminate:
+		return "terminate"
+	}
+	return "warn"
+}
+
+// filterChain runs instructions through the filters of a session. A nil chain forwards everything.
+type filterChain struct {
+	filters []InstructionFilter
+	policy  FilterErrorPolicy
+	logger  *zerolog.Logger
+	// fail is called when a filter errors under FailClosed, to disconnect the session
+	fail func(err error)
+
+	// authorizer is consulted before the filters, with the session's connection ID
+	authorizer   Authorizer
+	connectionID string
+	// denied is called when the authorizer terminates the session
+	denied func()
+
+	// budget is how long one call may take before budgetPolicy applies, unlimited if zero.
+	// bypassed marks the filters skipped under BudgetBypass, by both pumps.
+	budget       time.Duration
+	budgetPolicy FilterBudgetPolicy
+	bypassed     []atomic.Bool
+}
+
+func newFilterChain(filters []InstructionFilter, policy FilterErrorPolicy, logger *zerolog.Logger) *filterChain {
+	if len(filters) == 0 {
+		return nil
+	}
+	return &filterChain{
+		filters: filters,
+		policy:  policy,
+		logger:  logger,
+	}
+}
+
+// authorize adds an authorizer to the chain, creating one if there are no filters
+func (c *filterChain) authorize(authorizer Authorizer, connectionID string, logger *zerolog.Logger) *filterChain {
+	if c == nil {
+		c = &filterChain{logger: logger}
+	}
+	c.authorizer = authorizer
+	c.connectionID = connectionID
+	return c
+}
+
+// limit applies a time budget to each call of the chain's filters and authorizer
+func (c *filterChain) limit(budget time.Duration, policy FilterBudgetPolicy) {
+	if c == nil || budget <= 0 {
+		return
+	}
+	c.budget = budget
+	c.budgetPolicy = policy
+	c.bypassed = make([]atomic.Bool, len(c.filters))
+}
+
+// overBudget applies the budget policy to a call that took elapsed, returning an error if the
+// session must end. filter is the index of the filter, or -1 for the authorizer.
+func (c *filterChain) overBudget(filter int, ins *Instruction, dir Direction, elapsed time.Duration) error {
+	if c.budget <= 0 || elapsed <= c.budget {
+		return nil
+	}
+	event := c.logger.Warn().Str("opcode", ins.Opcode).Str("direction", dir.String()).
+		Dur("elapsed", elapsed).Dur("budget", c.budget).Stringer("policy", c.budgetPolicy)
+	if filter < 0 {
+		event.Msg("authorizer exceeded its time budget")
+	} else {
+		event.Int("filter", filter).Msg("instruction filter exceeded its time budget")
+	}
+
+	switch {
+	case c.budgetPolicy == BudgetTerminate:
+		err := ErrServer.NewError("Instruction filter exceeded its time budget.")
+		if c.fail != nil {
+			c.fail(err)
+		}
+		return err
+	case c.budgetPolicy == BudgetBypass && filter >= 0:
+		c.bypassed[filter].Store(true)
+	}
+	return nil
+}
+
+// apply filters every instruction in data, which may hold several, and returns what remains
+// to be forwarded. An error means the session must end.
+func (c *filterChain) apply(data []byte, dir Direction) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			return nil, malformed(dir, err)
+		}
+		raw := data[:n]
+		data = data[n:]
+
+		if bytes.HasPrefix(raw, internalOpcodeIns) {
+			out = append(out, raw...)
+			continue
+		}
+		ins, err := Parse(raw)
+		if err != nil {
+			return nil, malformed(dir, err)
+		}
+		if ins, err = c.run(ins, dir); err != nil {
+			return nil, err
+		}
+		if ins != nil {
+			// filters may have changed Args after the instruction was parsed
+			ins.cache = ""
+			out = append(out, ins.Bytes()...)
+		}
+	}
+	return out, nil
+}
+
+// malformed blames an instruction that can't be parsed on whichever side sent it
+func malformed(dir Direction, err error) error {
+	if dir == Inbound {
+		return ErrClient.NewError("Malformed instruction from client.", err.Error())
+	}
+	return ErrUpstream.NewError("Malformed instruction from guacd.", err.Error())
+}
+
+// run passes one instruction through the authorizer and every filter, applying the error policy
+func (c *filterChain) run(ins *Instruction, dir Direction) (*Instruction, error) {
+	if c.authorizer != nil {
+		start := time.Now()
+		decision := c.authorizer.Authorize(c.connectionID, ins)
+		if err := c.overBudget(-1, ins, dir, time.Since(start)); err != nil {
+			return nil, err
+		}
+		switch decision {
+		case Drop:
+			return nil, nil
+		case Terminate:
+			c.logger.Warn().Str("opcode", ins.Opcode).Str("direction", dir.String()).Msg("instruction not authorized, closing connection")
+			if c.denied != nil {
+				c.denied()
+			}
+			return nil, ErrSecurity.NewError("Instruction not authorized.", ins.Opcode)
+		}
+	}
+	for i, filter := range c.filters {
+		if c.bypassed != nil && c.bypassed[i].Load() {
+			continue
+		}
+		start := time.Now()
+		filtered, err := filter(ins, dir)
+		if budgetErr := c.overBudget(i, ins, dir, time.Since(start)); budgetErr != nil {
+			return nil, budgetErr
+		}
+		if errors.Is(err, ErrDrop) {
+			return nil, nil
+		}
+		if err != nil {
+			if c.policy == FailOpen {
+				c.logger.Warn().Err(err).Str("opcode", ins.Opcode).Str("direction", dir.String()).Msg("instruction filter failed, forwarding instruction")
+				continue
+			}
+			c.logger.Error().Err(err).Str("opcode", ins.Opcode).Str("direction", dir.String()).Msg("instruction filter failed, closing connection")
+			if c.fail != nil {
+				c.fail(err)
+			}
+			return nil, err
+		}
+		if filtered == nil {
+			return nil, nil
+		}
+		ins = filtered
+	}
+	return ins, nil
+}
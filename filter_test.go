@@ -0,0 +1,275 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// failingFilter errors on key instructions and drops mouse instructions
+func failingFilter(ins *Instruction, dir Direction) (*Instruction, error) {
+	switch ins.Opcode {
+	case "key":
+		return nil, errors.New("filter failed")
+	case "mouse":
+		return nil, nil
+	}
+	return ins, nil
+}
+
+func TestFilterChain(t *testing.T) {
+	upper := func(ins *Instruction, dir Direction) (*Instruction, error) {
+		if ins.Opcode == "name" && dir == Inbound {
+			return NewInstruction(ins.Opcode, strings.ToUpper(ins.Args[0])), nil
+		}
+		return ins, nil
+	}
+	chain := newFilterChain([]InstructionFilter{upper, failingFilter}, FailClosed, nopLogger())
+
+	out, err := chain.apply([]byte("4.name,3.bob;5.mouse,1.1,1.2;0.,4.ping;4.sync,1.1;"), Inbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "4.name,3.BOB;0.,4.ping;4.sync,1.1;" {
+		t.Error("Unexpected output", string(out))
+	}
+
+	if _, err = chain.apply([]byte("4.sync,1.1;3.key,2.65,1.1;"), Inbound); err == nil {
+		t.Error("Expected filter error")
+	}
+	if _, err = chain.apply([]byte("4.sync,1"), Outbound); err == nil || err.(*ErrGuac).Kind != ErrUpstream {
+		t.Error("Expected malformed instruction error, got", err)
+	}
+
+	var none *filterChain
+	if out, _ = none.apply([]byte("3.key,2.65,1.1;"), Inbound); string(out) != "3.key,2.65,1.1;" {
+		t.Error("Expected nil chain to forward everything, got", string(out))
+	}
+}
+
+func TestWebsocketServer_FilterFailClosed(t *testing.T) {
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.Filters = []InstructionFilter{failingFilter}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := ws.ReadMessage()
+	if err != nil || !strings.HasPrefix(string(msg), "5.error,") {
+		t.Error("Expected an error instruction, got", string(msg), err)
+	}
+	if _, _, err = ws.ReadMessage(); !websocket.IsCloseError(err, ServerError.GetWebSocketCode()) {
+		t.Error("Expected close frame, got", err)
+	}
+	waitDone(t, done)
+}
+
+func TestWebsocketServer_FilterFailOpen(t *testing.T) {
+	guacds := make(chan *fakeGuacd, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		guacds <- guacd
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.Filters = []InstructionFilter{failingFilter}
+	wsServer.FilterErrorPolicy = FailOpen
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	guacd := <-guacds
+
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("5.mouse,1.1,1.2;3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-guacd.Received; received != "3.key,2.65,1.1;" {
+		t.Error("Expected the key instruction to pass through, got", received)
+	}
+
+	_ = guacd.Close()
+	waitDone(t, done)
+}
+
+func TestWebsocketServer_ContextFilters(t *testing.T) {
+	type userKey struct{}
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		return &ConnectResult{
+			Tunnel:  tunnel,
+			Context: context.WithValue(r.Context(), userKey{}, "viewer"),
+		}, nil
+	}, nopLogger())
+	// viewers may not type
+	wsServer.ContextFilters = []ContextFilter{func(ctx context.Context, ins *Instruction, dir Direction) (*Instruction, error) {
+		if ins.Opcode == "key" && ctx.Value(userKey{}) == "viewer" {
+			return nil, nil
+		}
+		return ins, nil
+	}}
+	users := make(chan any, 1)
+	wsServer.OnDisconnect = func(id string, r *http.Request, tunnel Tunnel) {
+		users <- r.Context().Value(userKey{})
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-guacd.Received; received != "4.sync,1.1;" {
+		t.Errorf("Expected the filter to drop the viewer's key, got %q", received)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+	if user := <-users; user != "viewer" {
+		t.Error("Expected the callback's request to carry the value, got", user)
+	}
+}
+
+func TestFilterChain_ErrDrop(t *testing.T) {
+	noClipboard := func(ins *Instruction, dir Direction) (*Instruction, error) {
+		if ins.Opcode == "clipboard" {
+			return nil, fmt.Errorf("blocked by policy: %w", ErrDrop)
+		}
+		return ins, nil
+	}
+	failed := false
+	chain := newFilterChain([]InstructionFilter{noClipboard}, FailClosed, nopLogger())
+	chain.fail = func(error) { failed = true }
+
+	out, err := chain.apply([]byte("9.clipboard,1.0,10.text/plain;4.sync,1.1;"), Outbound)
+	if err != nil || failed {
+		t.Fatal("Expected a dropped instruction not to be a failure, got", err)
+	}
+	if string(out) != "4.sync,1.1;" {
+		t.Errorf("Expected the clipboard to be dropped, got %q", out)
+	}
+}
+
+func TestWebsocketServer_ConnectResultFilters(t *testing.T) {
+	guacds := make(chan *fakeGuacd, 2)
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		guacds <- guacd
+		result := &ConnectResult{Tunnel: tunnel}
+		if r.URL.Query().Get("role") == "viewer" {
+			result.Filters = []InstructionFilter{func(ins *Instruction, dir Direction) (*Instruction, error) {
+				if ins.Opcode == "key" {
+					return nil, ErrDrop
+				}
+				return ins, nil
+			}}
+		}
+		return result, nil
+	}, nopLogger())
+	// the server's filters run first, and are shared by every session
+	wsServer.Filters = make([]InstructionFilter, 1, 4)
+	wsServer.Filters[0] = func(ins *Instruction, dir Direction) (*Instruction, error) {
+		if ins.Opcode == "mouse" {
+			return nil, nil
+		}
+		return ins, nil
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	for _, tt := range []struct {
+		role   string
+		expect string
+	}{
+		{"viewer", "4.sync,1.1;"},
+		{"editor", "3.key,2.65,1.1;4.sync,1.1;"},
+	} {
+		ws, _, err := websocket.DefaultDialer.Dial(url+"?role="+tt.role, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		guacd := <-guacds
+		if err = ws.WriteMessage(websocket.TextMessage, []byte("5.mouse,1.1,1.2;3.key,2.65,1.1;4.sync,1.1;")); err != nil {
+			t.Fatal(err)
+		}
+		if received := <-guacd.Received; received != tt.expect {
+			t.Errorf("%s: expected %q, got %q", tt.role, tt.expect, received)
+		}
+		_ = ws.Close()
+		waitDone(t, done)
+	}
+	if len(wsServer.Filters) != 1 || wsServer.Filters[:2][1] != nil {
+		t.Error("Expected the server's filters to be left alone")
+	}
+}
+
+func TestFilterChain_Budget(t *testing.T) {
+	for _, policy := range []FilterBudgetPolicy{BudgetWarn, BudgetBypass, BudgetTerminate} {
+		t.Run(policy.String(), func(t *testing.T) {
+			calls := 0
+			slow := func(ins *Instruction, dir Direction) (*Instruction, error) {
+				calls++
+				if ins.Opcode == "key" {
+					time.Sleep(20 * time.Millisecond)
+				}
+				return ins, nil
+			}
+			var logs bytes.Buffer
+			logger := zerolog.New(&logs)
+			chain := newFilterChain([]InstructionFilter{slow}, FailClosed, &logger)
+			failed := false
+			chain.fail = func(error) { failed = true }
+			chain.limit(5*time.Millisecond, policy)
+
+			// fast instructions are within the budget
+			if _, err := chain.apply([]byte("4.sync,1.1;"), Inbound); err != nil || logs.Len() > 0 {
+				t.Fatal("Expected no budget to be exceeded, got", err, logs.String())
+			}
+			out, err := chain.apply([]byte("3.key,2.65,1.1;"), Inbound)
+			if !strings.Contains(logs.String(), "exceeded its time budget") {
+				t.Error("Expected the slow filter to be logged, got", logs.String())
+			}
+			if policy == BudgetTerminate {
+				if err == nil || !failed {
+					t.Error("Expected the session to end, got", err)
+				}
+				return
+			}
+			if err != nil || string(out) != "3.key,2.65,1.1;" {
+				t.Errorf("Expected the key to be forwarded, got %q %v", out, err)
+			}
+
+			if _, err = chain.apply([]byte("4.sync,1.2;"), Inbound); err != nil {
+				t.Fatal(err)
+			}
+			expect := 3
+			if policy == BudgetBypass {
+				expect = 2
+			}
+			if calls != expect {
+				t.Errorf("Expected the filter to be called %v times, got %v", expect, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package guac
+
+import "time"
+
+// drawOpcodes are the instructions that change what is on screen. Instructions that only
+// describe a path, such as rect, draw nothing until it is filled or stroked.
+var drawOpcodes = map[string]bool{
+	"img":      true,
+	"png":      true,
+	"jpeg":     true,
+	"copy":     true,
+	"transfer": true,
+	"put":      true,
+	"cfill":    true,
+	"lfill":    true,
+	"cstroke":  true,
+	"lstroke":  true,
+}
+
+// firstFrame reports how long after guacd was ready the first drawing instruction was sent to
+// the client. It is only used by the pump sending to the client.
+type firstFrame struct {
+	// ready is when the handshake finished, guacd having sent ready
+	ready  time.Time
+	report func(time.Duration)
+}
+
+// observe reports the first message sent with a drawing instruction, returning true once it has
+func (f *firstFrame) observe(data []byte) bool {
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			return false
+		}
+		if elements, err := peekElements(data[:n], 1); err == nil && len(elements) == 1 && drawOpcodes[elements[0]] {
+			f.report(time.Since(f.ready))
+			return true
+		}
+		data = data[n:]
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_FirstFrame(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	metrics := NewMetrics()
+	wsServer.Metrics = metrics
+	frames := make(chan time.Duration, 10)
+	wsServer.OnFirstFrame = func(connectionID string, elapsed time.Duration) {
+		if connectionID != "$fake" {
+			t.Error("Expected the connection ID, got", connectionID)
+		}
+		frames <- elapsed
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	send := func(msg string) {
+		t.Helper()
+		if _, err := guacd.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sizing the display and defining a path draw nothing
+	send("4.size,1.0,4.1024,3.768;4.rect,1.0,1.0,1.0,2.10,2.10;4.sync,1.1;")
+	select {
+	case <-frames:
+		t.Fatal("Expected no frame before anything is drawn")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	send("5.cfill,2.14,1.0,1.0,1.0,1.0,3.255;4.sync,1.2;")
+	select {
+	case elapsed := <-frames:
+		if elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+			t.Error("Expected the time since guacd was ready, got", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the first frame")
+	}
+
+	// only the first frame is reported
+	send("5.cfill,2.14,1.0,1.0,1.0,1.0,3.255;4.sync,1.3;")
+	_ = ws.Close()
+	waitDone(t, done)
+	if len(frames) != 0 {
+		t.Error("Expected one first frame, got another")
+	}
+	if count := metrics.FirstFrames.Snapshot().Count; count != 1 {
+		t.Error("Expected the first frame in the metrics, got", count)
+	}
+}
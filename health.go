@@ -0,0 +1,117 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// HealthCheckInterval is the default time between guacd health probes
+const HealthCheckInterval = 5 * time.Second
+
+// CheckGuacd verifies guacd is accepting connections at the given address. It only opens and
+// closes a connection so it doesn't start a protocol session on guacd.
+func CheckGuacd(ctx context.Context, network, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return ErrUpstreamUnavailable.NewError("guacd health check failed.", err.Error())
+	}
+	return conn.Close()
+}
+
+// HealthReporter reports whether guacd is believed to be able to serve new connections
+type HealthReporter interface {
+	// Healthy returns false if the most recent health check failed
+	Healthy() bool
+}
+
+// GuacdHealthChecker probes guacd on an interval and caches the result, so a server can refuse
+// connections quickly during an outage rather than having each one attempt a doomed dial.
+type GuacdHealthChecker struct {
+	sync.RWMutex
+	ticker   *time.Ticker
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// probe checks guacd once, it defaults to CheckGuacd
+	probe   func(context.Context) error
+	timeout time.Duration
+
+	lastErr     error
+	lastChecked time.Time
+}
+
+// NewGuacdHealthChecker creates a GuacdHealthChecker and starts probing guacd at the given interval.
+// guacd is considered healthy until the first probe says otherwise.
+func NewGuacdHealthChecker(network, address string, interval time.Duration) *GuacdHealthChecker {
+	return newGuacdHealthChecker(func(ctx context.Context) error {
+		return CheckGuacd(ctx, network, address)
+	}, interval)
+}
+
+func newGuacdHealthChecker(probe func(context.Context) error, interval time.Duration) *GuacdHealthChecker {
+	if interval <= 0 {
+		interval = HealthCheckInterval
+	}
+	checker := &GuacdHealthChecker{
+		ticker:  time.NewTicker(interval),
+		done:    make(chan struct{}),
+		probe:   probe,
+		timeout: interval,
+	}
+	go checker.checkTask()
+	return checker
+}
+
+func (c *GuacdHealthChecker) checkTask() {
+	for {
+		_ = c.Check()
+		select {
+		case <-c.ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Check probes guacd now and updates the cached state
+func (c *GuacdHealthChecker) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	err := c.probe(ctx)
+
+	c.Lock()
+	if err != nil && c.lastErr == nil {
+		globalLogger.Warn().Err(err).Msg("guacd became unhealthy")
+	} else if err == nil && c.lastErr != nil {
+		globalLogger.Info().Msg("guacd recovered")
+	}
+	c.lastErr = err
+	c.lastChecked = time.Now()
+	c.Unlock()
+	return err
+}
+
+// Healthy returns false if the most recent probe failed
+func (c *GuacdHealthChecker) Healthy() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.lastErr == nil
+}
+
+// LastCheck returns when the most recent probe ran and the error it returned
+func (c *GuacdHealthChecker) LastCheck() (time.Time, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.lastChecked, c.lastErr
+}
+
+// Shutdown stops probing guacd. Calling it again does nothing.
+func (c *GuacdHealthChecker) Shutdown() {
+	c.stopOnce.Do(func() {
+		c.ticker.Stop()
+		close(c.done)
+	})
+}
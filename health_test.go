@@ -0,0 +1,94 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckGuacd(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+
+	if err = CheckGuacd(context.Background(), "tcp", addr); err != nil {
+		t.Error("Expected guacd to be healthy, got", err)
+	}
+
+	_ = listener.Close()
+
+	err = CheckGuacd(context.Background(), "tcp", addr)
+	if err == nil || err.(*ErrGuac).Kind != ErrUpstreamUnavailable {
+		t.Error("Expected guacd to be unavailable, got", err)
+	}
+}
+
+func TestWebsocketServer_Health(t *testing.T) {
+	var down atomic.Bool
+	health := newGuacdHealthChecker(func(ctx context.Context) error {
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, time.Hour)
+	defer health.Shutdown()
+	// shutting down twice is harmless
+	defer health.Shutdown()
+
+	var connects int32
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		atomic.AddInt32(&connects, 1)
+		return NewSimpleTunnel(NewStream(&fakeConn{}, time.Minute)), nil
+	}, nopLogger())
+	wsServer.Health = health
+	errs := make(chan error, 1)
+	wsServer.OnError = func(r *http.Request, err error) {
+		errs <- err
+	}
+
+	url, done := serveWebsocket(t, wsServer)
+
+	down.Store(true)
+	if health.Check() == nil || health.Healthy() {
+		t.Fatal("Expected guacd to be unhealthy")
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("Expected connection to be rejected")
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected 503 got", resp.StatusCode)
+	}
+	waitDone(t, done)
+	if atomic.LoadInt32(&connects) != 0 {
+		t.Error("Expected rejected connection not to dial guacd")
+	}
+	var sessionErr *SessionError
+	if err = <-errs; !errors.As(err, &sessionErr) || sessionErr.Stage != StageConnect || errorStatus(sessionErr.Err) != UpstreamUnavailable {
+		t.Error("Expected OnError to be told guacd is unavailable, got", err)
+	}
+
+	down.Store(false)
+	if health.Check() != nil || !health.Healthy() {
+		t.Fatal("Expected guacd to have recovered")
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal("Expected connection to be accepted, got", err)
+	}
+	_ = ws.Close()
+	waitDone(t, done)
+	if atomic.LoadInt32(&connects) != 1 {
+		t.Error("Expected 1 connect got", atomic.LoadInt32(&connects))
+	}
+}
@@ -0,0 +1,80 @@
+package guac
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipWriters reuses gzip writers between read requests, as each long poll would otherwise
+// allocate the compressor's state again
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// gzipResponseWriter compresses a read response. Flush flushes the compressor before the
+// response, so each batch of instructions reaches the client as soon as it is written instead of
+// waiting for the compressor to fill a block.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+// newGzipResponseWriter sets the response headers and starts compressing. close must be called
+// once the response is written.
+func newGzipResponseWriter(response http.ResponseWriter) *gzipResponseWriter {
+	response.Header().Set("Content-Encoding", "gzip")
+	response.Header().Add("Vary", "Accept-Encoding")
+	response.Header().Del("Content-Length")
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(response)
+	return &gzipResponseWriter{ResponseWriter: response, gz: gz}
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	return w.gz.Write(data)
+}
+
+// Flush implements http.Flusher
+func (w *gzipResponseWriter) Flush() {
+	if err := w.gz.Flush(); err != nil {
+		globalLogger.Debug().Err(err).Msg("Error flushing gzip writer")
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close ends the compressed stream and returns the compressor to the pool
+func (w *gzipResponseWriter) close() {
+	if err := w.gz.Close(); err != nil {
+		globalLogger.Debug().Err(err).Msg("Error closing gzip writer")
+	}
+	w.gz.Reset(nil)
+	gzipWriters.Put(w.gz)
+}
+
+// acceptsGzip returns true if the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			// "gzip;q=0" means the client refuses it
+			q := strings.TrimSpace(params)
+			if !strings.HasPrefix(q, "q=") {
+				return true
+			}
+			weight, err := strconv.ParseFloat(q[len("q="):], 64)
+			return err == nil && weight > 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package guac
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveHTTPTunnelRead connects an HTTP tunnel to a guacd over TCP, so closing it ends the read
+// as it would in production, and starts a read request with the Accept-Encoding header
+func serveHTTPTunnelRead(t *testing.T, acceptEncoding string) (*http.Response, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guacd, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(conn, time.Minute)), nil
+	})
+	s.EnableCompression = true
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	// closing guacd first ends the read, so the server isn't left waiting for it
+	t.Cleanup(func() { _ = guacd.Close() })
+	// the client must not decompress transparently, so the encoding can be checked
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	resp, err := client.Get(server.URL + "/?connect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/?read:"+string(uuid), nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp, guacd
+}
+
+func TestServer_GzipRead(t *testing.T) {
+	resp, guacd := serveHTTPTunnelRead(t, "gzip")
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatal("Expected a gzip response, got", encoding)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bufio.NewReader(gz)
+
+	// the batch is flushed while the response is still open
+	sync := "4.sync,3.100;"
+	go func() { _, _ = guacd.Write([]byte(strings.Repeat("4.size,1.0,4.1024,3.768;", 50) + sync)) }()
+	received := ""
+	for !strings.HasSuffix(received, sync) {
+		line, err := body.ReadString(';')
+		if err != nil {
+			t.Fatal("Expected the batch before the response ended, got", err)
+		}
+		received += line
+	}
+	if !strings.HasPrefix(received, "4.size,1.0,4.1024,3.768;") {
+		t.Error("Unexpected data", received[:32])
+	}
+
+	// guacd leaving ends the response, which must still be a complete gzip stream
+	_ = guacd.Close()
+	if _, err = io.ReadAll(body); err != nil {
+		t.Error("Expected a complete gzip stream, got", err)
+	}
+}
+
+func TestServer_GzipNotAccepted(t *testing.T) {
+	resp, guacd := serveHTTPTunnelRead(t, "gzip;q=0, identity")
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		t.Fatal("Expected an uncompressed response, got", encoding)
+	}
+
+	sync := "4.sync,3.100;"
+	go func() { _, _ = guacd.Write([]byte(sync)) }()
+	received, err := bufio.NewReader(resp.Body).ReadString(';')
+	if err != nil || received != sync {
+		t.Error("Expected the instruction uncompressed, got", received, err)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, GZIP":       true,
+		"gzip;q=0.5, br":      true,
+		"gzip;q=0":            false,
+		"identity":            false,
+		"br;q=1.0, gzip; q=0": false,
+	}
+	for header, expect := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		if got := acceptsGzip(r); got != expect {
+			t.Errorf("%q: expected %v, got %v", header, expect, got)
+		}
+	}
+}
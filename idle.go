@@ -0,0 +1,122 @@
+package guac
+
+import (
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// userInputOpcodes are the instructions clients send because of something the user did, as
+// opposed to those sent on their own, such as sync replies to every frame and nop
+var userInputOpcodes = map[string]bool{
+	"key":       true,
+	"mouse":     true,
+	"touch":     true,
+	"clipboard": true,
+	"size":      true,
+	"file":      true,
+	"pipe":      true,
+	"blob":      true,
+}
+
+// hasUserInput returns true if any instruction in data is user input
+func hasUserInput(data []byte) bool {
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			return false
+		}
+		if elements, err := peekElements(data[:n], 1); err == nil && len(elements) == 1 && userInputOpcodes[elements[0]] {
+			return true
+		}
+		data = data[n:]
+	}
+	return false
+}
+
+// nopOpcode is the instruction clients send to keep the connection alive
+const nopOpcode = "nop"
+
+// nopOpcodes is the set of opcodes dropped by AbsorbNops
+var nopOpcodes = map[string]bool{nopOpcode: true}
+
+// withoutOpcodes returns data without the instructions that have one of the opcodes, and
+// whether there were any. data is returned as it is when there were none.
+func withoutOpcodes(data []byte, opcodes map[string]bool) ([]byte, bool) {
+	var out []byte
+	found := false
+	rest := data
+	for len(rest) > 0 {
+		n, err := scanInstruction(rest)
+		if err != nil {
+			break
+		}
+		if elements, err := peekElements(rest[:n], 1); err == nil && len(elements) == 1 && opcodes[elements[0]] {
+			if !found {
+				found = true
+				out = append(make([]byte, 0, len(data)), data[:len(data)-len(rest)]...)
+			}
+		} else if found {
+			out = append(out, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	if !found {
+		return data, false
+	}
+	// anything that can't be parsed is kept for the filters to reject
+	return append(out, rest...), true
+}
+
+// withoutBlocked returns data without the instructions that have one of the opcodes, for input
+// that must never reach guacd. Unlike withoutOpcodes it fails closed, as guacd may parse what
+// can't be parsed here into instructions, such as by sizing an invalid UTF-8 character from its
+// lead byte: a message that isn't valid UTF-8 is dropped whole, and so is everything from an
+// instruction that can't be scanned, including one left incomplete. invalid is set when
+// anything was dropped for either reason.
+func withoutBlocked(data []byte, opcodes map[string]bool) (out []byte, invalid bool) {
+	if !utf8.Valid(data) {
+		return nil, true
+	}
+	out = make([]byte, 0, len(data))
+	for rest := data; len(rest) > 0; {
+		n, err := scanInstruction(rest)
+		if err != nil {
+			return out, true
+		}
+		if elements, err := peekElements(rest[:n], 1); err == nil && len(elements) == 1 && !opcodes[elements[0]] {
+			out = append(out, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	return out, false
+}
+
+// markInput records that the user was active
+func (c *wsSession) markInput() {
+	atomic.StoreInt64(&c.lastInput, time.Now().UnixNano())
+}
+
+// watchIdle ends the session once the client sends no user input for timeout. Screen updates
+// from guacd and the client's replies to them don't count, so a session left open with a busy
+// screen still times out. It returns when stop is closed.
+func (c *wsSession) watchIdle(timeout time.Duration, stop <-chan struct{}) {
+	c.markInput()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastInput)))
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+		c.logger.Info().Dur("idle_timeout", timeout).Msg("no input from client, closing idle session")
+		c.terminate(CloseReasonTimeout, SessionTimeout, "Idle timeout.")
+		return
+	}
+}
@@ -0,0 +1,188 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHasUserInput(t *testing.T) {
+	tests := map[string]bool{
+		"4.sync,3.100;":                  false,
+		"3.nop;4.sync,3.100;":            false,
+		"4.sync,3.100;5.mouse,1.1,1.2;":  true,
+		"3.key,2.65,1.1;":                true,
+		"9.clipboard,1.1,10.text/plain;": true,
+	}
+	for data, expect := range tests {
+		if got := hasUserInput([]byte(data)); got != expect {
+			t.Errorf("%q: expected %v, got %v", data, expect, got)
+		}
+	}
+}
+
+// serveIdle connects a client to a server with an idle timeout, and sends it data every
+// interval until the session ends. It returns why the session ended, and the error the client
+// read it ending with.
+func serveIdle(t *testing.T, timeout, interval, wait time.Duration, data string) (CloseReason, error) {
+	tunnel, guacd := newFakeGuacd(t)
+	reasons := make(chan CloseReason, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.IdleTimeout = timeout
+	wsServer.OnDisconnectReason = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, reason CloseReason) {
+		reasons <- reason
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	// guacd keeps the screen busy, which isn't activity
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			_ = ws.WriteMessage(websocket.TextMessage, []byte(data))
+			_, _ = guacd.Write([]byte("4.sync,3.100;"))
+		}
+	}()
+
+	ended := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				ended <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err = <-ended:
+	case <-time.After(wait):
+		_ = ws.Close()
+		err = <-ended
+	}
+	_ = guacd.Close()
+	waitDone(t, done)
+	return <-reasons, err
+}
+
+func TestWebsocketServer_IdleTimeout(t *testing.T) {
+	// the client only acknowledges frames, so the user is idle
+	start := time.Now()
+	reason, err := serveIdle(t, 100*time.Millisecond, 20*time.Millisecond, 5*time.Second, "4.sync,3.100;")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("Expected the session to last the idle timeout, ended after", elapsed)
+	}
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != SessionTimeout.GetWebSocketCode() || closeErr.Text != "Idle timeout." {
+		t.Error("Expected an idle timeout close frame, got", err)
+	}
+	if reason != CloseReasonTimeout {
+		t.Error("Expected a timeout, got", reason)
+	}
+}
+
+func TestWebsocketServer_IdleTimeoutActive(t *testing.T) {
+	// the user keeps moving the mouse
+	reason, err := serveIdle(t, 100*time.Millisecond, 20*time.Millisecond, 400*time.Millisecond, "5.mouse,1.1,1.2;")
+	if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == SessionTimeout.GetWebSocketCode() {
+		t.Error("Expected an active session to stay open")
+	}
+	if reason == CloseReasonTimeout {
+		t.Error("Expected no timeout")
+	}
+}
+
+func TestWithoutOpcodes(t *testing.T) {
+	tests := []struct {
+		data, expect string
+		found        bool
+	}{
+		{"4.sync,3.100;", "4.sync,3.100;", false},
+		{"3.nop;", "", true},
+		{"3.nop;4.sync,3.100;3.nop;5.mouse,1.1,1.2;", "4.sync,3.100;5.mouse,1.1,1.2;", true},
+		{"4.sync,3.100;3.nop;4.sync", "4.sync,3.100;4.sync", true},
+	}
+	for _, tt := range tests {
+		out, found := withoutOpcodes([]byte(tt.data), nopOpcodes)
+		if string(out) != tt.expect || found != tt.found {
+			t.Errorf("%q: expected %q %v, got %q %v", tt.data, tt.expect, tt.found, out, found)
+		}
+	}
+}
+
+func TestWithoutBlocked(t *testing.T) {
+	blocked := map[string]bool{"key": true}
+	tests := []struct {
+		data, expect string
+		invalid      bool
+	}{
+		{"4.sync,3.100;", "4.sync,3.100;", false},
+		{"3.key,2.65,1.1;4.sync,3.100;", "4.sync,3.100;", false},
+		{"x;3.key,2.65,1.1;", "", true},
+		{"4.sync,3.100;x;4.sync,3.200;", "4.sync,3.100;", true},
+		{"3.nop,1.\xE2;4;3.key,2.65,1.1;", "", true},
+		{"4.sync,3.100;3.key,2.65", "4.sync,3.100;", true},
+	}
+	for _, tt := range tests {
+		out, invalid := withoutBlocked([]byte(tt.data), blocked)
+		if string(out) != tt.expect || invalid != tt.invalid {
+			t.Errorf("%q: expected %q %v, got %q %v", tt.data, tt.expect, tt.invalid, out, invalid)
+		}
+	}
+}
+
+func TestWebsocketServer_AbsorbNops(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	reasons := make(chan CloseReason, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.IdleTimeout = 100 * time.Millisecond
+	wsServer.AbsorbNops = true
+	wsServer.OnDisconnectReason = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, reason CloseReason) {
+		reasons <- reason
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	// nops for three times the idle timeout keep the session open
+	for i := 0; i < 15; i++ {
+		if err = ws.WriteMessage(websocket.TextMessage, []byte("3.nop;")); err != nil {
+			t.Fatal("Expected the session to stay open, got", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.nop;3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-guacd.Received; received != "3.key,2.65,1.1;" {
+		t.Errorf("Expected only the key to be forwarded, got %q", received)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+	if reason := <-reasons; reason == CloseReasonTimeout {
+		t.Error("Expected no idle timeout")
+	}
+}
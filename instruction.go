@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"unicode/utf8"
 )
 
 // Instruction represents a Guacamole instruction
@@ -27,19 +28,49 @@ func (i *Instruction) String() string {
 		return i.cache
 	}
 
-	i.cache = fmt.Sprintf("%d.%s", len(i.Opcode), i.Opcode)
+	// lengths count code points, not bytes
+	i.cache = fmt.Sprintf("%d.%s", utf8.RuneCountInString(i.Opcode), i.Opcode)
 	for _, value := range i.Args {
-		i.cache += fmt.Sprintf(",%d.%s", len(value), value)
+		i.cache += fmt.Sprintf(",%d.%s", utf8.RuneCountInString(value), value)
 	}
 	i.cache += ";"
 
 	return i.cache
 }
 
-func (i *Instruction) Byte() []byte {
+// Bytes returns the on-wire representation of the instruction
+func (i *Instruction) Bytes() []byte {
 	return []byte(i.String())
 }
 
+// Byte returns the on-wire representation of the instruction.
+// Deprecated: use Bytes
+func (i *Instruction) Byte() []byte {
+	return i.Bytes()
+}
+
+// ParseInstruction parses the first instruction in buf, returning it and its length in bytes so
+// whatever follows it can be parsed next. When buf ends before the instruction does, the error is
+// ErrIncompleteInstruction and the rest can be read before trying again.
+func ParseInstruction(buf []byte) (*Instruction, int, error) {
+	n, err := scanInstruction(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	var elements []string
+	for i := 0; ; {
+		// the instruction was scanned, so each element is complete
+		start, _ := skipLength(buf, i)
+		end, _ := skipElement(buf, i)
+		elements = append(elements, string(buf[start:end]))
+		if buf[end] == ';' {
+			break
+		}
+		i = end + 1
+	}
+	return NewInstruction(elements[0], elements[1:]...), n, nil
+}
+
 func Parse(buf []byte) (*Instruction, error) {
 	data := []rune(string(buf))
 
@@ -111,3 +142,93 @@ func ReadOne(stream *Stream) (instruction *Instruction, err error) {
 
 	return Parse(instructionBuffer)
 }
+
+// ErrIncompleteInstruction is returned by ParseInstruction when the buffer ends part way through
+// an instruction
+var ErrIncompleteInstruction = errors.New("guac: incomplete instruction")
+
+// scanInstruction returns the length in bytes of the first complete instruction in buf.
+// Element lengths on the wire count Unicode code points rather than bytes.
+func scanInstruction(buf []byte) (int, error) {
+	i := 0
+	for {
+		var err error
+		if i, err = skipElement(buf, i); err != nil {
+			return 0, err
+		}
+		if i >= len(buf) {
+			return 0, ErrIncompleteInstruction
+		}
+		switch buf[i] {
+		case ';':
+			return i + 1, nil
+		case ',':
+			i++
+		default:
+			return 0, errors.New("guac: element terminator of instruction was not ';' nor ','")
+		}
+	}
+}
+
+// skipElement returns the offset just past the element starting at i
+func skipElement(buf []byte, i int) (int, error) {
+	length := 0
+	start := i
+	for i < len(buf) && buf[i] >= '0' && buf[i] <= '9' {
+		length = length*10 + int(buf[i]-'0')
+		i++
+	}
+	if i >= len(buf) {
+		return 0, ErrIncompleteInstruction
+	}
+	if i == start || buf[i] != '.' {
+		return 0, errors.New("guac: non-numeric character in element length")
+	}
+	i++
+	for ; length > 0; length-- {
+		// a buffer can end part way through a character as well as between them
+		if i >= len(buf) || !utf8.FullRune(buf[i:]) {
+			return 0, ErrIncompleteInstruction
+		}
+		_, size := utf8.DecodeRune(buf[i:])
+		i += size
+	}
+	return i, nil
+}
+
+// peekElements returns up to n leading elements of the instruction in buf (the opcode first)
+// without decoding the rest of it.
+func peekElements(buf []byte, n int) ([]string, error) {
+	elements := make([]string, 0, n)
+	i := 0
+	for len(elements) < n {
+		start, err := skipLength(buf, i)
+		if err != nil {
+			return nil, err
+		}
+		end, err := skipElement(buf, i)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, string(buf[start:end]))
+		if end >= len(buf) {
+			return nil, ErrIncompleteInstruction
+		}
+		if buf[end] == ';' {
+			break
+		}
+		i = end + 1
+	}
+	return elements, nil
+}
+
+// skipLength returns the offset of the value of the element starting at i
+func skipLength(buf []byte, i int) (int, error) {
+	for i < len(buf) && buf[i] >= '0' && buf[i] <= '9' {
+		i++
+	}
+	if i >= len(buf) {
+		return 0, ErrIncompleteInstruction
+	}
+	return i + 1, nil
+}
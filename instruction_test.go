@@ -1,6 +1,8 @@
 package guac
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -68,3 +70,66 @@ func TestReadOne(t *testing.T) {
 		t.Error("Unexpected", ins.String())
 	}
 }
+
+func TestScanInstruction_SplitCharacter(t *testing.T) {
+	msg := []byte("4.name,7.rocket🚀;")
+	for end := 0; end < len(msg); end++ {
+		if _, err := scanInstruction(msg[:end]); err != ErrIncompleteInstruction {
+			t.Errorf("Expected %q to be incomplete, got %v", msg[:end], err)
+		}
+	}
+	if n, err := scanInstruction(msg); err != nil || n != len(msg) {
+		t.Error("Expected the whole instruction, got", n, err)
+	}
+}
+
+func TestInstruction_StringCountsCodePoints(t *testing.T) {
+	ins := NewInstruction("name", "rocket🚀", "héllo", "")
+	if ins.String() != "4.name,7.rocket🚀,5.héllo,0.;" {
+		t.Error("Unexpected result:", ins.String())
+	}
+}
+
+func TestParseInstruction(t *testing.T) {
+	for _, ins := range []*Instruction{
+		NewInstruction("sync", "100"),
+		NewInstruction("name", "rocket🚀"),
+		NewInstruction("clipboard", "1", "text/plain", "日本語,;."),
+		NewInstruction(InternalDataOpcode, "ping"),
+		NewInstruction("nop"),
+	} {
+		encoded := append(ins.Bytes(), "4.sync,1.1;"...)
+		parsed, n, err := ParseInstruction(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(ins.Bytes()) {
+			t.Errorf("Expected %q to be %v bytes, got %v", ins, len(ins.Bytes()), n)
+		}
+		if parsed.Opcode != ins.Opcode || !reflect.DeepEqual(append([]string{}, parsed.Args...), append([]string{}, ins.Args...)) {
+			t.Errorf("Expected %q back, got %q %q", ins, parsed.Opcode, parsed.Args)
+		}
+		if parsed.String() != ins.String() {
+			t.Errorf("Expected %q to round trip, got %q", ins, parsed)
+		}
+
+		// what follows is parsed next
+		if next, _, err := ParseInstruction(encoded[n:]); err != nil || next.String() != "4.sync,1.1;" {
+			t.Error("Expected the next instruction, got", next, err)
+		}
+	}
+}
+
+func TestParseInstruction_Errors(t *testing.T) {
+	msg := NewInstruction("name", "rocket🚀").Bytes()
+	for end := 0; end < len(msg); end++ {
+		if _, _, err := ParseInstruction(msg[:end]); !errors.Is(err, ErrIncompleteInstruction) {
+			t.Errorf("Expected %q to be incomplete, got %v", msg[:end], err)
+		}
+	}
+	for _, invalid := range []string{"4.name,6.rocket*;", "x.name;", "4.sync|"} {
+		if _, _, err := ParseInstruction([]byte(invalid)); err == nil || errors.Is(err, ErrIncompleteInstruction) {
+			t.Errorf("Expected %q to be invalid, got %v", invalid, err)
+		}
+	}
+}
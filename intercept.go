@@ -0,0 +1,189 @@
+package guac
+
+import (
+	"encoding/base64"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// interceptClipboardLimit is the most of one clipboard held to reassemble it for an
+	// InstructionInterceptor. Larger clipboards are dropped, rather than let through unseen.
+	interceptClipboardLimit = 8 << 20
+	// interceptBlobSize is the size of the blobs an intercepted clipboard is sent on in
+	interceptBlobSize = 4096
+)
+
+// InstructionInterceptor observes and rewrites the instructions of a session, for policies such
+// as logging copied text or blocking paste. OnInbound is called with each instruction from the
+// client and OnOutbound with each from guacd, after the filters. Each returns the instruction to
+// forward, or false to drop it.
+//
+// Clipboards are streamed, a clipboard instruction opening a stream followed by blobs of base64
+// data and an end, so the interceptor is instead called once per clipboard, when it ends, with
+// the whole of it as a clipboard instruction with the arguments stream index, mimetype and the
+// decoded data. What it returns as a clipboard instruction with those arguments is streamed on in
+// its place, and anything else is forwarded as it is. In particular:
+//   - several clipboards may stream at once, told apart by their index, and each is held until
+//     its own end. An index is reused once its stream ends, and a clipboard instruction for an
+//     index already streaming starts the clipboard over.
+//   - everything else is forwarded while a clipboard is held, so the clipboard arrives after the
+//     instructions that followed its first part
+//   - the blobs and ends of other streams, such as files and images, are passed one at a time
+//   - a clipboard over 8MB, or with data that isn't base64, is dropped without calling the
+//     interceptor
+//   - the receiver acknowledges the blobs sent on, which may be more or fewer than were sent, and
+//     acknowledgements are passed like any other instruction
+//
+// The methods of an interceptor are called from both pumps of every session at once.
+type InstructionInterceptor interface {
+	OnInbound(ins Instruction) (Instruction, bool)
+	OnOutbound(ins Instruction) (Instruction, bool)
+}
+
+// interception runs the instructions of one direction of a session through an interceptor
+type interception struct {
+	interceptor InstructionInterceptor
+	dir         Direction
+	logger      *zerolog.Logger
+	// streams are the clipboards being reassembled, by stream index
+	streams map[string]*interceptedClipboard
+}
+
+// interceptedClipboard is a clipboard being reassembled
+type interceptedClipboard struct {
+	mimetype string
+	data     []byte
+	// dropped is set once the clipboard can't be reassembled, and the rest of it is dropped
+	dropped bool
+}
+
+// newInterception returns nil if there is no interceptor
+func newInterception(interceptor InstructionInterceptor, dir Direction, logger *zerolog.Logger) *interception {
+	if interceptor == nil {
+		return nil
+	}
+	return &interception{
+		interceptor: interceptor,
+		dir:         dir,
+		logger:      logger,
+		streams:     map[string]*interceptedClipboard{},
+	}
+}
+
+// apply returns what to forward of data. A nil interception forwards everything.
+func (c *interception) apply(data []byte) []byte {
+	if c == nil {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for rest := data; len(rest) > 0; {
+		n, err := scanInstruction(rest)
+		if err != nil {
+			// the remainder of a message the filters let through
+			out = append(out, rest...)
+			break
+		}
+		raw := rest[:n]
+		rest = rest[n:]
+		ins, err := Parse(raw)
+		if err != nil {
+			out = append(out, raw...)
+			continue
+		}
+		out = c.instruction(out, raw, ins)
+	}
+	return out
+}
+
+// instruction appends what to forward of one instruction to out
+func (c *interception) instruction(out, raw []byte, ins *Instruction) []byte {
+	switch {
+	case ins.Opcode == "clipboard" && len(ins.Args) == 2:
+		c.streams[ins.Args[0]] = &interceptedClipboard{mimetype: ins.Args[1]}
+		return out
+	case ins.Opcode == "blob" && len(ins.Args) == 2:
+		clipboard, ok := c.streams[ins.Args[0]]
+		if !ok {
+			break
+		}
+		if !clipboard.dropped {
+			c.add(clipboard, ins.Args[1])
+		}
+		return out
+	case ins.Opcode == "end" && len(ins.Args) == 1:
+		clipboard, ok := c.streams[ins.Args[0]]
+		if !ok {
+			break
+		}
+		delete(c.streams, ins.Args[0])
+		if clipboard.dropped {
+			return out
+		}
+		result, ok := c.intercept(*NewInstruction("clipboard", ins.Args[0], clipboard.mimetype, string(clipboard.data)))
+		if !ok {
+			return out
+		}
+		if result.Opcode != "clipboard" || len(result.Args) != 3 {
+			return append(out, result.Bytes()...)
+		}
+		return appendClipboard(out, result.Args[0], result.Args[1], result.Args[2])
+	}
+
+	result, ok := c.intercept(*ins)
+	if !ok {
+		return out
+	}
+	if sameInstruction(ins, &result) {
+		// forwarded byte for byte
+		return append(out, raw...)
+	}
+	return append(out, result.Bytes()...)
+}
+
+// add decodes a blob of the clipboard, dropping the clipboard if it can't be reassembled
+func (c *interception) add(clipboard *interceptedClipboard, blob string) {
+	decoded, err := base64.StdEncoding.DecodeString(blob)
+	if err == nil && len(clipboard.data)+len(decoded) <= interceptClipboardLimit {
+		clipboard.data = append(clipboard.data, decoded...)
+		return
+	}
+	if err != nil {
+		c.logger.Warn().Err(err).Stringer("direction", c.dir).Msg("dropping clipboard with invalid data")
+	} else {
+		c.logger.Warn().Stringer("direction", c.dir).Int("max", interceptClipboardLimit).Msg("dropping clipboard too large to intercept")
+	}
+	clipboard.dropped = true
+	clipboard.data = nil
+}
+
+func (c *interception) intercept(ins Instruction) (Instruction, bool) {
+	if c.dir == Inbound {
+		return c.interceptor.OnInbound(ins)
+	}
+	return c.interceptor.OnOutbound(ins)
+}
+
+// appendClipboard appends the instructions that stream data as a clipboard
+func appendClipboard(out []byte, index, mimetype, data string) []byte {
+	out = append(out, NewInstruction("clipboard", index, mimetype).Bytes()...)
+	for len(data) > 0 {
+		n := min(len(data), interceptBlobSize)
+		out = append(out, NewInstruction("blob", index, base64.StdEncoding.EncodeToString([]byte(data[:n]))).Bytes()...)
+		data = data[n:]
+	}
+	return append(out, NewInstruction("end", index).Bytes()...)
+}
+
+// sameInstruction returns true if a and b have the same opcode and arguments
+func sameInstruction(a, b *Instruction) bool {
+	if a.Opcode != b.Opcode || len(a.Args) != len(b.Args) {
+		return false
+	}
+	for i := range a.Args {
+		if a.Args[i] != b.Args[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package guac
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// clipboardPolicy blocks paste and logs copies, redacting secrets from them
+type clipboardPolicy struct {
+	lock   sync.Mutex
+	copied []string
+}
+
+func (p *clipboardPolicy) OnInbound(ins Instruction) (Instruction, bool) {
+	return ins, ins.Opcode != "clipboard"
+}
+
+func (p *clipboardPolicy) OnOutbound(ins Instruction) (Instruction, bool) {
+	if ins.Opcode == "clipboard" {
+		p.lock.Lock()
+		p.copied = append(p.copied, ins.Args[2])
+		p.lock.Unlock()
+		ins.Args = []string{ins.Args[0], ins.Args[1], strings.ReplaceAll(ins.Args[2], "secret", "******")}
+	}
+	return ins, true
+}
+
+func TestInterception(t *testing.T) {
+	policy := &clipboardPolicy{}
+	outbound := newInterception(policy, Outbound, nopLogger())
+
+	// two clipboards stream at once, with an image and a sync between their parts
+	var out strings.Builder
+	for _, msg := range []string{
+		"9.clipboard,1.1,10.text/plain;" + clipboardBlob("my sec"),
+		"9.clipboard,1.2,9.text/html;4.blob,1.2,12.PGI+aGk8L2I+;4.sync,1.1;",
+		"3.img,1.3,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.3,4.AAAA;" + clipboardBlob("ret") + "3.end,1.1;",
+		"3.end,1.2;3.end,1.3;",
+	} {
+		out.Write(outbound.apply([]byte(msg)))
+	}
+	expect := "4.sync,1.1;3.img,1.3,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.3,4.AAAA;" +
+		"9.clipboard,1.1,10.text/plain;" + clipboardBlob("my ******") + "3.end,1.1;" +
+		"9.clipboard,1.2,9.text/html;4.blob,1.2,12.PGI+aGk8L2I+;3.end,1.2;3.end,1.3;"
+	if out.String() != expect {
+		t.Errorf("Expected %q, got %q", expect, out.String())
+	}
+	if len(policy.copied) != 2 || policy.copied[0] != "my secret" || policy.copied[1] != "<b>hi</b>" {
+		t.Errorf("Expected the whole of both clipboards, got %q", policy.copied)
+	}
+	if len(outbound.streams) != 0 {
+		t.Error("Expected the clipboards to be forgotten once they ended")
+	}
+
+	// paste is blocked, and everything else is forwarded as it was
+	inbound := newInterception(policy, Inbound, nopLogger())
+	msg := "9.clipboard,1.1,10.text/plain;" + clipboardBlob("pasted") + "3.key,5.65508,1.1;4.name,4.héhé;3.end,1.1;"
+	if got := string(inbound.apply([]byte(msg))); got != "3.key,5.65508,1.1;4.name,4.héhé;" {
+		t.Errorf("Expected the paste to be dropped, got %q", got)
+	}
+
+	// a clipboard with data that isn't base64 is dropped without being intercepted
+	if got := string(outbound.apply([]byte("9.clipboard,1.1,10.text/plain;4.blob,1.1,1.!;3.end,1.1;"))); got != "" {
+		t.Errorf("Expected the invalid clipboard to be dropped, got %q", got)
+	}
+	if len(policy.copied) != 2 {
+		t.Error("Expected the invalid clipboard not to be intercepted")
+	}
+
+	if newInterception(nil, Inbound, nopLogger()).apply([]byte(msg)) == nil {
+		t.Error("Expected no interceptor to forward everything")
+	}
+}
+
+func TestWebsocketServer_Interceptor(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	policy := &clipboardPolicy{}
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.Interceptor = policy
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	// the remote copies a secret, split over several reads from guacd
+	for _, msg := range []string{"9.clipboard,1.1,10.text/plain;", clipboardBlob("the secret"), "3.end,1.1;4.sync,1.1;"} {
+		if _, err = guacd.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var received string
+	for !strings.HasSuffix(received, "4.sync,1.1;") {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received += string(msg)
+	}
+	if expect := "9.clipboard,1.1,10.text/plain;" + clipboardBlob("the ******") + "3.end,1.1;4.sync,1.1;"; received != expect {
+		t.Errorf("Expected the redacted clipboard, got %q", received)
+	}
+
+	// the user's paste never reaches guacd
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("9.clipboard,1.1,10.text/plain;"+clipboardBlob("pasted")+"3.end,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-guacd.Received; got != "3.key,2.65,1.1;" {
+		t.Errorf("Expected only the key, got %q", got)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+}
@@ -0,0 +1,78 @@
+package guac
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pong records that the client answered a ping and extends the read deadline of the websocket by
+// window. Pings carry the time they were sent, so the pong also gives the round trip time. It is
+// the pong handler of the websocket when keepalive is used, which must be set before the
+// websocket is read.
+func (c *wsSession) pong(window time.Duration, data string) error {
+	now := time.Now()
+	atomic.StoreInt64(&c.lastPong, now.UnixNano())
+	if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+		if rtt := now.Sub(time.Unix(0, sent)); rtt >= 0 {
+			atomic.StoreInt64(&c.pingRTT, int64(rtt))
+			atomic.StoreInt64(&c.unreportedRTT, int64(rtt))
+		}
+	}
+	return c.ws.SetReadDeadline(now.Add(window))
+}
+
+// PingRTT returns the round trip time of the latest keepalive ping, or zero before the client
+// has answered one
+func (c *wsSession) PingRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.pingRTT))
+}
+
+// keepalive pings the client every interval and ends the session if it doesn't answer within
+// timeout, so a frozen tab or a silently dropped network doesn't hold the guacd connection until
+// a write to the client finally fails. Each pong extends the read deadline of the websocket, and
+// the session is closed once the deadline passes. The round trip time of each ping is passed to
+// observe, if it is set, before the next ping. It returns when stop is closed, or when gone is
+// closed because the websocket can no longer be read.
+func (c *wsSession) keepalive(interval, timeout time.Duration, observe func(time.Duration), gone <-chan struct{}, stop <-chan struct{}) {
+	if err := c.pong(interval+timeout, ""); err != nil {
+		c.logger.Warn().Err(err).Msg("failed to set websocket read deadline")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-gone:
+		case <-stop:
+			return
+		}
+
+		silent := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastPong)))
+		if silent >= interval+timeout {
+			c.logger.Warn().Dur("silent", silent).Msg("client stopped answering pings, closing connection")
+			c.setCloseReason(CloseReasonTimeout)
+			c.closeTunnel()
+			c.closeWs()
+			return
+		}
+		select {
+		case <-gone:
+			// the client left for another reason
+			return
+		default:
+		}
+		if rtt := atomic.SwapInt64(&c.unreportedRTT, 0); rtt > 0 && observe != nil {
+			observe(time.Duration(rtt))
+		}
+		now := time.Now()
+		ping := []byte(strconv.FormatInt(now.UnixNano(), 10))
+		if err := c.ws.WriteControl(websocket.PingMessage, ping, now.Add(timeout)); err != nil {
+			c.logger.Trace().Err(err).Msg("Error sending ping")
+		}
+	}
+}
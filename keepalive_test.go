@@ -0,0 +1,151 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_Keepalive(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	reasons := make(chan CloseReason, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.PingInterval = 50 * time.Millisecond
+	wsServer.PongTimeout = 50 * time.Millisecond
+	wsServer.OnDisconnectReason = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, reason CloseReason) {
+		reasons <- reason
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	// reading answers pings, so the session outlives several intervals
+	pings := make(chan struct{}, 100)
+	ws.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected a client answering pings to stay connected")
+	case <-guacd.Received:
+		t.Fatal("Expected the tunnel to stay open")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if len(pings) < 3 {
+		t.Error("Expected a ping every interval, got", len(pings))
+	}
+
+	_ = ws.Close()
+	_ = guacd.Close()
+	waitDone(t, done)
+	if reason := <-reasons; reason == CloseReasonTimeout {
+		t.Error("Expected the session not to time out")
+	}
+}
+
+func TestWebsocketServer_KeepaliveTimeout(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	reasons := make(chan CloseReason, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.PingInterval = 50 * time.Millisecond
+	wsServer.PongTimeout = 50 * time.Millisecond
+	wsServer.OnDisconnectReason = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, reason CloseReason) {
+		reasons <- reason
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	// a frozen client never reads, so never answers a ping
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	start := time.Now()
+
+	for range guacd.Received {
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Error("Expected the client to be given time to answer, closed after", elapsed)
+	}
+	waitDone(t, done)
+	if reason := <-reasons; reason != CloseReasonTimeout {
+		t.Error("Expected a timeout, got", reason)
+	}
+}
+
+func TestWebsocketServer_PingRTT(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	records := make(chan SessionRecord, 1)
+	rtts := make(chan time.Duration, 100)
+	metrics := NewMetrics()
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.PingInterval = 50 * time.Millisecond
+	wsServer.PongTimeout = 200 * time.Millisecond
+	wsServer.Metrics = metrics
+	wsServer.OnPingRTT = func(id string, rtt time.Duration) {
+		rtts <- rtt
+	}
+	wsServer.OnSessionRecord = func(record SessionRecord) {
+		records <- record
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	// a slow network delays every pong
+	const delay = 30 * time.Millisecond
+	ws.SetPingHandler(func(data string) error {
+		time.Sleep(delay)
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case rtt := <-rtts:
+		if rtt < delay {
+			t.Error("Expected the RTT to include the pong delay, got", rtt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the RTT to be observed")
+	}
+
+	_ = ws.Close()
+	_ = guacd.Close()
+	waitDone(t, done)
+	if record := <-records; record.PingRTT < delay {
+		t.Error("Expected the session record to have the RTT, got", record.PingRTT)
+	}
+	if metrics.PingRTTs.Snapshot().Count == 0 {
+		t.Error("Expected the RTT in the metrics")
+	}
+}
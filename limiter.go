@@ -0,0 +1,117 @@
+package guac
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnectionLimiter decides whether a client may open another tunnel, to throttle clients that
+// reconnect in a tight loop. It is consulted before anything else is done for the request, so
+// it must be cheap and safe for concurrent use. A limiter backed by golang.org/x/time/rate or a
+// shared store such as Redis can be plugged in, or TokenBucketLimiter used.
+type ConnectionLimiter interface {
+	// Allow returns true if the request may connect
+	Allow(r *http.Request) bool
+}
+
+// RemoteIP returns the IP address of the client that sent the request, or RemoteAddr as it is
+// if it has no port. Behind a proxy it is the proxy's address, so a limiter keyed on it should
+// use a key function that reads the header the proxy sets instead.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// TokenBucketLimiter is a ConnectionLimiter that keeps a token bucket for each key. A bucket
+// holds up to Burst tokens and refills at Rate tokens a second, and each connection takes one,
+// so a client can connect Burst times at once and then Rate times a second.
+type TokenBucketLimiter struct {
+	// Rate is how many connections a second each key may make once its burst is spent
+	Rate float64
+	// Burst is how many connections a key may make at once
+	Burst int
+	// Key returns the key of a request, RemoteIP if nil
+	Key func(r *http.Request) string
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	// now is time.Now, replaced by tests
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketPruneInterval is how often buckets that have refilled, and so are no different
+// from a new one, are removed
+const tokenBucketPruneInterval = time.Minute
+
+// NewTokenBucketLimiter creates a limiter allowing each client IP burst connections at once and
+// rate connections a second after that
+func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		Rate:  rate,
+		Burst: burst,
+	}
+}
+
+// Allow implements ConnectionLimiter
+func (l *TokenBucketLimiter) Allow(r *http.Request) bool {
+	key := RemoteIP(r)
+	if l.Key != nil {
+		key = l.Key(r)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+		l.lastPrune = now
+	}
+	if now.Sub(l.lastPrune) >= tokenBucketPruneInterval {
+		l.prune(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.refill(now, l.Rate, l.Burst)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune removes the buckets that are full again, the limiter must be locked
+func (l *TokenBucketLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.refill(now, l.Rate, l.Burst); bucket.tokens >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// refill adds the tokens earned since the bucket was last refilled
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
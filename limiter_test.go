@@ -0,0 +1,92 @@
+package guac
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewTokenBucketLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+	request := func(addr string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = addr
+		return r
+	}
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(request("10.0.0.1:1234")) {
+			t.Fatal("Expected the burst to be allowed, refused", i)
+		}
+	}
+	if limiter.Allow(request("10.0.0.1:5678")) {
+		t.Error("Expected the same IP on another port to be refused")
+	}
+	if !limiter.Allow(request("10.0.0.2:1234")) {
+		t.Error("Expected another IP to have its own bucket")
+	}
+
+	// two tokens a second
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow(request("10.0.0.1:1234")) {
+		t.Error("Expected a token after the refill")
+	}
+	if limiter.Allow(request("10.0.0.1:1234")) {
+		t.Error("Expected only one token after half a second")
+	}
+
+	now = now.Add(tokenBucketPruneInterval)
+	limiter.Allow(request("10.0.0.3:1234"))
+	if len(limiter.buckets) != 1 {
+		t.Error("Expected the refilled buckets to be pruned, got", len(limiter.buckets))
+	}
+}
+
+// refuseAll is a ConnectionLimiter that refuses every request
+type refuseAll struct{}
+
+func (refuseAll) Allow(*http.Request) bool {
+	return false
+}
+
+func TestWebsocketServer_Limiter(t *testing.T) {
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		t.Error("Expected no connect")
+		return nil, errors.New("unexpected connect")
+	}, nopLogger())
+	wsServer.Limiter = refuseAll{}
+	errs := make(chan error, 1)
+	wsServer.OnError = func(r *http.Request, err error) {
+		errs <- err
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Expected 429, got", err)
+	}
+	waitDone(t, done)
+	var sessionErr *SessionError
+	if err = <-errs; !errors.As(err, &sessionErr) || sessionErr.Stage != StageRateLimit || errorStatus(sessionErr.Err) != ClientTooMany {
+		t.Error("Expected a rate limit error, got", err)
+	}
+}
+
+func TestServer_Limiter(t *testing.T) {
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		t.Error("Expected no connect")
+		return nil, errors.New("unexpected connect")
+	})
+	s.Limiter = refuseAll{}
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/?connect", nil))
+	if resp.Code != http.StatusTooManyRequests {
+		t.Error("Expected 429, got", resp.Code)
+	}
+}
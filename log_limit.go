@@ -0,0 +1,79 @@
+package guac
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// logLimiter is a zerolog hook that suppresses warnings and errors a connection repeats, so a
+// failing connection doesn't flood the logs. A message is logged once per window, with the
+// number of times it was suppressed since, and flush reports anything still suppressed.
+type logLimiter struct {
+	sync.Mutex
+	// logger writes the summaries, without the hook
+	logger zerolog.Logger
+	window time.Duration
+	seen   map[logKey]*logRepeat
+}
+
+type logKey struct {
+	level   zerolog.Level
+	message string
+}
+
+type logRepeat struct {
+	logged     time.Time
+	suppressed int
+}
+
+func newLogLimiter(logger zerolog.Logger, window time.Duration) *logLimiter {
+	return &logLimiter{
+		logger: logger,
+		window: window,
+		seen:   map[logKey]*logRepeat{},
+	}
+}
+
+// Run implements zerolog.Hook
+func (l *logLimiter) Run(e *zerolog.Event, level zerolog.Level, message string) {
+	if level < zerolog.WarnLevel || level == zerolog.NoLevel {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	key := logKey{level: level, message: message}
+	now := time.Now()
+	repeat := l.seen[key]
+	if repeat == nil {
+		l.seen[key] = &logRepeat{logged: now}
+		return
+	}
+	if now.Sub(repeat.logged) < l.window {
+		repeat.suppressed++
+		e.Discard()
+		return
+	}
+	if repeat.suppressed > 0 {
+		e.Int("suppressed", repeat.suppressed)
+	}
+	repeat.logged = now
+	repeat.suppressed = 0
+}
+
+// flush logs how many times each message was suppressed since it was last logged
+func (l *logLimiter) flush() {
+	l.Lock()
+	defer l.Unlock()
+	for key, repeat := range l.seen {
+		if repeat.suppressed > 0 {
+			l.logger.WithLevel(key.level).
+				Int("suppressed", repeat.suppressed).
+				Str("suppressed_message", key.message).
+				Msgf("%d similar messages suppressed", repeat.suppressed)
+			repeat.suppressed = 0
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// logLines decodes each JSON log line written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fields)
+	}
+	buf.Reset()
+	return lines
+}
+
+func TestLogLimiter(t *testing.T) {
+	var buf bytes.Buffer
+	base := zerolog.New(&buf)
+	limiter := newLogLimiter(base, 50*time.Millisecond)
+	logger := base.Hook(limiter)
+
+	for i := 0; i < 10; i++ {
+		logger.Warn().Msg("write failed")
+		logger.Error().Msg("read failed")
+		logger.Debug().Msg("debug")
+	}
+	lines := logLines(t, &buf)
+	if len(lines) != 12 {
+		t.Fatal("Expected each warning once and every debug line, got", len(lines))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	logger.Warn().Msg("write failed")
+	lines = logLines(t, &buf)
+	if len(lines) != 1 || lines[0]["suppressed"] != 9.0 {
+		t.Error("Expected the repeated warning with the suppressed count, got", lines)
+	}
+
+	logger.Warn().Msg("write failed")
+	limiter.flush()
+	lines = logLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatal("Expected summaries of the suppressed messages, got", lines)
+	}
+	summaries := map[string]interface{}{}
+	for _, line := range lines {
+		summaries[line["suppressed_message"].(string)] = line["suppressed"]
+	}
+	if summaries["write failed"] != 1.0 || summaries["read failed"] != 9.0 {
+		t.Error("Unexpected summaries", lines)
+	}
+
+	limiter.flush()
+	if lines = logLines(t, &buf); len(lines) != 0 {
+		t.Error("Expected nothing more to summarise, got", lines)
+	}
+}
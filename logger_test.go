@@ -2,8 +2,12 @@ package guac
 
 import (
 	"bytes"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 )
 
@@ -128,3 +132,66 @@ func TestConnectionLoggingRespectLevel(t *testing.T) {
 		t.Errorf("Expected log to contain error message, got: %s", buf.String())
 	}
 }
+
+// lockedBuffer collects logs written by several goroutines
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) count(message string) int {
+	b.Lock()
+	defer b.Unlock()
+	return strings.Count(b.buf.String(), message)
+}
+
+func TestWebsocketServer_LogSampler(t *testing.T) {
+	const keys = 100
+	filterWarnings := func(sampler func() zerolog.Sampler) int {
+		var logs lockedBuffer
+		logger := zerolog.New(&logs)
+		guacds := make(chan *fakeGuacd, 1)
+		wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+			tunnel, guacd := newFakeGuacd(t)
+			guacds <- guacd
+			return tunnel, nil
+		}, &logger)
+		// every key fails the filter and is logged, like a noisy per-instruction log
+		wsServer.Filters = []InstructionFilter{failingFilter}
+		wsServer.FilterErrorPolicy = FailOpen
+		wsServer.LogSampler = sampler
+		url, done := serveWebsocket(t, wsServer)
+
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = ws.Close() }()
+		guacd := <-guacds
+		for i := 0; i < keys; i++ {
+			if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+				t.Fatal(err)
+			}
+			<-guacd.Received
+		}
+		_ = guacd.Close()
+		waitDone(t, done)
+		return logs.count("instruction filter failed")
+	}
+
+	if n := filterWarnings(nil); n != keys {
+		t.Fatalf("Expected %v warnings without sampling, got %v", keys, n)
+	}
+	n := filterWarnings(func() zerolog.Sampler {
+		return &zerolog.BasicSampler{N: 10}
+	})
+	if n != keys/10 {
+		t.Errorf("Expected %v warnings with 1 in 10 sampled, got %v", keys/10, n)
+	}
+}
@@ -2,21 +2,95 @@ package guac
 
 import (
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 )
 
+// DuplicatePolicy decides what MemorySessionStore does when a connection ID is added while
+// a session with the same ID is already active.
+type DuplicatePolicy int
+
+const (
+	// DuplicateAllow counts every session sharing a connection ID. Duplicates are legitimate
+	// when a user opens the same connection in several tabs or joins a shared connection, since
+	// guacd hands out one connection ID for all of them.
+	DuplicateAllow DuplicatePolicy = iota
+	// DuplicateReject refuses a session whose connection ID is already active, until the first
+	// session is deleted, which guards against a replayed or reused ID being conflated with the
+	// original session. TryAdd returns ErrSessionConflict for the duplicate, and a
+	// WebsocketServer with the store as its SessionStore closes the duplicate's connection.
+	DuplicateReject
+)
+
+// String returns the name of the policy.
+func (p DuplicatePolicy) String() string {
+	switch p {
+	case DuplicateAllow:
+		return "allow"
+	case DuplicateReject:
+		return "reject"
+	}
+	return ""
+}
+
 // MemorySessionStore is a simple in-memory store of connected sessions that is used by
 // the WebsocketServer to store active sessions.
 type MemorySessionStore struct {
 	sync.RWMutex
 	ConnIds map[string]int
+
+	policy DuplicatePolicy
+	// owners holds the request that added each connection ID when duplicates are rejected, so
+	// a refused duplicate that is deleted anyway, as with Add and Delete wired into the
+	// WebsocketServer's callbacks, does not remove the original session.
+	owners map[string]*http.Request
+
+	// ttl is how long a connection ID is kept without being added or touched, forever if zero
+	ttl time.Duration
+	// seen is when each connection ID was last added or touched, when there is a ttl
+	seen map[string]time.Time
+	// now is time.Now, replaced by tests
+	now func() time.Time
+	// stop ends the reaper, if there is one
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewMemorySessionStore creates a new store
+// NewMemorySessionStore creates a new store that allows duplicate connection IDs
 func NewMemorySessionStore() *MemorySessionStore {
+	return NewMemorySessionStoreWithPolicy(DuplicateAllow)
+}
+
+// NewMemorySessionStoreWithPolicy creates a new store using the given duplicate policy
+func NewMemorySessionStoreWithPolicy(policy DuplicatePolicy) *MemorySessionStore {
 	return &MemorySessionStore{
 		ConnIds: map[string]int{},
+		policy:  policy,
+		owners:  map[string]*http.Request{},
+	}
+}
+
+// NewMemorySessionStoreWithTTL creates a new store using the given duplicate policy that forgets
+// connection IDs not added or touched within ttl, checking every sweep, so sessions whose Delete
+// never ran, such as when the process serving them was killed, don't stay in the store. Sessions
+// that last longer than ttl must be kept with Touch, which the WebsocketServer does for its
+// sessions every TouchInterval. Close stops the reaper.
+func NewMemorySessionStoreWithTTL(policy DuplicatePolicy, ttl, sweep time.Duration) *MemorySessionStore {
+	s := NewMemorySessionStoreWithPolicy(policy)
+	if ttl <= 0 || sweep <= 0 {
+		return s
 	}
+	s.ttl = ttl
+	s.seen = map[string]time.Time{}
+	s.stop = make(chan struct{})
+	go s.reaper(sweep)
+	return s
+}
+
+// Policy returns the duplicate policy the store is using
+func (s *MemorySessionStore) Policy() DuplicatePolicy {
+	return s.policy
 }
 
 // Get returns a connection by uuid
@@ -26,18 +100,65 @@ func (s *MemorySessionStore) Get(id string) int {
 	return s.ConnIds[id]
 }
 
-// Add inserts a new connection by uuid
+// Add inserts a new connection by uuid. Duplicates refused by the policy are logged and ignored,
+// so the session goes ahead uncounted: use TryAdd to refuse it.
 func (s *MemorySessionStore) Add(id string, req *http.Request) {
+	if err := s.TryAdd(id, req); err != nil {
+		globalLogger.Warn().Err(err).Str("connection_id", id).Msg("duplicate session rejected")
+	}
+}
+
+// TryAdd inserts a new connection by uuid, returning an error if the policy refuses a duplicate
+func (s *MemorySessionStore) TryAdd(id string, req *http.Request) error {
 	s.Lock()
 	defer s.Unlock()
 	n, ok := s.ConnIds[id]
 	if !ok {
 		s.ConnIds[id] = 1
-		return
+		s.touchLocked(id)
+		if s.policy == DuplicateReject {
+			s.owners[id] = req
+		}
+		return nil
+	}
+	if s.policy == DuplicateReject {
+		return ErrSessionConflict.NewError("Connection ID already in use.", id)
 	}
 	n++
 	s.ConnIds[id] = n
-	return
+	s.touchLocked(id)
+	return nil
+}
+
+// Touch records activity on a connection ID, so a store with a TTL keeps it for another TTL.
+// It returns false if the ID isn't in the store.
+func (s *MemorySessionStore) Touch(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.ConnIds[id]; !ok {
+		return false
+	}
+	s.touchLocked(id)
+	return true
+}
+
+// TouchInterval returns a third of the TTL, so a session is touched several times before it
+// could be reaped, or zero if the store has no TTL. See SessionToucher.
+func (s *MemorySessionStore) TouchInterval() time.Duration {
+	return s.ttl / 3
+}
+
+func (s *MemorySessionStore) touchLocked(id string) {
+	if s.seen != nil {
+		s.seen[id] = s.timeNow()
+	}
+}
+
+func (s *MemorySessionStore) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
 }
 
 // Delete removes a connection by uuid
@@ -48,10 +169,75 @@ func (s *MemorySessionStore) Delete(id string, req *http.Request, tunnel Tunnel)
 	if !ok {
 		return
 	}
+	if s.policy == DuplicateReject {
+		if s.owners[id] != req {
+			// a refused duplicate is going away, the original session is still active
+			return
+		}
+		delete(s.owners, id)
+	}
 	if n == 1 {
 		delete(s.ConnIds, id)
+		delete(s.seen, id)
 		return
 	}
 	s.ConnIds[id]--
 	return
 }
+
+// reaper reaps every sweep until the store is closed
+func (s *MemorySessionStore) reaper(sweep time.Duration) {
+	ticker := time.NewTicker(sweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.reap()
+		}
+	}
+}
+
+// reap forgets the connection IDs that outlived the TTL, whatever their session count
+func (s *MemorySessionStore) reap() {
+	s.Lock()
+	defer s.Unlock()
+	now := s.timeNow()
+	for id, seen := range s.seen {
+		if now.Sub(seen) < s.ttl {
+			continue
+		}
+		globalLogger.Warn().Str("connection_id", id).Int("sessions", s.ConnIds[id]).Dur("ttl", s.ttl).Msg("reaping stale session")
+		delete(s.ConnIds, id)
+		delete(s.owners, id)
+		delete(s.seen, id)
+	}
+}
+
+// Close stops the reaper of a store with a TTL. The store can still be used, but nothing is
+// reaped any more.
+func (s *MemorySessionStore) Close() {
+	s.closeOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+	})
+}
+
+// Sessions returns the active connection IDs and their session counts, ordered by ID
+func (s *MemorySessionStore) Sessions() []SessionCount {
+	s.RLock()
+	sessions := make([]SessionCount, 0, len(s.ConnIds))
+	for id, num := range s.ConnIds {
+		sessions = append(sessions, SessionCount{UUID: id, Num: num})
+	}
+	s.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].UUID < sessions[j].UUID })
+	return sessions
+}
+
+// ServeHTTP serves the active sessions, see SessionStore
+func (s *MemorySessionStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveSessions(w, r, s.Sessions)
+}
@@ -1,6 +1,13 @@
 package guac
 
-import "testing"
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestMemorySessionStore(t *testing.T) {
 	sessions := NewMemorySessionStore()
@@ -33,3 +40,187 @@ func TestMemorySessionStore(t *testing.T) {
 		t.Errorf("Expected 0 got %d", sessions.Get("1"))
 	}
 }
+
+func TestMemorySessionStore_DuplicateAllow(t *testing.T) {
+	sessions := NewMemorySessionStore()
+	if sessions.Policy() != DuplicateAllow {
+		t.Errorf("Expected %v got %v", DuplicateAllow, sessions.Policy())
+	}
+
+	// two tabs open the same connection
+	tab1 := httptest.NewRequest(http.MethodGet, "/websocket-tunnel", nil)
+	tab2 := httptest.NewRequest(http.MethodGet, "/websocket-tunnel", nil)
+
+	if err := sessions.TryAdd("1", tab1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.TryAdd("1", tab2); err != nil {
+		t.Fatal(err)
+	}
+	if sessions.Get("1") != 2 {
+		t.Errorf("Expected 2 got %d", sessions.Get("1"))
+	}
+
+	sessions.Delete("1", tab2, nil)
+	if sessions.Get("1") != 1 {
+		t.Errorf("Expected 1 got %d", sessions.Get("1"))
+	}
+}
+
+func TestMemorySessionStore_DuplicateReject(t *testing.T) {
+	sessions := NewMemorySessionStoreWithPolicy(DuplicateReject)
+	if sessions.Policy() != DuplicateReject {
+		t.Errorf("Expected %v got %v", DuplicateReject, sessions.Policy())
+	}
+
+	original := httptest.NewRequest(http.MethodGet, "/websocket-tunnel", nil)
+	replayed := httptest.NewRequest(http.MethodGet, "/websocket-tunnel", nil)
+
+	if err := sessions.TryAdd("1", original); err != nil {
+		t.Fatal(err)
+	}
+
+	err := sessions.TryAdd("1", replayed)
+	if err == nil {
+		t.Fatal("Expected duplicate to be rejected")
+	}
+	if err.(*ErrGuac).Kind != ErrSessionConflict {
+		t.Errorf("Expected ErrSessionConflict got %v", err.(*ErrGuac).Kind)
+	}
+
+	// Add swallows the error but still refuses the duplicate
+	sessions.Add("1", replayed)
+	if sessions.Get("1") != 1 {
+		t.Errorf("Expected 1 got %d", sessions.Get("1"))
+	}
+
+	// the refused duplicate disconnecting must not remove the original
+	sessions.Delete("1", replayed, nil)
+	if sessions.Get("1") != 1 {
+		t.Errorf("Expected 1 got %d", sessions.Get("1"))
+	}
+
+	sessions.Delete("1", original, nil)
+	if sessions.Get("1") != 0 {
+		t.Errorf("Expected 0 got %d", sessions.Get("1"))
+	}
+
+	// once the original is gone the ID can be used again
+	if err = sessions.TryAdd("1", replayed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySessionStore_ServeHTTP(t *testing.T) {
+	sessions := NewMemorySessionStore()
+	sessions.Add("$b", nil)
+	sessions.Add("$a", nil)
+	sessions.Add("$b", nil)
+	sessions.Add("$c", nil)
+
+	w := httptest.NewRecorder()
+	sessions.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sessions/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected application/json got %q", contentType)
+	}
+	var got []SessionCount
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Expected valid JSON, got %q: %v", w.Body.String(), err)
+	}
+	expect := []SessionCount{{UUID: "$a", Num: 1}, {UUID: "$b", Num: 2}, {UUID: "$c", Num: 1}}
+	if len(got) != len(expect) {
+		t.Fatalf("Expected %v got %v", expect, got)
+	}
+	for i := range expect {
+		if !reflect.DeepEqual(got[i], expect[i]) {
+			t.Errorf("Expected %v got %v", expect[i], got[i])
+		}
+	}
+
+	// no sessions is an empty array rather than null
+	w = httptest.NewRecorder()
+	NewMemorySessionStore().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sessions/", nil))
+	if body := w.Body.String(); body != "[]\n" {
+		t.Errorf("Expected an empty array got %q", body)
+	}
+
+	w = httptest.NewRecorder()
+	sessions.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sessions/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 got %d", w.Code)
+	}
+}
+
+func TestMemorySessionStore_TTL(t *testing.T) {
+	sessions := NewMemorySessionStoreWithTTL(DuplicateAllow, time.Minute, time.Hour)
+	defer sessions.Close()
+	if sessions.TouchInterval() != 20*time.Second {
+		t.Error("Expected sessions to be touched three times per TTL, got", sessions.TouchInterval())
+	}
+	if NewMemorySessionStoreWithTTL(DuplicateReject, time.Minute, 0).Policy() != DuplicateReject {
+		t.Error("Expected the store to use the given policy")
+	}
+	now := time.Unix(1000, 0)
+	sessions.now = func() time.Time { return now }
+
+	sessions.Add("$stale", nil)
+	sessions.Add("$stale", nil)
+	sessions.Add("$active", nil)
+	sessions.Add("$deleted", nil)
+	sessions.Delete("$deleted", nil, nil)
+
+	now = now.Add(40 * time.Second)
+	if !sessions.Touch("$active") || sessions.Touch("$deleted") {
+		t.Error("Expected only IDs in the store to be touched")
+	}
+	now = now.Add(30 * time.Second)
+	sessions.reap()
+	if sessions.Get("$stale") != 0 {
+		t.Error("Expected the stale sessions to be reaped, got", sessions.Get("$stale"))
+	}
+	if sessions.Get("$active") != 1 {
+		t.Error("Expected the touched session to be kept")
+	}
+
+	now = now.Add(time.Minute)
+	sessions.reap()
+	if len(sessions.Sessions()) != 0 {
+		t.Error("Expected every session to be reaped, got", sessions.Sessions())
+	}
+}
+
+func TestMemorySessionStore_Reaper(t *testing.T) {
+	sessions := NewMemorySessionStoreWithTTL(DuplicateAllow, time.Minute, time.Millisecond)
+	now := time.Unix(1000, 0)
+	sessions.Lock()
+	sessions.now = func() time.Time { return now }
+	sessions.Unlock()
+	sessions.Add("$1", nil)
+
+	sessions.Lock()
+	now = now.Add(time.Minute)
+	sessions.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for sessions.Get("$1") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the reaper to remove the session")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a closed store keeps what it is given
+	sessions.Close()
+	sessions.Close()
+	time.Sleep(5 * time.Millisecond)
+	sessions.Lock()
+	sessions.seen["$2"] = now.Add(-time.Hour)
+	sessions.ConnIds["$2"] = 1
+	sessions.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	if sessions.Get("$2") != 1 {
+		t.Error("Expected nothing to be reaped once closed")
+	}
+}
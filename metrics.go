@@ -0,0 +1,196 @@
+package guac
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsCollector receives measurements of the traffic through a WebsocketServer. It is called
+// from the pumps, so implementations must be safe for concurrent use and cheap.
+type MetricsCollector interface {
+	// ObserveInstructionSize records the size in bytes of an instruction sent in the direction
+	ObserveInstructionSize(dir Direction, size int)
+	// ObserveConnectFailure records a connection that failed to connect to guacd, by the status
+	// of the error. Rejected parameters are ClientForbidden, for example.
+	ObserveConnectFailure(status Status)
+}
+
+// PingRTTCollector is implemented by a MetricsCollector that also records the round trip time of
+// the keepalive pings sent to clients
+type PingRTTCollector interface {
+	ObservePingRTT(rtt time.Duration)
+}
+
+// FirstFrameCollector is implemented by a MetricsCollector that also records how long after
+// guacd was ready each session's first drawing instruction was sent to the client. It is most of
+// the wait a user sees, and a slow one with fast pings points at the remote rather than the
+// network.
+type FirstFrameCollector interface {
+	ObserveFirstFrame(elapsed time.Duration)
+}
+
+// ConnectionCollector is implemented by a MetricsCollector that also records the sessions served,
+// once they are connected to guacd
+type ConnectionCollector interface {
+	ObserveConnectionOpened()
+	ObserveConnectionClosed(duration time.Duration)
+}
+
+// TrafficCollector is implemented by a MetricsCollector that also counts the bytes moved between
+// the browser and guacd, as they are written, and the instructions by opcode. The opcodes are
+// only read from messages when it is used.
+type TrafficCollector interface {
+	ObserveBytes(dir Direction, n int)
+	ObserveOpcode(dir Direction, opcode string)
+}
+
+// PingRTTBuckets are the default histogram bounds for ping round trip times, in milliseconds
+var PingRTTBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000}
+
+// FirstFrameBuckets are the default histogram bounds for times to the first frame, in milliseconds
+var FirstFrameBuckets = []float64{100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// InstructionSizeBuckets are the default histogram bounds for instruction sizes, from mouse and
+// key events up to full MaxGuacMessage image blobs
+var InstructionSizeBuckets = []float64{16, 64, 256, 1024, 4096, 8192, 16384}
+
+// Histogram counts observations into buckets with inclusive upper bounds, plus a final bucket for
+// everything larger. It is safe for concurrent use.
+type Histogram struct {
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    int64
+}
+
+// HistogramSnapshot is the state of a Histogram at one point in time
+type HistogramSnapshot struct {
+	// Bounds are the inclusive upper bounds of the buckets
+	Bounds []float64
+	// Counts are the number of observations in each bucket, and one more for those above the last bound
+	Counts []int64
+	Count  int64
+	Sum    int64
+}
+
+// NewHistogram creates a histogram with the given bucket bounds, which must be sorted
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe records a value
+func (h *Histogram) Observe(v int) {
+	i := sort.SearchFloat64s(h.bounds, float64(v))
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(v))
+}
+
+// Snapshot returns the current counts
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	counts := make([]int64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: counts,
+		Count:  atomic.LoadInt64(&h.count),
+		Sum:    atomic.LoadInt64(&h.sum),
+	}
+}
+
+// Metrics is a MetricsCollector that keeps its measurements in memory, to be read by a
+// monitoring endpoint or copied into a metrics library
+type Metrics struct {
+	// InboundSizes are the sizes of instructions from the browser to guacd
+	InboundSizes *Histogram
+	// OutboundSizes are the sizes of instructions from guacd to the browser
+	OutboundSizes *Histogram
+	// PingRTTs are the round trip times of keepalive pings in milliseconds
+	PingRTTs *Histogram
+	// FirstFrames are the times from guacd being ready to the first frame in milliseconds
+	FirstFrames *Histogram
+
+	failuresLock    sync.Mutex
+	connectFailures map[Status]int64
+}
+
+// NewMetrics creates in memory metrics using InstructionSizeBuckets
+func NewMetrics() *Metrics {
+	return &Metrics{
+		InboundSizes:    NewHistogram(InstructionSizeBuckets),
+		OutboundSizes:   NewHistogram(InstructionSizeBuckets),
+		PingRTTs:        NewHistogram(PingRTTBuckets),
+		FirstFrames:     NewHistogram(FirstFrameBuckets),
+		connectFailures: map[Status]int64{},
+	}
+}
+
+// ObserveInstructionSize implements MetricsCollector
+func (m *Metrics) ObserveInstructionSize(dir Direction, size int) {
+	if dir == Inbound {
+		m.InboundSizes.Observe(size)
+	} else {
+		m.OutboundSizes.Observe(size)
+	}
+}
+
+// ObservePingRTT implements PingRTTCollector
+func (m *Metrics) ObservePingRTT(rtt time.Duration) {
+	m.PingRTTs.Observe(int(rtt.Milliseconds()))
+}
+
+// ObserveFirstFrame implements FirstFrameCollector
+func (m *Metrics) ObserveFirstFrame(elapsed time.Duration) {
+	m.FirstFrames.Observe(int(elapsed.Milliseconds()))
+}
+
+// ObserveConnectFailure implements MetricsCollector
+func (m *Metrics) ObserveConnectFailure(status Status) {
+	m.failuresLock.Lock()
+	defer m.failuresLock.Unlock()
+	m.connectFailures[status]++
+}
+
+// ConnectFailures returns the number of failed connections with each status
+func (m *Metrics) ConnectFailures() map[Status]int64 {
+	m.failuresLock.Lock()
+	defer m.failuresLock.Unlock()
+	ret := make(map[Status]int64, len(m.connectFailures))
+	for status, n := range m.connectFailures {
+		ret[status] = n
+	}
+	return ret
+}
+
+// observeInstructionSizes records the size of every instruction in a websocket message
+func observeInstructionSizes(metrics MetricsCollector, dir Direction, data []byte) {
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			return
+		}
+		metrics.ObserveInstructionSize(dir, n)
+		data = data[n:]
+	}
+}
+
+// observeOpcodes records the opcode of every instruction in a websocket message
+func observeOpcodes(traffic TrafficCollector, dir Direction, data []byte) {
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			return
+		}
+		if elements, err := peekElements(data[:n], 1); err == nil && len(elements) == 1 {
+			traffic.ObserveOpcode(dir, elements[0])
+		}
+		data = data[n:]
+	}
+}
@@ -0,0 +1,119 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeMessageReader returns its messages in order, then io.EOF
+type fakeMessageReader struct {
+	messages [][]byte
+}
+
+func (f *fakeMessageReader) ReadMessage() (int, []byte, error) {
+	if len(f.messages) == 0 {
+		return 0, nil, io.EOF
+	}
+	msg := f.messages[0]
+	f.messages = f.messages[1:]
+	return 1, msg, nil
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{10, 100})
+	for _, v := range []int{1, 10, 11, 100, 1000} {
+		h.Observe(v)
+	}
+
+	snapshot := h.Snapshot()
+	expected := []int64{2, 2, 1}
+	for i := range expected {
+		if snapshot.Counts[i] != expected[i] {
+			t.Error("Bucket", i, "expected", expected[i], "got", snapshot.Counts[i])
+		}
+	}
+	if snapshot.Count != 5 || snapshot.Sum != 1122 {
+		t.Error("Unexpected count and sum", snapshot.Count, snapshot.Sum)
+	}
+}
+
+func TestPumps_InstructionSizeMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	opts := pumpOptions{metrics: metrics}
+
+	// 15 bytes, 13 bytes, and an internal instruction which isn't sent
+	ws := &fakeMessageReader{messages: [][]byte{
+		[]byte("3.key,2.65,1.1;4.sync,3.100;"),
+		[]byte("0.,4.ping,3.100;"),
+	}}
+	var guacd bytes.Buffer
+	wsToGuacd(context.Background(), nopLogger(), ws, &guacd, opts)
+
+	inbound := metrics.InboundSizes.Snapshot()
+	if inbound.Count != 2 || inbound.Sum != 28 || inbound.Counts[0] != 2 {
+		t.Error("Unexpected inbound sizes", inbound)
+	}
+
+	// a 3 byte blob is 17 bytes, and a 5000 byte one 5017
+	big := make([]byte, 5000)
+	for i := range big {
+		big[i] = 'A'
+	}
+	stream := NewStream(&fakeConn{ToRead: []byte("4.blob,1.1,3.AAA;4.blob,1.1,5000." + string(big) + ";")}, time.Minute)
+	guacdToWs(context.Background(), nopLogger(), &fakeMessageWriter{}, stream, opts)
+
+	outbound := metrics.OutboundSizes.Snapshot()
+	if outbound.Count != 2 || outbound.Sum != 17+5017 {
+		t.Error("Unexpected outbound sizes", outbound)
+	}
+	if outbound.Counts[1] != 1 || outbound.Counts[5] != 1 {
+		t.Error("Unexpected outbound buckets", outbound.Counts)
+	}
+}
+
+// trafficMetrics records what a TrafficCollector is given
+type trafficMetrics struct {
+	*Metrics
+	bytes   map[Direction]int
+	opcodes map[Direction][]string
+}
+
+func (m *trafficMetrics) ObserveBytes(dir Direction, n int) {
+	m.bytes[dir] += n
+}
+
+func (m *trafficMetrics) ObserveOpcode(dir Direction, opcode string) {
+	m.opcodes[dir] = append(m.opcodes[dir], opcode)
+}
+
+func TestPumps_TrafficMetrics(t *testing.T) {
+	metrics := &trafficMetrics{Metrics: NewMetrics(), bytes: map[Direction]int{}, opcodes: map[Direction][]string{}}
+	opts := pumpOptions{metrics: metrics, traffic: metrics}
+
+	ws := &fakeMessageReader{messages: [][]byte{
+		[]byte("3.key,2.65,1.1;4.sync,3.100;"),
+		[]byte("0.,4.ping,3.100;"),
+	}}
+	var guacd bytes.Buffer
+	wsToGuacd(context.Background(), nopLogger(), ws, &guacd, opts)
+
+	stream := NewStream(&fakeConn{ToRead: []byte("4.blob,1.1,3.AAA;4.sync,3.100;")}, time.Minute)
+	client := &fakeMessageWriter{}
+	guacdToWs(context.Background(), nopLogger(), client, stream, opts)
+
+	if metrics.bytes[Inbound] != guacd.Len() || metrics.bytes[Inbound] != 28 {
+		t.Error("Expected the bytes written to guacd, got", metrics.bytes[Inbound])
+	}
+	if metrics.bytes[Outbound] != 30 {
+		t.Error("Expected the bytes sent to the client, got", metrics.bytes[Outbound])
+	}
+	if opcodes := metrics.opcodes[Inbound]; len(opcodes) != 2 || opcodes[0] != "key" || opcodes[1] != "sync" {
+		t.Error("Unexpected inbound opcodes", opcodes)
+	}
+	if opcodes := metrics.opcodes[Outbound]; len(opcodes) != 2 || opcodes[0] != "blob" || opcodes[1] != "sync" {
+		t.Error("Unexpected outbound opcodes", opcodes)
+	}
+}
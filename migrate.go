@@ -0,0 +1,147 @@
+package guac
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultMigrateBackoff is how long Migrate waits after a failed attempt unless the Stream's
+	// MigrateBackoff is set
+	DefaultMigrateBackoff = 500 * time.Millisecond
+	// maxMigrateBackoff bounds the wait as failures double it
+	maxMigrateBackoff = 30 * time.Second
+)
+
+// Migrate moves the connection to the guacd at address, reached with dialer or directly over
+// TCP if it is nil, for taking a guacd out of service without ending the sessions on it. guacd
+// has no way to hand over the state of a session, so Migrate always falls back to reconnecting:
+// it repeats the original handshake against the new guacd and, once that guacd is ready,
+// switches reads and writes over to it and closes the old connection. If the new guacd can't be
+// reached or refuses the handshake, the connection stays on the old one and the error is
+// returned.
+//
+// The client stays connected throughout, but what it sees depends on the protocol:
+//
+//   - rdp and vnc redraw the display from scratch. The remote desktop itself usually survives,
+//     as RDP servers reattach a user to their disconnected session and VNC servers are unaware
+//     of the viewer changing.
+//   - ssh, telnet and kubernetes start a new shell or attach, so terminal contents and anything
+//     running in the old shell are lost unless the remote runs it under screen or tmux.
+//   - File and clipboard transfers in progress are abandoned, and anything drawn after the switch
+//     is requested but before the reader moves over is dropped.
+//
+// The connection ID changes, so viewers that joined through the old guacd are disconnected, and
+// connections that were themselves joins, see Config.ConnectionID, can't be migrated. The
+// handshake uses the screen size of the original one, and a client that has since resized is
+// resized back until it next sends its size.
+//
+// Calls on the same connection are queued and run one at a time, and after one fails the next
+// waits for MigrateBackoff, so a burst of them, such as from errors on a flapping connection,
+// doesn't storm a guacd that is recovering. A call that gives up waiting, because ctx is done,
+// returns ErrUpstreamTimeout.
+func (s *Stream) Migrate(ctx context.Context, dialer *GuacdDialer, address string) (err error) {
+	if s.config == nil {
+		return ErrUnsupported.NewError("Only connections established with a handshake can be migrated.")
+	}
+	if s.config.ConnectionID != "" {
+		return ErrUnsupported.NewError("Joined connections can't be migrated.", s.config.ConnectionID)
+	}
+	if err = s.acquireMigration(ctx); err != nil {
+		return err
+	}
+	defer func() { s.releaseMigration(err == nil) }()
+
+	if dialer == nil {
+		dialer = &GuacdDialer{}
+	}
+	next, err := dialer.Dial(ctx, address)
+	if err != nil {
+		return err
+	}
+	next.timeout = s.timeout
+	next.ReadyTimeout = s.ReadyTimeout
+	if err = next.HandshakeContext(ctx, s.config); err != nil {
+		_ = next.Close()
+		return err
+	}
+
+	s.connLock.Lock()
+	if s.closed {
+		s.connLock.Unlock()
+		_ = next.Close()
+		return ErrResourceClosed.NewError("Connection closed during migration.")
+	}
+	if s.previous != nil {
+		// migrated again before the reader moved off the last connection
+		_ = s.conn.Close()
+	} else {
+		s.previous = s.conn
+	}
+	s.conn = next.conn
+	s.carried = append([]rune(nil), next.buffer...)
+	s.carriedPartial = next.partial
+	previousID := s.ConnectionID
+	s.ConnectionID = next.ConnectionID
+	// wake a reader blocked on the old connection
+	_ = s.previous.SetReadDeadline(time.Now())
+	s.connLock.Unlock()
+
+	globalLogger.Info().Str("connection_id", previousID).Str("new_connection_id", next.ConnectionID).
+		Str("address", address).Msg("migrated connection to another guacd")
+	s.streams.clear()
+	return nil
+}
+
+// acquireMigration waits for the migration in progress to finish and then for the backoff after a
+// failure, or until ctx is done
+func (s *Stream) acquireMigration(ctx context.Context) error {
+	select {
+	case s.migrating <- struct{}{}:
+	case <-ctx.Done():
+		return ErrUpstreamTimeout.NewError("Gave up waiting for an earlier migration.", ctx.Err().Error())
+	}
+	wait := time.Until(s.nextMigrate)
+	if wait <= 0 {
+		return nil
+	}
+	globalLogger.Debug().Str("connection_id", s.connectionID()).Dur("wait", wait).Int("failures", s.migrateFailures).
+		Msg("backing off before migrating again")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		<-s.migrating
+		return ErrUpstreamTimeout.NewError("Gave up waiting to migrate after a failed attempt.", ctx.Err().Error())
+	}
+}
+
+// releaseMigration lets the next migration start, after a backoff if this one failed
+func (s *Stream) releaseMigration(ok bool) {
+	defer func() { <-s.migrating }()
+	if ok {
+		s.migrateFailures = 0
+		s.nextMigrate = time.Time{}
+		return
+	}
+	backoff := s.MigrateBackoff
+	if backoff == 0 {
+		backoff = DefaultMigrateBackoff
+	}
+	if backoff < 0 {
+		return
+	}
+	for i := 0; i < s.migrateFailures && backoff < maxMigrateBackoff; i++ {
+		backoff *= 2
+	}
+	s.migrateFailures++
+	s.nextMigrate = time.Now().Add(min(backoff, maxMigrateBackoff))
+}
+
+// Migrate moves the tunnel to the guacd at address, see Stream.Migrate. Like CancelStream it
+// doesn't need the reader or writer lock, so it can be used while a websocket is connected.
+func (t *SimpleTunnel) Migrate(ctx context.Context, dialer *GuacdDialer, address string) error {
+	return t.stream.Migrate(ctx, dialer, address)
+}
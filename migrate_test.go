@@ -0,0 +1,281 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// migrationBackend accepts one connection, completes the handshake as id and then sends after.
+// It returns the address, the instructions it received and a channel closed when the
+// connection is closed.
+func migrationBackend(t *testing.T, id string, after string) (string, <-chan *Instruction, <-chan struct{}) {
+	return migrationBackendNetwork(t, "tcp", "127.0.0.1:0", id, after)
+}
+
+// migrationBackendNetwork is migrationBackend listening on the given network
+func migrationBackendNetwork(t *testing.T, network, address, id string, after string) (string, <-chan *Instruction, <-chan struct{}) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	received := make(chan *Instruction, 16)
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer close(closed)
+		guacd := NewStream(conn, time.Minute)
+		for {
+			ins, err := ReadOne(guacd)
+			if err != nil {
+				return
+			}
+			received <- ins
+			switch ins.Opcode {
+			case "select":
+				_, _ = guacd.Write(NewInstruction("args", "hostname").Bytes())
+			case "connect":
+				_, _ = guacd.Write([]byte(NewInstruction("ready", id).String() + after))
+			}
+		}
+	}()
+	return listener.Addr().String(), received, closed
+}
+
+func TestSimpleTunnel_Migrate(t *testing.T) {
+	// the old guacd goes quiet, so the reader is blocked on it when the migration happens
+	oldAddr, _, oldClosed := migrationBackend(t, "$old", "")
+	newAddr, newReceived, _ := migrationBackend(t, "$new", "4.name,3.new;")
+
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "vnc"
+	config.Parameters["hostname"] = "10.0.0.1"
+	stream, err := ConnectGuacd(context.Background(), oldAddr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewSimpleTunnel(stream)
+	defer func() { _ = tunnel.Close() }()
+
+	read := make(chan []byte, 1)
+	go func() {
+		ins, err := tunnel.AcquireReader().ReadSome()
+		if err != nil {
+			t.Error(err)
+		}
+		read <- ins
+	}()
+
+	if err = tunnel.Migrate(context.Background(), nil, newAddr); err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.ConnectionID() != "$new" {
+		t.Error("Expected the connection ID of the new guacd, got", tunnel.ConnectionID())
+	}
+
+	select {
+	case ins := <-read:
+		if string(ins) != "4.name,3.new;" {
+			t.Error("Expected to read from the new guacd, got", string(ins))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reader did not move to the new guacd")
+	}
+	select {
+	case <-oldClosed:
+	case <-time.After(time.Second):
+		t.Error("Expected the old guacd connection to be closed")
+	}
+
+	var connect *Instruction
+	for connect == nil {
+		if ins := <-newReceived; ins.Opcode == "connect" {
+			connect = ins
+		}
+	}
+	if connect.String() != "7.connect,8.10.0.0.1;" {
+		t.Error("Expected the handshake to be repeated, got", connect.String())
+	}
+	if _, err = tunnel.AcquireWriter().Write(NewInstruction("key", "65", "1").Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+	if ins := <-newReceived; ins.String() != "3.key,2.65,1.1;" {
+		t.Error("Expected writes to go to the new guacd, got", ins.String())
+	}
+}
+
+func TestSimpleTunnel_MigrateDialer(t *testing.T) {
+	oldAddr, _, _ := migrationBackend(t, "$old", "")
+	newPath, _, _ := migrationBackendNetwork(t, "unix", filepath.Join(t.TempDir(), "guacd.sock"), "$new", "")
+
+	stream, err := ConnectGuacd(context.Background(), oldAddr, NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewSimpleTunnel(stream)
+	defer func() { _ = tunnel.Close() }()
+
+	// the ID is read while the migration changes it, as the websocket server's logging does
+	stop := make(chan struct{})
+	reading := make(chan struct{})
+	go func() {
+		defer close(reading)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = tunnel.ConnectionID()
+			}
+		}
+	}()
+
+	err = tunnel.Migrate(context.Background(), &GuacdDialer{Network: "unix"}, newPath)
+	close(stop)
+	<-reading
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.ConnectionID() != "$new" {
+		t.Error("Expected the connection ID of the new guacd, got", tunnel.ConnectionID())
+	}
+}
+
+func TestSimpleTunnel_MigrateUnavailable(t *testing.T) {
+	oldAddr, oldReceived, _ := migrationBackend(t, "$old", "")
+	stream, err := ConnectGuacd(context.Background(), oldAddr, NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewSimpleTunnel(stream)
+	defer func() { _ = tunnel.Close() }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := listener.Addr().String()
+	_ = listener.Close()
+
+	err = tunnel.Migrate(context.Background(), nil, unreachable)
+	if err == nil || err.(*ErrGuac).Kind != ErrUpstreamUnavailable {
+		t.Fatal("Expected upstream unavailable, got", err)
+	}
+	if tunnel.ConnectionID() != "$old" {
+		t.Error("Expected the connection to stay on the old guacd, got", tunnel.ConnectionID())
+	}
+	for ins := range oldReceived {
+		if ins.Opcode == "connect" {
+			break
+		}
+	}
+	if _, err = tunnel.AcquireWriter().Write(NewInstruction("nop").Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+	if ins := <-oldReceived; ins.Opcode != "nop" {
+		t.Error("Expected writes to still go to the old guacd, got", ins.String())
+	}
+}
+
+func TestStream_MigrateJoin(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+	go func() { _, _ = serveHandshake(guacd, "$abc", "hostname") }()
+
+	config := NewGuacamoleConfiguration()
+	config.ConnectionID = "$abc"
+	stream := NewStream(client, time.Minute)
+	if err := stream.Handshake(config); err != nil {
+		t.Fatal(err)
+	}
+	err := stream.Migrate(context.Background(), nil, "127.0.0.1:1")
+	if err == nil || err.(*ErrGuac).Kind != ErrUnsupported {
+		t.Error("Expected a join to be refused, got", err)
+	}
+}
+
+func TestStream_MigrateBackoff(t *testing.T) {
+	oldAddr, _, _ := migrationBackend(t, "$old", "")
+	stream, err := ConnectGuacd(context.Background(), oldAddr, NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.Close() }()
+	stream.MigrateBackoff = 20 * time.Millisecond
+
+	// a guacd that is recovering: it accepts connections and drops them before the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	var lock sync.Mutex
+	var attempts []time.Time
+	open, maxOpen := 0, 0
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			attempts = append(attempts, time.Now())
+			open++
+			maxOpen = max(maxOpen, open)
+			lock.Unlock()
+			go func() {
+				// held long enough for an overlapping attempt to be seen
+				time.Sleep(10 * time.Millisecond)
+				lock.Lock()
+				open--
+				lock.Unlock()
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	// a burst of errors on the session each asks for a reconnect
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := stream.Migrate(context.Background(), nil, listener.Addr().String()); err == nil {
+				t.Error("Expected the migration to fail")
+			}
+		}()
+	}
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(attempts) != 4 || maxOpen != 1 {
+		t.Fatalf("Expected 4 attempts one at a time, got %v with %v at once", len(attempts), maxOpen)
+	}
+	// each failure doubles the wait before the next
+	for i := 1; i < len(attempts); i++ {
+		if gap, backoff := attempts[i].Sub(attempts[i-1]), stream.MigrateBackoff<<(i-1); gap < backoff {
+			t.Errorf("Expected attempt %v to wait %v, it came after %v", i, backoff, gap)
+		}
+	}
+	if stream.ConnectionID != "$old" {
+		t.Error("Expected the connection to stay on the old guacd, got", stream.ConnectionID)
+	}
+
+	// a caller that can't wait out the backoff gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err = stream.Migrate(ctx, nil, listener.Addr().String()); err == nil || err.(*ErrGuac).Kind != ErrUpstreamTimeout {
+		t.Error("Expected to give up waiting, got", err)
+	}
+}
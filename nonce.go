@@ -0,0 +1,107 @@
+package guac
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// NonceStore remembers the nonces of connect requests that have been used, so a captured connect
+// URL can't be replayed. The nonce is the "jti" of the request's signed token, see
+// TokenClaims.ID. It is shared by every server that accepts the URLs, so with several servers
+// it must be backed by shared storage. With Redis, for example, Consume is
+// "SET nonce:<nonce> 1 NX PX <ttl>", which is fresh when the key was set.
+type NonceStore interface {
+	// Consume marks the nonce used, returning false if it already was
+	Consume(ctx context.Context, nonce string) (bool, error)
+}
+
+// DefaultNonceTTL is how long MemoryNonceStore remembers a nonce unless its TTL is set
+const DefaultNonceTTL = 10 * time.Minute
+
+// MemoryNonceStore is a NonceStore for a single server. Nonces are forgotten after the TTL, so
+// connect URLs must expire sooner, for example by carrying a token, see TokenConnect.
+type MemoryNonceStore struct {
+	// TTL is how long a nonce is remembered, DefaultNonceTTL if zero
+	TTL time.Duration
+
+	lock    sync.Mutex
+	used    map[string]time.Time
+	expires nonceHeap
+}
+
+// NewMemoryNonceStore creates an in-memory store remembering nonces for ttl
+func NewMemoryNonceStore(ttl time.Duration) *MemoryNonceStore {
+	return &MemoryNonceStore{TTL: ttl}
+}
+
+// Consume implements NonceStore
+func (s *MemoryNonceStore) Consume(ctx context.Context, nonce string) (bool, error) {
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultNonceTTL
+	}
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.used == nil {
+		s.used = map[string]time.Time{}
+	}
+	// the heap is ordered by expiry, so only the nonces that expired are visited
+	for len(s.expires) > 0 && now.After(s.expires[0].expires) {
+		delete(s.used, heap.Pop(&s.expires).(usedNonce).nonce)
+	}
+	if _, ok := s.used[nonce]; ok {
+		return false, nil
+	}
+	s.used[nonce] = now.Add(ttl)
+	heap.Push(&s.expires, usedNonce{nonce: nonce, expires: now.Add(ttl)})
+	return true, nil
+}
+
+// usedNonce is a nonce and when MemoryNonceStore forgets it
+type usedNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+// nonceHeap is a heap.Interface of used nonces, soonest to expire first
+type nonceHeap []usedNonce
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(usedNonce)) }
+
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// consumeNonce checks the jti of the token in ctx against the policy's Nonces, if it has any
+func (p *Policy) consumeNonce(ctx context.Context) error {
+	if p.Nonces == nil {
+		return nil
+	}
+	var nonce string
+	if claims, ok := TokenClaimsFromContext(ctx); ok {
+		nonce = claims.ID
+	}
+	if nonce == "" {
+		return ErrClient.NewError("No nonce provided.", "the token has no jti")
+	}
+	fresh, err := p.Nonces.Consume(ctx, nonce)
+	if err != nil {
+		return ErrServer.NewError("Unable to check nonce.", err.Error())
+	}
+	if !fresh {
+		globalLogger.Warn().Str("nonce", nonce).Msg("connect request replayed")
+		return ErrSecurity.NewError("Connect request was already used.")
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := NewMemoryNonceStore(50 * time.Millisecond)
+	ctx := context.Background()
+
+	if fresh, err := store.Consume(ctx, "abc"); err != nil || !fresh {
+		t.Error("Expected a new nonce to be fresh, got", fresh, err)
+	}
+	if fresh, _ := store.Consume(ctx, "abc"); fresh {
+		t.Error("Expected a used nonce to be refused")
+	}
+	if fresh, _ := store.Consume(ctx, "def"); !fresh {
+		t.Error("Expected another nonce to be fresh")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if fresh, _ := store.Consume(ctx, "abc"); !fresh {
+		t.Error("Expected the nonce to be forgotten after the TTL")
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if len(store.used) != 1 {
+		t.Error("Expected expired nonces to be pruned, got", store.used)
+	}
+}
+
+type failingNonceStore struct{}
+
+func (failingNonceStore) Consume(ctx context.Context, nonce string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+// tokenRequest is a connect request whose context carries a token with the jti
+func tokenRequest(query, jti string) *http.Request {
+	r := prepareRequest(query)
+	return r.WithContext(ContextWithTokenClaims(r.Context(), &TokenClaims{ID: jti}))
+}
+
+func TestPrepareConfig_Nonce(t *testing.T) {
+	policy := testPolicy
+	policy.Nonces = NewMemoryNonceStore(time.Minute)
+
+	if _, err := PrepareConfig(tokenRequest("scheme=rdp&hostname=10.0.0.1", "n1"), policy); err != nil {
+		t.Fatal("Expected a fresh nonce to be accepted, got", err)
+	}
+	joins := policy
+	joins.JoinAuthorizer = joinPolicy(false, nil).JoinAuthorizer
+	if _, err := PrepareConfig(tokenRequest("uuid=$abc", "n2"), joins); err != nil {
+		t.Fatal("Expected a join with a fresh nonce to be accepted, got", err)
+	}
+
+	for name, test := range map[string]struct {
+		request *http.Request
+		policy  Policy
+		status  Status
+	}{
+		"Replayed":   {tokenRequest("scheme=rdp&hostname=10.0.0.1", "n1"), policy, ClientForbidden},
+		"NoJTI":      {tokenRequest("scheme=rdp&hostname=10.0.0.1", ""), policy, ClientBadRequest},
+		"NoToken":    {prepareRequest("scheme=rdp&hostname=10.0.0.1"), policy, ClientBadRequest},
+		"StoreError": {tokenRequest("scheme=rdp&hostname=10.0.0.1", "n3"), Policy{Schema: testPolicy.Schema, Nonces: failingNonceStore{}}, ServerError},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := PrepareConfig(test.request, test.policy)
+			var guacErr *ErrGuac
+			if !errors.As(err, &guacErr) || guacErr.Status != test.status {
+				t.Fatal("Expected", test.status, "got", err)
+			}
+		})
+	}
+}
+
+func TestPrepareConfig_NonceKeptWhenRefused(t *testing.T) {
+	policy := testPolicy
+	policy.Nonces = NewMemoryNonceStore(time.Minute)
+
+	if _, err := PrepareConfig(tokenRequest("scheme=rdp&hostname=169.254.169.254", "n1"), policy); err == nil {
+		t.Fatal("Expected a forbidden host to be refused")
+	}
+	if _, err := PrepareConfig(tokenRequest("scheme=rdp&hostname=10.0.0.1", "n1"), policy); err != nil {
+		t.Fatal("Expected the nonce of a refused request to still be fresh, got", err)
+	}
+}
@@ -0,0 +1,49 @@
+package guac
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AllowOrigins returns a WebsocketServer.CheckOrigin that accepts websockets opened from pages
+// on the given origins, such as "https://app.example.com". Origins are compared without regard
+// to case and a port must be given if it isn't the default for the scheme. Requests without an
+// Origin header don't come from a browser, so they are accepted.
+func AllowOrigins(origins ...string) func(*http.Request) bool {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || allowed[strings.ToLower(origin)]
+	}
+}
+
+// sameOrigin accepts requests from pages served by the host the websocket is opened on, and
+// requests without an Origin header
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// allowOrigin checks the Origin of an upgrade request, logging the ones that are refused
+func (s *WebsocketServer) allowOrigin(r *http.Request) bool {
+	check := s.CheckOrigin
+	if check == nil {
+		check = sameOrigin
+	}
+	if check(r) {
+		return true
+	}
+	s.logger.Warn().Str("origin", r.Header.Get("Origin")).Str("remote_addr", r.RemoteAddr).Msg("websocket origin not allowed, rejecting connection")
+	return false
+}
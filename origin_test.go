@@ -0,0 +1,76 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAllowOrigins(t *testing.T) {
+	check := AllowOrigins("https://app.example.com", "http://localhost:3000/")
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"https://app.example.com", true},
+		{"HTTPS://App.Example.com", true},
+		{"http://localhost:3000", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://evil.example.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if ok := check(r); ok != tt.ok {
+			t.Errorf("Origin %q: expected %v, got %v", tt.origin, tt.ok, ok)
+		}
+	}
+}
+
+func TestWebsocketServer_CheckOrigin(t *testing.T) {
+	tests := []struct {
+		name        string
+		checkOrigin func(*http.Request) bool
+		origin      func(url string) string
+		ok          bool
+	}{
+		{"same origin by default", nil, func(url string) string { return "http" + url[2:] }, true},
+		{"no origin by default", nil, func(string) string { return "" }, true},
+		{"cross origin by default", nil, func(string) string { return "https://evil.example.com" }, false},
+		{"allowed origin", AllowOrigins("https://app.example.com"), func(string) string { return "https://app.example.com" }, true},
+		{"other origin", AllowOrigins("https://app.example.com"), func(url string) string { return "http" + url[2:] }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel, guacd := newFakeGuacd(t)
+			wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+				return tunnel, nil
+			}, nopLogger())
+			wsServer.CheckOrigin = tt.checkOrigin
+			url, done := serveWebsocket(t, wsServer)
+
+			header := http.Header{}
+			if origin := tt.origin(url); origin != "" {
+				header.Set("Origin", origin)
+			}
+			ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = ws.Close()
+				_ = guacd.Close()
+			} else if err == nil || resp.StatusCode != http.StatusForbidden {
+				t.Fatal("Expected 403, got", err)
+			}
+			waitDone(t, done)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package guac
+
+import "sort"
+
+// ParameterSchema lists, for each protocol, the parameters a connection is allowed to set. It
+// stops clients from injecting parameters that change how guacd connects, such as a recording
+// path or a proxy.
+type ParameterSchema map[string][]string
+
+// Validate returns an error if the protocol isn't in the schema or a parameter isn't allowed for it
+func (s ParameterSchema) Validate(protocol string, parameters map[string]string) error {
+	allowed, ok := s[protocol]
+	if !ok {
+		return ErrSecurity.NewError("Protocol not allowed.", protocol)
+	}
+
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !containsString(allowed, name) {
+			return ErrSecurity.NewError("Parameter not allowed.", protocol, name)
+		}
+	}
+	return nil
+}
+
+// validateSchema checks the config's Parameters against its ParameterSchema, if it has one. A
+// join connects to a session whose protocol guacd already knows, so it is checked against the
+// entry for the empty protocol whatever its Protocol is. The handshake and ValidatePolicy both
+// check this way, so a config they accept is the same.
+func (c *Config) validateSchema() error {
+	if c.ParameterSchema == nil {
+		return nil
+	}
+	protocol := c.Protocol
+	if c.ConnectionID != "" {
+		protocol = ""
+	}
+	return c.ParameterSchema.Validate(protocol, c.Parameters)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package guac
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var testSchema = ParameterSchema{
+	"ssh": {"hostname", "port", "username", "font-size"},
+}
+
+func TestParameterSchema_Validate(t *testing.T) {
+	if err := testSchema.Validate("ssh", map[string]string{"hostname": "10.0.0.1", "font-size": "12"}); err != nil {
+		t.Error("Expected allowed parameters to pass, got", err)
+	}
+	if err := testSchema.Validate("ssh", nil); err != nil {
+		t.Error("Expected no parameters to pass, got", err)
+	}
+
+	err := testSchema.Validate("ssh", map[string]string{"hostname": "10.0.0.1", "recording-path": "/etc"})
+	if err == nil || err.(*ErrGuac).Status != ClientForbidden {
+		t.Error("Expected forbidden parameter, got", err)
+	}
+	if err = testSchema.Validate("rdp", map[string]string{"hostname": "10.0.0.1"}); err == nil {
+		t.Error("Expected protocol missing from the schema to be rejected")
+	}
+}
+
+func TestStream_Handshake_ParameterSchema(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "ssh"
+	config.ParameterSchema = testSchema
+	config.Parameters["recording-path"] = "/etc"
+
+	// nothing is written to guacd, which would block on the pipe
+	err := NewStream(client, time.Minute).Handshake(config)
+	if err == nil || err.(*ErrGuac).Kind != ErrSecurity {
+		t.Error("Expected security error, got", err)
+	}
+}
+
+func TestConfig_JoinSchema(t *testing.T) {
+	tests := map[string]struct {
+		schema  ParameterSchema
+		allowed bool
+	}{
+		"join entry":          {ParameterSchema{"": {"hostname"}}, true},
+		"only protocol entry": {ParameterSchema{"ssh": {"hostname"}}, false},
+		"join entry without":  {ParameterSchema{"": {}, "ssh": {"hostname"}}, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			// a join that also names a protocol is checked as a join both times
+			config := NewGuacamoleConfiguration()
+			config.Protocol = "ssh"
+			config.ConnectionID = "$abc"
+			config.Parameters["hostname"] = "h"
+			config.ParameterSchema = tt.schema
+
+			err := config.Validate()
+			if validated := err == nil; validated != tt.allowed {
+				t.Error("Unexpected validation result", err)
+			}
+
+			// a handshake the schema allows goes on to fail writing to the closed guacd
+			client, guacd := net.Pipe()
+			_ = guacd.Close()
+			err = NewStream(client, time.Minute).Handshake(config)
+			var guacErr *ErrGuac
+			if refused := errors.As(err, &guacErr) && guacErr.Kind == ErrSecurity; refused == tt.allowed {
+				t.Error("Unexpected handshake result", err)
+			}
+		})
+	}
+}
+
+func TestWebsocketServer_ConnectFailureMetric(t *testing.T) {
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "ssh"
+	config.ParameterSchema = testSchema
+	config.Parameters["recording-path"] = "/etc"
+
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		client, guacd := net.Pipe()
+		defer func() { _ = guacd.Close() }()
+		stream := NewStream(client, time.Minute)
+		if err := stream.HandshakeContext(r.Context(), config); err != nil {
+			return nil, err
+		}
+		return NewSimpleTunnel(stream), nil
+	}, nopLogger())
+	metrics := NewMetrics()
+	wsServer.Metrics = metrics
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	waitDone(t, done)
+
+	if n := metrics.ConnectFailures()[ClientForbidden]; n != 1 {
+		t.Error("Expected 1 forbidden connection, got", n)
+	}
+}
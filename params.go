@@ -0,0 +1,82 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ParamDecoder reads the connection parameters of a connect request, so applications can accept
+// JSON bodies, custom encodings or signed payloads
+type ParamDecoder func(*http.Request) (url.Values, error)
+
+// maxParamBodyBytes limits how much of a request body is read for parameters
+const maxParamBodyBytes = 1 << 20
+
+// DefaultParamDecoder reads parameters the way the Guacamole tunnels send them: the HTTP tunnel
+// sends a form encoded body with its "connect" request, and the websocket tunnel uses the query.
+func DefaultParamDecoder(r *http.Request) (url.Values, error) {
+	if r.URL.RawQuery != "connect" {
+		return r.URL.Query(), nil
+	}
+	data, err := readParamBody(r)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, ErrClient.NewError("Malformed connect parameters.", err.Error())
+	}
+	return values, nil
+}
+
+// JSONParamDecoder reads parameters from a JSON object in the request body. Strings, numbers and
+// booleans become single values and arrays of them become repeated values.
+func JSONParamDecoder(r *http.Request) (url.Values, error) {
+	data, err := readParamBody(r)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&body); err != nil {
+		return nil, ErrClient.NewError("Malformed connect parameters.", err.Error())
+	}
+
+	values := url.Values{}
+	for name, value := range body {
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			switch v := item.(type) {
+			case string:
+				values.Add(name, v)
+			case json.Number:
+				values.Add(name, v.String())
+			case bool:
+				values.Add(name, strconv.FormatBool(v))
+			default:
+				return nil, ErrClient.NewError("Unsupported value for connect parameter.", name)
+			}
+		}
+	}
+	return values, nil
+}
+
+func readParamBody(r *http.Request) ([]byte, error) {
+	defer func() { _ = r.Body.Close() }()
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxParamBodyBytes+1))
+	if err != nil {
+		return nil, ErrClient.NewError("Unable to read connect parameters.", err.Error())
+	}
+	if len(data) > maxParamBodyBytes {
+		return nil, ErrClientOverrun.NewError("Connect parameters too large.")
+	}
+	return bytes.TrimSpace(data), nil
+}
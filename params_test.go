@@ -0,0 +1,58 @@
+package guac
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDefaultParamDecoder(t *testing.T) {
+	// the HTTP tunnel sends a form body
+	r := httptest.NewRequest("POST", "/tunnel?connect", strings.NewReader("scheme=ssh&hostname=10.0.0.1&width=1024\n"))
+	values, err := DefaultParamDecoder(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("scheme") != "ssh" || values.Get("hostname") != "10.0.0.1" || values.Get("width") != "1024" {
+		t.Error("Unexpected parameters", values)
+	}
+
+	// the websocket tunnel uses the query
+	r = httptest.NewRequest("GET", "/websocket-tunnel?scheme=rdp&hostname=10.0.0.2", nil)
+	if values, err = DefaultParamDecoder(r); err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("scheme") != "rdp" || values.Get("hostname") != "10.0.0.2" {
+		t.Error("Unexpected parameters", values)
+	}
+
+	r = httptest.NewRequest("POST", "/tunnel?connect", strings.NewReader("scheme=%zz"))
+	if _, err = DefaultParamDecoder(r); err == nil || err.(*ErrGuac).Kind != ErrClient {
+		t.Error("Expected malformed body error, got", err)
+	}
+}
+
+func TestJSONParamDecoder(t *testing.T) {
+	body := `{"scheme": "rdp", "port": 3389, "ignore-cert": true, "image": ["image/png", "image/webp"]}`
+	values, err := JSONParamDecoder(httptest.NewRequest("POST", "/tunnel?connect", strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("scheme") != "rdp" || values.Get("port") != "3389" || values.Get("ignore-cert") != "true" {
+		t.Error("Unexpected parameters", values)
+	}
+	if images := values["image"]; len(images) != 2 || images[1] != "image/webp" {
+		t.Error("Expected repeated values, got", images)
+	}
+
+	for _, body := range []string{`not json`, `{"nested": {"a": "b"}}`, `["a"]`} {
+		if _, err = JSONParamDecoder(httptest.NewRequest("POST", "/tunnel?connect", strings.NewReader(body))); err == nil {
+			t.Error("Expected an error for", body)
+		}
+	}
+
+	big := `{"a": "` + strings.Repeat("x", maxParamBodyBytes) + `"}`
+	if _, err = JSONParamDecoder(httptest.NewRequest("POST", "/tunnel?connect", strings.NewReader(big))); err == nil || err.(*ErrGuac).Kind != ErrClientOverrun {
+		t.Error("Expected overrun error, got", err)
+	}
+}
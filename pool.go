@@ -0,0 +1,187 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// PoolMaxIdleTime is how long a warm connection is kept before it is replaced. guacd closes
+// connections that don't select a protocol within 15 seconds, so it must be shorter than that.
+const PoolMaxIdleTime = 10 * time.Second
+
+// GuacdPool keeps connections to guacd dialed ahead of time so connecting a session doesn't wait
+// for a dial. The connections haven't started a handshake, so any Config can be used with them.
+type GuacdPool struct {
+	sync.Mutex
+	ticker  *time.Ticker
+	done    chan struct{}
+	refill  chan struct{}
+	dial    func(context.Context) (net.Conn, error)
+	minIdle int
+
+	idle []pooledConn
+}
+
+type pooledConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// NewGuacdPool creates a pool keeping at least minIdle connections to guacd at the given
+// address. It warms the pool straight away, then tops it up as connections are taken and checks
+// the idle ones every interval, replacing any guacd closed or that are too old to use.
+func NewGuacdPool(network, address string, minIdle int, interval time.Duration) *GuacdPool {
+	var dialer net.Dialer
+	return newGuacdPool(func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}, minIdle, interval)
+}
+
+func newGuacdPool(dial func(context.Context) (net.Conn, error), minIdle int, interval time.Duration) *GuacdPool {
+	if interval <= 0 {
+		interval = HealthCheckInterval
+	}
+	pool := &GuacdPool{
+		ticker:  time.NewTicker(interval),
+		done:    make(chan struct{}),
+		refill:  make(chan struct{}, 1),
+		dial:    dial,
+		minIdle: minIdle,
+	}
+	go pool.maintainTask()
+	return pool
+}
+
+func (p *GuacdPool) maintainTask() {
+	for {
+		p.prune()
+		p.fill()
+		select {
+		case <-p.ticker.C:
+		case <-p.refill:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Get returns a stream on a warm connection, or dials one if the pool is empty
+func (p *GuacdPool) Get(ctx context.Context) (*Stream, error) {
+	conn := p.take()
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+	if conn != nil {
+		return NewStream(conn, SocketTimeout), nil
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, handshakeAborted(ctx)
+		}
+		return nil, ErrUpstreamUnavailable.NewError("Unable to connect to guacd.", err.Error())
+	}
+	return NewStream(conn, SocketTimeout), nil
+}
+
+// take removes the newest idle connection that is still young enough to use
+func (p *GuacdPool) take() net.Conn {
+	p.Lock()
+	defer p.Unlock()
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(pc.created) < PoolMaxIdleTime {
+			return pc.conn
+		}
+		_ = pc.conn.Close()
+	}
+	return nil
+}
+
+// Idle returns the number of warm connections in the pool
+func (p *GuacdPool) Idle() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.idle)
+}
+
+// prune closes idle connections which guacd closed or which are too old
+func (p *GuacdPool) prune() {
+	p.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.Unlock()
+
+	var alive []pooledConn
+	for _, pc := range idle {
+		if time.Since(pc.created) < PoolMaxIdleTime && connAlive(pc.conn) {
+			alive = append(alive, pc)
+		} else {
+			_ = pc.conn.Close()
+		}
+	}
+
+	p.Lock()
+	p.idle = append(alive, p.idle...)
+	p.Unlock()
+}
+
+// fill dials connections until the pool has minIdle
+func (p *GuacdPool) fill() {
+	for p.Idle() < p.minIdle {
+		ctx, cancel := context.WithTimeout(context.Background(), SocketTimeout)
+		conn, err := p.dial(ctx)
+		cancel()
+		if err != nil {
+			globalLogger.Warn().Err(err).Msg("failed to warm guacd connection")
+			return
+		}
+
+		p.Lock()
+		select {
+		case <-p.done:
+			p.Unlock()
+			_ = conn.Close()
+			return
+		default:
+		}
+		p.idle = append(p.idle, pooledConn{conn: conn, created: time.Now()})
+		p.Unlock()
+	}
+}
+
+// connAlive returns true if guacd hasn't closed the idle connection. guacd sends nothing before
+// the handshake, so a read that times out means it is still open.
+func connAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// Shutdown stops maintaining the pool and closes the idle connections
+func (p *GuacdPool) Shutdown() {
+	p.ticker.Stop()
+
+	p.Lock()
+	close(p.done)
+	idle := p.idle
+	p.idle = nil
+	p.Unlock()
+
+	for _, pc := range idle {
+		_ = pc.conn.Close()
+	}
+}
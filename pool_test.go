@@ -0,0 +1,107 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acceptingGuacd accepts connections and keeps them open until closed
+type acceptingGuacd struct {
+	sync.Mutex
+	net.Listener
+	conns []net.Conn
+}
+
+func newAcceptingGuacd(t *testing.T) *acceptingGuacd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guacd := &acceptingGuacd{Listener: listener}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		guacd.Lock()
+		defer guacd.Unlock()
+		for _, conn := range guacd.conns {
+			_ = conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			guacd.Lock()
+			guacd.conns = append(guacd.conns, conn)
+			guacd.Unlock()
+		}
+	}()
+	return guacd
+}
+
+func (g *acceptingGuacd) accepted() int {
+	g.Lock()
+	defer g.Unlock()
+	return len(g.conns)
+}
+
+// waitFor polls until cond is true
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGuacdPool_MinIdle(t *testing.T) {
+	guacd := newAcceptingGuacd(t)
+	pool := NewGuacdPool("tcp", guacd.Addr().String(), 3, 20*time.Millisecond)
+	defer pool.Shutdown()
+
+	waitFor(t, "the pool to warm", func() bool { return pool.Idle() == 3 })
+
+	// taking connections replenishes the pool
+	for i := 0; i < 2; i++ {
+		stream, err := pool.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = stream.Close() }()
+	}
+	waitFor(t, "the pool to refill", func() bool { return pool.Idle() == 3 && guacd.accepted() == 5 })
+
+	// connections guacd closes are replaced
+	guacd.Lock()
+	_ = guacd.conns[4].Close()
+	guacd.Unlock()
+	waitFor(t, "the closed connection to be replaced", func() bool { return guacd.accepted() == 6 })
+	waitFor(t, "the pool to refill", func() bool { return pool.Idle() == 3 })
+}
+
+func TestGuacdPool_DialsWhenEmpty(t *testing.T) {
+	guacd := newAcceptingGuacd(t)
+	pool := NewGuacdPool("tcp", guacd.Addr().String(), 0, time.Minute)
+	defer pool.Shutdown()
+
+	stream, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.Close()
+	if pool.Idle() != 0 {
+		t.Error("Expected no idle connections, got", pool.Idle())
+	}
+
+	_ = guacd.Close()
+	if _, err = pool.Get(context.Background()); err == nil || err.(*ErrGuac).Kind != ErrUpstreamUnavailable {
+		t.Error("Expected upstream unavailable, got", err)
+	}
+}
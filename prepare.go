@@ -0,0 +1,248 @@
+package guac
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Policy is what PrepareConfig accepts from a connect request
+type Policy struct {
+	// Decoder reads the request parameters, DefaultParamDecoder if nil
+	Decoder ParamDecoder
+	// Schema lists the protocols and parameters clients may use. A nil schema allows nothing.
+	Schema ParameterSchema
+	// AllowedNetworks, if set, are the only networks hosts may resolve into. Loopback, link-local,
+	// multicast and unspecified addresses are refused unless listed here.
+	AllowedNetworks []*net.IPNet
+	// MaxWidth and MaxHeight bound the requested screen size, DefaultMaxScreenWidth and
+	// DefaultMaxScreenHeight if zero. Larger sizes are clamped to them.
+	MaxWidth  int
+	MaxHeight int
+	// MaxParameters limits how many parameters a connect request may have, including the
+	// screen size, DefaultMaxParameters if zero. A negative value removes the limit.
+	MaxParameters int
+	// Nonces optionally makes connect requests single use. The nonce is the "jti" of the
+	// request's token, so it is signed with the rest of the token: requests must come through
+	// TokenConnect with a token that has a jti, and one that was already used is refused.
+	Nonces NonceStore
+	// LookupIP resolves hosts, net.DefaultResolver if nil
+	LookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	// JoinAuthorizer decides whether the request may join the session with the connection ID,
+	// and whether only as a viewer. Joins are refused if it is nil. The client can ask for
+	// read-only with "readonly=true", but never for more than the authorizer allows.
+	JoinAuthorizer func(ctx context.Context, connectionID string) (readOnly bool, err error)
+}
+
+const (
+	// DefaultMaxScreenWidth is the widest screen PrepareConfig requests unless the Policy sets
+	// one, enough for four 4K monitors side by side
+	DefaultMaxScreenWidth = 16384
+	// DefaultMaxScreenHeight is the tallest screen PrepareConfig requests unless the Policy sets one
+	DefaultMaxScreenHeight = 8192
+	// maxScreenDPI bounds the requested resolution
+	maxScreenDPI = 1200
+	// DefaultMaxParameters is the most parameters PrepareConfig accepts unless the Policy sets a
+	// limit, well above what any guacd protocol takes
+	DefaultMaxParameters = 256
+)
+
+// connectRequestParams are the request parameters PrepareConfig reads into the Config itself,
+// rather than passing them to guacd
+var connectRequestParams = map[string]bool{
+	"scheme":   true,
+	"width":    true,
+	"height":   true,
+	"dpi":      true,
+	"uuid":     true,
+	"readonly": true,
+	"audio":    true,
+	"video":    true,
+	"image":    true,
+	"timezone": true,
+}
+
+// hostParameters are the guacd parameters naming a host guacd will connect to
+var hostParameters = []string{"hostname", "gateway-hostname", "sftp-hostname"}
+
+// PrepareConfig reads a connect request into a Config, validating everything the client sent
+// against the policy:
+//   - "scheme" is the protocol and the remaining parameters, other than the screen size ("width",
+//     "height" and "dpi"), joins ("uuid" and "readonly") and the client's capabilities ("audio",
+//     "video", "image" and "timezone"), must be allowed by the Schema
+//   - the formats the client announced are offered to guacd, see ClientCapabilities
+//   - hosts must resolve only to addresses the policy allows, so clients can't reach guacd's own
+//     host or cloud metadata services
+//   - the screen size must be positive, and is clamped to the policy's bounds
+//   - there can be no more than MaxParameters parameters
+//   - joins ("uuid") are refused unless the JoinAuthorizer allows them, and are read-only if it
+//     says so
+//   - with Nonces set, the jti of the request's token must not have been used before. It is only
+//     consumed once everything else is valid, so a refused request doesn't use it up.
+//
+// The errors are *ErrGuac, so the status gives the HTTP and websocket codes. Hosts are resolved
+// again by guacd, so a policy that must hold against DNS changes should use AllowedNetworks with
+// addresses rather than names.
+func PrepareConfig(r *http.Request, policy Policy) (*Config, error) {
+	decoder := policy.Decoder
+	if decoder == nil {
+		decoder = DefaultParamDecoder
+	}
+	query, err := decoder(r)
+	if err != nil {
+		return nil, err
+	}
+	maxParameters := policy.MaxParameters
+	if maxParameters == 0 {
+		maxParameters = DefaultMaxParameters
+	}
+	if maxParameters > 0 && len(query) > maxParameters {
+		return nil, ErrClientOverrun.NewError("Too many connect parameters.", strconv.Itoa(len(query)))
+	}
+
+	config := NewGuacamoleConfiguration()
+	if config.OptimalScreenWidth, err = screenDimension(query.Get("width"), config.OptimalScreenWidth, policy.MaxWidth, DefaultMaxScreenWidth, "width"); err != nil {
+		return nil, err
+	}
+	if config.OptimalScreenHeight, err = screenDimension(query.Get("height"), config.OptimalScreenHeight, policy.MaxHeight, DefaultMaxScreenHeight, "height"); err != nil {
+		return nil, err
+	}
+	if config.OptimalResolution, err = screenParam(query.Get("dpi"), config.OptimalResolution, maxScreenDPI, maxScreenDPI, "dpi"); err != nil {
+		return nil, err
+	}
+
+	clientCapabilities(query).Configure(config)
+
+	if uuid := query.Get("uuid"); uuid != "" {
+		// a join connects to an existing session, so the client chooses nothing else
+		if policy.JoinAuthorizer == nil {
+			return nil, ErrSecurity.NewError("Joining sessions is not allowed.", uuid)
+		}
+		if config.ReadOnly, err = policy.JoinAuthorizer(r.Context(), uuid); err != nil {
+			return nil, err
+		}
+		config.ConnectionID = uuid
+		// the client may give up control, but not take it
+		config.ReadOnly = config.ReadOnly || query.Get("readonly") == "true"
+		if err = policy.consumeNonce(r.Context()); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+
+	config.Protocol = query.Get("scheme")
+	if config.Protocol == "" {
+		return nil, ErrClient.NewError("No protocol provided.")
+	}
+	for name, values := range query {
+		if connectRequestParams[name] {
+			continue
+		}
+		if len(values) != 1 {
+			return nil, ErrClient.NewError("Connect parameter repeated.", name)
+		}
+		config.Parameters[name] = values[0]
+	}
+	if err = policy.Schema.Validate(config.Protocol, config.Parameters); err != nil {
+		return nil, err
+	}
+
+	for _, name := range hostParameters {
+		if host, ok := config.Parameters[name]; ok {
+			if err = policy.checkHost(r.Context(), host); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = policy.consumeNonce(r.Context()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// screenDimension parses the requested width or height, clamping it to max so an absurd size
+// can't exhaust guacd or the remote
+func screenDimension(value string, def, max, defaultMax int, name string) (int, error) {
+	if max <= 0 {
+		max = defaultMax
+	}
+	n, err := screenParam(value, def, math.MaxInt, math.MaxInt, name)
+	if err != nil || n <= max {
+		return n, err
+	}
+	globalLogger.Warn().Str("dimension", name).Int("requested", n).Int("max", max).Msg("clamping requested screen size")
+	return max, nil
+}
+
+// screenParam parses a screen dimension, returning def if it isn't set
+func screenParam(value string, def, max, defaultMax int, name string) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	if max <= 0 {
+		max = defaultMax
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > max {
+		return 0, ErrClient.NewError("Invalid screen "+name+".", value)
+	}
+	return n, nil
+}
+
+// checkHost returns an error if the host resolves to any address the policy doesn't allow
+func (p *Policy) checkHost(ctx context.Context, host string) error {
+	if host == "" {
+		return ErrClient.NewError("No host provided.")
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		lookup := p.LookupIP
+		if lookup == nil {
+			lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+				return net.DefaultResolver.LookupIP(ctx, "ip", host)
+			}
+		}
+		var err error
+		if ips, err = lookup(ctx, host); err != nil || len(ips) == 0 {
+			return ErrUpstreamNotFound.NewError("Unable to resolve host.", host)
+		}
+	}
+
+	for _, ip := range ips {
+		if !p.allowedIP(ip) {
+			return ErrSecurity.NewError("Host not allowed.", host)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) allowedIP(ip net.IP) bool {
+	if len(p.AllowedNetworks) > 0 {
+		for _, network := range p.AllowedNetworks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// Redacted returns a copy of the config, safe to log, with the values of sensitive parameters
+// such as passwords and private keys replaced
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.Parameters = make(map[string]string, len(c.Parameters))
+	for name, value := range c.Parameters {
+		if sensitiveArgs[name] {
+			value = "********"
+		}
+		redacted.Parameters[name] = value
+	}
+	return &redacted
+}
@@ -0,0 +1,209 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func prepareRequest(query string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/websocket-tunnel?"+query, nil)
+}
+
+var testPolicy = Policy{
+	Schema: ParameterSchema{
+		"rdp": {"hostname", "port", "password", "gateway-hostname"},
+	},
+	LookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "desktop.internal":
+			return []net.IP{net.ParseIP("10.0.0.5")}, nil
+		case "rebind.internal":
+			return []net.IP{net.ParseIP("10.0.0.6"), net.ParseIP("127.0.0.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	},
+}
+
+func TestPrepareConfig(t *testing.T) {
+	config, err := PrepareConfig(prepareRequest("scheme=rdp&hostname=desktop.internal&port=3389&password=secret&width=1920&height=1080&dpi=120"), testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Protocol != "rdp" || config.OptimalScreenWidth != 1920 || config.OptimalScreenHeight != 1080 || config.OptimalResolution != 120 {
+		t.Error("Unexpected config", config)
+	}
+	if len(config.Parameters) != 3 || config.Parameters["hostname"] != "desktop.internal" || config.Parameters["port"] != "3389" {
+		t.Error("Unexpected parameters", config.Parameters)
+	}
+
+	redacted := config.Redacted()
+	if redacted.Parameters["password"] != "********" || redacted.Parameters["port"] != "3389" {
+		t.Error("Unexpected redacted parameters", redacted.Parameters)
+	}
+	if config.Parameters["password"] != "secret" {
+		t.Error("Redacting changed the config")
+	}
+
+	// a join only takes the connection and the screen
+	config, err = PrepareConfig(prepareRequest("uuid=$abc&readonly=true&hostname=127.0.0.1"), joinPolicy(false, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ConnectionID != "$abc" || !config.ReadOnly || len(config.Parameters) != 0 {
+		t.Error("Unexpected join config", config)
+	}
+}
+
+// joinPolicy is testPolicy with a JoinAuthorizer answering readOnly and err
+func joinPolicy(readOnly bool, err error) Policy {
+	policy := testPolicy
+	policy.JoinAuthorizer = func(ctx context.Context, connectionID string) (bool, error) {
+		return readOnly, err
+	}
+	return policy
+}
+
+func TestPrepareConfig_Join(t *testing.T) {
+	for name, test := range map[string]struct {
+		query    string
+		policy   Policy
+		readOnly bool
+		status   Status
+	}{
+		"NoAuthorizer":   {"uuid=$abc", testPolicy, false, ClientForbidden},
+		"Refused":        {"uuid=$abc", joinPolicy(false, ErrSecurity.NewError("Not your session.")), false, ClientForbidden},
+		"ReadWrite":      {"uuid=$abc", joinPolicy(false, nil), false, 0},
+		"ClientReadOnly": {"uuid=$abc&readonly=true", joinPolicy(false, nil), true, 0},
+		"ForcedReadOnly": {"uuid=$abc&readonly=false", joinPolicy(true, nil), true, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, err := PrepareConfig(prepareRequest(test.query), test.policy)
+			if test.status != 0 {
+				var guacErr *ErrGuac
+				if !errors.As(err, &guacErr) || guacErr.Status != test.status {
+					t.Fatal("Expected", test.status, "got", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ReadOnly != test.readOnly {
+				t.Error("Expected read-only", test.readOnly, "got", config.ReadOnly)
+			}
+		})
+	}
+}
+
+func TestPrepareConfig_Rejected(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	withLoopback := testPolicy
+	withLoopback.AllowedNetworks = []*net.IPNet{loopback}
+
+	for name, test := range map[string]struct {
+		query  string
+		policy Policy
+		status Status
+	}{
+		"NoProtocol":         {"hostname=10.0.0.1", testPolicy, ClientBadRequest},
+		"UnknownProtocol":    {"scheme=vnc&hostname=10.0.0.1", testPolicy, ClientForbidden},
+		"NoSchema":           {"scheme=rdp&hostname=10.0.0.1", Policy{}, ClientForbidden},
+		"ForbiddenParameter": {"scheme=rdp&hostname=10.0.0.1&recording-path=/tmp", testPolicy, ClientForbidden},
+		"RepeatedParameter":  {"scheme=rdp&hostname=10.0.0.1&port=1&port=2", testPolicy, ClientBadRequest},
+		"EmptyHost":          {"scheme=rdp&hostname=", testPolicy, ClientBadRequest},
+		"LoopbackHost":       {"scheme=rdp&hostname=127.0.0.1", testPolicy, ClientForbidden},
+		"IPv6LoopbackHost":   {"scheme=rdp&hostname=::1", testPolicy, ClientForbidden},
+		"MetadataHost":       {"scheme=rdp&hostname=169.254.169.254", testPolicy, ClientForbidden},
+		"UnspecifiedHost":    {"scheme=rdp&hostname=0.0.0.0", testPolicy, ClientForbidden},
+		"ResolvesToLoopback": {"scheme=rdp&hostname=rebind.internal", testPolicy, ClientForbidden},
+		"GatewayHost":        {"scheme=rdp&hostname=10.0.0.1&gateway-hostname=127.0.0.1", testPolicy, ClientForbidden},
+		"UnresolvableHost":   {"scheme=rdp&hostname=missing.internal", testPolicy, UpstreamNotFound},
+		"OutsideNetworks":    {"scheme=rdp&hostname=10.0.0.1", withLoopback, ClientForbidden},
+		"InvalidWidth":       {"scheme=rdp&hostname=10.0.0.1&width=wide", testPolicy, ClientBadRequest},
+		"ZeroHeight":         {"scheme=rdp&hostname=10.0.0.1&height=0", testPolicy, ClientBadRequest},
+		"NegativeWidth":      {"scheme=rdp&hostname=10.0.0.1&width=-1", testPolicy, ClientBadRequest},
+		"HugeWidth":          {"scheme=rdp&hostname=10.0.0.1&width=100000000000000000000", testPolicy, ClientBadRequest},
+		"InvalidDPI":         {"scheme=rdp&hostname=10.0.0.1&dpi=100000", testPolicy, ClientBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := PrepareConfig(prepareRequest(test.query), test.policy)
+			var guacErr *ErrGuac
+			if !errors.As(err, &guacErr) || guacErr.Status != test.status {
+				t.Fatal("Expected", test.status, "got", err)
+			}
+			if guacErr.Status.GetHTTPStatusCode() < 400 {
+				t.Error("Expected an HTTP error status, got", guacErr.Status.GetHTTPStatusCode())
+			}
+		})
+	}
+
+	// loopback is only allowed when listed
+	if _, err := PrepareConfig(prepareRequest("scheme=rdp&hostname=127.0.0.1"), withLoopback); err != nil {
+		t.Error("Expected an allowed network to be accepted, got", err)
+	}
+}
+
+func TestPrepareConfig_DecoderError(t *testing.T) {
+	policy := testPolicy
+	policy.Decoder = JSONParamDecoder
+	r := httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil)
+	if _, err := PrepareConfig(r, policy); err == nil || err.(*ErrGuac).Kind != ErrClient {
+		t.Error("Expected the decoder error, got", err)
+	}
+}
+
+func TestPrepareConfig_ClampScreenSize(t *testing.T) {
+	bounded := Policy{Schema: testPolicy.Schema, MaxWidth: 1920, MaxHeight: 1080}
+	for name, test := range map[string]struct {
+		query         string
+		policy        Policy
+		width, height int
+	}{
+		"Normal":         {"width=1280&height=720", bounded, 1280, 720},
+		"AtBoundary":     {"width=1920&height=1080", bounded, 1920, 1080},
+		"OverBoundary":   {"width=1921&height=1081", bounded, 1920, 1080},
+		"Absurd":         {"width=100000&height=100000", bounded, 1920, 1080},
+		"DefaultBounds":  {"width=100000&height=100000", testPolicy, DefaultMaxScreenWidth, DefaultMaxScreenHeight},
+		"MultiMonitor":   {"width=15360&height=2160", testPolicy, 15360, 2160},
+		"DefaultSize":    {"", bounded, 1024, 768},
+		"OnlyWidthLarge": {"width=5000", bounded, 1920, 768},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, err := PrepareConfig(prepareRequest("scheme=rdp&hostname=10.0.0.1&"+test.query), test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.OptimalScreenWidth != test.width || config.OptimalScreenHeight != test.height {
+				t.Errorf("Expected %vx%v, got %vx%v", test.width, test.height, config.OptimalScreenWidth, config.OptimalScreenHeight)
+			}
+		})
+	}
+}
+
+func TestPrepareConfig_MaxParameters(t *testing.T) {
+	form := url.Values{"scheme": {"rdp"}, "hostname": {"10.0.0.1"}}
+	for i := 0; i < DefaultMaxParameters; i++ {
+		form.Set(fmt.Sprint("flood-", i), "1")
+	}
+	r := httptest.NewRequest(http.MethodPost, "/tunnel?connect", strings.NewReader(form.Encode()))
+	_, err := PrepareConfig(r, testPolicy)
+	if err == nil || err.(*ErrGuac).Kind != ErrClientOverrun {
+		t.Error("Expected too many parameters to be rejected, got", err)
+	}
+
+	policy := testPolicy
+	policy.MaxParameters = 3
+	if _, err = PrepareConfig(prepareRequest("scheme=rdp&hostname=10.0.0.1&port=3389"), policy); err != nil {
+		t.Error("Expected parameters within the limit to be accepted, got", err)
+	}
+	if _, err = PrepareConfig(prepareRequest("scheme=rdp&hostname=10.0.0.1&port=3389&width=800"), policy); err == nil || err.(*ErrGuac).Kind != ErrClientOverrun {
+		t.Error("Expected parameters over the limit to be rejected, got", err)
+	}
+}
@@ -0,0 +1,319 @@
+// Package prometheus exposes the metrics of a guac.WebsocketServer in the Prometheus text
+// format, without depending on the Prometheus client library:
+//
+//	wsServer.Metrics = prometheus.NewCollector()
+//	mux.Handle("/metrics", wsServer.Metrics.(*prometheus.Collector))
+//
+// or, for the common case of one collector for the process,
+//
+//	prometheus.UseDefault(wsServer)
+//	mux.Handle("/metrics", prometheus.Handler())
+//
+// A Collector isn't a prometheus.Collector and can't be registered with a prometheus.Registry.
+// It serves its own metrics in version 0.0.4 of the text exposition format, and only the subset
+// of it the metrics below need: HELP and TYPE lines, gauges, counters and histograms, with label
+// values escaped. It writes no timestamps, exemplars, summaries or untyped metrics, doesn't
+// negotiate the protobuf or OpenMetrics formats, and doesn't add the process and Go runtime
+// metrics of the client library. A service that also uses the client library serves the two
+// from separate paths.
+//
+// The metrics are
+//   - guac_active_connections, the sessions connected to guacd
+//   - guac_connection_duration_seconds, a histogram of how long sessions lasted
+//   - guac_time_to_first_frame_seconds, a histogram of how long sessions took from guacd being
+//     ready to drawing on the client
+//   - guac_bytes_sent_total and guac_bytes_received_total, the bytes sent to browsers and
+//     received from them, counted where they are written
+//   - guac_instructions_total{opcode, direction}, the instructions passed each way
+//   - guac_instruction_size_bytes{direction}, a histogram of their sizes
+//   - guac_connect_failures_total{status}, the sessions that failed to connect to guacd
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecademy-engineering/guac"
+)
+
+// DurationBuckets are the bounds of guac_connection_duration_seconds, from a minute to a working
+// day
+var DurationBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800}
+
+// FirstFrameBuckets are the bounds of guac_time_to_first_frame_seconds
+var FirstFrameBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// opcodes are the instructions of the Guacamole protocol. Other opcodes are counted as "other",
+// as clients can send anything and each opcode is a time series.
+var opcodes = map[string]bool{
+	"ack": true, "arc": true, "argv": true, "audio": true, "blob": true, "body": true,
+	"cfill": true, "clip": true, "clipboard": true, "close": true, "copy": true, "cstroke": true,
+	"cursor": true, "curve": true, "disconnect": true, "dispose": true, "distort": true,
+	"end": true, "error": true, "file": true, "filesystem": true, "get": true, "identity": true,
+	"img": true, "jpeg": true, "key": true, "lfill": true, "line": true, "log": true,
+	"lstroke": true, "mouse": true, "move": true, "msg": true, "name": true, "nest": true,
+	"nop": true, "pipe": true, "png": true, "pop": true, "push": true, "put": true, "ready": true,
+	"rect": true, "required": true, "reset": true, "set": true, "shade": true, "size": true,
+	"start": true, "sync": true, "touch": true, "transfer": true, "transform": true,
+	"undefine": true, "video": true,
+}
+
+// Collector is a guac.MetricsCollector, also implementing guac.ConnectionCollector,
+// guac.TrafficCollector and guac.FirstFrameCollector, that serves what it collects to
+// Prometheus. It is safe for concurrent use, so one collector can be shared by several servers.
+type Collector struct {
+	active        atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	inboundSizes  *guac.Histogram
+	outboundSizes *guac.Histogram
+
+	lock         sync.Mutex
+	durations    []int64
+	durationSum  float64
+	firstFrames  []int64
+	firstSum     float64
+	instructions map[instructionKey]int64
+	failures     map[string]int64
+}
+
+type instructionKey struct {
+	opcode string
+	dir    guac.Direction
+}
+
+// NewCollector creates a collector with nothing collected
+func NewCollector() *Collector {
+	return &Collector{
+		inboundSizes:  guac.NewHistogram(guac.InstructionSizeBuckets),
+		outboundSizes: guac.NewHistogram(guac.InstructionSizeBuckets),
+		durations:     make([]int64, len(DurationBuckets)+1),
+		firstFrames:   make([]int64, len(FirstFrameBuckets)+1),
+		instructions:  map[instructionKey]int64{},
+		failures:      map[string]int64{},
+	}
+}
+
+// Default is the collector of UseDefault and Handler
+var Default = NewCollector()
+
+// UseDefault makes Default the Metrics of server, replacing any it had, and returns it
+func UseDefault(server *guac.WebsocketServer) *Collector {
+	server.Metrics = Default
+	return Default
+}
+
+// Handler serves Default
+func Handler() http.Handler {
+	return Default
+}
+
+// ObserveInstructionSize implements guac.MetricsCollector
+func (c *Collector) ObserveInstructionSize(dir guac.Direction, size int) {
+	if dir == guac.Inbound {
+		c.inboundSizes.Observe(size)
+	} else {
+		c.outboundSizes.Observe(size)
+	}
+}
+
+// ObserveConnectFailure implements guac.MetricsCollector
+func (c *Collector) ObserveConnectFailure(status guac.Status) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.failures[status.String()]++
+}
+
+// ObserveConnectionOpened implements guac.ConnectionCollector
+func (c *Collector) ObserveConnectionOpened() {
+	c.active.Add(1)
+}
+
+// ObserveConnectionClosed implements guac.ConnectionCollector
+func (c *Collector) ObserveConnectionClosed(duration time.Duration) {
+	c.active.Add(-1)
+	seconds := duration.Seconds()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.durations[sort.SearchFloat64s(DurationBuckets, seconds)]++
+	c.durationSum += seconds
+}
+
+// ObserveFirstFrame implements guac.FirstFrameCollector
+func (c *Collector) ObserveFirstFrame(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.firstFrames[sort.SearchFloat64s(FirstFrameBuckets, seconds)]++
+	c.firstSum += seconds
+}
+
+// ObserveBytes implements guac.TrafficCollector
+func (c *Collector) ObserveBytes(dir guac.Direction, n int) {
+	if dir == guac.Inbound {
+		c.bytesReceived.Add(int64(n))
+	} else {
+		c.bytesSent.Add(int64(n))
+	}
+}
+
+// ObserveOpcode implements guac.TrafficCollector
+func (c *Collector) ObserveOpcode(dir guac.Direction, opcode string) {
+	if !opcodes[opcode] {
+		opcode = "other"
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.instructions[instructionKey{opcode, dir}]++
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	// an error means the client has gone, and the headers are already sent
+	_, _ = c.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	out := &countingWriter{w: bufio.NewWriter(w)}
+
+	out.metric("guac_active_connections", "gauge", "Sessions connected to guacd.")
+	out.sample("guac_active_connections", "", float64(c.active.Load()))
+
+	c.lock.Lock()
+	durations := append([]int64(nil), c.durations...)
+	durationSum := c.durationSum
+	firstFrames := append([]int64(nil), c.firstFrames...)
+	firstSum := c.firstSum
+	instructions := make([]instructionKey, 0, len(c.instructions))
+	for key := range c.instructions {
+		instructions = append(instructions, key)
+	}
+	sort.Slice(instructions, func(i, j int) bool {
+		if instructions[i].opcode != instructions[j].opcode {
+			return instructions[i].opcode < instructions[j].opcode
+		}
+		return instructions[i].dir < instructions[j].dir
+	})
+	instructionCounts := make([]int64, len(instructions))
+	for i, key := range instructions {
+		instructionCounts[i] = c.instructions[key]
+	}
+	statuses := make([]string, 0, len(c.failures))
+	for status := range c.failures {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	failures := make([]int64, len(statuses))
+	for i, status := range statuses {
+		failures[i] = c.failures[status]
+	}
+	c.lock.Unlock()
+
+	out.metric("guac_connection_duration_seconds", "histogram", "How long sessions lasted.")
+	out.histogram("guac_connection_duration_seconds", "", DurationBuckets, durations, durationSum)
+
+	out.metric("guac_time_to_first_frame_seconds", "histogram", "How long sessions took from guacd being ready to drawing on the browser.")
+	out.histogram("guac_time_to_first_frame_seconds", "", FirstFrameBuckets, firstFrames, firstSum)
+
+	out.metric("guac_bytes_sent_total", "counter", "Bytes sent to browsers.")
+	out.sample("guac_bytes_sent_total", "", float64(c.bytesSent.Load()))
+	out.metric("guac_bytes_received_total", "counter", "Bytes received from browsers.")
+	out.sample("guac_bytes_received_total", "", float64(c.bytesReceived.Load()))
+
+	out.metric("guac_instructions_total", "counter", "Instructions passed between browsers and guacd.")
+	for i, key := range instructions {
+		out.sample("guac_instructions_total", labels("opcode", key.opcode, "direction", key.dir.String()), float64(instructionCounts[i]))
+	}
+
+	out.metric("guac_instruction_size_bytes", "histogram", "Sizes of the instructions passed between browsers and guacd.")
+	for _, dir := range []guac.Direction{guac.Inbound, guac.Outbound} {
+		h := c.inboundSizes
+		if dir == guac.Outbound {
+			h = c.outboundSizes
+		}
+		snapshot := h.Snapshot()
+		out.histogram("guac_instruction_size_bytes", labels("direction", dir.String()), snapshot.Bounds, snapshot.Counts, float64(snapshot.Sum))
+	}
+
+	out.metric("guac_connect_failures_total", "counter", "Sessions that failed to connect to guacd.")
+	for i, status := range statuses {
+		out.sample("guac_connect_failures_total", labels("status", status), float64(failures[i]))
+	}
+
+	if out.err == nil {
+		out.err = out.w.Flush()
+	}
+	return out.n, out.err
+}
+
+// countingWriter writes the text format, keeping the first error
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) printf(format string, args ...any) {
+	if w.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(w.w, format, args...)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *countingWriter) metric(name, kind, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *countingWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	w.printf("%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// histogram writes cumulative buckets from counts, which have one more than bounds for the
+// values above the last bound
+func (w *countingWriter) histogram(name, extra string, bounds []float64, counts []int64, sum float64) {
+	prefix := ""
+	if extra != "" {
+		prefix = extra + ","
+	}
+	var cumulative int64
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		w.sample(name+"_bucket", prefix+labels("le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+	}
+	cumulative += counts[len(bounds)]
+	w.sample(name+"_bucket", prefix+labels("le", "+Inf"), float64(cumulative))
+	w.sample(name+"_sum", extra, sum)
+	w.sample(name+"_count", extra, float64(cumulative))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats pairs of label names and values
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
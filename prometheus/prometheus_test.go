@@ -0,0 +1,117 @@
+package prometheus
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecademy-engineering/guac"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector()
+	c.ObserveConnectionOpened()
+	c.ObserveConnectionOpened()
+	c.ObserveConnectionClosed(90 * time.Second)
+	c.ObserveBytes(guac.Inbound, 15)
+	c.ObserveBytes(guac.Outbound, 100)
+	c.ObserveOpcode(guac.Inbound, "key")
+	c.ObserveOpcode(guac.Inbound, "key")
+	c.ObserveOpcode(guac.Outbound, "sync")
+	c.ObserveOpcode(guac.Inbound, "made-up")
+	c.ObserveInstructionSize(guac.Inbound, 15)
+	c.ObserveConnectFailure(guac.UpstreamNotFound)
+	c.ObserveFirstFrame(300 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Error("Expected the text format, got", contentType)
+	}
+	body := w.Body.String()
+	for _, expect := range []string{
+		"# TYPE guac_active_connections gauge\nguac_active_connections 1\n",
+		`guac_connection_duration_seconds_bucket{le="60"} 0` + "\n",
+		`guac_connection_duration_seconds_bucket{le="300"} 1` + "\n",
+		`guac_connection_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"guac_connection_duration_seconds_sum 90\nguac_connection_duration_seconds_count 1\n",
+		`guac_time_to_first_frame_seconds_bucket{le="0.25"} 0` + "\n",
+		`guac_time_to_first_frame_seconds_bucket{le="0.5"} 1` + "\n",
+		"guac_bytes_sent_total 100\n",
+		"guac_bytes_received_total 15\n",
+		`guac_instructions_total{opcode="key",direction="inbound"} 2` + "\n",
+		`guac_instructions_total{opcode="sync",direction="outbound"} 1` + "\n",
+		`guac_instructions_total{opcode="other",direction="inbound"} 1` + "\n",
+		`guac_instruction_size_bytes_bucket{direction="inbound",le="16"} 1` + "\n",
+		`guac_instruction_size_bytes_count{direction="outbound"} 0` + "\n",
+		`guac_connect_failures_total{status="` + guac.UpstreamNotFound.String() + `"} 1` + "\n",
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("Expected %q in\n%s", expect, body)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	if got := labels("a", `x"y\z`+"\n", "b", "c"); got != `a="x\"y\\z\n",b="c"` {
+		t.Error("Unexpected labels", got)
+	}
+}
+
+func TestCollector_WebsocketServer(t *testing.T) {
+	conn, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, guacd) }()
+
+	wsServer := guac.NewWebsocketServer(func(r *http.Request) (guac.Tunnel, error) {
+		return guac.NewSimpleTunnel(guac.NewStream(conn, time.Minute)), nil
+	}, &zerolog.Logger{})
+	c := NewCollector()
+	wsServer.Metrics = c
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsServer.ServeHTTP(w, r)
+		close(done)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = guacd.Write([]byte("4.sync,3.100;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if c.active.Load() != 1 {
+		t.Error("Expected an active connection, got", c.active.Load())
+	}
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	_ = guacd.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the session to end")
+	}
+
+	if c.active.Load() != 0 || c.durations[0] != 1 {
+		t.Error("Expected the connection to be closed, got", c.active.Load(), c.durations)
+	}
+	if sent := c.bytesSent.Load(); sent != 13 {
+		t.Error("Expected the sync to be counted, got", sent)
+	}
+	if c.instructions[instructionKey{"sync", guac.Outbound}] != 1 {
+		t.Error("Expected the sync's opcode to be counted")
+	}
+}
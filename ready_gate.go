@@ -0,0 +1,43 @@
+package guac
+
+import "sync"
+
+// ClientReadySignal is the argument of the internal instruction, "0.,5.ready;", a client sends
+// once it is set up to receive guacd's output, see WebsocketServer.AwaitClientReady
+const ClientReadySignal = "ready"
+
+// DefaultClientReadyLimit is the default WebsocketServer.ClientReadyLimit
+const DefaultClientReadyLimit = 1 << 20
+
+// readyGate is opened once by the client's ready signal
+type readyGate struct {
+	once  sync.Once
+	ready chan struct{}
+	// opcode is an instruction that also opens the gate, none if it is empty
+	opcode string
+}
+
+func newReadyGate(opcode string) *readyGate {
+	return &readyGate{
+		ready:  make(chan struct{}),
+		opcode: opcode,
+	}
+}
+
+// observe opens the gate if a message from the client holds the ready signal or opcode
+func (g *readyGate) observe(data []byte) {
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			return
+		}
+		if elements, err := peekElements(data[:n], 2); err == nil && len(elements) > 0 {
+			if (elements[0] == InternalDataOpcode && len(elements) > 1 && elements[1] == ClientReadySignal) ||
+				(g.opcode != "" && elements[0] == g.opcode) {
+				g.once.Do(func() { close(g.ready) })
+				return
+			}
+		}
+		data = data[n:]
+	}
+}
@@ -0,0 +1,117 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReadyGate_Observe(t *testing.T) {
+	tests := []struct {
+		opcode, data string
+		ready        bool
+	}{
+		{"", "0.,5.ready;", true},
+		{"", "4.sync,1.1;0.,5.ready;", true},
+		{"", "0.,4.ping,3.100;", false},
+		{"", "4.sync,1.1;", false},
+		{"sync", "4.sync,1.1;", true},
+		{"sync", "3.key,2.65,1.1;", false},
+	}
+	for _, tt := range tests {
+		gate := newReadyGate(tt.opcode)
+		gate.observe([]byte(tt.data))
+		select {
+		case <-gate.ready:
+			if !tt.ready {
+				t.Errorf("%q %q: expected the gate to stay closed", tt.opcode, tt.data)
+			}
+		default:
+			if tt.ready {
+				t.Errorf("%q %q: expected the gate to open", tt.opcode, tt.data)
+			}
+		}
+	}
+}
+
+func TestGuacdToWs_ClientReadyLimit(t *testing.T) {
+	syncs := []string{"4.sync,1.1;", "4.sync,1.2;", "4.sync,1.3;"}
+	for _, limit := range []int{20, 100} {
+		ws := &fakeMessageWriter{}
+		opts := pumpOptions{ready: newReadyGate(""), readyLimit: limit}
+		guacdToWs(context.Background(), nopLogger(), ws, &sliceReader{instructions: append([]string(nil), syncs...)}, opts)
+		if limit < 33 && (len(ws.Messages) != 1 || string(ws.Messages[0]) != "4.sync,1.1;4.sync,1.2;4.sync,1.3;") {
+			t.Errorf("Expected everything held beyond the limit of %v to be sent, got %q", limit, ws.Messages)
+		}
+		if limit >= 33 && len(ws.Messages) != 0 {
+			t.Errorf("Expected everything to be held within the limit of %v, got %q", limit, ws.Messages)
+		}
+	}
+}
+
+func TestWebsocketServer_AwaitClientReady(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.AwaitClientReady = true
+	connected := make(chan struct{}, 1)
+	wsServer.OnConnectWs = func(string, *websocket.Conn, *http.Request) {
+		connected <- struct{}{}
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	<-connected
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- string(msg)
+		}
+	}()
+
+	for _, sync := range []string{"4.sync,1.1;", "4.sync,1.2;"} {
+		if _, err = guacd.Write([]byte(sync)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("Expected output to be held until the client is ready, got %q", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("0.,5.ready;")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-messages; msg != "4.sync,1.1;4.sync,1.2;" {
+		t.Errorf("Expected the held output once the client is ready, got %q", msg)
+	}
+	if _, err = guacd.Write([]byte("4.sync,1.3;")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-messages; msg != "4.sync,1.3;" {
+		t.Errorf("Expected output to flow once the client is ready, got %q", msg)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+	for received := range guacd.Received {
+		// only the disconnect as the session ends
+		if received != "10.disconnect;" {
+			t.Errorf("Expected the ready signal not to reach guacd, got %q", received)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package guac
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordingReconnect is the internal opcode marking where a session continued in an appended
+// recording. Players ignore instructions they don't know, so the recording still replays.
+const RecordingReconnect = "reconnect"
+
+// RecordingTunnel is a Tunnel that writes everything guacd sends to a session recording, which
+// guacenc and guacamole-common-js's SessionRecording can replay. Recording is part of the audit
+// trail, so if it fails the session ends.
+//
+// The recording is the .guac format: the instructions as guacd sent them, without the internal
+// ones the websocket server doesn't forward either. Players pace themselves by the timestamps of
+// the sync instructions, so playback runs at the speed of the session. Writes are buffered and
+// flushed at each sync, so a frame is written at once, and when the tunnel is closed.
+//
+// Other formats, such as asciicast for terminals, can be recorded with NewRecordingTunnelFormat.
+type RecordingTunnel struct {
+	Tunnel
+	lock   sync.Mutex
+	buf    *bufio.Writer
+	w      io.WriteCloser
+	format RecordingFormat
+	closed bool
+}
+
+// NewRecordingTunnel records tunnel to w, which is closed with the tunnel
+func NewRecordingTunnel(tunnel Tunnel, w io.WriteCloser) *RecordingTunnel {
+	return NewRecordingTunnelFormat(tunnel, w, GuacFormat{})
+}
+
+// NewRecordingTunnelFormat records tunnel to w in the format, such as RecordingFormatFor the
+// session's protocol. w is closed with the tunnel.
+func NewRecordingTunnelFormat(tunnel Tunnel, w io.WriteCloser, format RecordingFormat) *RecordingTunnel {
+	t := &RecordingTunnel{Tunnel: tunnel, buf: bufio.NewWriter(w), w: w, format: format}
+	// a failure to write the header is reported by the first write or Close
+	_, _ = t.buf.Write(format.Header())
+	return t
+}
+
+// NewRecordingTunnelWriter records tunnel to w, which is flushed but left open when the tunnel
+// is closed
+func NewRecordingTunnelWriter(tunnel Tunnel, w io.Writer) *RecordingTunnel {
+	return NewRecordingTunnel(tunnel, nopWriteCloser{w})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type recordedReader struct {
+	InstructionReader
+	t *RecordingTunnel
+}
+
+func (r recordedReader) ReadSome() ([]byte, error) {
+	ins, err := r.InstructionReader.ReadSome()
+	if err != nil || len(ins) == 0 || bytes.HasPrefix(ins, internalOpcodeIns) {
+		return ins, err
+	}
+	if err = r.t.write(ins); err != nil {
+		return nil, err
+	}
+	return ins, nil
+}
+
+// AcquireReader returns a reader that records the instructions read from guacd
+func (t *RecordingTunnel) AcquireReader() InstructionReader {
+	return recordedReader{t.Tunnel.AcquireReader(), t}
+}
+
+func (t *RecordingTunnel) write(data []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrResourceClosed.NewError("Recording closed.")
+	}
+	encoded, frame := t.format.Encode(data)
+	if _, err := t.buf.Write(encoded); err != nil {
+		return ErrServer.NewError("Unable to write session recording.", err.Error())
+	}
+	if frame {
+		if err := t.buf.Flush(); err != nil {
+			return ErrServer.NewError("Unable to write session recording.", err.Error())
+		}
+	}
+	return nil
+}
+
+// FlushRecording writes out what has been recorded but not yet written, such as the end of a
+// frame that was cut short. The WebsocketServer calls it as the session ends, before the tunnel is
+// closed.
+func (t *RecordingTunnel) FlushRecording() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	if err := t.buf.Flush(); err != nil {
+		return ErrServer.NewError("Unable to write session recording.", err.Error())
+	}
+	return nil
+}
+
+// Close closes the tunnel and the recording
+func (t *RecordingTunnel) Close() error {
+	err := t.Tunnel.Close()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.closed {
+		t.closed = true
+		flushErr := t.buf.Flush()
+		if closeErr := t.w.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && flushErr != nil {
+			err = ErrServer.NewError("Unable to write session recording.", flushErr.Error())
+		}
+	}
+	return err
+}
+
+// RecordingStore keeps session recordings as files in a directory
+type RecordingStore struct {
+	// Dir is the directory recordings are written to
+	Dir string
+	// Append continues the recording of a session identity, such as a user and host, when it
+	// reconnects rather than starting a new file, with a RecordingReconnect instruction between
+	// the connections. Only one connection per identity should be recorded at a time.
+	Append bool
+}
+
+// Path returns the file a session identity is recorded to when appending. The identity is
+// encoded so it can't escape Dir.
+func (s *RecordingStore) Path(identity string) string {
+	return filepath.Join(s.Dir, base64.RawURLEncoding.EncodeToString([]byte(identity))+".guac")
+}
+
+// Record wraps tunnel in a RecordingTunnel writing to the file for the session identity
+func (s *RecordingStore) Record(tunnel Tunnel, identity string) (*RecordingTunnel, error) {
+	path := s.Path(identity)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !s.Append {
+		path = fmt.Sprintf("%v-%v.guac", path[:len(path)-len(".guac")], time.Now().UnixNano())
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return nil, ErrServer.NewError("Unable to open session recording.", err.Error())
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, ErrServer.NewError("Unable to open session recording.", err.Error())
+	}
+	if info.Size() > 0 {
+		marker := NewInstruction(InternalDataOpcode, RecordingReconnect, strconv.FormatInt(time.Now().UnixMilli(), 10))
+		if _, err = file.Write(marker.Bytes()); err != nil {
+			_ = file.Close()
+			return nil, ErrServer.NewError("Unable to write session recording.", err.Error())
+		}
+	}
+	return NewRecordingTunnel(tunnel, file), nil
+}
+
+// RecordConnection wraps tunnel in a RecordingTunnel writing to a new file named by its
+// connection ID, such as "$<uuid>.guac", for recordings looked up by the ID an OnConnectWs hook
+// or the session's logs report
+func (s *RecordingStore) RecordConnection(tunnel Tunnel) (*RecordingTunnel, error) {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, tunnel.ConnectionID())
+	if name == "" {
+		return nil, ErrServer.NewError("Unable to open session recording.", "invalid connection ID")
+	}
+	file, err := os.OpenFile(filepath.Join(s.Dir, name+".guac"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, ErrServer.NewError("Unable to open session recording.", err.Error())
+	}
+	return NewRecordingTunnel(tunnel, file), nil
+}
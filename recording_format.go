@@ -0,0 +1,173 @@
+package guac
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordingFormat serializes what guacd sends into a session recording. A format keeps the state
+// of one recording, so each RecordingTunnel needs its own.
+type RecordingFormat interface {
+	// Header returns what the recording starts with, if anything
+	Header() []byte
+	// Encode returns what records the instructions in data, if anything, and whether a frame
+	// ended, so what was recorded so far should be written out
+	Encode(data []byte) ([]byte, bool)
+}
+
+// GuacFormat records the instructions as guacd sent them, the .guac format guacenc and
+// guacamole-common-js's SessionRecording replay
+type GuacFormat struct{}
+
+// Header implements RecordingFormat
+func (GuacFormat) Header() []byte {
+	return nil
+}
+
+// Encode implements RecordingFormat, ending a frame at each sync
+func (GuacFormat) Encode(data []byte) ([]byte, bool) {
+	return data, hasOpcode(data, "sync")
+}
+
+// RecordingFormatFor returns a format suiting the protocol: asciicast for the text protocols, so
+// their recordings play in terminal players, and the .guac format for graphical ones
+func RecordingFormatFor(protocol string) RecordingFormat {
+	if textProtocols[protocol] {
+		return NewAsciicastFormat(DefaultAsciicastWidth, DefaultAsciicastHeight)
+	}
+	return GuacFormat{}
+}
+
+const (
+	// AsciicastPipe is the name of the pipe streams AsciicastFormat records terminal output from.
+	// It mirrors the STDIN pipe guacd's terminal reads input from.
+	AsciicastPipe = "STDOUT"
+	// DefaultAsciicastWidth and DefaultAsciicastHeight are the terminal size RecordingFormatFor
+	// gives asciicast recordings, in columns and rows
+	DefaultAsciicastWidth  = 80
+	DefaultAsciicastHeight = 24
+)
+
+// AsciicastFormat records terminal output as an asciicast v2 recording, a line of JSON for the
+// header followed by one for each output event, which asciinema and other terminal players
+// replay.
+//
+// guacd draws a terminal as images rather than sending its text, so the output recorded is the
+// text guacd sends on text/* pipe streams named AsciicastPipe, which a guacd configured to mirror
+// its terminal output sends alongside the display. The output of each frame is an event at the
+// frame's sync, which is when the client shows it, so playback runs at the speed of the session.
+// Output after the last sync, and everything else guacd sends, is left out.
+type AsciicastFormat struct {
+	// Width and Height are the size of the terminal in columns and rows
+	Width  int
+	Height int
+	// Title optionally names the recording
+	Title string
+
+	// streams are the output pipes open, by index, with the start of a character cut off at the
+	// end of the last blob
+	streams map[string][]byte
+	// frame is the output since the last sync
+	frame []byte
+	// first is the timestamp of the first sync, in milliseconds
+	first  int64
+	synced bool
+}
+
+// NewAsciicastFormat creates an asciicast format for a terminal of width columns and height rows
+func NewAsciicastFormat(width, height int) *AsciicastFormat {
+	return &AsciicastFormat{Width: width, Height: height, streams: map[string][]byte{}}
+}
+
+// asciicastHeader is the first line of an asciicast v2 recording
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+// Header implements RecordingFormat
+func (f *AsciicastFormat) Header() []byte {
+	header, _ := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     f.Width,
+		Height:    f.Height,
+		Timestamp: time.Now().Unix(),
+		Title:     f.Title,
+	})
+	return append(header, '\n')
+}
+
+// Encode implements RecordingFormat, ending a frame at each sync
+func (f *AsciicastFormat) Encode(data []byte) ([]byte, bool) {
+	if f.streams == nil {
+		f.streams = map[string][]byte{}
+	}
+	var out []byte
+	synced := false
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			break
+		}
+		raw := data[:n]
+		data = data[n:]
+		elements, err := peekElements(raw, 4)
+		if err != nil || len(elements) < 2 {
+			continue
+		}
+		switch elements[0] {
+		case "sync":
+			timestamp, err := strconv.ParseInt(elements[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			if !f.synced {
+				f.first, f.synced = timestamp, true
+			}
+			out = f.event(out, timestamp)
+			synced = true
+		case "pipe":
+			if len(elements) == 4 && strings.HasPrefix(elements[2], "text/") && elements[3] == AsciicastPipe {
+				f.streams[elements[1]] = nil
+			}
+		case "blob":
+			partial, ok := f.streams[elements[1]]
+			if !ok {
+				continue
+			}
+			ins, err := Parse(raw)
+			if err != nil || len(ins.Args) < 2 {
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(ins.Args[1])
+			if err != nil {
+				continue
+			}
+			text := append(partial, decoded...)
+			complete := completeRunes(text)
+			f.streams[elements[1]] = append([]byte(nil), text[complete:]...)
+			f.frame = append(f.frame, text[:complete]...)
+		case "end":
+			delete(f.streams, elements[1])
+		}
+	}
+	return out, synced
+}
+
+// event appends an event with the output of the frame ended by the sync at timestamp, if there
+// is any
+func (f *AsciicastFormat) event(out []byte, timestamp int64) []byte {
+	if len(f.frame) == 0 {
+		return out
+	}
+	seconds := float64(timestamp-f.first) / 1000
+	event, _ := json.Marshal([]any{seconds, "o", string(f.frame)})
+	f.frame = f.frame[:0]
+	return append(append(out, event...), '\n')
+}
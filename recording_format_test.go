@@ -0,0 +1,67 @@
+package guac
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAsciicastFormat(t *testing.T) {
+	text := []byte("héllo\r\n")
+	// the é is split between blobs
+	first, second := base64.StdEncoding.EncodeToString(text[:2]), base64.StdEncoding.EncodeToString(text[2:])
+	var w flushCounter
+	tunnel := NewRecordingTunnelFormat(&fakeTunnel{reader: &sliceReader{instructions: []string{
+		"4.size,1.0,3.640,3.480;",
+		NewInstruction("pipe", "5", "text/plain", AsciicastPipe).String(),
+		NewInstruction("blob", "5", first).String() + "4.sync,4.1000;",
+		// other streams are left out
+		NewInstruction("img", "6", "14", "0", "image/png", "0", "0").String() + NewInstruction("blob", "6", "AAAA").String(),
+		NewInstruction("blob", "5", second).String() + "3.end,1.5;4.sync,4.2500;",
+		NewInstruction("blob", "5", "AAAA").String(),
+	}}}, nopWriteCloser{&w}, &AsciicastFormat{Width: 100, Height: 30, Title: "ssh"})
+	reader := tunnel.AcquireReader()
+	for i := 0; i < 6; i++ {
+		if _, err := reader.ReadSome(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a header and an event a frame, got %q", w.String())
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width != 100 || header.Height != 30 || header.Title != "ssh" || header.Timestamp == 0 {
+		t.Error("Unexpected header", lines[0])
+	}
+	// each frame's output is timed from the first sync
+	for i, expect := range []struct {
+		seconds float64
+		text    string
+	}{{0, "h"}, {1.5, "éllo\r\n"}} {
+		var event []any
+		if err := json.Unmarshal([]byte(lines[i+1]), &event); err != nil {
+			t.Fatal(err)
+		}
+		if len(event) != 3 || event[0] != expect.seconds || event[1] != "o" || event[2] != expect.text {
+			t.Error("Unexpected event", lines[i+1])
+		}
+	}
+}
+
+func TestRecordingFormatFor(t *testing.T) {
+	if _, ok := RecordingFormatFor("ssh").(*AsciicastFormat); !ok {
+		t.Error("Expected asciicast for ssh")
+	}
+	if _, ok := RecordingFormatFor("rdp").(GuacFormat); !ok {
+		t.Error("Expected the .guac format for rdp")
+	}
+}
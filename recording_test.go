@@ -0,0 +1,168 @@
+package guac
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordSession reads every instruction through a recorded tunnel, as the websocket server does
+func recordSession(t *testing.T, store *RecordingStore, identity string, instructions ...string) {
+	tunnel, err := store.Record(&fakeTunnel{reader: &sliceReader{instructions: instructions}}, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := tunnel.AcquireReader()
+	for {
+		if _, err = reader.ReadSome(); err != nil {
+			break
+		}
+	}
+	if err = tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replay parses a recording into its instructions
+func replay(t *testing.T, path string) []*Instruction {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var instructions []*Instruction
+	for len(data) > 0 {
+		n, err := scanInstruction(data)
+		if err != nil {
+			t.Fatal("Recording is not replayable:", err)
+		}
+		ins, err := Parse(data[:n])
+		if err != nil {
+			t.Fatal("Recording is not replayable:", err)
+		}
+		instructions = append(instructions, ins)
+		data = data[n:]
+	}
+	return instructions
+}
+
+func opcodes(instructions []*Instruction) string {
+	var ret []string
+	for _, ins := range instructions {
+		ret = append(ret, ins.Opcode)
+	}
+	return strings.Join(ret, ",")
+}
+
+func TestRecordingStore_Append(t *testing.T) {
+	store := &RecordingStore{Dir: t.TempDir(), Append: true}
+
+	recordSession(t, store, "alice@10.0.0.1", "4.size,1.0,4.1024,3.768;", "0.,4.ping;", "4.sync,3.100;")
+	recordSession(t, store, "alice@10.0.0.1", "4.size,1.0,3.800,3.600;", "4.sync,3.200;")
+	recordSession(t, store, "bob@10.0.0.1", "4.sync,3.300;")
+
+	instructions := replay(t, store.Path("alice@10.0.0.1"))
+	if got := opcodes(instructions); got != "size,sync,,size,sync" {
+		t.Fatal("Unexpected recording", got)
+	}
+	if marker := instructions[2]; marker.Args[0] != RecordingReconnect || len(marker.Args) != 2 {
+		t.Error("Unexpected reconnect marker", marker)
+	}
+	if got := opcodes(replay(t, store.Path("bob@10.0.0.1"))); got != "sync" {
+		t.Error("Expected a separate recording for another identity, got", got)
+	}
+
+	files, _ := os.ReadDir(store.Dir)
+	if len(files) != 2 {
+		t.Error("Expected 2 recordings, got", len(files))
+	}
+}
+
+func TestRecordingStore_New(t *testing.T) {
+	store := &RecordingStore{Dir: t.TempDir()}
+	recordSession(t, store, "alice", "4.sync,3.100;")
+	recordSession(t, store, "alice", "4.sync,3.200;")
+
+	files, _ := filepath.Glob(filepath.Join(store.Dir, "*.guac"))
+	if len(files) != 2 {
+		t.Fatal("Expected a recording per connection, got", files)
+	}
+	for _, file := range files {
+		if got := opcodes(replay(t, file)); got != "sync" {
+			t.Error("Unexpected recording", got)
+		}
+	}
+}
+
+func TestRecordingStore_Path(t *testing.T) {
+	store := &RecordingStore{Dir: "/recordings"}
+	if path := store.Path("../../etc/passwd"); filepath.Dir(path) != "/recordings" {
+		t.Error("Identity escaped the directory", path)
+	}
+}
+
+// flushCounter counts the writes that reach it
+type flushCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (f *flushCounter) Write(p []byte) (int, error) {
+	f.writes++
+	return f.Buffer.Write(p)
+}
+
+func TestRecordingTunnel_FlushesFrames(t *testing.T) {
+	var w flushCounter
+	tunnel := NewRecordingTunnelWriter(&fakeTunnel{reader: &sliceReader{instructions: []string{
+		"4.size,1.0,4.1024,3.768;", "4.rect,1.0,1.0,1.0,2.10,2.10;", "0.,4.ping;", "4.sync,3.100;", "4.cfill,1.0;",
+	}}}, &w)
+	reader := tunnel.AcquireReader()
+	for i := 0; i < 4; i++ {
+		if _, err := reader.ReadSome(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the frame is written at once at its sync
+	if w.writes != 1 || w.String() != "4.size,1.0,4.1024,3.768;4.rect,1.0,1.0,1.0,2.10,2.10;4.sync,3.100;" {
+		t.Errorf("Expected the frame in one write, got %v writes of %q", w.writes, w.String())
+	}
+
+	// the rest is flushed on close
+	if _, err := reader.ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(w.String(), "4.sync,3.100;4.cfill,1.0;") {
+		t.Errorf("Expected the rest flushed on close, got %q", w.String())
+	}
+}
+
+func TestRecordingStore_RecordConnection(t *testing.T) {
+	store := &RecordingStore{Dir: t.TempDir()}
+	tunnel, guacd := newFakeGuacd(t)
+	recorded, err := store.RecordConnection(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = guacd.Write([]byte("4.size,1.0,3.800,3.600;"))
+	}()
+	if _, err = recorded.AcquireReader().ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	recorded.ReleaseReader()
+	if err = recorded.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := opcodes(replay(t, filepath.Join(store.Dir, "$fake.guac"))); got != "size" {
+		t.Error("Unexpected recording", got)
+	}
+	if _, err = store.RecordConnection(tunnel); err == nil {
+		t.Error("Expected an existing recording not to be overwritten")
+	}
+}
@@ -0,0 +1,251 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisClient is the part of a Redis client RedisSessionStore uses, so any client library can
+// be adapted to it. Keys and fields are strings and HGetAll returns the hash's values as
+// strings, as Redis does.
+type RedisClient interface {
+	HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error)
+	HSet(ctx context.Context, key, field, value string) error
+	HDel(ctx context.Context, key string, fields ...string) error
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Del(ctx context.Context, key string) error
+	// Keys returns the keys matching a glob-style pattern, such as with SCAN
+	Keys(ctx context.Context, pattern string) ([]string, error)
+}
+
+const (
+	// DefaultRedisSessionPrefix is the default RedisSessionStore.Prefix
+	DefaultRedisSessionPrefix = "guac:sessions:"
+	// DefaultRedisSessionTTL is how long the sessions of a pod that stopped refreshing them are
+	// kept, unless NewRedisSessionStore is given another
+	DefaultRedisSessionTTL = time.Minute
+	// DefaultRedisTimeout is the default RedisSessionStore.Timeout
+	DefaultRedisTimeout = time.Second
+)
+
+// RedisSessionStore is a SessionStore shared by several processes, such as pods behind a load
+// balancer. Each pod keeps its sessions in a hash of connection IDs to session counts under
+// Prefix and its name, which expires after the TTL unless Run refreshes it, so the sessions of
+// a pod that dies are forgotten.
+//
+// Redis is only a shared view: each pod also counts its own sessions in memory. While Redis is
+// unavailable, errors are logged, Sessions falls back to the pod's own sessions and Run puts
+// Redis right once it is back, so neither connecting nor disconnecting depends on it.
+type RedisSessionStore struct {
+	// Prefix is prepended to the pod name to make its key
+	Prefix string
+	// Timeout bounds each call to Redis, so an unresponsive Redis doesn't hold up connecting
+	Timeout time.Duration
+
+	client RedisClient
+	pod    string
+	ttl    time.Duration
+	local  *MemorySessionStore
+}
+
+// NewRedisSessionStore creates a store for the pod, which must be unique among the processes
+// sharing client, keeping its sessions for ttl, or DefaultRedisSessionTTL if it is zero
+func NewRedisSessionStore(client RedisClient, pod string, ttl time.Duration) *RedisSessionStore {
+	if ttl <= 0 {
+		ttl = DefaultRedisSessionTTL
+	}
+	return &RedisSessionStore{
+		Prefix:  DefaultRedisSessionPrefix,
+		Timeout: DefaultRedisTimeout,
+		client:  client,
+		pod:     pod,
+		ttl:     ttl,
+		local:   NewMemorySessionStore(),
+	}
+}
+
+// Pod returns the name the store records its sessions under
+func (s *RedisSessionStore) Pod() string {
+	return s.pod
+}
+
+func (s *RedisSessionStore) key() string {
+	return s.Prefix + s.pod
+}
+
+// context returns the context bounding a call to Redis
+func (s *RedisSessionStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.Timeout)
+}
+
+// Add records a session with the connection ID for the pod
+func (s *RedisSessionStore) Add(id string, req *http.Request) {
+	s.local.Add(id, req)
+	s.increment(id, 1)
+}
+
+// Delete removes a session Add recorded
+func (s *RedisSessionStore) Delete(id string, req *http.Request, tunnel Tunnel) {
+	if s.local.Get(id) == 0 {
+		return
+	}
+	s.local.Delete(id, req, tunnel)
+	s.increment(id, -1)
+}
+
+// increment changes the pod's count of id in Redis. Increments commute, so concurrent sessions
+// don't need to be ordered, and a count left at zero is removed by the next Refresh.
+func (s *RedisSessionStore) increment(id string, incr int64) {
+	ctx, cancel := s.context()
+	defer cancel()
+	key := s.key()
+	if _, err := s.client.HIncrBy(ctx, key, id, incr); err != nil {
+		globalLogger.Warn().Err(err).Str("connection_id", id).Msg("unable to record session in redis")
+		return
+	}
+	if err := s.client.Expire(ctx, key, s.ttl); err != nil {
+		globalLogger.Warn().Err(err).Msg("unable to refresh sessions in redis")
+	}
+}
+
+// Refresh writes the pod's sessions to Redis, correcting whatever it missed, and renews their
+// TTL
+func (s *RedisSessionStore) Refresh() error {
+	ctx, cancel := s.context()
+	defer cancel()
+	key := s.key()
+	current := map[string]int{}
+	for _, session := range s.local.Sessions() {
+		current[session.UUID] = session.Num
+	}
+	recorded, err := s.client.HGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for id := range recorded {
+		if _, ok := current[id]; !ok {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		if err = s.client.HDel(ctx, key, stale...); err != nil {
+			return err
+		}
+	}
+	for id, num := range current {
+		if recorded[id] == strconv.Itoa(num) {
+			continue
+		}
+		if err = s.client.HSet(ctx, key, id, strconv.Itoa(num)); err != nil {
+			return err
+		}
+	}
+	if len(current) == 0 {
+		return nil
+	}
+	return s.client.Expire(ctx, key, s.ttl)
+}
+
+// Run refreshes the pod's sessions three times per TTL until ctx is done, then removes them
+// from Redis, as the pod is going away
+func (s *RedisSessionStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(); err != nil {
+			globalLogger.Warn().Err(err).Msg("unable to refresh sessions in redis")
+		}
+		select {
+		case <-ctx.Done():
+			stopCtx, cancel := s.context()
+			defer cancel()
+			if err := s.client.Del(stopCtx, s.key()); err != nil {
+				globalLogger.Warn().Err(err).Msg("unable to remove sessions from redis")
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sessions returns the active sessions of every pod, ordered by connection ID. If Redis is
+// unavailable, it returns the pod's own.
+func (s *RedisSessionStore) Sessions() []SessionCount {
+	sessions, err := s.shared()
+	if err != nil {
+		globalLogger.Warn().Err(err).Msg("unable to read sessions from redis, listing this pod's")
+		sessions = s.local.Sessions()
+		for i := range sessions {
+			sessions[i].Pods = []string{s.pod}
+		}
+	}
+	return sessions
+}
+
+// Get returns the number of active sessions with the connection ID on every pod. If Redis is
+// unavailable, it returns the pod's own.
+func (s *RedisSessionStore) Get(id string) int {
+	for _, session := range s.Sessions() {
+		if session.UUID == id {
+			return session.Num
+		}
+	}
+	return 0
+}
+
+// shared reads the sessions of every pod from Redis
+func (s *RedisSessionStore) shared() ([]SessionCount, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	keys, err := s.client.Keys(ctx, escapeRedisPattern(s.Prefix)+"*")
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*SessionCount{}
+	for _, key := range keys {
+		pod := strings.TrimPrefix(key, s.Prefix)
+		counts, err := s.client.HGetAll(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		for id, value := range counts {
+			// counts left at zero or below by a failed increment are skipped
+			num, err := strconv.Atoi(value)
+			if err != nil || num <= 0 {
+				continue
+			}
+			session, ok := byID[id]
+			if !ok {
+				session = &SessionCount{UUID: id}
+				byID[id] = session
+			}
+			session.Num += num
+			session.Pods = append(session.Pods, pod)
+		}
+	}
+	sessions := make([]SessionCount, 0, len(byID))
+	for _, session := range byID {
+		sort.Strings(session.Pods)
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].UUID < sessions[j].UUID })
+	return sessions, nil
+}
+
+// ServeHTTP serves the active sessions of every pod, see SessionStore
+func (s *RedisSessionStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveSessions(w, r, s.Sessions)
+}
+
+var redisPatternEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// escapeRedisPattern makes a key match itself in a Redis glob-style pattern
+func escapeRedisPattern(key string) string {
+	return redisPatternEscaper.Replace(key)
+}
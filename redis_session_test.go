@@ -0,0 +1,232 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis keeps hashes in memory, failing every call while down is set
+type fakeRedis struct {
+	lock   sync.Mutex
+	down   bool
+	hashes map[string]map[string]string
+	ttls   map[string]time.Duration
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{hashes: map[string]map[string]string{}, ttls: map[string]time.Duration{}}
+}
+
+var errRedisDown = errors.New("connection refused")
+
+func (r *fakeRedis) setDown(down bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.down = down
+}
+
+func (r *fakeRedis) HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.down {
+		return 0, errRedisDown
+	}
+	if r.hashes[key] == nil {
+		r.hashes[key] = map[string]string{}
+	}
+	n, _ := strconv.ParseInt(r.hashes[key][field], 10, 64)
+	n += incr
+	r.hashes[key][field] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (r *fakeRedis) HSet(ctx context.Context, key, field, value string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.down {
+		return errRedisDown
+	}
+	if r.hashes[key] == nil {
+		r.hashes[key] = map[string]string{}
+	}
+	r.hashes[key][field] = value
+	return nil
+}
+
+func (r *fakeRedis) HDel(ctx context.Context, key string, fields ...string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.down {
+		return errRedisDown
+	}
+	for _, field := range fields {
+		delete(r.hashes[key], field)
+	}
+	if len(r.hashes[key]) == 0 {
+		delete(r.hashes, key)
+	}
+	return nil
+}
+
+func (r *fakeRedis) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.down {
+		return nil, errRedisDown
+	}
+	hash := map[string]string{}
+	for field, value := range r.hashes[key] {
+		hash[field] = value
+	}
+	return hash, nil
+}
+
+func (r *fakeRedis) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.down {
+		return errRedisDown
+	}
+	r.ttls[key] = ttl
+	return nil
+}
+
+func (r *fakeRedis) Del(ctx context.Context, key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.down {
+		return errRedisDown
+	}
+	delete(r.hashes, key)
+	return nil
+}
+
+// Keys only supports patterns matching a prefix
+func (r *fakeRedis) Keys(ctx context.Context, pattern string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.down {
+		return nil, errRedisDown
+	}
+	prefix := strings.NewReplacer(`\*`, `*`, `\?`, `?`, `\[`, `[`, `\]`, `]`, `\\`, `\`).Replace(strings.TrimSuffix(pattern, "*"))
+	var keys []string
+	for key := range r.hashes {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	redis := newFakeRedis()
+	a := NewRedisSessionStore(redis, "pod-a", 30*time.Second)
+	b := NewRedisSessionStore(redis, "pod-b", 30*time.Second)
+
+	a.Add("$1", nil)
+	a.Add("$1", nil)
+	b.Add("$1", nil)
+	b.Add("$2", nil)
+	b.Delete("$2", nil, nil)
+	// deleting what was never added isn't counted
+	b.Delete("$3", nil, nil)
+
+	expect := []SessionCount{{UUID: "$1", Num: 3, Pods: []string{"pod-a", "pod-b"}}}
+	for _, store := range []*RedisSessionStore{a, b} {
+		if sessions := store.Sessions(); !reflect.DeepEqual(sessions, expect) {
+			t.Errorf("Expected %+v from %s, got %+v", expect, store.Pod(), sessions)
+		}
+	}
+	if n := b.Get("$1"); n != 3 {
+		t.Error("Expected the sessions of both pods, got", n)
+	}
+	if ttl := redis.ttls[DefaultRedisSessionPrefix+"pod-a"]; ttl != 30*time.Second {
+		t.Error("Expected the pod's sessions to expire, got", ttl)
+	}
+
+	// the endpoint is the same as the memory store's
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sessions/", nil))
+	var got []SessionCount
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %+v, got %q %v", expect, w.Body.String(), err)
+	}
+
+	// Refresh removes the count left at zero
+	if err := b.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if hash := redis.hashes[DefaultRedisSessionPrefix+"pod-b"]; !reflect.DeepEqual(hash, map[string]string{"$1": "1"}) {
+		t.Error("Expected only the active session, got", hash)
+	}
+}
+
+func TestRedisSessionStore_Unavailable(t *testing.T) {
+	redis := newFakeRedis()
+	a := NewRedisSessionStore(redis, "pod-a", time.Minute)
+	b := NewRedisSessionStore(redis, "pod-b", time.Minute)
+	b.Add("$other", nil)
+
+	// sessions come and go while Redis is down
+	redis.setDown(true)
+	a.Add("$1", nil)
+	a.Add("$2", nil)
+	a.Delete("$2", nil, nil)
+	if sessions := a.Sessions(); !reflect.DeepEqual(sessions, []SessionCount{{UUID: "$1", Num: 1, Pods: []string{"pod-a"}}}) {
+		t.Error("Expected the pod's own sessions, got", sessions)
+	}
+	if err := a.Refresh(); err == nil {
+		t.Error("Expected the refresh to fail")
+	}
+
+	// and are put right once it is back
+	redis.setDown(false)
+	if err := a.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []SessionCount{
+		{UUID: "$1", Num: 1, Pods: []string{"pod-a"}},
+		{UUID: "$other", Num: 1, Pods: []string{"pod-b"}},
+	}
+	if sessions := b.Sessions(); !reflect.DeepEqual(sessions, expect) {
+		t.Errorf("Expected %+v, got %+v", expect, sessions)
+	}
+}
+
+func TestRedisSessionStore_Run(t *testing.T) {
+	redis := newFakeRedis()
+	store := NewRedisSessionStore(redis, "pod-a", 30*time.Millisecond)
+	redis.setDown(true)
+	store.Add("$1", nil)
+	redis.setDown(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		store.Run(ctx)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(store.Sessions()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected Run to write the sessions")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// a pod that stops removes its sessions
+	cancel()
+	<-stopped
+	if sessions := store.Sessions(); len(sessions) != 0 {
+		t.Error("Expected no sessions, got", sessions)
+	}
+}
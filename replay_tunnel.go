@@ -0,0 +1,233 @@
+package guac
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReplayTunnel is a Tunnel that plays a .guac session recording, such as one written by a
+// RecordingTunnel, as if guacd were sending it, so a WebsocketServer can serve recorded
+// sessions without guacd. Playback is paced by the timestamps of the recording's sync
+// instructions, and whatever the client sends is discarded.
+type ReplayTunnel struct {
+	r     io.Reader
+	uuid  uuid.UUID
+	id    string
+	speed float64
+
+	readerLock CountedLock
+	writerLock CountedLock
+
+	// buf holds what has been read from the recording but not returned, and the rest of the
+	// playback state is only used by the reader too
+	buf       []byte
+	eof       bool
+	firstSync int64
+	started   bool
+	base      time.Time
+
+	// position is how far playback is, and seekTo how far it should play without pausing,
+	// both as durations in the recording. seeked wakes a paused reader after a Seek.
+	position atomic.Int64
+	seekTo   atomic.Int64
+	seeked   chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewReplayTunnel plays the recording read from r at speed times real time, or at real time if
+// speed isn't positive. r is closed with the tunnel if it is an io.Closer.
+func NewReplayTunnel(r io.Reader, speed float64) *ReplayTunnel {
+	if speed <= 0 {
+		speed = 1
+	}
+	id := uuid.New()
+	return &ReplayTunnel{
+		r:      r,
+		uuid:   id,
+		id:     "$replay-" + id.String(),
+		speed:  speed,
+		seeked: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// Seek plays the recording without pausing until position, a duration from its first sync, and
+// at its speed from there. The display can't be unwound, so a position already played does
+// nothing.
+func (t *ReplayTunnel) Seek(position time.Duration) {
+	t.seekTo.Store(int64(position))
+	select {
+	case t.seeked <- struct{}{}:
+	default:
+	}
+}
+
+// Position returns how far playback is, as a duration from the recording's first sync
+func (t *ReplayTunnel) Position() time.Duration {
+	return time.Duration(t.position.Load())
+}
+
+// AcquireReader acquires the reader lock
+func (t *ReplayTunnel) AcquireReader() InstructionReader {
+	t.readerLock.Lock()
+	return t
+}
+
+// ReleaseReader releases the reader lock
+func (t *ReplayTunnel) ReleaseReader() {
+	t.readerLock.Unlock()
+}
+
+// HasQueuedReaderThreads returns true if more than one goroutine is trying to read
+func (t *ReplayTunnel) HasQueuedReaderThreads() bool {
+	return t.readerLock.HasQueued()
+}
+
+// AcquireWriter acquires the writer lock and returns a writer that discards the client's input
+func (t *ReplayTunnel) AcquireWriter() io.Writer {
+	t.writerLock.Lock()
+	return io.Discard
+}
+
+// ReleaseWriter releases the writer lock
+func (t *ReplayTunnel) ReleaseWriter() {
+	t.writerLock.Unlock()
+}
+
+// HasQueuedWriterThreads returns true if more than one goroutine is trying to write
+func (t *ReplayTunnel) HasQueuedWriterThreads() bool {
+	return t.writerLock.HasQueued()
+}
+
+// GetUUID returns the tunnel's UUID
+func (t *ReplayTunnel) GetUUID() string {
+	return t.uuid.String()
+}
+
+// ConnectionID returns a synthetic connection ID, as there is no guacd connection
+func (t *ReplayTunnel) ConnectionID() string {
+	return t.id
+}
+
+// Close stops playback, and closes the recording if it is an io.Closer
+func (t *ReplayTunnel) Close() (err error) {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		if closer, ok := t.r.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+// ReadSome returns the next instruction of the recording, pausing before each sync until it is
+// due. The end of the recording is returned as ErrConnectionClosed, like guacd closing.
+func (t *ReplayTunnel) ReadSome() ([]byte, error) {
+	for {
+		select {
+		case <-t.closed:
+			return nil, ErrConnectionClosed.NewError("Replay closed.")
+		default:
+		}
+
+		n, err := scanInstruction(t.buf)
+		if err == nil {
+			ins := t.buf[:n]
+			t.buf = t.buf[n:]
+			if err = t.pace(ins); err != nil {
+				return nil, err
+			}
+			return ins, nil
+		}
+		if err != ErrIncompleteInstruction {
+			return nil, ErrServer.NewError("Corrupt recording.", err.Error())
+		}
+		if t.eof {
+			return nil, ErrConnectionClosed.NewError("Recording ended.")
+		}
+		if err = t.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fill reads more of the recording into buf
+func (t *ReplayTunnel) fill() error {
+	chunk := make([]byte, MaxGuacMessage)
+	n, err := t.r.Read(chunk)
+	t.buf = append(t.buf, chunk[:n]...)
+	if err == io.EOF {
+		t.eof = true
+		return nil
+	}
+	if err != nil {
+		return ErrServer.NewError("Unable to read recording.", err.Error())
+	}
+	return nil
+}
+
+// Available returns true if the next instruction can be returned without reading or pausing
+func (t *ReplayTunnel) Available() bool {
+	n, err := scanInstruction(t.buf)
+	if err != nil {
+		return false
+	}
+	elements, err := peekElements(t.buf[:n], 1)
+	return err == nil && len(elements) == 1 && elements[0] != "sync"
+}
+
+// Flush does nothing, as the recording is buffered by the tunnel
+func (t *ReplayTunnel) Flush() {}
+
+// pace waits until a sync instruction is due, doing nothing for other instructions
+func (t *ReplayTunnel) pace(ins []byte) error {
+	elements, err := peekElements(ins, 2)
+	if err != nil || len(elements) < 2 || elements[0] != "sync" {
+		return nil
+	}
+	timestamp, err := strconv.ParseInt(elements[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	if !t.started {
+		t.started = true
+		t.firstSync = timestamp
+		t.base = time.Now()
+		return nil
+	}
+
+	position := time.Duration(timestamp-t.firstSync) * time.Millisecond
+	t.position.Store(int64(position))
+	if position <= time.Duration(t.seekTo.Load()) {
+		// carry on at speed from here once the seek is done
+		t.base = time.Now().Add(-t.scaled(position))
+		return nil
+	}
+	timer := time.NewTimer(time.Until(t.base.Add(t.scaled(position))))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-t.seeked:
+			if position <= time.Duration(t.seekTo.Load()) {
+				// the next sync carries on from the seek
+				return nil
+			}
+		case <-t.closed:
+			return ErrConnectionClosed.NewError("Replay closed.")
+		}
+	}
+}
+
+// scaled returns how long a duration of the recording takes to play
+func (t *ReplayTunnel) scaled(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / t.speed)
+}
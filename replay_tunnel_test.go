@@ -0,0 +1,119 @@
+package guac
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReplayTunnel_Pacing(t *testing.T) {
+	recording := "4.size,1.0,3.800,3.600;4.sync,4.1000;0.,9.reconnect,4.1050;4.rect,1.0,1.0,1.0,2.10,2.10;4.sync,4.1100;4.sync,4.1200;"
+	tests := []struct {
+		speed    float64
+		min, max time.Duration
+	}{
+		{1, 200 * time.Millisecond, time.Second},
+		{4, 50 * time.Millisecond, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		tunnel := NewReplayTunnel(strings.NewReader(recording), tt.speed)
+		reader := tunnel.AcquireReader()
+		start := time.Now()
+		var played []string
+		for {
+			ins, err := reader.ReadSome()
+			if err != nil {
+				if guacErr, ok := err.(*ErrGuac); !ok || guacErr.Kind != ErrConnectionClosed {
+					t.Error("Expected the end of the recording, got", err)
+				}
+				break
+			}
+			played = append(played, string(ins))
+		}
+		if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("Speed %v: expected playback to take %v to %v, took %v", tt.speed, tt.min, tt.max, elapsed)
+		}
+		if strings.Join(played, "") != recording {
+			t.Errorf("Expected the whole recording, got %q", played)
+		}
+		if tunnel.Position() != 200*time.Millisecond {
+			t.Error("Expected to be at the end of the recording, got", tunnel.Position())
+		}
+		_ = tunnel.Close()
+	}
+}
+
+func TestReplayTunnel_Seek(t *testing.T) {
+	recording := "4.sync,4.1000;4.sync,4.2000;4.sync,4.3000;4.sync,4.3100;"
+	tunnel := NewReplayTunnel(strings.NewReader(recording), 1)
+	defer func() { _ = tunnel.Close() }()
+	reader := tunnel.AcquireReader()
+	if _, err := reader.ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+
+	// skip a paused second, then carry on at speed from the seek
+	time.AfterFunc(20*time.Millisecond, func() { tunnel.Seek(2 * time.Second) })
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := reader.ReadSome(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Expected the seek to skip the pause, took", elapsed)
+	}
+	start = time.Now()
+	if _, err := reader.ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Error("Expected playback at speed after the seek, took", elapsed)
+	}
+}
+
+func TestReplayTunnel_Close(t *testing.T) {
+	tunnel := NewReplayTunnel(strings.NewReader("4.sync,4.1000;4.sync,5.60000;"), 1)
+	reader := tunnel.AcquireReader()
+	if _, err := reader.ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, func() { _ = tunnel.Close() })
+	if _, err := reader.ReadSome(); err == nil {
+		t.Error("Expected closing to end a pause")
+	}
+}
+
+func TestWebsocketServer_ReplayTunnel(t *testing.T) {
+	recording := "4.size,1.0,3.800,3.600;4.sync,4.1000;4.sync,4.1050;"
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewReplayTunnel(strings.NewReader(recording), 1), nil
+	}, nopLogger())
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	// input is discarded rather than ending playback
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("5.mouse,1.1,1.2;")); err != nil {
+		t.Fatal(err)
+	}
+
+	var received strings.Builder
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		received.Write(msg)
+	}
+	if received.String() != recording {
+		t.Errorf("Expected the recording, got %q", received.String())
+	}
+	waitDone(t, done)
+}
@@ -0,0 +1,138 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// drawingOpcodes are the instructions guacd sends to change the display
+var drawingOpcodes = map[string]bool{
+	"arc": true, "cfill": true, "clip": true, "close": true, "copy": true, "cstroke": true,
+	"cursor": true, "curve": true, "dispose": true, "distort": true, "identity": true,
+	"img": true, "jpeg": true, "lfill": true, "line": true, "lstroke": true, "move": true,
+	"png": true, "pop": true, "push": true, "rect": true, "reset": true, "set": true,
+	"shade": true, "size": true, "start": true, "transfer": true, "transform": true,
+}
+
+var syncPrefix = []byte("4.sync,")
+
+// frameCapture collects the drawing instructions of one frame, ending with its sync
+type frameCapture struct {
+	instructions []*Instruction
+	// images are the indexes of img streams opened in the frame, whose blobs are part of it
+	images map[string]bool
+	done   chan struct{}
+}
+
+// observe adds an instruction to the frame and returns true once the frame is complete
+func (c *frameCapture) observe(ins *Instruction) bool {
+	switch {
+	case ins.Opcode == "sync":
+		c.instructions = append(c.instructions, ins)
+		return true
+	case ins.Opcode == "img" && len(ins.Args) > 0:
+		c.images[ins.Args[0]] = true
+	case ins.Opcode == "blob" || ins.Opcode == "end":
+		if len(ins.Args) == 0 || !c.images[ins.Args[0]] {
+			return false
+		}
+		if ins.Opcode == "end" {
+			delete(c.images, ins.Args[0])
+		}
+	case !drawingOpcodes[ins.Opcode]:
+		return false
+	}
+	c.instructions = append(c.instructions, ins)
+	return false
+}
+
+// frameCapturer copies frames read from guacd to the captures waiting for them. Instructions
+// are copied rather than taken, so whatever is reading the stream keeps receiving them.
+type frameCapturer struct {
+	sync.Mutex
+	captures []*frameCapture
+	// lastSync is the timestamp of the last sync received from guacd
+	lastSync string
+}
+
+func newFrameCapturer() *frameCapturer {
+	return &frameCapturer{}
+}
+
+// observe passes an instruction read from guacd to the waiting captures
+func (f *frameCapturer) observe(raw []byte) {
+	isSync := bytes.HasPrefix(raw, syncPrefix)
+
+	f.Lock()
+	defer f.Unlock()
+	if len(f.captures) == 0 && !isSync {
+		return
+	}
+
+	ins, err := Parse(raw)
+	if err != nil {
+		return
+	}
+	if isSync && len(ins.Args) > 0 {
+		f.lastSync = ins.Args[0]
+	}
+
+	remaining := f.captures[:0]
+	for _, c := range f.captures {
+		if c.observe(ins) {
+			close(c.done)
+		} else {
+			remaining = append(remaining, c)
+		}
+	}
+	f.captures = remaining
+}
+
+// add starts capturing the next frame and returns the timestamp of the last sync, if any
+func (f *frameCapturer) add(c *frameCapture) string {
+	f.Lock()
+	defer f.Unlock()
+	f.captures = append(f.captures, c)
+	return f.lastSync
+}
+
+func (f *frameCapturer) remove(c *frameCapture) {
+	f.Lock()
+	defer f.Unlock()
+	for i, other := range f.captures {
+		if other == c {
+			f.captures = append(f.captures[:i], f.captures[i+1:]...)
+			return
+		}
+	}
+}
+
+// Screenshot captures the drawing instructions of the next frame guacd sends, up to and
+// including its sync, for rendering a thumbnail. The last frame is acknowledged with a sync so
+// guacd isn't holding the frame back waiting for the client. The stream must be being read, by a
+// running WebsocketServer for example, which carries on receiving every instruction while the
+// frame is captured.
+func (s *Stream) Screenshot(ctx context.Context) ([]*Instruction, error) {
+	capture := &frameCapture{
+		images: map[string]bool{},
+		done:   make(chan struct{}),
+	}
+	if lastSync := s.frames.add(capture); lastSync != "" {
+		if _, err := s.Write(NewInstruction("sync", lastSync).Bytes()); err != nil {
+			s.frames.remove(capture)
+			return nil, err
+		}
+	}
+
+	select {
+	case <-capture.done:
+		return capture.instructions, nil
+	case <-ctx.Done():
+		s.frames.remove(capture)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrUpstreamTimeout.NewError("No frame received from guacd in time.")
+		}
+		return nil, ErrResourceClosed.NewError("Screenshot cancelled.")
+	}
+}
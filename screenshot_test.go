@@ -0,0 +1,93 @@
+package guac
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSimpleTunnel_Screenshot(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+
+	// the pump keeps reading while the frame is captured
+	pumped := make(chan string, 100)
+	go func() {
+		reader := tunnel.AcquireReader()
+		for {
+			ins, err := reader.ReadSome()
+			if err != nil {
+				close(pumped)
+				return
+			}
+			pumped <- string(ins)
+		}
+	}()
+
+	if _, err := guacd.Write([]byte("4.sync,3.100;")); err != nil {
+		t.Fatal(err)
+	}
+	if ins := <-pumped; ins != "4.sync,3.100;" {
+		t.Fatal("Unexpected instruction", ins)
+	}
+
+	type result struct {
+		frame []*Instruction
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		frame, err := tunnel.Screenshot(ctx)
+		results <- result{frame, err}
+	}()
+
+	// guacd sends the next frame once the last one is acknowledged
+	if received := <-guacd.Received; received != "4.sync,3.100;" {
+		t.Fatal("Expected the last frame to be acknowledged, got", received)
+	}
+	frame := "3.img,1.1,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.1,4.AAAA;3.end,1.1;" +
+		"3.nop;4.blob,1.2,4.BBBB;4.rect,1.0,1.0,1.0,2.10,2.10;4.sync,3.200;"
+	if _, err := guacd.Write([]byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	expected := []string{"img", "blob", "end", "rect", "sync"}
+	if len(r.frame) != len(expected) {
+		t.Fatal("Unexpected frame", r.frame)
+	}
+	for i, opcode := range expected {
+		if r.frame[i].Opcode != opcode {
+			t.Error("Expected", opcode, "got", r.frame[i].Opcode)
+		}
+	}
+	if r.frame[4].Args[0] != "200" {
+		t.Error("Expected the frame to end with its sync, got", r.frame[4])
+	}
+
+	// every instruction still reached the pump
+	count := 0
+	for ins := range pumped {
+		count++
+		if ins == "4.sync,3.200;" {
+			break
+		}
+	}
+	if count != 7 {
+		t.Error("Expected the pump to read 7 instructions, got", count)
+	}
+}
+
+func TestSimpleTunnel_ScreenshotTimeout(t *testing.T) {
+	tunnel, _ := newFakeGuacd(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := tunnel.Screenshot(ctx); err == nil || err.(*ErrGuac).Kind != ErrUpstreamTimeout {
+		t.Error("Expected upstream timeout, got", err)
+	}
+}
@@ -1,10 +1,13 @@
 package guac
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
 const (
@@ -19,6 +22,25 @@ const (
 type Server struct {
 	tunnels *TunnelMap
 	connect func(*http.Request) (Tunnel, error)
+
+	// EnableCompression gzips read responses for clients that accept it, which saves bandwidth
+	// on the text instructions guacd sends. Each batch of instructions is still flushed to the
+	// client as soon as it is written.
+	EnableCompression bool
+
+	// Limiter optionally throttles clients opening tunnels. Connect requests it refuses get 429.
+	Limiter ConnectionLimiter
+
+	// ReadRequestTimeout and WriteRequestTimeout replace the http.Server's timeouts for the two
+	// kinds of tunnel request, which behave very differently, and leave them in place if unset.
+	// A read is a long poll streaming guacd's output until the client polls again, which the
+	// http.Server's WriteTimeout cuts off however healthy it is, so with ReadRequestTimeout set a
+	// read instead only fails once no batch has been sent for that long. A write uploads a
+	// few instructions and should be quick, so WriteRequestTimeout, if set, bounds how long its
+	// body takes to arrive, and then how long its response takes, and a write that stalls closes
+	// the tunnel and gets 408.
+	ReadRequestTimeout  time.Duration
+	WriteRequestTimeout time.Duration
 }
 
 // NewServer constructor
@@ -65,7 +87,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	guacErr := err.(*ErrGuac)
 	switch guacErr.Kind {
-	case ErrClient:
+	case ErrClient, ErrClientTooMany, ErrClientTimeout:
 		globalLogger.Warn().Err(err).Msg("HTTP tunnel request rejected")
 		s.sendError(w, guacErr.Status, err.Error())
 	default:
@@ -84,6 +106,10 @@ func (s *Server) handleTunnelRequestCore(response http.ResponseWriter, request *
 
 	// Call the supplied connect callback upon HTTP connect request
 	if query == "connect" {
+		if s.Limiter != nil && !s.Limiter.Allow(request) {
+			err = ErrClientTooMany.NewError("Too many connection attempts.")
+			return
+		}
 		tunnel, e := s.connect(request)
 		if e != nil {
 			err = ErrResourceNotFound.NewError("No tunnel created.", e.Error())
@@ -126,17 +152,27 @@ func (s *Server) doRead(response http.ResponseWriter, request *http.Request, tun
 	reader := tunnel.AcquireReader()
 	defer tunnel.ReleaseReader()
 
+	// the controller of the response itself, as the gzip writer doesn't unwrap
+	controller := http.NewResponseController(response)
+	s.extendReadDeadline(controller)
+
 	// Note that although we are sending text, Webkit browsers will
 	// buffer 1024 bytes before starting a normal stream if we use
 	// anything but application/octet-stream.
 	response.Header().Set("Content-Type", "application/octet-stream")
 	response.Header().Set("Cache-Control", "no-cache")
 
+	if s.EnableCompression && acceptsGzip(request) {
+		gz := newGzipResponseWriter(response)
+		defer gz.close()
+		response = gz
+	}
+
 	if v, ok := response.(http.Flusher); ok {
 		v.Flush()
 	}
 
-	err = s.writeSome(response, reader, tunnel)
+	err = s.writeSome(response, reader, tunnel, controller)
 
 	if err == nil {
 		// success
@@ -164,7 +200,7 @@ func (s *Server) doRead(response http.ResponseWriter, request *http.Request, tun
 }
 
 // writeSome drains the guacd buffer holding instructions into the response
-func (s *Server) writeSome(response http.ResponseWriter, guacd InstructionReader, tunnel Tunnel) (err error) {
+func (s *Server) writeSome(response http.ResponseWriter, guacd InstructionReader, tunnel Tunnel, controller *http.ResponseController) (err error) {
 	var message []byte
 
 	for {
@@ -189,6 +225,7 @@ func (s *Server) writeSome(response http.ResponseWriter, guacd InstructionReader
 			if v, ok := response.(http.Flusher); ok {
 				v.Flush()
 			}
+			s.extendReadDeadline(controller)
 		}
 
 		// No more messages another guacd can take over
@@ -222,17 +259,44 @@ func (s *Server) doWrite(response http.ResponseWriter, request *http.Request, tu
 	response.Header().Set("Cache-Control", "no-cache")
 	response.Header().Set("Content-Length", "0")
 
+	if s.WriteRequestTimeout > 0 {
+		// the response then has as long again, so a stalled write can still be answered
+		controller := http.NewResponseController(response)
+		deadline := time.Now().Add(s.WriteRequestTimeout)
+		if e := controller.SetReadDeadline(deadline); e != nil {
+			globalLogger.Debug().Err(e).Msg("Unable to set the deadline of a write request")
+		}
+		_ = controller.SetWriteDeadline(deadline.Add(s.WriteRequestTimeout))
+	}
+
 	writer := tunnel.AcquireWriter()
 	defer tunnel.ReleaseWriter()
 
 	_, err = io.Copy(writer, request.Body)
 
 	if err != nil {
+		copyErr := err
 		s.deregisterTunnel(tunnel)
 		if err = tunnel.Close(); err != nil {
 			globalLogger.Debug().Err(err).Msg("Error closing tunnel")
 		}
+		var netErr net.Error
+		if errors.As(copyErr, &netErr) && netErr.Timeout() {
+			return ErrClientTimeout.NewError("Write request timed out.", copyErr.Error())
+		}
 	}
 
 	return err
 }
+
+// extendReadDeadline gives a read response ReadRequestTimeout from now to send its next batch.
+// If it isn't set the deadline is left alone, so the http.Server's WriteTimeout applies.
+func (s *Server) extendReadDeadline(controller *http.ResponseController) {
+	if s.ReadRequestTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(s.ReadRequestTimeout)
+	if err := controller.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		globalLogger.Debug().Err(err).Msg("Unable to set the deadline of a read request")
+	}
+}
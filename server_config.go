@@ -0,0 +1,180 @@
+package guac
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ServerConfig holds the settings of a WebsocketServer that can be changed while it is serving.
+// The fields are those of WebsocketServer with the same names. Each connection reads the
+// settings once when it starts, so a change applies to the connections that start after it and
+// active sessions keep the settings they started with.
+//
+// MaxConcurrentHandshakes, the callbacks and the Filters, Authorizer, Interceptor and Metrics
+// aren't included, and are only read from the WebsocketServer's fields. MaxConcurrentHandshakes
+// is only read when the first connection starts.
+type ServerConfig struct {
+	MaxHandshakeDuration    time.Duration
+	ReadBufferSize          int
+	WriteBufferSize         int
+	EnableCompression       bool
+	CompressionLevel        int
+	MaxConnections          int
+	MaxSessionsPerUser      int
+	HandshakeQueueTimeout   time.Duration
+	FilterErrorPolicy       FilterErrorPolicy
+	FilterBudget            time.Duration
+	FilterBudgetPolicy      FilterBudgetPolicy
+	MaxInboundMessageBytes  int64
+	MaxOutboundClipboard    int
+	OutboundClipboardPolicy ClipboardPolicy
+	SendConnectionID        bool
+	MaxBufferLatency        time.Duration
+	CoalesceLayers          bool
+	CoalesceSyncs           bool
+	PingInterval            time.Duration
+	PongTimeout             time.Duration
+	IdleTimeout             time.Duration
+	AbsorbNops              bool
+	AwaitClientReady        bool
+	ClientReadyOpcode       string
+	ClientReadyLimit        int
+	DisconnectWait          time.Duration
+	LogUpgradeHeaders       bool
+	LogRepeatWindow         time.Duration
+	ThumbnailInterval       time.Duration
+	ThumbnailWidth          int
+}
+
+// Config returns the settings new connections use: the last ServerConfig applied, or the
+// server's fields if ApplyConfig hasn't been called
+func (s *WebsocketServer) Config() ServerConfig {
+	if config := s.config.Load(); config != nil {
+		return *config
+	}
+	return ServerConfig{
+		MaxHandshakeDuration:    s.MaxHandshakeDuration,
+		ReadBufferSize:          s.ReadBufferSize,
+		WriteBufferSize:         s.WriteBufferSize,
+		EnableCompression:       s.EnableCompression,
+		CompressionLevel:        s.CompressionLevel,
+		MaxConnections:          s.MaxConnections,
+		MaxSessionsPerUser:      s.MaxSessionsPerUser,
+		HandshakeQueueTimeout:   s.HandshakeQueueTimeout,
+		FilterErrorPolicy:       s.FilterErrorPolicy,
+		FilterBudget:            s.FilterBudget,
+		FilterBudgetPolicy:      s.FilterBudgetPolicy,
+		MaxInboundMessageBytes:  s.MaxInboundMessageBytes,
+		MaxOutboundClipboard:    s.MaxOutboundClipboard,
+		OutboundClipboardPolicy: s.OutboundClipboardPolicy,
+		SendConnectionID:        s.SendConnectionID,
+		MaxBufferLatency:        s.MaxBufferLatency,
+		CoalesceLayers:          s.CoalesceLayers,
+		CoalesceSyncs:           s.CoalesceSyncs,
+		PingInterval:            s.PingInterval,
+		PongTimeout:             s.PongTimeout,
+		IdleTimeout:             s.IdleTimeout,
+		AbsorbNops:              s.AbsorbNops,
+		AwaitClientReady:        s.AwaitClientReady,
+		ClientReadyOpcode:       s.ClientReadyOpcode,
+		ClientReadyLimit:        s.ClientReadyLimit,
+		DisconnectWait:          s.DisconnectWait,
+		LogUpgradeHeaders:       s.LogUpgradeHeaders,
+		LogRepeatWindow:         s.LogRepeatWindow,
+		ThumbnailInterval:       s.ThumbnailInterval,
+		ThumbnailWidth:          s.ThumbnailWidth,
+	}
+}
+
+// ApplyConfig validates the settings and replaces those new connections use, all at once, while
+// the server is serving. Active sessions are not disturbed. Once it is called the fields of the
+// WebsocketServer that ServerConfig covers are no longer read, so change the settings through
+// Config and ApplyConfig:
+//
+//	config := server.Config()
+//	config.IdleTimeout = 30 * time.Minute
+//	err := server.ApplyConfig(config)
+//
+// An invalid config returns an error and changes nothing.
+func (s *WebsocketServer) ApplyConfig(config ServerConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	s.config.Store(&config)
+	s.logger.Info().Interface("config", config).Msg("applied server config")
+	return nil
+}
+
+// validate returns an error if a setting is out of range
+func (c *ServerConfig) validate() error {
+	durations := map[string]time.Duration{
+		"MaxHandshakeDuration":  c.MaxHandshakeDuration,
+		"HandshakeQueueTimeout": c.HandshakeQueueTimeout,
+		"MaxBufferLatency":      c.MaxBufferLatency,
+		"FilterBudget":          c.FilterBudget,
+		"PingInterval":          c.PingInterval,
+		"PongTimeout":           c.PongTimeout,
+		"IdleTimeout":           c.IdleTimeout,
+		"DisconnectWait":        c.DisconnectWait,
+		"LogRepeatWindow":       c.LogRepeatWindow,
+		"ThumbnailInterval":     c.ThumbnailInterval,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			return ErrServer.NewError("Invalid server config.", name+" is negative")
+		}
+	}
+	sizes := map[string]int{
+		"ReadBufferSize":       c.ReadBufferSize,
+		"WriteBufferSize":      c.WriteBufferSize,
+		"MaxConnections":       c.MaxConnections,
+		"MaxSessionsPerUser":   c.MaxSessionsPerUser,
+		"ClientReadyLimit":     c.ClientReadyLimit,
+		"MaxOutboundClipboard": c.MaxOutboundClipboard,
+		"ThumbnailWidth":       c.ThumbnailWidth,
+	}
+	for name, n := range sizes {
+		if n < 0 {
+			return ErrServer.NewError("Invalid server config.", name+" is negative")
+		}
+	}
+	if c.CompressionLevel < 0 || c.CompressionLevel > 9 {
+		return ErrServer.NewError("Invalid server config.", "CompressionLevel "+strconv.Itoa(c.CompressionLevel)+" is not between 1 and 9")
+	}
+	if c.FilterErrorPolicy != FailClosed && c.FilterErrorPolicy != FailOpen {
+		return ErrServer.NewError("Invalid server config.", "unknown FilterErrorPolicy")
+	}
+	if c.FilterBudgetPolicy < BudgetWarn || c.FilterBudgetPolicy > BudgetTerminate {
+		return ErrServer.NewError("Invalid server config.", "unknown FilterBudgetPolicy")
+	}
+	if c.OutboundClipboardPolicy != ClipboardTruncate && c.OutboundClipboardPolicy != ClipboardDrop {
+		return ErrServer.NewError("Invalid server config.", "unknown OutboundClipboardPolicy")
+	}
+	return nil
+}
+
+// pongTimeout returns how long the client has to answer a keepalive ping
+func (c *ServerConfig) pongTimeout() time.Duration {
+	if c.PongTimeout > 0 {
+		return c.PongTimeout
+	}
+	return c.PingInterval
+}
+
+// upgrader returns the websocket upgrader for the settings, without CheckOrigin
+func (c *ServerConfig) upgrader() websocket.Upgrader {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    websocketReadBufferSize,
+		WriteBufferSize:   websocketWriteBufferSize,
+		EnableCompression: c.EnableCompression,
+	}
+	if c.ReadBufferSize > 0 {
+		upgrader.ReadBufferSize = c.ReadBufferSize
+	}
+	if c.WriteBufferSize > 0 {
+		upgrader.WriteBufferSize = c.WriteBufferSize
+	}
+	return upgrader
+}
@@ -0,0 +1,122 @@
+package guac
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_ApplyConfig(t *testing.T) {
+	wsServer := NewWebsocketServer(nil, nopLogger())
+	wsServer.IdleTimeout = time.Minute
+	config := wsServer.Config()
+	if config.IdleTimeout != time.Minute {
+		t.Error("Expected the config to have the server's settings, got", config.IdleTimeout)
+	}
+
+	invalid := []func(*ServerConfig){
+		func(c *ServerConfig) { c.PingInterval = -time.Second },
+		func(c *ServerConfig) { c.MaxConnections = -1 },
+		func(c *ServerConfig) { c.CompressionLevel = 42 },
+		func(c *ServerConfig) { c.FilterErrorPolicy = 7 },
+	}
+	for _, change := range invalid {
+		bad := config
+		change(&bad)
+		if err := wsServer.ApplyConfig(bad); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+	if wsServer.Config() != config {
+		t.Error("Expected a rejected config to change nothing")
+	}
+
+	config.IdleTimeout = time.Hour
+	config.SendConnectionID = true
+	if err := wsServer.ApplyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if wsServer.Config() != config {
+		t.Error("Expected the applied config, got", wsServer.Config())
+	}
+}
+
+func TestWebsocketServer_ApplyConfigConcurrent(t *testing.T) {
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	}, nopLogger())
+	url, done := serveWebsocket(t, wsServer)
+
+	stop := make(chan struct{})
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			config := wsServer.Config()
+			config.SendConnectionID = i%2 == 0
+			config.MaxBufferLatency = time.Duration(i%5) * time.Millisecond
+			config.CoalesceSyncs = !config.CoalesceSyncs
+			if err := wsServer.ApplyConfig(config); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	const clients = 20
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = ws.Close()
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < clients; i++ {
+		waitDone(t, done)
+	}
+	close(stop)
+	<-applied
+}
+
+func TestWebsocketServer_ApplyConfigNewConnections(t *testing.T) {
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	}, nopLogger())
+	url, done := serveWebsocket(t, wsServer)
+
+	config := wsServer.Config()
+	config.SendConnectionID = true
+	if err := wsServer.ApplyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	_, data, err := ws.ReadMessage()
+	if err != nil || !bytes.HasPrefix(data, internalOpcodeIns) {
+		t.Errorf("Expected the connection ID, got %q %v", data, err)
+	}
+	_ = ws.Close()
+	waitDone(t, done)
+}
@@ -0,0 +1,153 @@
+package guac
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveHTTPTunnel starts an HTTP tunnel to a guacd over a pipe behind an http.Server with a
+// short WriteTimeout and ReadTimeout, and connects it, returning the server's URL and the UUID
+func serveHTTPTunnel(t *testing.T, s *Server) (string, string) {
+	server := httptest.NewUnstartedServer(s)
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "/?connect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(uuid) != uuidLength {
+		t.Fatalf("Expected a UUID, got %d %q", resp.StatusCode, uuid)
+	}
+	return server.URL, string(uuid)
+}
+
+func TestServer_LongPollOutlastsWriteTimeout(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	})
+	s.ReadRequestTimeout = time.Second
+	url, uuid := serveHTTPTunnel(t, s)
+	// closing guacd ends the read, so the server isn't left waiting for it
+	t.Cleanup(func() { _ = guacd.Close() })
+
+	resp, err := http.Get(url + "/?read:" + uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// guacd keeps sending frames for several times the server's WriteTimeout
+	body := bufio.NewReader(resp.Body)
+	start := time.Now()
+	for time.Since(start) < 400*time.Millisecond {
+		if _, err = guacd.Write([]byte("4.sync,3.100;")); err != nil {
+			t.Fatal(err)
+		}
+		if received, err := body.ReadString(';'); err != nil || received != "4.sync,3.100;" {
+			t.Fatalf("Expected the long poll to carry on after %v, got %q %v", time.Since(start), received, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServer_LongPollKeepsWriteTimeout(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	})
+	url, uuid := serveHTTPTunnel(t, s)
+	t.Cleanup(func() { _ = guacd.Close() })
+
+	resp, err := http.Get(url + "/?read:" + uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// without ReadRequestTimeout the server's WriteTimeout still cuts the read off, after which
+	// nothing more arrives
+	body := bufio.NewReader(resp.Body)
+	received := make(chan error, 200)
+	go func() {
+		defer close(received)
+		for {
+			_, err := body.ReadString(';')
+			received <- err
+			if err != nil {
+				return
+			}
+		}
+	}()
+	start := time.Now()
+	for time.Since(start) < 2*time.Second {
+		if _, err = guacd.Write([]byte("4.sync,3.100;")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err = <-received:
+			if err != nil {
+				return
+			}
+		case <-time.After(500 * time.Millisecond):
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("Expected the server's WriteTimeout to end the long poll")
+}
+
+func TestServer_StalledWrite(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	})
+	s.WriteRequestTimeout = 200 * time.Millisecond
+	url, uuid := serveHTTPTunnel(t, s)
+
+	// the client promises more of the body than it sends
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	request := "POST /?write:" + uuid + " HTTP/1.1\r\nHost: guac\r\nContent-Length: 100\r\n\r\n4.sync,3.100;"
+	if _, err = conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-guacd.Received; received != "4.sync,3.100;" {
+		t.Errorf("Expected guacd to receive what was sent, got %q", received)
+	}
+
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal("Expected a response to the stalled write, got", err)
+	}
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Error("Expected 408, got", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Error("Expected the write to time out, it took", elapsed)
+	}
+
+	// the tunnel is closed and forgotten
+	if _, ok := <-guacd.Received; ok {
+		t.Error("Expected the tunnel to be closed")
+	}
+	if _, err = s.getTunnel(uuid); err == nil {
+		t.Error("Expected the tunnel to be deregistered")
+	}
+}
@@ -0,0 +1,81 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrorStage is where in a session an error given to WebsocketServer.OnError happened
+type ErrorStage int
+
+const (
+	// StageUpgrade means the websocket upgrade failed, including when the origin wasn't allowed
+	StageUpgrade ErrorStage = iota
+	// StageConnect means connecting to guacd failed, the WebsocketServer's Health reported guacd
+	// unhealthy, or no handshake slot was free
+	StageConnect
+	// StageTransport means the session ended abnormally: reading or writing the client or guacd
+	// failed, the client stopped answering pings, or an instruction was rejected. A client or
+	// guacd closing the connection normally isn't an error.
+	StageTransport
+	// StageRateLimit means the WebsocketServer's Limiter refused the connection
+	StageRateLimit
+)
+
+// String returns the name of the stage
+func (s ErrorStage) String() string {
+	switch s {
+	case StageUpgrade:
+		return "upgrade"
+	case StageConnect:
+		return "connect"
+	case StageRateLimit:
+		return "rate limit"
+	default:
+		return "transport"
+	}
+}
+
+// SessionError is the error given to WebsocketServer.OnError. Err is what failed, and is an
+// *ErrGuac when the library or a connect function returned one.
+type SessionError struct {
+	Stage ErrorStage
+	Err   error
+}
+
+func (e *SessionError) Error() string {
+	return e.Stage.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+// reportError passes an error to OnError, if it is set
+func (s *WebsocketServer) reportError(r *http.Request, stage ErrorStage, err error) {
+	if s.OnError != nil {
+		s.OnError(r, &SessionError{Stage: stage, Err: err})
+	}
+}
+
+// stop records the error that stopped a pump, and reports it if the pump stopped abnormally.
+// Once ctx is done the error is a consequence of the other pump stopping first, and is ignored.
+func (o pumpOptions) stop(ctx context.Context, err error, abnormal bool) {
+	if ctx.Err() != nil {
+		return
+	}
+	if o.stopped != nil {
+		o.stopped(err, abnormal)
+	}
+	if abnormal && o.failed != nil {
+		o.failed(err)
+	}
+}
+
+// guacdClosed returns true if a read from guacd failed because guacd closed the connection
+func guacdClosed(err error) bool {
+	var guacErr *ErrGuac
+	return errors.As(err, &guacErr) && guacErr.Kind == ErrConnectionClosed
+}
@@ -0,0 +1,135 @@
+package guac
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_OnError(t *testing.T) {
+	tests := []struct {
+		name       string
+		connectErr error
+		filters    []InstructionFilter
+		// run makes the request and ends the session
+		run    func(t *testing.T, url string, guacds <-chan *fakeGuacd)
+		expect *ErrorStage
+	}{
+		{
+			name: "upgrade",
+			run: func(t *testing.T, url string, guacds <-chan *fakeGuacd) {
+				resp, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = resp.Body.Close()
+			},
+			expect: stage(StageUpgrade),
+		},
+		{
+			name:       "connect",
+			connectErr: ErrUpstreamUnavailable.NewError("guacd is down"),
+			run: func(t *testing.T, url string, guacds <-chan *fakeGuacd) {
+				ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = ws.Close()
+			},
+			expect: stage(StageConnect),
+		},
+		{
+			name:    "transport",
+			filters: []InstructionFilter{failingFilter},
+			run: func(t *testing.T, url string, guacds <-chan *fakeGuacd) {
+				ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = ws.Close() }()
+				<-guacds
+				if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+					t.Fatal(err)
+				}
+				_, _, _ = ws.ReadMessage()
+			},
+			expect: stage(StageTransport),
+		},
+		{
+			name: "guacd closed",
+			run: func(t *testing.T, url string, guacds <-chan *fakeGuacd) {
+				ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = ws.Close() }()
+				_ = (<-guacds).Close()
+			},
+		},
+		{
+			name: "client closed",
+			run: func(t *testing.T, url string, guacds <-chan *fakeGuacd) {
+				ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				<-guacds
+				_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				_ = ws.Close()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guacds := make(chan *fakeGuacd, 1)
+			wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+				if tt.connectErr != nil {
+					return nil, tt.connectErr
+				}
+				tunnel, guacd := newFakeGuacd(t)
+				guacds <- guacd
+				return tunnel, nil
+			}, nopLogger())
+			wsServer.Filters = tt.filters
+			errs := make(chan error, 10)
+			wsServer.OnError = func(r *http.Request, err error) {
+				errs <- err
+			}
+			url, done := serveWebsocket(t, wsServer)
+
+			tt.run(t, url, guacds)
+			waitDone(t, done)
+			close(errs)
+
+			var reported []error
+			for err := range errs {
+				reported = append(reported, err)
+			}
+			if tt.expect == nil {
+				if len(reported) != 0 {
+					t.Error("Expected no errors, got", reported)
+				}
+				return
+			}
+			if len(reported) != 1 {
+				t.Fatal("Expected one error, got", reported)
+			}
+			var sessionErr *SessionError
+			if !errors.As(reported[0], &sessionErr) || sessionErr.Stage != *tt.expect {
+				t.Errorf("Expected a %v error, got %v", *tt.expect, reported[0])
+			}
+			if tt.connectErr != nil && !errors.Is(reported[0], tt.connectErr) {
+				t.Error("Expected the connect error to be wrapped, got", reported[0])
+			}
+		})
+	}
+}
+
+func stage(s ErrorStage) *ErrorStage {
+	return &s
+}
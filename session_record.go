@@ -0,0 +1,76 @@
+package guac
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SessionRecord describes one session after it ended, for analytics pipelines that store a row
+// per session rather than aggregate metrics
+type SessionRecord struct {
+	ConnectionID string
+	// Protocol and Host are as reported by the connect function in its ConnectResult
+	Protocol string
+	Host     string
+	Labels   map[string]string
+	// RemoteAddr is the address of the client
+	RemoteAddr string
+
+	Start    time.Time
+	Duration time.Duration
+
+	BytesToGuacd         int64
+	BytesToClient        int64
+	InstructionsToGuacd  int64
+	InstructionsToClient int64
+	// PeakBuffer is the largest websocket message sent to the client, in bytes
+	PeakBuffer int64
+	// PingRTT is the round trip time of the latest keepalive ping, zero without
+	// WebsocketServer.PingInterval
+	PingRTT time.Duration
+
+	CloseReason CloseReason
+}
+
+// ChannelSink returns a WebsocketServer.OnSessionRecord callback that sends records to ch. Records
+// are dropped rather than holding up the end of a session when ch is full.
+func ChannelSink(ch chan<- SessionRecord) func(SessionRecord) {
+	return func(record SessionRecord) {
+		select {
+		case ch <- record:
+		default:
+			globalLogger.Warn().Str("connection_id", record.ConnectionID).Msg("session record sink is full, dropping record")
+		}
+	}
+}
+
+// sessionCounts are the counters of a session only kept for its SessionRecord
+type sessionCounts struct {
+	instructionsToGuacd  int64
+	instructionsToClient int64
+	peakBuffer           int64
+}
+
+// countInstructions adds the number of instructions in data to n
+func countInstructions(n *int64, data []byte) {
+	count := int64(0)
+	for len(data) > 0 {
+		size, err := scanInstruction(data)
+		if err != nil {
+			break
+		}
+		count++
+		data = data[size:]
+	}
+	atomic.AddInt64(n, count)
+}
+
+// observeBuffer records the size of a message sent to the client
+func (c *sessionCounts) observeBuffer(size int) {
+	for {
+		peak := atomic.LoadInt64(&c.peakBuffer)
+		if int64(size) <= peak || atomic.CompareAndSwapInt64(&c.peakBuffer, peak, int64(size)) {
+			return
+		}
+	}
+}
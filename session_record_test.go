@@ -0,0 +1,76 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_OnSessionRecord(t *testing.T) {
+	guacds := make(chan *fakeGuacd, 1)
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		guacds <- guacd
+		return &ConnectResult{
+			Tunnel:   tunnel,
+			Labels:   map[string]string{"user": "alice"},
+			Protocol: "rdp",
+			Host:     "10.0.0.1",
+		}, nil
+	}, nopLogger())
+	records := make(chan SessionRecord, 1)
+	wsServer.OnSessionRecord = ChannelSink(records)
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	guacd := <-guacds
+
+	input := "3.key,2.65,1.1;3.key,2.65,1.0;"
+	if err = ws.WriteMessage(websocket.TextMessage, []byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-guacd.Received; received != input {
+		t.Error("Unexpected instructions", received)
+	}
+	output := "4.size,1.0,4.1024,3.768;4.sync,3.100;3.nop;"
+	if _, err = guacd.Write([]byte(output)); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != output {
+		t.Fatal("Unexpected message", string(msg), err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_ = guacd.Close()
+	waitDone(t, done)
+
+	var record SessionRecord
+	select {
+	case record = <-records:
+	default:
+		t.Fatal("Expected a record when the session ended")
+	}
+	if record.ConnectionID != "$fake" || record.Protocol != "rdp" || record.Host != "10.0.0.1" || record.Labels["user"] != "alice" {
+		t.Error("Unexpected session", record)
+	}
+	if record.RemoteAddr == "" || record.Start.IsZero() || record.Duration < 10*time.Millisecond {
+		t.Error("Unexpected timing", record.RemoteAddr, record.Start, record.Duration)
+	}
+	if record.BytesToGuacd != int64(len(input)) || record.BytesToClient != int64(len(output)) {
+		t.Error("Unexpected bytes", record.BytesToGuacd, record.BytesToClient)
+	}
+	if record.InstructionsToGuacd != 2 || record.InstructionsToClient != 3 {
+		t.Error("Unexpected instruction counts", record.InstructionsToGuacd, record.InstructionsToClient)
+	}
+	if record.PeakBuffer != int64(len(output)) {
+		t.Error("Unexpected peak buffer", record.PeakBuffer)
+	}
+	if record.CloseReason != CloseReasonGuacd {
+		t.Error("Unexpected close reason", record.CloseReason)
+	}
+}
@@ -0,0 +1,105 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// SessionStore keeps track of the active sessions. The WebsocketServer adds and deletes them
+// when it is its SessionStore, and ServeHTTP serves Sessions, so a store can be mounted as a
+// /sessions/ endpoint whichever implementation it is:
+//
+//	wsServer.SessionStore = sessions
+//	mux.Handle("/sessions/", sessions)
+//
+// Add and Delete also fit WebsocketServer.OnConnect and OnDisconnect.
+//
+// MemorySessionStore keeps the sessions of one process and RedisSessionStore shares them
+// between processes.
+type SessionStore interface {
+	// Add records a session with the connection ID
+	Add(id string, req *http.Request)
+	// Delete removes a session Add recorded
+	Delete(id string, req *http.Request, tunnel Tunnel)
+	// Get returns the number of active sessions with the connection ID
+	Get(id string) int
+	// Sessions returns the active connection IDs and their session counts, ordered by ID
+	Sessions() []SessionCount
+	// ServeHTTP responds to GET and HEAD requests with Sessions as a JSON array, and to other
+	// methods with 405
+	http.Handler
+}
+
+// SessionAdder is implemented by stores that can refuse a session, such as a MemorySessionStore
+// with DuplicateReject. The WebsocketServer adds its sessions with TryAdd when its SessionStore is
+// one, and closes the connection with the error's status when the session is refused. A refused
+// session isn't deleted.
+type SessionAdder interface {
+	// TryAdd records a session with the connection ID, or returns why it can't be
+	TryAdd(id string, req *http.Request) error
+}
+
+// SessionToucher is implemented by stores that forget the sessions which aren't touched, such as
+// a MemorySessionStore with a TTL. The WebsocketServer touches each of its sessions in its
+// SessionStore every TouchInterval while the session is connected.
+type SessionToucher interface {
+	// Touch records that the session with the connection ID is still active
+	Touch(id string) bool
+	// TouchInterval is how often active sessions must be touched, zero if they needn't be
+	TouchInterval() time.Duration
+}
+
+var (
+	_ SessionAdder   = (*MemorySessionStore)(nil)
+	_ SessionToucher = (*MemorySessionStore)(nil)
+	_ SessionStore   = (*MemorySessionStore)(nil)
+	_ SessionStore   = (*RedisSessionStore)(nil)
+)
+
+// SessionCount is an entry of the JSON a SessionStore serves
+type SessionCount struct {
+	// UUID is the connection ID
+	UUID string `json:"uuid"`
+	// Num is the number of active sessions with the connection ID
+	Num int `json:"num"`
+	// Pods are the processes with the sessions, when a store is shared between them
+	Pods []string `json:"pods,omitempty"`
+}
+
+// serveSessions responds with the sessions as JSON
+func serveSessions(w http.ResponseWriter, r *http.Request, sessions func() []SessionCount) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	// encoded before anything is written, so a failure can still be reported
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(sessions()); err != nil {
+		globalLogger.Error().Err(err).Msg("error encoding sessions")
+		http.Error(w, "Unable to encode sessions.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(body.Bytes())
+}
+
+// touchSession touches the session every interval until stop is closed
+func touchSession(store SessionToucher, id string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			store.Touch(id)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package guac
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_SessionStore(t *testing.T) {
+	tunnel, _ := newFakeGuacd(t)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	sessions := NewMemorySessionStore()
+	wsServer.SessionStore = sessions
+	// the callbacks are still called alongside the store
+	disconnected := make(chan string, 1)
+	wsServer.OnDisconnectWs = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel) {
+		disconnected <- id
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	for i := 0; i < 1000 && sessions.Get("$fake") == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := sessions.Get("$fake"); n != 1 {
+		t.Fatal("Expected the session to be added, got", n)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+	if n := sessions.Get("$fake"); n != 0 {
+		t.Error("Expected the session to be deleted, got", n)
+	}
+	if id := <-disconnected; id != "$fake" {
+		t.Error("Expected OnDisconnectWs to be called, got", id)
+	}
+}
+
+func TestWebsocketServer_SessionStoreTouched(t *testing.T) {
+	tunnel, _ := newFakeGuacd(t)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	sessions := NewMemorySessionStoreWithTTL(DuplicateAllow, 150*time.Millisecond, 5*time.Millisecond)
+	defer sessions.Close()
+	wsServer.SessionStore = sessions
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	for i := 0; i < 1000 && sessions.Get("$fake") == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the session outlives several TTLs without being reaped
+	time.Sleep(500 * time.Millisecond)
+	if n := sessions.Get("$fake"); n != 1 {
+		t.Error("Expected the connected session to be kept, got", n)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+	if n := sessions.Get("$fake"); n != 0 {
+		t.Error("Expected the session to be deleted, got", n)
+	}
+}
+
+func TestWebsocketServer_SessionStoreRefused(t *testing.T) {
+	tunnels := make(chan Tunnel, 2)
+	for i := 0; i < 2; i++ {
+		tunnel, _ := newFakeGuacd(t)
+		tunnels <- tunnel
+	}
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return <-tunnels, nil
+	}, nopLogger())
+	sessions := NewMemorySessionStoreWithPolicy(DuplicateReject)
+	wsServer.SessionStore = sessions
+	refused := make(chan error, 1)
+	wsServer.OnError = func(r *http.Request, err error) {
+		refused <- err
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	original, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = original.Close() }()
+	for i := 0; i < 1000 && sessions.Get("$fake") == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	duplicate, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = duplicate.Close() }()
+	for {
+		if _, _, err = duplicate.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, SessionConflict.GetWebSocketCode()) {
+		t.Error("Expected the duplicate to be closed with a conflict, got", err)
+	}
+	waitDone(t, done)
+	var sessionErr *SessionError
+	if err = <-refused; !errors.As(err, &sessionErr) || sessionErr.Stage != StageConnect || errorStatus(sessionErr.Err) != SessionConflict {
+		t.Error("Expected OnError to be told of the conflict, got", err)
+	}
+	if n := sessions.Get("$fake"); n != 1 {
+		t.Error("Expected the original session to stay, got", n)
+	}
+
+	_ = original.Close()
+	waitDone(t, done)
+	if n := sessions.Get("$fake"); n != 0 {
+		t.Error("Expected the original session to be deleted, got", n)
+	}
+}
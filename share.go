@@ -0,0 +1,344 @@
+package guac
+
+import (
+	"io"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultShareDisplayLimit is the default SharedTunnels.DisplayStateLimit
+	DefaultShareDisplayLimit = 4 << 20
+	// DefaultShareQueueSize is the default SharedTunnels.QueueSize
+	DefaultShareQueueSize = 256
+)
+
+// joinerOpcodes are the instructions a joiner may never send, as they would resize or end the
+// connection for everyone attached to it
+var joinerOpcodes = map[string]bool{"size": true, "disconnect": true}
+
+// SharedTunnels lets several websockets attach to one guacd connection without guacd knowing. The
+// owner shares the tunnel it connected, and a connect function can then return a tunnel joined to
+// it by connection ID:
+//   - everything guacd sends reaches every attached tunnel, and joiners are first sent the
+//     display drawn before they joined
+//   - input from every tunnel is written to guacd whole, one message at a time
+//   - joiners can't resize or disconnect the connection, and read-only joiners can't send
+//     ReadOnlyOpcodes either
+//   - closing a joiner detaches it, while closing the owner closes the guacd connection and so
+//     ends every joiner
+//
+// Joiners that don't keep up with guacd are disconnected rather than holding up everyone else.
+type SharedTunnels struct {
+	// DisplayStateLimit is how many bytes of drawing instructions each connection keeps to bring
+	// joiners up to date. Connections that draw more can't be joined.
+	DisplayStateLimit int
+	// QueueSize is how many messages a tunnel may fall behind guacd before it is disconnected
+	QueueSize int
+
+	lock        sync.Mutex
+	connections map[string]*sharedConnection
+}
+
+// NewSharedTunnels creates an empty registry with the default limits
+func NewSharedTunnels() *SharedTunnels {
+	return &SharedTunnels{
+		DisplayStateLimit: DefaultShareDisplayLimit,
+		QueueSize:         DefaultShareQueueSize,
+		connections:       map[string]*sharedConnection{},
+	}
+}
+
+// Share registers tunnel under its connection ID and returns the owner's tunnel, to be used in
+// its place. tunnel must not have been read from, as joiners need the whole display.
+func (s *SharedTunnels) Share(tunnel Tunnel) Tunnel {
+	c := &sharedConnection{
+		registry: s,
+		id:       tunnel.ConnectionID(),
+		tunnel:   tunnel,
+		viewers:  map[*sharedTunnel]bool{},
+		display:  newDisplayState(s.DisplayStateLimit),
+		writer:   tunnel.AcquireWriter(),
+	}
+	owner := c.attach(true, false, nil)
+
+	s.lock.Lock()
+	s.connections[c.id] = c
+	s.lock.Unlock()
+
+	go c.fanOut()
+	return owner
+}
+
+// Join attaches a new tunnel to the shared connection with the ID. It fails with
+// ErrResourceNotFound if there is no such connection or it drew too much to be replayed.
+func (s *SharedTunnels) Join(connectionID string, readOnly bool) (Tunnel, error) {
+	s.lock.Lock()
+	c, ok := s.connections[connectionID]
+	s.lock.Unlock()
+	if !ok {
+		return nil, ErrResourceNotFound.NewError("No shared connection with that ID.", connectionID)
+	}
+
+	var replay sliceMessageWriter
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return nil, ErrResourceClosed.NewError("Shared connection has ended.", connectionID)
+	}
+	if err := c.display.replay(&replay); err != nil {
+		return nil, err
+	}
+	return c.attach(false, readOnly, replay), nil
+}
+
+// Connections returns the number of tunnels attached to the shared connection with the ID,
+// including its owner, or zero if there is none
+func (s *SharedTunnels) Connections(connectionID string) int {
+	s.lock.Lock()
+	c, ok := s.connections[connectionID]
+	s.lock.Unlock()
+	if !ok {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.viewers)
+}
+
+// remove forgets the connection once guacd is done with it
+func (s *SharedTunnels) remove(c *sharedConnection) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.connections[c.id] == c {
+		delete(s.connections, c.id)
+	}
+}
+
+// sliceMessageWriter collects messages, copying them
+type sliceMessageWriter [][]byte
+
+func (w *sliceMessageWriter) WriteMessage(_ int, data []byte) error {
+	*w = append(*w, append([]byte(nil), data...))
+	return nil
+}
+
+// sharedConnection is a guacd connection read by one goroutine and fanned out to its viewers
+type sharedConnection struct {
+	registry *SharedTunnels
+	id       string
+	tunnel   Tunnel
+
+	// lock guards viewers, display and err, so a joiner's replay and what it is sent after
+	// neither miss nor repeat anything
+	lock    sync.Mutex
+	viewers map[*sharedTunnel]bool
+	display *displayState
+	// err is why reading from guacd stopped
+	err error
+
+	// writeLock serializes writes from the viewers to guacd
+	writeLock sync.Mutex
+	writer    io.Writer
+}
+
+// attach adds a viewer whose queue starts with messages. It must be called with the lock held,
+// except for the owner, which is attached before anything is read.
+func (c *sharedConnection) attach(owner, readOnly bool, messages [][]byte) *sharedTunnel {
+	size := c.registry.QueueSize
+	if size <= 0 {
+		size = DefaultShareQueueSize
+	}
+	t := &sharedTunnel{
+		conn:  c,
+		uuid:  uuid.New(),
+		owner: owner,
+		queue: make(chan []byte, len(messages)+size),
+	}
+	if !owner {
+		t.blocked = joinerOpcodes
+		if readOnly {
+			t.blocked = make(map[string]bool, len(joinerOpcodes)+len(ReadOnlyOpcodes))
+			for opcode := range joinerOpcodes {
+				t.blocked[opcode] = true
+			}
+			for _, opcode := range ReadOnlyOpcodes {
+				t.blocked[opcode] = true
+			}
+		}
+	}
+	for _, msg := range messages {
+		t.queue <- msg
+	}
+	c.viewers[t] = true
+	return t
+}
+
+// detach removes a viewer, closing its queue so its reader sees err. It must be called with the
+// lock held.
+func (c *sharedConnection) detach(t *sharedTunnel, err error) {
+	if !c.viewers[t] {
+		return
+	}
+	delete(c.viewers, t)
+	t.err = err
+	close(t.queue)
+}
+
+// fanOut reads from guacd until it fails, sending a copy of every message to every viewer
+func (c *sharedConnection) fanOut() {
+	reader := c.tunnel.AcquireReader()
+	defer c.tunnel.ReleaseReader()
+	defer c.registry.remove(c)
+
+	for {
+		data, err := reader.ReadSome()
+		if err != nil {
+			c.lock.Lock()
+			c.err = err
+			for t := range c.viewers {
+				c.detach(t, err)
+			}
+			c.lock.Unlock()
+			return
+		}
+		msg := append([]byte(nil), data...)
+
+		c.lock.Lock()
+		for rest := msg; len(rest) > 0; {
+			n, err := scanInstruction(rest)
+			if err != nil {
+				break
+			}
+			c.display.observe(rest[:n])
+			rest = rest[n:]
+		}
+		for t := range c.viewers {
+			select {
+			case t.queue <- msg:
+			default:
+				globalLogger.Warn().Str("connection_id", c.id).Bool("owner", t.owner).Msg("shared connection viewer fell behind, disconnecting it")
+				c.detach(t, ErrClientOverrun.NewError("Fell too far behind the shared connection."))
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+// sharedTunnel is one viewer's Tunnel onto a sharedConnection. It is its own reader and writer.
+type sharedTunnel struct {
+	conn  *sharedConnection
+	uuid  uuid.UUID
+	owner bool
+	// blocked are the opcodes dropped from what the viewer writes, nil for the owner
+	blocked map[string]bool
+
+	// queue is closed when the viewer is detached, with err saying why
+	queue chan []byte
+	err   error
+
+	readerLock CountedLock
+	writerLock CountedLock
+	closeOnce  sync.Once
+}
+
+// AcquireReader acquires the reader lock
+func (t *sharedTunnel) AcquireReader() InstructionReader {
+	t.readerLock.Lock()
+	return t
+}
+
+// ReleaseReader releases the reader lock
+func (t *sharedTunnel) ReleaseReader() {
+	t.readerLock.Unlock()
+}
+
+// HasQueuedReaderThreads returns true if more than one goroutine is trying to read
+func (t *sharedTunnel) HasQueuedReaderThreads() bool {
+	return t.readerLock.HasQueued()
+}
+
+// AcquireWriter acquires the writer lock
+func (t *sharedTunnel) AcquireWriter() io.Writer {
+	t.writerLock.Lock()
+	return t
+}
+
+// ReleaseWriter releases the writer lock
+func (t *sharedTunnel) ReleaseWriter() {
+	t.writerLock.Unlock()
+}
+
+// HasQueuedWriterThreads returns true if more than one goroutine is trying to write
+func (t *sharedTunnel) HasQueuedWriterThreads() bool {
+	return t.writerLock.HasQueued()
+}
+
+// GetUUID returns the viewer's own UUID
+func (t *sharedTunnel) GetUUID() string {
+	return t.uuid.String()
+}
+
+// ConnectionID returns the guacd connection ID shared by every viewer
+func (t *sharedTunnel) ConnectionID() string {
+	return t.conn.id
+}
+
+// ReadSome returns the next message from guacd
+func (t *sharedTunnel) ReadSome() ([]byte, error) {
+	msg, ok := <-t.queue
+	if !ok {
+		// err was set before the queue was closed
+		return nil, t.err
+	}
+	return msg, nil
+}
+
+// Available returns true if a message from guacd is queued
+func (t *sharedTunnel) Available() bool {
+	return len(t.queue) > 0
+}
+
+// Flush does nothing as every message is its own buffer
+func (t *sharedTunnel) Flush() {}
+
+// Write sends whole instructions to guacd, after dropping those the viewer may not send. A
+// joiner's input that can't be parsed is dropped too, as guacd might find blocked instructions in
+// it.
+func (t *sharedTunnel) Write(data []byte) (int, error) {
+	n := len(data)
+	if t.blocked != nil {
+		var invalid bool
+		if data, invalid = withoutBlocked(data, t.blocked); invalid {
+			globalLogger.Warn().Str("connection_id", t.conn.id).Msg("dropped input from shared connection viewer that could not be parsed")
+		}
+		if len(data) == 0 {
+			return n, nil
+		}
+	}
+	t.conn.writeLock.Lock()
+	defer t.conn.writeLock.Unlock()
+	if _, err := t.conn.writer.Write(data); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Close detaches the viewer. Closing the owner closes the guacd connection, ending every viewer.
+func (t *sharedTunnel) Close() (err error) {
+	t.closeOnce.Do(func() {
+		c := t.conn
+		c.lock.Lock()
+		c.detach(t, ErrConnectionClosed.NewError("Shared connection viewer closed."))
+		c.lock.Unlock()
+		if t.owner {
+			c.registry.remove(c)
+			c.writeLock.Lock()
+			c.tunnel.ReleaseWriter()
+			c.writeLock.Unlock()
+			err = c.tunnel.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,207 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readShared reads the next message from a shared tunnel, failing the test if it takes too long
+func readShared(t *testing.T, tunnel Tunnel) string {
+	t.Helper()
+	msg := make(chan string, 1)
+	go func() {
+		data, err := tunnel.AcquireReader().ReadSome()
+		tunnel.ReleaseReader()
+		if err != nil {
+			msg <- "error: " + err.Error()
+			return
+		}
+		msg <- string(data)
+	}()
+	select {
+	case m := <-msg:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out reading from shared tunnel")
+		return ""
+	}
+}
+
+func writeShared(t *testing.T, tunnel Tunnel, data string) {
+	t.Helper()
+	_, err := tunnel.AcquireWriter().Write([]byte(data))
+	tunnel.ReleaseWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedTunnels(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	shared := NewSharedTunnels()
+	owner := shared.Share(tunnel)
+
+	if _, err := guacd.Write([]byte("4.size,1.0,3.640,3.480;")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readShared(t, owner); msg != "4.size,1.0,3.640,3.480;" {
+		t.Errorf("Expected the size for the owner, got %q", msg)
+	}
+
+	joiner, err := shared.Join("$fake", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := shared.Join("$fake", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := shared.Connections("$fake"); n != 3 {
+		t.Error("Expected 3 connections, got", n)
+	}
+
+	// joiners are sent the display so far, then everything else
+	if _, err = guacd.Write([]byte("4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tunnel := range []Tunnel{joiner, viewer} {
+		if msg := readShared(t, tunnel); msg != "4.size,1.0,3.640,3.480;" {
+			t.Errorf("Expected the replayed size, got %q", msg)
+		}
+	}
+	for _, tunnel := range []Tunnel{owner, joiner, viewer} {
+		if msg := readShared(t, tunnel); msg != "4.sync,1.1;" {
+			t.Errorf("Expected the sync, got %q", msg)
+		}
+	}
+
+	// the joiner can't resize, and the read-only viewer can't send input at all
+	writeShared(t, viewer, "3.key,2.65,1.1;")
+	writeShared(t, joiner, "4.size,4.1024,3.768;5.mouse,1.1,1.2;")
+	writeShared(t, owner, "4.size,4.1024,3.768;")
+	for _, expect := range []string{"5.mouse,1.1,1.2;", "4.size,4.1024,3.768;"} {
+		if received := <-guacd.Received; received != expect {
+			t.Errorf("Expected guacd to receive %q, got %q", expect, received)
+		}
+	}
+
+	// nor can they by hiding instructions behind something that can't be parsed
+	writeShared(t, joiner, "x;10.disconnect;")
+	writeShared(t, viewer, "3.nop,1.\xE2;4;3.key,2.65,1.1;")
+	writeShared(t, joiner, "4.sync,1.2;4.size,4.1024")
+	writeShared(t, owner, "4.sync,1.3;")
+	for _, expect := range []string{"4.sync,1.2;", "4.sync,1.3;"} {
+		if received := <-guacd.Received; received != expect {
+			t.Errorf("Expected guacd to receive %q, got %q", expect, received)
+		}
+	}
+
+	// closing a joiner only detaches it
+	_ = joiner.Close()
+	if msg := readShared(t, joiner); msg == "" || msg[:6] != "error:" {
+		t.Errorf("Expected the closed joiner to fail, got %q", msg)
+	}
+	if n := shared.Connections("$fake"); n != 2 {
+		t.Error("Expected 2 connections, got", n)
+	}
+	writeShared(t, owner, "4.sync,1.1;")
+	if received := <-guacd.Received; received != "4.sync,1.1;" {
+		t.Errorf("Expected the owner's sync, got %q", received)
+	}
+
+	// closing the owner ends the connection for everyone
+	_ = owner.Close()
+	if msg := readShared(t, viewer); msg == "" || msg[:6] != "error:" {
+		t.Errorf("Expected the viewer to fail once the owner closed, got %q", msg)
+	}
+	if _, err = shared.Join("$fake", false); err == nil {
+		t.Error("Expected no connection to join once the owner closed")
+	}
+}
+
+func TestSharedTunnels_SlowViewer(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	shared := NewSharedTunnels()
+	shared.QueueSize = 1
+	owner := shared.Share(tunnel)
+	defer func() { _ = owner.Close() }()
+
+	joiner, err := shared.Join("$fake", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the owner keeps up while the joiner reads nothing
+	for i := 0; i < 3; i++ {
+		if _, err = guacd.Write([]byte("4.sync,1.1;")); err != nil {
+			t.Fatal(err)
+		}
+		if msg := readShared(t, owner); msg != "4.sync,1.1;" {
+			t.Errorf("Expected the owner to keep receiving, got %q", msg)
+		}
+	}
+	if msg := readShared(t, joiner); msg != "4.sync,1.1;" {
+		t.Errorf("Expected the queued sync, got %q", msg)
+	}
+	_, err = joiner.AcquireReader().ReadSome()
+	if guacErr, ok := err.(*ErrGuac); !ok || guacErr.Kind != ErrClientOverrun {
+		t.Error("Expected the slow joiner to be disconnected, got", err)
+	}
+}
+
+func TestSharedTunnels_WebsocketServer(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	shared := NewSharedTunnels()
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		if id := r.URL.Query().Get("join"); id != "" {
+			joiner, err := shared.Join(id, false)
+			if err != nil {
+				return nil, err
+			}
+			return &ConnectResult{Tunnel: joiner}, nil
+		}
+		return &ConnectResult{Tunnel: shared.Share(tunnel)}, nil
+	}, nopLogger())
+	connected := make(chan struct{}, 2)
+	wsServer.OnConnectWs = func(string, *websocket.Conn, *http.Request) {
+		connected <- struct{}{}
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = first.Close() }()
+	<-connected
+	second, _, err := websocket.DefaultDialer.Dial(url+"?join=$fake", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = second.Close() }()
+	<-connected
+
+	if _, err = guacd.Write([]byte("4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ws := range []*websocket.Conn{first, second} {
+		if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "4.sync,1.1;" {
+			t.Errorf("Expected both websockets to see the sync, got %q %v", msg, err)
+		}
+	}
+
+	for _, ws := range []*websocket.Conn{first, second} {
+		if err = ws.WriteMessage(websocket.TextMessage, []byte("5.mouse,1.1,1.2;")); err != nil {
+			t.Fatal(err)
+		}
+		if received := <-guacd.Received; received != "5.mouse,1.1,1.2;" {
+			t.Errorf("Expected the input of both websockets, got %q", received)
+		}
+	}
+
+	_ = second.Close()
+	_ = first.Close()
+	waitDone(t, done)
+}
@@ -0,0 +1,89 @@
+package guac
+
+import (
+	"context"
+	"time"
+)
+
+// Shutdown stops the server accepting connections and waits for the active connections to end.
+// New connections are refused with 503 Service Unavailable, and connections still connecting to
+// guacd are turned away once connected. Call it after http.Server.Shutdown, which doesn't wait for
+// websockets, so a deploy drains the sessions of the old process, or register ShutdownHook.
+//
+// If ctx is done before the connections have drained, the remaining sessions are disconnected,
+// closing their websockets and tunnels, and ctx.Err() is returned without waiting for them to
+// finish closing.
+func (s *WebsocketServer) Shutdown(ctx context.Context) error {
+	return s.ShutdownWithProgress(ctx, nil)
+}
+
+// ShutdownWithProgress is Shutdown, calling onProgress, if set, with the number of sessions
+// remaining at the start and each time it changes
+func (s *WebsocketServer) ShutdownWithProgress(ctx context.Context, onProgress func(remaining int)) error {
+	s.sessions.Lock()
+	s.sessions.closed = true
+	if s.sessions.removed == nil {
+		s.sessions.removed = make(chan struct{}, 1)
+	}
+	removed := s.sessions.removed
+	remaining := len(s.sessions.sessions)
+	s.sessions.Unlock()
+
+	// no ServeHTTP call is counted once closed is set, so waiting can't race with one starting
+	handlersDone := make(chan struct{})
+	go func() {
+		s.sessions.handlers.Wait()
+		close(handlersDone)
+	}()
+
+	if onProgress != nil {
+		onProgress(remaining)
+	}
+	for remaining > 0 {
+		select {
+		case <-removed:
+		case <-ctx.Done():
+			return s.forceClose(ctx)
+		}
+
+		s.sessions.RLock()
+		n := len(s.sessions.sessions)
+		s.sessions.RUnlock()
+		if n != remaining {
+			remaining = n
+			if onProgress != nil {
+				onProgress(remaining)
+			}
+		}
+	}
+
+	select {
+	case <-handlersDone:
+		return nil
+	case <-ctx.Done():
+		return s.forceClose(ctx)
+	}
+}
+
+// ShutdownHook returns a function for http.Server.RegisterOnShutdown that runs Shutdown, giving
+// the sessions timeout to drain. http.Server.Shutdown doesn't wait for the hook, so a process that
+// must not exit before the sessions are gone should call Shutdown itself.
+func (s *WebsocketServer) ShutdownHook(timeout time.Duration) func() {
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			s.logger.Warn().Err(err).Msg("sessions did not drain before the shutdown timeout")
+		}
+	}
+}
+
+// forceClose disconnects the sessions left when a shutdown runs out of time
+func (s *WebsocketServer) forceClose(ctx context.Context) error {
+	sessions := s.sessions.find(func(*wsSession) bool { return true })
+	s.logger.Warn().Int("remaining", len(sessions)).Msg("shutdown timed out, disconnecting remaining sessions")
+	for _, sess := range sessions {
+		sess.terminate(CloseReasonAdmin, SessionClosed, "Server is shutting down.")
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,185 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_Shutdown(t *testing.T) {
+	const sessions = 3
+	guacds := make(chan *fakeGuacd, sessions)
+	connected := make(chan struct{}, sessions)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		guacds <- guacd
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.OnConnect = func(string, *http.Request) {
+		connected <- struct{}{}
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	for i := 0; i < sessions; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = ws.Close() }()
+		<-connected
+	}
+
+	var lock sync.Mutex
+	var progress []int
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- wsServer.ShutdownWithProgress(context.Background(), func(remaining int) {
+			lock.Lock()
+			defer lock.Unlock()
+			progress = append(progress, remaining)
+		})
+	}()
+	waitFor(t, "shutdown to start", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(progress) == 1
+	})
+
+	// new connections are refused while draining
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected the connection to be refused, got", err)
+	}
+	waitDone(t, done)
+
+	for i := 0; i < sessions; i++ {
+		_ = (<-guacds).Close()
+		waitDone(t, done)
+		waitFor(t, "progress", func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(progress) == i+2
+		})
+	}
+	if err := <-shutdown; err != nil {
+		t.Error("Unexpected error", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for i, remaining := range progress {
+		if remaining != sessions-i {
+			t.Error("Unexpected progress", progress)
+			break
+		}
+	}
+}
+
+func TestWebsocketServer_ShutdownForce(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.OnConnect = func(string, *http.Request) {
+		connected <- struct{}{}
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	<-connected
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = wsServer.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected the deadline to be exceeded, got", err)
+	}
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Error("Expected an error instruction, got", err)
+	}
+	if _, _, err = ws.ReadMessage(); !websocket.IsCloseError(err, SessionClosed.GetWebSocketCode()) {
+		t.Error("Expected close frame, got", err)
+	}
+	waitDone(t, done)
+}
+
+func TestWebsocketServer_ShutdownHook(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.OnConnect = func(string, *http.Request) {
+		connected <- struct{}{}
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	<-connected
+
+	var server http.Server
+	server.RegisterOnShutdown(wsServer.ShutdownHook(50 * time.Millisecond))
+	if err = server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, _, err = ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, SessionClosed.GetWebSocketCode()) {
+		t.Error("Expected the session to be closed by the hook, got", err)
+	}
+	waitDone(t, done)
+}
+
+func TestWebsocketServer_ShutdownWaitsForConnecting(t *testing.T) {
+	connecting := make(chan struct{})
+	release := make(chan struct{})
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		close(connecting)
+		<-release
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	}, nopLogger())
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	<-connecting
+
+	// the connection has no session yet, but Shutdown still waits for it
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- wsServer.Shutdown(context.Background())
+	}()
+	select {
+	case err = <-shutdown:
+		t.Fatal("Expected Shutdown to wait for the connecting session, got", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	waitDone(t, done)
+	select {
+	case err = <-shutdown:
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Shutdown to return once the connection was turned away")
+	}
+}
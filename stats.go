@@ -0,0 +1,69 @@
+package guac
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ServerStats are totals for a WebsocketServer since it was created
+type ServerStats struct {
+	// ActiveConnections is the number of sessions currently connected
+	ActiveConnections int
+	// TotalConnections is the number of sessions that connected to guacd
+	TotalConnections int64
+	// HandshakeFailures is the number of connections that failed to connect to guacd
+	HandshakeFailures int64
+	// BytesToGuacd is the number of bytes sent from clients to guacd, including active sessions
+	BytesToGuacd int64
+	// BytesToClient is the number of bytes sent from guacd to clients, including active sessions
+	BytesToClient int64
+	// Uptime is the time since the server was created
+	Uptime time.Duration
+}
+
+// serverCounters are the totals behind ServerStats, updated atomically
+type serverCounters struct {
+	started           time.Time
+	connections       int64
+	handshakeFailures int64
+	bytesToGuacd      int64
+	bytesToClient     int64
+}
+
+// Stats returns totals for the server, for admin endpoints and quick health checks
+func (s *WebsocketServer) Stats() ServerStats {
+	s.sessions.RLock()
+	defer s.sessions.RUnlock()
+
+	stats := ServerStats{
+		ActiveConnections: len(s.sessions.sessions),
+		TotalConnections:  atomic.LoadInt64(&s.counters.connections),
+		HandshakeFailures: atomic.LoadInt64(&s.counters.handshakeFailures),
+		BytesToGuacd:      atomic.LoadInt64(&s.counters.bytesToGuacd),
+		BytesToClient:     atomic.LoadInt64(&s.counters.bytesToClient),
+	}
+	for sess := range s.sessions.sessions {
+		stats.BytesToGuacd += atomic.LoadInt64(&sess.bytesToGuacd)
+		stats.BytesToClient += atomic.LoadInt64(&sess.bytesToClient)
+	}
+	if !s.counters.started.IsZero() {
+		stats.Uptime = time.Since(s.counters.started)
+	}
+	return stats
+}
+
+// ActiveConnections returns the number of websockets the server is handling, which unlike
+// ServerStats.ActiveConnections includes those still connecting to guacd
+func (s *WebsocketServer) ActiveConnections() int {
+	return int(atomic.LoadInt64(&s.activeConnections))
+}
+
+// endSession removes a session from the registry and adds its bytes to the totals, together so
+// Stats doesn't count them twice or not at all
+func (s *WebsocketServer) endSession(sess *wsSession) {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	s.sessions.remove(sess)
+	atomic.AddInt64(&s.counters.bytesToGuacd, atomic.LoadInt64(&sess.bytesToGuacd))
+	atomic.AddInt64(&s.counters.bytesToClient, atomic.LoadInt64(&sess.bytesToClient))
+}
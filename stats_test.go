@@ -0,0 +1,67 @@
+package guac
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_Stats(t *testing.T) {
+	guacds := make(chan *fakeGuacd, 2)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		if r.URL.Query().Get("fail") != "" {
+			return nil, ErrUpstreamUnavailable.NewError("test")
+		}
+		tunnel, guacd := newFakeGuacd(t)
+		guacds <- guacd
+		return tunnel, nil
+	}, nopLogger())
+	url, done := serveWebsocket(t, wsServer)
+
+	// one session that ends, one that's still connected and one that fails
+	var guacdList []*fakeGuacd
+	for i := 0; i < 2; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = ws.Close() }()
+		guacd := <-guacds
+		guacdList = append(guacdList, guacd)
+
+		if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+			t.Fatal(err)
+		}
+		<-guacd.Received
+		if _, err = guacd.Write([]byte("4.sync,3.100;")); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = ws.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = guacdList[0].Close()
+	waitDone(t, done)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url+"?fail=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	waitDone(t, done)
+
+	stats := wsServer.Stats()
+	if stats.ActiveConnections != 1 || stats.TotalConnections != 2 || stats.HandshakeFailures != 1 {
+		t.Error("Unexpected connection counts", stats)
+	}
+	if stats.BytesToGuacd != 2*int64(len("3.key,2.65,1.1;")) || stats.BytesToClient != 2*int64(len("4.sync,3.100;")) {
+		t.Error("Unexpected byte counts", stats)
+	}
+	if stats.Uptime <= 0 {
+		t.Error("Expected uptime, got", stats.Uptime)
+	}
+
+	_ = guacdList[1].Close()
+	waitDone(t, done)
+}
@@ -1,9 +1,15 @@
 package guac
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -16,35 +22,99 @@ const (
 // would be an error)
 type Stream struct {
 	conn net.Conn
-
-	// ConnectionID is the ID Guacamole gives and can be used to reconnect or share sessions
+	// connLock guards conn, which Migrate replaces while the stream is in use
+	connLock sync.Mutex
+	// previous is the connection Migrate replaced, until the reader moves off it
+	previous net.Conn
+	// carried is what the new connection sent after ready, for the reader to continue with
+	carried []rune
+	// carriedPartial is the start of a character the new connection cut off after what is carried
+	carriedPartial []byte
+	// toClient are the instructions telling the client about transfers CancelStream aborted,
+	// which the reader returns ahead of what guacd sends
+	toClient [][]byte
+	closed   bool
+	// config is what the handshake was done with, to repeat it when migrating
+	config *Config
+
+	// ConnectionID is the ID Guacamole gives and can be used to reconnect or share sessions.
+	// Migrate changes it, so while a migration may be running read it with
+	// SimpleTunnel.ConnectionID, which holds the lock Migrate changes it under.
 	ConnectionID string
 	timeout      time.Duration
 
+	// TransferTimeout replaces the read timeout while a file or clipboard transfer is in
+	// progress, so a slow backend doesn't kill the transfer between blobs. It is only used
+	// when it is longer than the regular timeout.
+	TransferTimeout time.Duration
+
+	// TrackStreams keeps track of the transfers in progress for OpenStreams and CancelStream.
+	// Tracking looks at every instruction, so it is off unless this or TransferTimeout is set.
+	TrackStreams bool
+
+	// ReadyTimeout limits how long the handshake waits for guacd to send ready once connect is
+	// sent, so a backend that accepts the connection but never starts fails with an error naming
+	// the stage rather than a generic socket timeout. Zero waits for the regular timeout.
+	ReadyTimeout time.Duration
+
+	// MigrateBackoff is how long Migrate waits after a failed attempt before making another,
+	// doubling with each failure in a row, DefaultMigrateBackoff if zero. A negative value
+	// doesn't wait.
+	MigrateBackoff time.Duration
+	// migrating is held by the Migrate in progress, so attempts run one at a time, and guards
+	// migrateFailures and nextMigrate, the failed attempts in a row and when the next may start
+	migrating       chan struct{}
+	migrateFailures int
+	nextMigrate     time.Time
+
+	// HandshakeArgs are the names of the arguments guacd requested during the handshake, in the
+	// order their values are sent in the connect instruction
+	HandshakeArgs []string
+	streams       *streamTracker
+	frames        *frameCapturer
+	display       *displayState
+
+	// writeLock keeps instructions written by different goroutines from interleaving
+	writeLock sync.Mutex
+
 	// if more than a single instruction is read, the rest are buffered here
 	parseStart int
 	buffer     []rune
 	reset      []rune
+	// readBuffer receives the bytes read from guacd
+	readBuffer []byte
+	// partial is the start of a character cut off at the end of the last read, which is decoded
+	// once the rest of it is read
+	partial []byte
 }
 
 // NewStream creates a new stream
 func NewStream(conn net.Conn, timeout time.Duration) (ret *Stream) {
 	buffer := make([]rune, 0, MaxGuacMessage*3)
 	return &Stream{
-		conn:    conn,
-		timeout: timeout,
-		buffer:  buffer,
-		reset:   buffer[:cap(buffer)],
+		conn:      conn,
+		timeout:   timeout,
+		buffer:    buffer,
+		reset:     buffer[:cap(buffer)],
+		streams:   newStreamTracker(),
+		frames:    newFrameCapturer(),
+		migrating: make(chan struct{}, 1),
 	}
 }
 
 // Write sends messages to Guacamole with a timeout
 func (s *Stream) Write(data []byte) (n int, err error) {
-	if err = s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	conn := s.connection()
+	if err = conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
 		globalLogger.Error().Err(err).Msg("error setting write deadline")
 		return
 	}
-	return s.conn.Write(data)
+	if s.tracking() {
+		s.streams.observeAll(data, Inbound)
+	}
+	return conn.Write(data)
 }
 
 // Available returns true if there are messages buffered
@@ -61,12 +131,20 @@ func (s *Stream) Flush() {
 // ReadSome takes the next instruction (from the network or from the buffer) and returns it.
 // io.Reader is not implemented because this seems like the right place to maintain a buffer.
 func (s *Stream) ReadSome() (instruction []byte, err error) {
-	if err = s.conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
-		globalLogger.Error().Err(err).Msg("error setting read deadline")
+	if instruction = s.takeToClient(); instruction != nil {
+		return
+	}
+	timeout := s.readTimeout()
+	conn, err := s.readConnection(timeout)
+	if err != nil {
 		return
 	}
 
-	buffer := make([]byte, MaxGuacMessage)
+	// only one goroutine reads at a time, so the read buffer is kept for the next call
+	if s.readBuffer == nil {
+		s.readBuffer = make([]byte, MaxGuacMessage)
+	}
+	buffer := s.readBuffer
 	var n int
 	// While we're blocking, or input is available
 	for {
@@ -113,6 +191,13 @@ func (s *Stream) ReadSome() (instruction []byte, err error) {
 					instruction = []byte(string(s.buffer[0:i]))
 					s.parseStart = 0
 					s.buffer = s.buffer[i:]
+					if s.tracking() {
+						s.streams.observe(instruction, Outbound)
+					}
+					s.frames.observe(instruction)
+					if s.display != nil {
+						s.display.observe(instruction)
+					}
 					return
 				case ',':
 					// keep going
@@ -127,20 +212,36 @@ func (s *Stream) ReadSome() (instruction []byte, err error) {
 			}
 		}
 
-		n, err = s.conn.Read(buffer)
+		n, err = conn.Read(buffer)
+		if s.connection() != conn {
+			// Migrate moved the stream to another guacd, so anything more from the old one is dropped
+			if conn, err = s.readConnection(timeout); err != nil {
+				return
+			}
+			continue
+		}
 		if err != nil && n == 0 {
+			if instruction = s.takeToClient(); instruction != nil {
+				// CancelStream woke the reader, see readConnection
+				return instruction, nil
+			}
 			switch err.(type) {
 			case net.Error:
 				ex := err.(net.Error)
 				if ex.Timeout() {
-					globalLogger.Warn().Str("connection_id", s.ConnectionID).Dur("timeout", s.timeout).Msg("connection to guacd timed out")
+					globalLogger.Warn().Str("connection_id", s.connectionID()).Dur("timeout", timeout).Msg("connection to guacd timed out")
 					err = ErrUpstreamTimeout.NewError("Connection to guacd timed out.", err.Error())
 				} else {
-					globalLogger.Warn().Err(err).Str("connection_id", s.ConnectionID).Msg("connection to guacd closed unexpectedly")
+					globalLogger.Warn().Err(err).Str("connection_id", s.connectionID()).Msg("connection to guacd closed unexpectedly")
 					err = ErrConnectionClosed.NewError("Connection to guacd is closed.", err.Error())
 				}
 			default:
-				globalLogger.Error().Err(err).Str("connection_id", s.ConnectionID).Msg("error reading from guacd")
+				if errors.Is(err, io.EOF) {
+					globalLogger.Debug().Str("connection_id", s.connectionID()).Msg("guacd closed the connection")
+					err = ErrConnectionClosed.NewError("Connection to guacd is closed.", err.Error())
+					break
+				}
+				globalLogger.Error().Err(err).Str("connection_id", s.connectionID()).Msg("error reading from guacd")
 				err = ErrServer.NewError(err.Error())
 			}
 			return
@@ -148,7 +249,15 @@ func (s *Stream) ReadSome() (instruction []byte, err error) {
 		if n == 0 {
 			err = ErrServer.NewError("read 0 bytes")
 		}
-		runes := []rune(string(buffer[:n]))
+		// element lengths count characters, so one split between reads must not be decoded
+		// until it is whole, or each half would be counted as a replacement character
+		data := buffer[:n]
+		if len(s.partial) > 0 {
+			data = append(s.partial, data...)
+		}
+		complete := completeRunes(data)
+		s.partial = append(s.partial[:0:0], data[complete:]...)
+		runes := []rune(string(data[:complete]))
 
 		if cap(s.buffer)-len(s.buffer) < len(runes) {
 			s.Flush()
@@ -160,20 +269,226 @@ func (s *Stream) ReadSome() (instruction []byte, err error) {
 	}
 }
 
+// OpenStreams returns the file, clipboard, pipe and argv transfers currently in progress. It is
+// always empty unless TrackStreams or TransferTimeout is set.
+func (s *Stream) OpenStreams() []StreamInfo {
+	return s.streams.open()
+}
+
+// CancelStream aborts the transfer with the given index. Uploads are ended towards guacd and
+// refused with an error ack towards the client, and downloads are refused with an error ack so
+// guacd stops sending and ended towards the client. The client's instructions are returned by
+// the next ReadSome, which is woken if it is waiting on guacd, so a websocket reading the
+// stream passes them on. If both sides have a stream open with the index, both are cancelled.
+func (s *Stream) CancelStream(index int) error {
+	streams := s.streams.remove(index)
+	if len(streams) == 0 {
+		return ErrResourceNotFound.NewError("No such stream.", strconv.Itoa(index))
+	}
+
+	end := NewInstruction("end", strconv.Itoa(index))
+	ack := NewInstruction("ack", strconv.Itoa(index), "Stream cancelled.",
+		strconv.Itoa(ResourceClosed.GetGuacamoleStatusCode()))
+	for _, info := range streams {
+		toGuacd, toClient := end, ack
+		if info.Direction == Outbound {
+			toGuacd, toClient = ack, end
+		}
+		globalLogger.Debug().Str("connection_id", s.connectionID()).Int("stream", index).
+			Str("type", string(info.Type)).Stringer("direction", info.Direction).Msg("cancelling stream")
+		if _, err := s.Write(toGuacd.Bytes()); err != nil {
+			return err
+		}
+		s.sendToClient(toClient.Bytes())
+	}
+	return nil
+}
+
+// sendToClient queues an instruction for the reader to return, waking it if it is waiting on guacd
+func (s *Stream) sendToClient(instruction []byte) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	s.toClient = append(s.toClient, instruction)
+	_ = s.conn.SetReadDeadline(time.Now())
+}
+
+// takeToClient returns the next instruction queued by sendToClient, or nil
+func (s *Stream) takeToClient() []byte {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if len(s.toClient) == 0 {
+		return nil
+	}
+	instruction := s.toClient[0]
+	s.toClient = s.toClient[1:]
+	return instruction
+}
+
+// RetainDisplayState keeps up to limit bytes of the drawing instructions read from guacd, so
+// ReplayDisplayState can bring a late viewer up to date. The cost is up to limit bytes of memory
+// for the connection. Sessions that draw more than limit can't be replayed, and late viewers
+// should join through guacd instead, see Config.ConnectionID. It must be called before the
+// stream is read.
+func (s *Stream) RetainDisplayState(limit int) {
+	s.display = newDisplayState(limit)
+}
+
+// ReplayDisplayState writes everything drawn on the connection so far to ws. Reading from guacd
+// waits while the state is replayed, so ws doesn't miss anything drawn in the meantime.
+func (s *Stream) ReplayDisplayState(ws MessageWriter) error {
+	if s.display == nil {
+		return ErrUnsupported.NewError("Display state is not retained.")
+	}
+	return s.display.replay(ws)
+}
+
+// connection returns the connection to guacd
+func (s *Stream) connection() net.Conn {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return s.conn
+}
+
+// connectionID returns the connection ID, which Migrate changes under connLock
+func (s *Stream) connectionID() string {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return s.ConnectionID
+}
+
+// readConnection returns the connection to read from with its read deadline set. After a
+// migration it closes the old connection and carries on with what the new one has sent.
+func (s *Stream) readConnection(timeout time.Duration) (net.Conn, error) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.previous != nil {
+		_ = s.previous.Close()
+		s.previous = nil
+		s.buffer = s.reset[:copy(s.reset, s.carried)]
+		s.parseStart = 0
+		s.partial = s.carriedPartial
+		s.carried = nil
+		s.carriedPartial = nil
+	}
+	// the deadline is set under the lock so Migrate and sendToClient can't miss a reader about
+	// to block
+	deadline := time.Now().Add(timeout)
+	if len(s.toClient) > 0 {
+		deadline = time.Now()
+	}
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		globalLogger.Error().Err(err).Msg("error setting read deadline")
+		return nil, err
+	}
+	return s.conn, nil
+}
+
+// tracking returns true if the transfers in progress are tracked
+func (s *Stream) tracking() bool {
+	return s.TrackStreams || s.TransferTimeout > 0
+}
+
+// readTimeout returns how long a read may block, extended while a transfer is active
+func (s *Stream) readTimeout() time.Duration {
+	if s.TransferTimeout > s.timeout && s.streams.active() {
+		return s.TransferTimeout
+	}
+	return s.timeout
+}
+
 // Close closes the underlying network connection
 func (s *Stream) Close() error {
-	globalLogger.Trace().Str("connection_id", s.ConnectionID).Msg("closing guacd stream")
+	globalLogger.Trace().Str("connection_id", s.connectionID()).Msg("closing guacd stream")
+	s.connLock.Lock()
+	s.closed = true
+	if s.previous != nil {
+		_ = s.previous.Close()
+	}
 	err := s.conn.Close()
+	s.connLock.Unlock()
 	if err != nil {
-		globalLogger.Error().Err(err).Str("connection_id", s.ConnectionID).Msg("error closing guacd connection")
+		globalLogger.Error().Err(err).Str("connection_id", s.connectionID()).Msg("error closing guacd connection")
 	} else {
-		globalLogger.Trace().Str("connection_id", s.ConnectionID).Msg("guacd stream closed successfully")
+		globalLogger.Trace().Str("connection_id", s.connectionID()).Msg("guacd stream closed successfully")
 	}
 	return err
 }
 
 // Handshake configures the guacd session
 func (s *Stream) Handshake(config *Config) error {
+	return s.HandshakeContext(context.Background(), config)
+}
+
+// HandshakeContext configures the guacd session, recording a span if ctx carries a Tracer.
+// If ctx is done before guacd is ready the connection to guacd is closed and an error returned,
+// so a deadline on ctx bounds the whole handshake rather than each read and write.
+func (s *Stream) HandshakeContext(ctx context.Context, config *Config) (err error) {
+	_, span := tracerFromContext(ctx).Start(ctx, SpanHandshake, Attribute{Key: "guac.protocol", Value: config.Protocol})
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		} else {
+			span.SetAttributes(Attribute{Key: "guac.connection_id", Value: s.ConnectionID})
+		}
+		span.End()
+	}()
+
+	stop := context.AfterFunc(ctx, func() {
+		globalLogger.Warn().Err(ctx.Err()).Str("protocol", config.Protocol).Msg("aborting guacd handshake")
+		_ = s.connection().Close()
+	})
+	err = s.handshake(config)
+	if !stop() {
+		// the connection was closed whether or not the handshake got to finish
+		err = handshakeAborted(ctx)
+	}
+	return err
+}
+
+// handshakeAborted returns the error for a handshake ended by its context
+func handshakeAborted(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrUpstreamTimeout.NewError("Handshake with guacd did not complete in time.")
+	}
+	return ErrResourceClosed.NewError("Handshake with guacd was cancelled.")
+}
+
+// DialGuacd connects to guacd at the given TCP address, giving up when ctx is done. Use a
+// GuacdDialer to connect through a proxy or with TLS, and DialGuacdNetwork for a Unix socket.
+func DialGuacd(ctx context.Context, address string) (*Stream, error) {
+	var dialer GuacdDialer
+	return dialer.Dial(ctx, address)
+}
+
+// DialGuacdNetwork connects to guacd at the address on the network, such as "unix" and the path
+// of guacd's socket, giving up when ctx is done
+func DialGuacdNetwork(ctx context.Context, network, address string) (*Stream, error) {
+	dialer := GuacdDialer{Network: network}
+	return dialer.Dial(ctx, address)
+}
+
+// ConnectGuacd dials guacd and performs the handshake for config. The whole connection attempt,
+// from dialing through guacd being ready, is bounded by ctx and the connection is closed if it fails.
+func ConnectGuacd(ctx context.Context, address string, config *Config) (*Stream, error) {
+	stream, err := DialGuacd(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.HandshakeContext(ctx, config); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// readOnlyArg is the guacd parameter that disables input for a connection
+const readOnlyArg = "read-only"
+
+func (s *Stream) handshake(config *Config) error {
+	if err := config.validateSchema(); err != nil {
+		return err
+	}
+
 	// Get protocol / connection ID
 	selectArg := config.ConnectionID
 	if len(selectArg) == 0 {
@@ -181,7 +496,7 @@ func (s *Stream) Handshake(config *Config) error {
 	}
 
 	// Send requested protocol or connection ID
-	_, err := s.Write(NewInstruction("select", selectArg).Byte())
+	_, err := s.Write(NewInstruction("select", selectArg).Bytes())
 	if err != nil {
 		return err
 	}
@@ -194,7 +509,9 @@ func (s *Stream) Handshake(config *Config) error {
 
 	// Build Args list off provided names and config
 	argNameS := args.Args
+	s.HandshakeArgs = argNameS
 	argValueS := make([]string, 0, len(argNameS))
+	readOnly := false
 	for _, argName := range argNameS {
 
 		// Retrieve argument name
@@ -206,46 +523,63 @@ func (s *Stream) Handshake(config *Config) error {
 		if len(value) == 0 {
 			value = ""
 		}
+		if argName == readOnlyArg && config.ReadOnly {
+			value = "true"
+			readOnly = true
+		}
 		argValueS = append(argValueS, value)
 	}
+	if config.ReadOnly && !readOnly {
+		return ErrUnsupported.NewError("guacd does not offer read-only access to this connection.")
+	}
 
 	// Send size
 	_, err = s.Write(NewInstruction("size",
 		fmt.Sprintf("%v", config.OptimalScreenWidth),
 		fmt.Sprintf("%v", config.OptimalScreenHeight),
-		fmt.Sprintf("%v", config.OptimalResolution)).Byte(),
+		fmt.Sprintf("%v", config.OptimalResolution)).Bytes(),
 	)
 
 	if err != nil {
 		return err
 	}
 
-	// Send supported audio formats
-	_, err = s.Write(NewInstruction("audio", config.AudioMimetypes...).Byte())
-	if err != nil {
-		return err
-	}
-
-	// Send supported video formats
-	_, err = s.Write(NewInstruction("video", config.VideoMimetypes...).Byte())
-	if err != nil {
-		return err
+	// Send supported audio, video and image formats, which text protocols have no use for
+	media := config.negotiatesMedia()
+	for _, formats := range []struct {
+		opcode    string
+		mimetypes []string
+	}{
+		{"audio", config.AudioMimetypes},
+		{"video", config.VideoMimetypes},
+		{"image", config.ImageMimetypes},
+	} {
+		if !media && len(formats.mimetypes) == 0 {
+			continue
+		}
+		_, err = s.Write(NewInstruction(formats.opcode, formats.mimetypes...).Bytes())
+		if err != nil {
+			return err
+		}
 	}
 
-	// Send supported image formats
-	_, err = s.Write(NewInstruction("image", config.ImageMimetypes...).Byte())
-	if err != nil {
-		return err
+	// Send Args, giving the config a last chance to change them
+	connect := NewInstruction("connect", argValueS...)
+	if config.BeforeConnect != nil {
+		connect = config.BeforeConnect(connect)
+		if connect == nil || connect.Opcode != "connect" || len(connect.Args) != len(argNameS) {
+			return ErrServer.NewError("BeforeConnect must return a connect instruction with a value for each argument guacd requested")
+		}
+		// the hook may have changed Args after rendering the instruction
+		connect.cache = ""
 	}
-
-	// Send Args
-	_, err = s.Write(NewInstruction("connect", argValueS...).Byte())
+	_, err = s.Write(connect.Bytes())
 	if err != nil {
 		return err
 	}
 
 	// Wait for ready, store ID
-	ready, err := s.AssertOpcode("ready")
+	ready, err := s.awaitReady()
 	if err != nil {
 		return err
 	}
@@ -258,11 +592,31 @@ func (s *Stream) Handshake(config *Config) error {
 
 	s.Flush()
 	s.ConnectionID = readyArgs[0]
+	s.config = config
 
 	return nil
 }
 
+// awaitReady reads the ready instruction that follows connect, within ReadyTimeout if it is set
+func (s *Stream) awaitReady() (*Instruction, error) {
+	if s.ReadyTimeout <= 0 {
+		return s.AssertOpcode("ready")
+	}
+	timeout := s.timeout
+	s.timeout = s.ReadyTimeout
+	defer func() { s.timeout = timeout }()
+
+	ready, err := s.AssertOpcode("ready")
+	if guacErr, ok := err.(*ErrGuac); ok && guacErr.Kind == ErrUpstreamTimeout {
+		globalLogger.Warn().Dur("ready_timeout", s.ReadyTimeout).Msg("guacd accepted connect but did not send ready")
+		return nil, ErrUpstreamTimeout.NewError("guacd did not send ready after connect.", fmt.Sprintf("waited %v", s.ReadyTimeout))
+	}
+	return ready, err
+}
+
 // AssertOpcode checks the next opcode in the stream matches what is expected. Useful during handshake.
+// An error instruction from guacd is returned as an error with its status, and bad credentials
+// as ErrAuthenticationFailed.
 func (s *Stream) AssertOpcode(opcode string) (instruction *Instruction, err error) {
 	instruction, err = ReadOne(s)
 	if err != nil {
@@ -274,9 +628,28 @@ func (s *Stream) AssertOpcode(opcode string) (instruction *Instruction, err erro
 		return
 	}
 
+	if instruction.Opcode == "error" && opcode != "error" {
+		err = guacdError(instruction)
+		return
+	}
+
 	if instruction.Opcode != opcode {
 		err = ErrServer.NewError("Expected \"" + opcode + "\" instruction but instead received \"" + instruction.Opcode + "\".")
 		return
 	}
 	return
 }
+
+// completeRunes returns the length of data without the start of a character cut off at its end.
+// Invalid bytes count as complete, and are decoded as replacement characters.
+func completeRunes(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i > len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
@@ -2,8 +2,11 @@ package guac
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -78,6 +81,44 @@ func TestInstructionReader_ReadSome_Unicode(t *testing.T) {
 	}
 }
 
+func TestInstructionReader_ReadSome_SplitCharacters(t *testing.T) {
+	// each character of the text is split across reads at every byte
+	msg := "4.name,6.hé€🚀!é;4.sync,1.1;"
+	chunks := map[string][][]byte{"bytewise": nil}
+	for i := 0; i < len(msg); i++ {
+		chunks["bytewise"] = append(chunks["bytewise"], []byte{msg[i]})
+	}
+	for i := 9; i < 22; i++ {
+		chunks["at "+strconv.Itoa(i)] = [][]byte{[]byte(msg[:i]), []byte(msg[i:])}
+	}
+
+	for name, reads := range chunks {
+		t.Run(name, func(t *testing.T) {
+			client, guacd := net.Pipe()
+			defer func() { _ = guacd.Close() }()
+			go func() {
+				// a pipe delivers each write to a separate read
+				for _, read := range reads {
+					if _, err := guacd.Write(read); err != nil {
+						return
+					}
+				}
+			}()
+			stream := NewStream(client, time.Minute)
+
+			for _, expected := range []string{"4.name,6.hé€🚀!é;", "4.sync,1.1;"} {
+				ins, err := stream.ReadSome()
+				if err != nil {
+					t.Fatal("Unexpected error", err)
+				}
+				if string(ins) != expected {
+					t.Fatalf("Expected %q, got %q", expected, ins)
+				}
+			}
+		})
+	}
+}
+
 func TestInstructionReader_Flush(t *testing.T) {
 	s := NewStream(&fakeConn{}, time.Second)
 	s.buffer = s.buffer[:4]
@@ -101,6 +142,7 @@ type fakeConn struct {
 	ToRead  []byte
 	HasRead bool
 	Closed  bool
+	Written []byte
 }
 
 func (f *fakeConn) Read(b []byte) (n int, err error) {
@@ -113,7 +155,8 @@ func (f *fakeConn) Read(b []byte) (n int, err error) {
 }
 
 func (f *fakeConn) Write(b []byte) (n int, err error) {
-	return 0, nil
+	f.Written = append(f.Written, b...)
+	return len(b), nil
 }
 
 func (f *fakeConn) Close() error {
@@ -140,3 +183,353 @@ func (f *fakeConn) SetReadDeadline(t time.Time) error {
 func (f *fakeConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+// serveHandshake plays guacd's side of a handshake on conn, offering the given argument names,
+// and returns the instructions the client sent up to and including connect.
+func serveHandshake(conn net.Conn, connectionID string, args ...string) ([]*Instruction, error) {
+	guacd := NewStream(conn, time.Minute)
+	var received []*Instruction
+	for {
+		ins, err := ReadOne(guacd)
+		if err != nil {
+			return received, err
+		}
+		received = append(received, ins)
+
+		switch ins.Opcode {
+		case "select":
+			if _, err = guacd.Write(NewInstruction("args", args...).Bytes()); err != nil {
+				return received, err
+			}
+		case "connect":
+			_, err = guacd.Write(NewInstruction("ready", connectionID).Bytes())
+			return received, err
+		}
+	}
+}
+
+// slowGuacd accepts one connection and answers each handshake step after delay. It returns
+// the listener address and a channel that is closed once guacd sees the connection closed.
+func slowGuacd(t *testing.T, delay time.Duration) (string, <-chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer close(closed)
+		guacd := NewStream(conn, time.Minute)
+		for {
+			ins, err := ReadOne(guacd)
+			if err != nil {
+				return
+			}
+			switch ins.Opcode {
+			case "select":
+				time.Sleep(delay)
+				_, _ = guacd.Write(NewInstruction("args", "hostname").Bytes())
+			case "connect":
+				time.Sleep(delay)
+				_, _ = guacd.Write(NewInstruction("ready", "$abc").Bytes())
+			}
+		}
+	}()
+	return listener.Addr().String(), closed
+}
+
+func TestConnectGuacd(t *testing.T) {
+	addr, _ := slowGuacd(t, 0)
+
+	stream, err := ConnectGuacd(context.Background(), addr, NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.Close() }()
+	if stream.ConnectionID != "$abc" {
+		t.Error("Unexpected connection ID", stream.ConnectionID)
+	}
+}
+
+func TestConnectGuacd_Timeout(t *testing.T) {
+	// each step is well within the socket timeout but the whole handshake takes too long
+	addr, closed := slowGuacd(t, 60*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := ConnectGuacd(ctx, addr, NewGuacamoleConfiguration())
+	if err == nil || err.(*ErrGuac).Kind != ErrUpstreamTimeout {
+		t.Fatal("Expected upstream timeout, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Handshake was not aborted promptly, took", elapsed)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Expected the guacd connection to be closed")
+	}
+}
+
+func TestStream_Handshake_BeforeConnect(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+
+	stream := NewStream(client, time.Minute)
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+	config.Parameters["hostname"] = "10.0.0.1"
+	config.BeforeConnect = func(ins *Instruction) *Instruction {
+		for i, name := range stream.HandshakeArgs {
+			if name == "password" {
+				ins.Args[i] = "computed"
+			}
+		}
+		return ins
+	}
+
+	received := make(chan []*Instruction, 1)
+	go func() {
+		ins, _ := serveHandshake(guacd, "$abc", "hostname", "password", "port")
+		received <- ins
+	}()
+
+	if err := stream.Handshake(config); err != nil {
+		t.Fatal(err)
+	}
+	sent := <-received
+	connect := sent[len(sent)-1]
+	if connect.String() != "7.connect,8.10.0.0.1,8.computed,0.;" {
+		t.Error("Unexpected connect instruction", connect.String())
+	}
+}
+
+func TestStream_Handshake_BeforeConnectArgCount(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+	go func() { _, _ = serveHandshake(guacd, "$abc", "hostname", "port") }()
+
+	config := NewGuacamoleConfiguration()
+	config.BeforeConnect = func(ins *Instruction) *Instruction {
+		return NewInstruction("connect", "too few")
+	}
+	if err := NewStream(client, time.Minute).Handshake(config); err == nil {
+		t.Error("Expected a connect instruction with the wrong number of args to be refused")
+	}
+}
+
+func TestStream_Handshake_ReadOnlyJoin(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+
+	received := make(chan []*Instruction, 1)
+	go func() {
+		ins, _ := serveHandshake(guacd, "$abc", "VERSION_1_5_0", "read-only", "hostname")
+		received <- ins
+	}()
+
+	config := NewGuacamoleConfiguration()
+	config.ConnectionID = "$abc"
+	config.ReadOnly = true
+	if err := NewStream(client, time.Minute).Handshake(config); err != nil {
+		t.Fatal(err)
+	}
+	sent := <-received
+	if sent[0].String() != "6.select,4.$abc;" {
+		t.Error("Unexpected select instruction", sent[0].String())
+	}
+	connect := sent[len(sent)-1]
+	if connect.String() != "7.connect,0.,4.true,0.;" {
+		t.Error("Expected read-only to be set, got", connect.String())
+	}
+}
+
+func TestStream_Handshake_Select(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		protocol, id string
+		expect       string
+	}{
+		{"protocol", "rdp", "", "6.select,3.rdp;"},
+		{"join", "", "$abc", "6.select,4.$abc;"},
+		{"join ignores the protocol", "rdp", "$abc", "6.select,4.$abc;"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, guacd := net.Pipe()
+			defer func() { _ = guacd.Close() }()
+			received := make(chan []*Instruction, 1)
+			go func() {
+				ins, _ := serveHandshake(guacd, "$abc", "hostname")
+				received <- ins
+			}()
+
+			config := NewGuacamoleConfiguration()
+			config.Protocol = test.protocol
+			config.ConnectionID = test.id
+			if err := NewStream(client, time.Minute).Handshake(config); err != nil {
+				t.Fatal(err)
+			}
+			if sent := <-received; sent[0].String() != test.expect {
+				t.Errorf("Expected %q, got %q", test.expect, sent[0].String())
+			}
+		})
+	}
+}
+
+func TestStream_Handshake_ReadOnlyUnsupported(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+	go func() {
+		_, _ = serveHandshake(guacd, "$abc", "hostname")
+	}()
+
+	config := NewGuacamoleConfiguration()
+	config.ConnectionID = "$abc"
+	config.ReadOnly = true
+	err := NewStream(client, time.Minute).Handshake(config)
+	if err == nil || err.(*ErrGuac).Kind != ErrUnsupported {
+		t.Error("Expected unsupported error, got", err)
+	}
+}
+
+func TestStream_Handshake_MediaNegotiation(t *testing.T) {
+	opcodes := func(config *Config) string {
+		client, guacd := net.Pipe()
+		defer func() { _ = guacd.Close() }()
+		received := make(chan []*Instruction, 1)
+		go func() {
+			ins, _ := serveHandshake(guacd, "$abc", "hostname")
+			received <- ins
+		}()
+		if err := NewStream(client, time.Minute).Handshake(config); err != nil {
+			t.Fatal(err)
+		}
+		var ret []string
+		for _, ins := range <-received {
+			ret = append(ret, ins.Opcode)
+		}
+		return strings.Join(ret, ",")
+	}
+
+	ssh := NewGuacamoleConfiguration()
+	ssh.Protocol = "ssh"
+	if sent := opcodes(ssh); sent != "select,size,connect" {
+		t.Error("Expected ssh to skip media negotiation, got", sent)
+	}
+
+	ssh.ImageMimetypes = []string{"image/webp"}
+	if sent := opcodes(ssh); sent != "select,size,image,connect" {
+		t.Error("Expected explicitly set image formats to be sent, got", sent)
+	}
+
+	rdp := NewGuacamoleConfiguration()
+	rdp.Protocol = "rdp"
+	if sent := opcodes(rdp); sent != "select,size,audio,video,image,connect" {
+		t.Error("Expected rdp to negotiate media, got", sent)
+	}
+}
+
+func TestStream_Handshake_ReadyTimeout(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+
+	// guacd takes the connect instruction but never sends ready
+	go func() {
+		stream := NewStream(guacd, time.Minute)
+		for {
+			ins, err := ReadOne(stream)
+			if err != nil {
+				return
+			}
+			if ins.Opcode == "select" {
+				_, _ = stream.Write(NewInstruction("args", "hostname").Bytes())
+			}
+		}
+	}()
+
+	stream := NewStream(client, time.Minute)
+	stream.ReadyTimeout = 50 * time.Millisecond
+	start := time.Now()
+	err := stream.Handshake(NewGuacamoleConfiguration())
+	if err == nil || err.(*ErrGuac).Kind != ErrUpstreamTimeout {
+		t.Fatal("Expected upstream timeout, got", err)
+	}
+	if !strings.Contains(err.Error(), "ready after connect") {
+		t.Error("Expected the error to name the handshake stage, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected ReadyTimeout to end the wait, took", elapsed)
+	}
+}
+
+func TestStream_Handshake_GuacdError(t *testing.T) {
+	tests := []struct {
+		name string
+		// reply is guacd's answer to connect, nil to close the connection instead
+		reply      *Instruction
+		kind       ErrKind
+		authFailed bool
+	}{
+		{
+			name:       "bad credentials",
+			reply:      NewInstruction("error", "Authentication failure (invalid credentials?)", "769"),
+			kind:       ErrAuthenticationFailed,
+			authFailed: true,
+		},
+		{
+			name:  "host unreachable",
+			reply: NewInstruction("error", "Unable to connect to RDP server.", "519"),
+			kind:  ErrUpstreamNotFound,
+		},
+		{
+			name: "network",
+			kind: ErrConnectionClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, guacd := net.Pipe()
+			defer func() { _ = guacd.Close() }()
+			go func() {
+				stream := NewStream(guacd, time.Minute)
+				for {
+					ins, err := ReadOne(stream)
+					if err != nil {
+						return
+					}
+					switch ins.Opcode {
+					case "select":
+						_, _ = stream.Write(NewInstruction("args", "hostname", "username", "password").Bytes())
+					case "connect":
+						if tt.reply == nil {
+							_ = guacd.Close()
+							return
+						}
+						_, _ = stream.Write(tt.reply.Bytes())
+					}
+				}
+			}()
+
+			err := NewStream(client, time.Minute).Handshake(NewGuacamoleConfiguration())
+			guacErr, ok := err.(*ErrGuac)
+			if !ok || guacErr.Kind != tt.kind {
+				t.Fatalf("Expected kind %v, got %v", tt.kind, err)
+			}
+			if IsAuthenticationFailed(&SessionError{Stage: StageConnect, Err: err}) != tt.authFailed {
+				t.Error("Expected IsAuthenticationFailed", tt.authFailed, "for", err)
+			}
+			if tt.reply != nil && err.Error() != tt.reply.Args[0] {
+				t.Error("Expected guacd's message, got", err)
+			}
+		})
+	}
+}
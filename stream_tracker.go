@@ -0,0 +1,209 @@
+package guac
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Direction is the way an instruction flows through a tunnel
+type Direction int
+
+const (
+	// Inbound instructions flow from the client to guacd
+	Inbound Direction = iota
+	// Outbound instructions flow from guacd to the client
+	Outbound
+)
+
+// String returns the name of the direction
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	}
+	return ""
+}
+
+func (d Direction) reverse() Direction {
+	if d == Inbound {
+		return Outbound
+	}
+	return Inbound
+}
+
+// StreamType is the kind of transfer a Guacamole stream carries
+type StreamType string
+
+const (
+	StreamFile      StreamType = "file"
+	StreamClipboard StreamType = "clipboard"
+	StreamPipe      StreamType = "pipe"
+	StreamArgv      StreamType = "argv"
+)
+
+// StreamInfo describes a file, clipboard, pipe or argv stream that is open on a connection
+type StreamInfo struct {
+	// Index is the stream index chosen by the side that opened the stream
+	Index int
+	// Type is the opcode that opened the stream
+	Type StreamType
+	// Direction is the way the stream's data flows
+	Direction Direction
+	// Mimetype is the type of data being transferred
+	Mimetype string
+	// Bytes is the number of decoded bytes received in blobs so far
+	Bytes int64
+	// StartedAt is when the stream was opened
+	StartedAt time.Time
+}
+
+type streamKey struct {
+	dir   Direction
+	index int
+}
+
+// streamTracker follows the transfers open on a connection by watching the stream
+// instructions that pass through it. Stream indices are allocated independently by
+// each side, so streams are keyed by the direction their data flows in.
+type streamTracker struct {
+	sync.Mutex
+	streams map[streamKey]*StreamInfo
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{
+		streams: map[streamKey]*StreamInfo{},
+	}
+}
+
+// observe updates the open streams with a single raw instruction flowing in dir
+func (t *streamTracker) observe(raw []byte, dir Direction) {
+	elements, err := peekElements(raw, 2)
+	if err != nil || len(elements) < 2 {
+		return
+	}
+
+	switch elements[0] {
+	case "file", "clipboard", "pipe", "argv", "blob", "end", "ack":
+	default:
+		return
+	}
+
+	index, err := strconv.Atoi(elements[1])
+	if err != nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	key := streamKey{dir: dir, index: index}
+	switch elements[0] {
+	case "file", "clipboard", "pipe", "argv":
+		ins, err := Parse(raw)
+		if err != nil {
+			return
+		}
+		info := &StreamInfo{
+			Index:     index,
+			Type:      StreamType(ins.Opcode),
+			Direction: dir,
+			StartedAt: time.Now(),
+		}
+		if len(ins.Args) > 1 {
+			info.Mimetype = ins.Args[1]
+		}
+		t.streams[key] = info
+	case "blob":
+		info, ok := t.streams[key]
+		if !ok {
+			// most blobs belong to image and audio streams which aren't tracked
+			return
+		}
+		ins, err := Parse(raw)
+		if err != nil || len(ins.Args) < 2 {
+			return
+		}
+		info.Bytes += int64(decodedLen(ins.Args[1]))
+	case "end":
+		delete(t.streams, key)
+	case "ack":
+		// an ack travels against the stream, a non-zero status means the receiver aborted it
+		ins, err := Parse(raw)
+		if err != nil || len(ins.Args) < 3 || ins.Args[2] == "0" {
+			return
+		}
+		delete(t.streams, streamKey{dir: dir.reverse(), index: index})
+	}
+}
+
+// observeAll updates the open streams with every instruction in buf
+func (t *streamTracker) observeAll(buf []byte, dir Direction) {
+	for len(buf) > 0 {
+		n, err := scanInstruction(buf)
+		if err != nil {
+			return
+		}
+		t.observe(buf[:n], dir)
+		buf = buf[n:]
+	}
+}
+
+// active returns true if any transfer is in progress
+func (t *streamTracker) active() bool {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.streams) > 0
+}
+
+// open returns a copy of the open streams ordered by index
+func (t *streamTracker) open() []StreamInfo {
+	t.Lock()
+	defer t.Unlock()
+	ret := make([]StreamInfo, 0, len(t.streams))
+	for _, info := range t.streams {
+		ret = append(ret, *info)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Index != ret[j].Index {
+			return ret[i].Index < ret[j].Index
+		}
+		return ret[i].Direction < ret[j].Direction
+	})
+	return ret
+}
+
+// remove stops tracking the streams with the given index and returns them
+func (t *streamTracker) remove(index int) []StreamInfo {
+	t.Lock()
+	defer t.Unlock()
+	var ret []StreamInfo
+	for _, dir := range []Direction{Inbound, Outbound} {
+		key := streamKey{dir: dir, index: index}
+		if info, ok := t.streams[key]; ok {
+			ret = append(ret, *info)
+			delete(t.streams, key)
+		}
+	}
+	return ret
+}
+
+// clear forgets every open stream
+func (t *streamTracker) clear() {
+	t.Lock()
+	defer t.Unlock()
+	t.streams = map[streamKey]*StreamInfo{}
+}
+
+// decodedLen returns the number of bytes a base64 blob decodes to
+func decodedLen(data string) int {
+	n := len(data) / 4 * 3
+	for i := len(data) - 1; i >= 0 && data[i] == '='; i-- {
+		n--
+	}
+	return n
+}
@@ -0,0 +1,205 @@
+package guac
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamTracker(t *testing.T) {
+	tracker := newStreamTracker()
+
+	tracker.observeAll([]byte("4.file,1.3,10.text/plain,5.a.txt;4.blob,1.3,4.aGk=;"), Inbound)
+	if !tracker.active() {
+		t.Fatal("Expected an active transfer")
+	}
+	info := tracker.streams[streamKey{dir: Inbound, index: 3}]
+	if info == nil || info.Type != StreamFile || info.Mimetype != "text/plain" || info.Bytes != 2 {
+		t.Errorf("Unexpected stream info %+v", info)
+	}
+
+	// blobs for untracked streams (images) and the other direction are ignored
+	tracker.observe([]byte("4.blob,1.3,4.aGk=;"), Outbound)
+	tracker.observe([]byte("4.blob,1.9,4.aGk=;"), Inbound)
+	if info.Bytes != 2 {
+		t.Errorf("Expected 2 got %d", info.Bytes)
+	}
+
+	tracker.observe([]byte("3.end,1.3;"), Inbound)
+	if tracker.active() {
+		t.Error("Expected transfer to have ended")
+	}
+
+	// a failed ack from the receiver aborts the stream
+	tracker.observe([]byte("9.clipboard,1.1,10.text/plain;"), Outbound)
+	tracker.observe([]byte("3.ack,1.1,2.OK,1.0;"), Inbound)
+	if !tracker.active() {
+		t.Fatal("Expected a successful ack to keep the transfer open")
+	}
+	tracker.observe([]byte("3.ack,1.1,4.FAIL,3.256;"), Inbound)
+	if tracker.active() {
+		t.Error("Expected a failed ack to abort the transfer")
+	}
+}
+
+func TestStream_TransferTimeout(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+
+	stream := NewStream(client, 20*time.Millisecond)
+	stream.TransferTimeout = time.Second
+	defer func() { _ = stream.Close() }()
+
+	received := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, MaxGuacMessage)
+		for {
+			n, err := guacd.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	// start an upload, guacd is slow to acknowledge it
+	if _, err := stream.Write([]byte("4.file,1.0,10.text/plain,5.a.txt;")); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = guacd.Write([]byte("3.ack,1.0,2.OK,1.0;"))
+	}()
+
+	ins, err := stream.ReadSome()
+	if err != nil {
+		t.Fatal("Expected the transfer to extend the read timeout, got", err)
+	}
+	if string(ins) != "3.ack,1.0,2.OK,1.0;" {
+		t.Error("Unexpected instruction", string(ins))
+	}
+
+	// once the transfer is over the regular timeout applies again
+	if _, err = stream.Write([]byte("3.end,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	_, err = stream.ReadSome()
+	if err == nil || err.(*ErrGuac).Kind != ErrUpstreamTimeout {
+		t.Error("Expected upstream timeout, got", err)
+	}
+}
+
+func TestStream_TrackingDisabled(t *testing.T) {
+	conn := &fakeConn{ToRead: []byte("4.file,1.2,24.application/octet-stream,7.big.iso;")}
+	stream := NewStream(conn, time.Minute)
+	if _, err := stream.Write([]byte("9.clipboard,1.0,10.text/plain;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	if streams := stream.OpenStreams(); len(streams) != 0 {
+		t.Error("Expected no tracking without TrackStreams or a TransferTimeout, got", streams)
+	}
+}
+
+func TestSimpleTunnel_CancelStreamWakesReader(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	defer func() { _ = tunnel.Close() }()
+	tunnel.stream.TrackStreams = true
+
+	if _, err := tunnel.AcquireWriter().Write([]byte("4.file,1.0,10.text/plain,8.file.txt;")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+	<-guacd.Received
+
+	// guacd is quiet, so the reader is waiting on it when the upload is cancelled
+	read := make(chan string, 1)
+	go func() {
+		ins, _ := tunnel.AcquireReader().ReadSome()
+		read <- string(ins)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := tunnel.CancelStream(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-guacd.Received; got != "3.end,1.0;" {
+		t.Error("Expected guacd to be told the upload ended, got", got)
+	}
+	select {
+	case ins := <-read:
+		if ins != "3.ack,1.0,17.Stream cancelled.,3.518;" {
+			t.Error("Expected the client to be told the upload failed, got", ins)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reader was not woken")
+	}
+}
+
+func TestSimpleTunnel_CancelStream(t *testing.T) {
+	conn := &fakeConn{
+		ToRead: []byte("4.file,1.2,24.application/octet-stream,7.big.iso;4.blob,1.2,8.AAAAAAAA;"),
+	}
+	stream := NewStream(conn, time.Minute)
+	stream.TrackStreams = true
+	tunnel := NewSimpleTunnel(stream)
+
+	// the client starts an upload while guacd starts a download
+	if _, err := tunnel.AcquireWriter().Write([]byte("9.clipboard,1.0,10.text/plain;")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+	reader := tunnel.AcquireReader()
+	for i := 0; i < 2; i++ {
+		if _, err := reader.ReadSome(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tunnel.ReleaseReader()
+
+	var controller StreamController = tunnel
+	streams := controller.OpenStreams()
+	if len(streams) != 2 {
+		t.Fatal("Expected 2 open streams got", len(streams))
+	}
+	if streams[0].Index != 0 || streams[0].Type != StreamClipboard || streams[0].Direction != Inbound {
+		t.Errorf("Unexpected stream %+v", streams[0])
+	}
+	if streams[1].Index != 2 || streams[1].Type != StreamFile || streams[1].Direction != Outbound ||
+		streams[1].Mimetype != "application/octet-stream" || streams[1].Bytes != 6 || streams[1].StartedAt.IsZero() {
+		t.Errorf("Unexpected stream %+v", streams[1])
+	}
+
+	conn.Written = nil
+	if err := controller.CancelStream(2); err != nil {
+		t.Fatal(err)
+	}
+	if string(conn.Written) != "3.ack,1.2,17.Stream cancelled.,3.518;" {
+		t.Error("Unexpected cancel of download", string(conn.Written))
+	}
+
+	conn.Written = nil
+	if err := controller.CancelStream(0); err != nil {
+		t.Fatal(err)
+	}
+	if string(conn.Written) != "3.end,1.0;" {
+		t.Error("Unexpected cancel of upload", string(conn.Written))
+	}
+
+	if len(controller.OpenStreams()) != 0 {
+		t.Error("Expected no open streams")
+	}
+	for _, expected := range []string{"3.end,1.2;", "3.ack,1.0,17.Stream cancelled.,3.518;"} {
+		if ins, err := reader.ReadSome(); err != nil || string(ins) != expected {
+			t.Error("Expected the client to be told", expected, "got", string(ins), err)
+		}
+	}
+	if err := controller.CancelStream(0); err == nil || err.(*ErrGuac).Kind != ErrResourceNotFound {
+		t.Error("Expected not found cancelling a closed stream, got", err)
+	}
+}
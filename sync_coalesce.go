@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// instructionSpan is the position of an instruction in a batch
+type instructionSpan struct {
+	start, end int
+}
+
+// coalesceSyncs removes every sync but the last from a batch of instructions. The client renders
+// a frame at each sync and acknowledges it, so when frames arrive together only the latest sync
+// matters: the drawing of the dropped frames is still applied, and acknowledging the latest
+// timestamp tells guacd the client has caught up. When the syncs carry the number of frames
+// guacd combined into them, the last sync carries the total. Batches that can't be parsed are
+// returned as they are.
+func coalesceSyncs(data []byte) []byte {
+	var syncs []instructionSpan
+	for i := 0; i < len(data); {
+		n, err := scanInstruction(data[i:])
+		if err != nil {
+			return data
+		}
+		if bytes.HasPrefix(data[i:], syncPrefix) {
+			syncs = append(syncs, instructionSpan{i, i + n})
+		}
+		i += n
+	}
+	if len(syncs) < 2 {
+		return data
+	}
+
+	last := syncs[len(syncs)-1]
+	latest := data[last.start:last.end]
+	if frames, ok := syncFrames(data, syncs); ok {
+		elements, err := peekElements(latest, 2)
+		if err != nil || len(elements) < 2 {
+			return data
+		}
+		latest = NewInstruction("sync", elements[1], strconv.Itoa(frames)).Bytes()
+	}
+
+	ret := make([]byte, 0, len(data))
+	prev := 0
+	for _, sync := range syncs[:len(syncs)-1] {
+		ret = append(ret, data[prev:sync.start]...)
+		prev = sync.end
+	}
+	ret = append(ret, data[prev:last.start]...)
+	ret = append(ret, latest...)
+	return append(ret, data[last.end:]...)
+}
+
+// syncFrames returns the total of the frames argument of the syncs, if they all have one
+func syncFrames(data []byte, syncs []instructionSpan) (int, bool) {
+	total := 0
+	for _, sync := range syncs {
+		elements, err := peekElements(data[sync.start:sync.end], 3)
+		if err != nil || len(elements) < 3 {
+			return 0, false
+		}
+		frames, err := strconv.Atoi(elements[2])
+		if err != nil {
+			return 0, false
+		}
+		total += frames
+	}
+	return total, true
+}
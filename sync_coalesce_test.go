@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCoalesceSyncs(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		batch    []string
+		expected []string
+	}{
+		{
+			name:     "Single",
+			batch:    []string{ins("rect", "0", "0", "0", "1", "1"), ins("sync", "100")},
+			expected: []string{ins("rect", "0", "0", "0", "1", "1"), ins("sync", "100")},
+		},
+		{
+			name:     "LatestKept",
+			batch:    []string{ins("sync", "100"), copyIns, ins("sync", "200"), copyIns, ins("sync", "300"), ins("nop")},
+			expected: []string{copyIns, copyIns, ins("sync", "300"), ins("nop")},
+		},
+		{
+			name:     "FramesSummed",
+			batch:    []string{ins("sync", "100", "2"), ins("sync", "200", "1"), ins("sync", "300", "3")},
+			expected: []string{ins("sync", "300", "6")},
+		},
+		{
+			name:     "FramesMissing",
+			batch:    []string{ins("sync", "100"), ins("sync", "200", "1")},
+			expected: []string{ins("sync", "200", "1")},
+		},
+		{
+			name:     "Malformed",
+			batch:    []string{ins("sync", "100"), "4.sync,3.20"},
+			expected: []string{ins("sync", "100"), "4.sync,3.20"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := coalesceSyncs([]byte(strings.Join(tt.batch, "")))
+			if expected := strings.Join(tt.expected, ""); string(got) != expected {
+				t.Errorf("Expected %s got %s", expected, got)
+			}
+		})
+	}
+}
+
+func TestGuacdToWs_CoalesceSyncs(t *testing.T) {
+	var burst []string
+	for i := 1; i <= 50; i++ {
+		burst = append(burst, copyIns, ins("sync", strings.Repeat("1", i)))
+	}
+	writer := &fakeMessageWriter{}
+	guacdToWs(context.Background(), nopLogger(), writer, &sliceReader{instructions: burst}, pumpOptions{coalesceSyncs: true})
+
+	if len(writer.Messages) != 1 {
+		t.Fatal("Expected 1 message, got", len(writer.Messages))
+	}
+	message := string(writer.Messages[0])
+	if n := strings.Count(message, "4.sync,"); n != 1 {
+		t.Error("Expected only one sync, got", n)
+	}
+	if !strings.HasSuffix(message, ins("sync", strings.Repeat("1", 50))) {
+		t.Error("Expected the latest sync last, got", message)
+	}
+	if n := strings.Count(message, copyIns); n != 50 {
+		t.Error("Expected every drawing instruction, got", n)
+	}
+}
@@ -0,0 +1,109 @@
+package guac
+
+import "sync/atomic"
+
+// teardownStage is a step in ending a session that connected to guacd. The stages run in the
+// order they are declared, once both pumps have stopped, whatever ended the session.
+type teardownStage int
+
+const (
+	// teardownFlushRecording writes out what a RecordingTunnel holds, so the recording has
+	// everything guacd sent even if closing the tunnel fails
+	teardownFlushRecording teardownStage = iota
+	// teardownFinalInstructions tells guacd to end the remote session, unless it already ended or
+	// was told
+	teardownFinalInstructions
+	// teardownRelease releases the tunnel's writer and reader
+	teardownRelease
+	// teardownCloseTunnel closes the connection to guacd
+	teardownCloseTunnel
+	// teardownCloseWs closes the websocket
+	teardownCloseWs
+	// teardownSummary reports the session: its callbacks, metrics and span, which then see its
+	// final traffic and why it ended
+	teardownSummary
+)
+
+// recordingFlusher is implemented by tunnels that record the session, such as RecordingTunnel
+type recordingFlusher interface {
+	FlushRecording() error
+}
+
+// teardown ends a session in a fixed order, so what is reported about it is complete and
+// nothing is written to a connection that was already closed. ServeHTTP defers run once the
+// session is connected, and anything reporting on the session is added to it with summarize
+// rather than deferred.
+type teardown struct {
+	sess    *wsSession
+	summary []func()
+	// hook is called as each stage starts, for tests
+	hook func(teardownStage)
+}
+
+// summarize adds f to the summary. Like deferred calls, the last added runs first.
+func (t *teardown) summarize(f func()) {
+	t.summary = append(t.summary, f)
+}
+
+func (t *teardown) stage(stage teardownStage) {
+	if t.hook != nil {
+		t.hook(stage)
+	}
+}
+
+// run ends the session. It must be deferred.
+func (t *teardown) run() {
+	sess := t.sess
+
+	t.stage(teardownFlushRecording)
+	t.flushRecording()
+
+	t.stage(teardownFinalInstructions)
+	if sess.getCloseReason() != CloseReasonGuacd {
+		sess.disconnectGuacd()
+	}
+
+	t.stage(teardownRelease)
+	sess.tunnel.ReleaseWriter()
+	sess.tunnel.ReleaseReader()
+
+	t.stage(teardownCloseTunnel)
+	sess.closeTunnel()
+
+	t.stage(teardownCloseWs)
+	sess.closeWs()
+
+	t.stage(teardownSummary)
+	for i := len(t.summary) - 1; i >= 0; i-- {
+		t.summary[i]()
+	}
+}
+
+// stopGuacd closes the tunnel ahead of the teardown, to stop the guacd to websocket pump when the
+// other side ended first, as reading guacd has no deadline. The stages before it are done first,
+// so guacd and the recording see the same order either way, and the teardown skips them.
+func (t *teardown) stopGuacd() {
+	t.flushRecording()
+	t.sess.disconnectGuacd()
+	t.sess.closeTunnel()
+}
+
+func (t *teardown) flushRecording() {
+	if recording, ok := t.sess.tunnel.(recordingFlusher); ok {
+		if err := recording.FlushRecording(); err != nil {
+			t.sess.logger.Warn().Err(err).Msg("failed to flush session recording")
+		}
+	}
+}
+
+// disconnectGuacd sends guacd a disconnect, once, if the tunnel is still open
+func (c *wsSession) disconnectGuacd() {
+	if c.writer == nil || atomic.LoadInt32(&c.tunnelClosed) == 1 || !atomic.CompareAndSwapInt32(&c.disconnectSent, 0, 1) {
+		return
+	}
+	if _, err := c.writer.Write(NewInstruction(disconnectOpcode).Bytes()); err != nil {
+		c.logger.Trace().Err(err).Msg("Error sending disconnect to guacd")
+		return
+	}
+	atomic.AddInt64(&c.counts.instructionsToGuacd, 1)
+}
@@ -0,0 +1,178 @@
+package guac
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// teardownLog records the steps of a session ending, from the server's hook and a tunnel
+type teardownLog struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (l *teardownLog) add(event string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *teardownLog) get() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// loggedTunnel logs what the teardown does to a recording tunnel
+type loggedTunnel struct {
+	Tunnel
+	log *teardownLog
+}
+
+func (t *loggedTunnel) FlushRecording() error {
+	t.log.add("flush recording")
+	return nil
+}
+
+func (t *loggedTunnel) AcquireWriter() io.Writer {
+	return loggedWriter{t.Tunnel.AcquireWriter(), t.log}
+}
+
+func (t *loggedTunnel) ReleaseWriter() {
+	t.log.add("release writer")
+	t.Tunnel.ReleaseWriter()
+}
+
+func (t *loggedTunnel) ReleaseReader() {
+	t.log.add("release reader")
+	t.Tunnel.ReleaseReader()
+}
+
+func (t *loggedTunnel) Close() error {
+	t.log.add("close tunnel")
+	return t.Tunnel.Close()
+}
+
+type loggedWriter struct {
+	io.Writer
+	log *teardownLog
+}
+
+func (w loggedWriter) Write(data []byte) (int, error) {
+	if hasOpcode(data, disconnectOpcode) {
+		w.log.add("disconnect")
+	}
+	return w.Writer.Write(data)
+}
+
+var teardownStages = []string{"flush", "final instructions", "release", "close tunnel", "close ws", "summary"}
+
+// teardownServer serves a session on a logged tunnel, returning the log, the guacd side and the
+// websocket. configure, if set, is given the server before it serves.
+func teardownServer(t *testing.T, configure func(*WebsocketServer, *teardownLog)) (*teardownLog, *fakeGuacd, *websocket.Conn, <-chan struct{}) {
+	tunnel, guacd := newFakeGuacd(t)
+	log := &teardownLog{}
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return &loggedTunnel{Tunnel: tunnel, log: log}, nil
+	}, nopLogger())
+	wsServer.onTeardown = func(stage teardownStage) {
+		log.add("stage " + teardownStages[stage])
+	}
+	wsServer.OnDisconnect = func(string, *http.Request, Tunnel) {
+		log.add("OnDisconnect")
+	}
+	wsServer.OnSessionRecord = func(SessionRecord) {
+		log.add("OnSessionRecord")
+	}
+	if configure != nil {
+		configure(wsServer, log)
+	}
+	url, done := serveWebsocket(t, wsServer)
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+	if _, err = guacd.Write([]byte("4.sync,3.100;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	return log, guacd, ws, done
+}
+
+func TestWebsocketServer_TeardownOrder(t *testing.T) {
+	log, guacd, _, done := teardownServer(t, nil)
+	_ = guacd.Close()
+	waitDone(t, done)
+
+	// guacd ended the session, so it isn't sent a disconnect
+	expect := []string{
+		"stage flush", "flush recording",
+		"stage final instructions",
+		"stage release", "release writer", "release reader",
+		"stage close tunnel", "close tunnel",
+		"stage close ws",
+		"stage summary", "OnSessionRecord", "OnDisconnect",
+	}
+	if events := log.get(); !reflect.DeepEqual(events, expect) {
+		t.Errorf("Expected the teardown\n%q\ngot\n%q", expect, events)
+	}
+}
+
+func TestWebsocketServer_TeardownOrder_ClientLeft(t *testing.T) {
+	log, guacd, ws, done := teardownServer(t, nil)
+	if err := ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, done)
+
+	// the tunnel is closed early to stop reading guacd, after the stages before it
+	expect := []string{
+		"flush recording", "disconnect", "close tunnel",
+		"stage flush", "flush recording",
+		"stage final instructions",
+		"stage release", "release writer", "release reader",
+		"stage close tunnel",
+		"stage close ws",
+		"stage summary", "OnSessionRecord", "OnDisconnect",
+	}
+	if events := log.get(); !reflect.DeepEqual(events, expect) {
+		t.Errorf("Expected the teardown\n%q\ngot\n%q", expect, events)
+	}
+	if received := <-guacd.Received; received != "10.disconnect;" {
+		t.Errorf("Expected guacd to be told to disconnect, got %q", received)
+	}
+}
+
+func TestWebsocketServer_TeardownWaitsForInput(t *testing.T) {
+	inFilter := make(chan struct{})
+	log, guacd, ws, done := teardownServer(t, func(s *WebsocketServer, log *teardownLog) {
+		s.Filters = []InstructionFilter{func(ins *Instruction, dir Direction) (*Instruction, error) {
+			if dir == Inbound && ins.Opcode == "key" {
+				close(inFilter)
+				time.Sleep(100 * time.Millisecond)
+				log.add("input done")
+			}
+			return ins, nil
+		}}
+	})
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	// guacd ends the session while the client's input is still being handled
+	<-inFilter
+	_ = guacd.Close()
+	waitDone(t, done)
+
+	if events := log.get(); len(events) == 0 || events[0] != "input done" {
+		t.Errorf("Expected the teardown to wait for the input, got %q", events)
+	}
+}
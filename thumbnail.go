@@ -0,0 +1,249 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/draw"
+	_ "image/jpeg" // guacd sends JPEG images to clients that accept them
+	_ "image/png"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultThumbnailWidth is the default WebsocketServer.ThumbnailWidth
+	DefaultThumbnailWidth = 320
+	// thumbnailBacklog is the most of the images guacd draws kept between thumbnails. Images
+	// beyond it aren't drawn, which bounds the cost of a busy session.
+	thumbnailBacklog = 4 << 20
+	// thumbnailSrcOver is the channel mask of img instructions drawn over what is below them
+	thumbnailSrcOver = "14"
+)
+
+// Thumbnail is a small image of a session's display, see WebsocketServer.OnThumbnail
+type Thumbnail struct {
+	ConnectionID string
+	Time         time.Time
+	Image        *image.RGBA
+	// Partial is set when images were left out of this thumbnail or an earlier one, because
+	// guacd drew more between thumbnails than is kept, so it may be out of date until those
+	// parts of the screen are drawn again
+	Partial bool
+}
+
+// thumbnailer draws periodic thumbnails of a session from the images guacd draws on the default
+// layer, which is most of what is on screen. Other layers, such as the cursor, and instructions
+// other than img and size are ignored, as are images Go can't decode, such as WebP, so thumbnails
+// are an approximation. The pump only copies the instructions that draw images, and they are
+// decoded and drawn when the thumbnail is due, apart from the pump, so the user's stream isn't
+// held up.
+type thumbnailer struct {
+	id    string
+	width int
+	sink  func(Thumbnail)
+
+	// lock guards what the pump observes for the next thumbnail
+	lock    sync.Mutex
+	pending []byte
+	// images are the img streams drawing on the default layer
+	images map[string]bool
+	// dropped is set when pending was discarded, so the streams being decoded are abandoned
+	dropped bool
+
+	// the rest is only used by run
+	canvas  *image.RGBA
+	scale   float64
+	streams map[string]*thumbnailImage
+	partial bool
+}
+
+// thumbnailImage is an image being received for a thumbnail
+type thumbnailImage struct {
+	mask string
+	x, y int
+	data []byte
+}
+
+func newThumbnailer(id string, width int, sink func(Thumbnail)) *thumbnailer {
+	if width <= 0 {
+		width = DefaultThumbnailWidth
+	}
+	return &thumbnailer{
+		id:      id,
+		width:   width,
+		sink:    sink,
+		images:  map[string]bool{},
+		streams: map[string]*thumbnailImage{},
+	}
+}
+
+// observe copies the instructions of data that draw on the default layer
+func (t *thumbnailer) observe(data []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for rest := data; len(rest) > 0; {
+		n, err := scanInstruction(rest)
+		if err != nil {
+			return
+		}
+		raw := rest[:n]
+		rest = rest[n:]
+		elements, err := peekElements(raw, 4)
+		if err != nil || len(elements) < 2 {
+			continue
+		}
+		switch elements[0] {
+		case "size":
+			if elements[1] != "0" {
+				continue
+			}
+		case "img":
+			if len(elements) < 4 || elements[3] != "0" {
+				continue
+			}
+			t.images[elements[1]] = true
+		case "blob", "end":
+			if !t.images[elements[1]] {
+				continue
+			}
+			if elements[0] == "end" {
+				delete(t.images, elements[1])
+			}
+		default:
+			continue
+		}
+		if len(t.pending)+len(raw) > thumbnailBacklog {
+			// the images in progress can't be completed
+			t.pending = t.pending[:0]
+			t.images = map[string]bool{}
+			t.dropped = true
+			continue
+		}
+		t.pending = append(t.pending, raw...)
+	}
+}
+
+// run sends a thumbnail every interval until stop is closed
+func (t *thumbnailer) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if thumbnail, ok := t.render(); ok {
+			t.sink(thumbnail)
+		}
+	}
+}
+
+// render draws what was observed since the last thumbnail and returns a copy of the result,
+// or false if guacd hasn't sized the display yet
+func (t *thumbnailer) render() (Thumbnail, bool) {
+	t.lock.Lock()
+	pending := t.pending
+	t.pending = nil
+	if t.dropped {
+		t.dropped = false
+		t.partial = true
+		t.streams = map[string]*thumbnailImage{}
+	}
+	t.lock.Unlock()
+
+	for rest := pending; len(rest) > 0; {
+		n, err := scanInstruction(rest)
+		if err != nil {
+			break
+		}
+		if ins, err := Parse(rest[:n]); err == nil {
+			t.draw(ins)
+		}
+		rest = rest[n:]
+	}
+
+	if t.canvas == nil {
+		return Thumbnail{}, false
+	}
+	img := image.NewRGBA(t.canvas.Rect)
+	copy(img.Pix, t.canvas.Pix)
+	return Thumbnail{ConnectionID: t.id, Time: time.Now(), Image: img, Partial: t.partial}, true
+}
+
+// draw applies an instruction observed on the default layer
+func (t *thumbnailer) draw(ins *Instruction) {
+	switch ins.Opcode {
+	case "size":
+		if len(ins.Args) < 3 {
+			return
+		}
+		width, err1 := strconv.Atoi(ins.Args[1])
+		height, err2 := strconv.Atoi(ins.Args[2])
+		if err1 != nil || err2 != nil || width <= 0 || height <= 0 {
+			return
+		}
+		t.scale = float64(t.width) / float64(width)
+		t.canvas = image.NewRGBA(image.Rect(0, 0, t.width, max(1, int(float64(height)*t.scale))))
+	case "img":
+		if len(ins.Args) < 6 {
+			return
+		}
+		x, err1 := strconv.Atoi(ins.Args[4])
+		y, err2 := strconv.Atoi(ins.Args[5])
+		if err1 != nil || err2 != nil {
+			return
+		}
+		t.streams[ins.Args[0]] = &thumbnailImage{mask: ins.Args[1], x: x, y: y}
+	case "blob":
+		if stream, ok := t.streams[ins.Args[0]]; ok && len(ins.Args) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(ins.Args[1])
+			if err != nil {
+				delete(t.streams, ins.Args[0])
+				return
+			}
+			stream.data = append(stream.data, decoded...)
+		}
+	case "end":
+		stream, ok := t.streams[ins.Args[0]]
+		if !ok {
+			return
+		}
+		delete(t.streams, ins.Args[0])
+		if t.canvas == nil {
+			return
+		}
+		src, _, err := image.Decode(bytes.NewReader(stream.data))
+		if err != nil {
+			return
+		}
+		t.drawScaled(src, stream.x, stream.y, stream.mask == thumbnailSrcOver)
+	}
+}
+
+// drawScaled draws src at x, y of the display onto the canvas, scaled by nearest neighbour
+func (t *thumbnailer) drawScaled(src image.Image, x, y int, over bool) {
+	bounds := src.Bounds()
+	dst := image.Rect(
+		int(float64(x)*t.scale), int(float64(y)*t.scale),
+		int(float64(x+bounds.Dx())*t.scale+0.5), int(float64(y+bounds.Dy())*t.scale+0.5),
+	).Intersect(t.canvas.Rect)
+	if dst.Empty() {
+		return
+	}
+	op := draw.Src
+	if over {
+		op = draw.Over
+	}
+	scaled := image.NewRGBA(dst)
+	for dy := dst.Min.Y; dy < dst.Max.Y; dy++ {
+		sy := bounds.Min.Y + min(bounds.Dy()-1, int((float64(dy)+0.5)/t.scale)-y)
+		for dx := dst.Min.X; dx < dst.Max.X; dx++ {
+			sx := bounds.Min.X + min(bounds.Dx()-1, int((float64(dx)+0.5)/t.scale)-x)
+			scaled.Set(dx, dy, src.At(max(bounds.Min.X, sx), max(bounds.Min.Y, sy)))
+		}
+	}
+	draw.Draw(t.canvas, dst, scaled, dst.Min, op)
+}
@@ -0,0 +1,124 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// drawImage returns the instructions drawing a square PNG of one colour at x, y of the layer
+func drawImage(t *testing.T, stream, layer string, x, y, size int, c color.Color) string {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < size; i++ {
+		for j := 0; j < size; j++ {
+			img.Set(i, j, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return NewInstruction("img", stream, "14", layer, "image/png", strconv.Itoa(x), strconv.Itoa(y)).String() +
+		NewInstruction("blob", stream, base64.StdEncoding.EncodeToString(buf.Bytes())).String() +
+		NewInstruction("end", stream).String()
+}
+
+func TestThumbnailer(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	thumbnails := newThumbnailer("$fake", 10, nil)
+	if _, ok := thumbnails.render(); ok {
+		t.Error("Expected no thumbnail before the display is sized")
+	}
+
+	// a 20x20 display drawn at half size, with a red square in its top left and the cursor,
+	// which is on another layer, over the rest
+	thumbnails.observe([]byte("4.size,1.0,2.20,2.20;" + drawImage(t, "1", "0", 0, 0, 10, red)))
+	thumbnails.observe([]byte(drawImage(t, "2", "-1", 10, 10, 10, red) + "4.sync,1.1;"))
+	thumbnail, ok := thumbnails.render()
+	if !ok {
+		t.Fatal("Expected a thumbnail")
+	}
+	if bounds := thumbnail.Image.Bounds(); bounds.Dx() != 10 || bounds.Dy() != 10 {
+		t.Fatal("Expected a 10x10 thumbnail, got", bounds)
+	}
+	if c := thumbnail.Image.RGBAAt(2, 2); c != red {
+		t.Error("Expected the square to be drawn, got", c)
+	}
+	if c := thumbnail.Image.RGBAAt(4, 4); c != red {
+		t.Error("Expected the square to be half size, got", c)
+	}
+	if c := thumbnail.Image.RGBAAt(5, 5); c == red {
+		t.Error("Expected other layers to be left out")
+	}
+	if thumbnail.ConnectionID != "$fake" || thumbnail.Partial {
+		t.Error("Unexpected thumbnail", thumbnail.ConnectionID, thumbnail.Partial)
+	}
+
+	// thumbnails are copies, and the display is kept for the next
+	thumbnail.Image.Pix[0] = 0
+	if next, _ := thumbnails.render(); next.Image.RGBAAt(0, 0) != red {
+		t.Error("Expected the display to be kept between thumbnails")
+	}
+}
+
+func TestWebsocketServer_Thumbnails(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		return &ConnectResult{Tunnel: tunnel, Thumbnails: true}, nil
+	}, nopLogger())
+	thumbnails := make(chan Thumbnail, 100)
+	wsServer.OnThumbnail = func(thumbnail Thumbnail) {
+		thumbnails <- thumbnail
+	}
+	wsServer.ThumbnailInterval = 50 * time.Millisecond
+	wsServer.ThumbnailWidth = 10
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	blue := color.RGBA{B: 255, A: 255}
+	msg := "4.size,1.0,2.20,2.20;" + drawImage(t, "1", "0", 0, 0, 20, blue) + "4.sync,1.1;"
+	if _, err = guacd.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	// the user's stream is untouched
+	if _, received, err := ws.ReadMessage(); err != nil || string(received) != msg {
+		t.Fatal("Expected the client to receive the frame, got", err)
+	}
+
+	var times []time.Time
+	for len(times) < 4 {
+		select {
+		case thumbnail := <-thumbnails:
+			if thumbnail.ConnectionID != "$fake" {
+				t.Error("Expected the connection ID, got", thumbnail.ConnectionID)
+			}
+			if c := thumbnail.Image.RGBAAt(9, 9); c != blue {
+				t.Error("Expected the display to be drawn, got", c)
+			}
+			times = append(times, thumbnail.Time)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for thumbnails")
+		}
+	}
+	for i := 1; i < len(times); i++ {
+		if interval := times[i].Sub(times[i-1]); interval < 25*time.Millisecond || interval > time.Second {
+			t.Error("Expected a thumbnail every 50ms, got one after", interval)
+		}
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+}
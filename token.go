@@ -0,0 +1,176 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TokenClaims are the claims of a signed connect token
+type TokenClaims struct {
+	// Subject identifies the user the token was issued to
+	Subject string
+	// ExpiresAt is when the token, and any session it started, expires
+	ExpiresAt time.Time
+	// NotBefore is when the token becomes valid
+	NotBefore time.Time
+	// ID is the token's "jti", the nonce of the connect request when the Policy has Nonces
+	ID string
+	// Claims holds every claim in the token, including the registered ones above
+	Claims map[string]interface{}
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+}
+
+// ParseToken verifies a JWT signed with HMAC SHA-256 and returns its claims. Tokens that are
+// expired or not yet valid are rejected.
+func ParseToken(token string, secret []byte) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthorized.NewError("Malformed token.")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrUnauthorized.NewError("Malformed token header.", err.Error())
+	}
+	var header tokenHeader
+	if err = json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, ErrUnauthorized.NewError("Malformed token header.", err.Error())
+	}
+	if header.Alg != "HS256" {
+		return nil, ErrUnauthorized.NewError("Unsupported token algorithm.", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrUnauthorized.NewError("Malformed token signature.", err.Error())
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrUnauthorized.NewError("Invalid token signature.")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrUnauthorized.NewError("Malformed token claims.", err.Error())
+	}
+	claims := &TokenClaims{}
+	decoder := json.NewDecoder(bytes.NewReader(claimsJSON))
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims.Claims); err != nil {
+		return nil, ErrUnauthorized.NewError("Malformed token claims.", err.Error())
+	}
+
+	if sub, ok := claims.Claims["sub"].(string); ok {
+		claims.Subject = sub
+	}
+	if jti, ok := claims.Claims["jti"].(string); ok {
+		claims.ID = jti
+	}
+	if claims.ExpiresAt, err = numericDate(claims.Claims["exp"]); err != nil {
+		return nil, err
+	}
+	if claims.NotBefore, err = numericDate(claims.Claims["nbf"]); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !claims.ExpiresAt.IsZero() && !now.Before(claims.ExpiresAt) {
+		return nil, ErrUnauthorized.NewError("Token expired.")
+	}
+	if !claims.NotBefore.IsZero() && now.Before(claims.NotBefore) {
+		return nil, ErrUnauthorized.NewError("Token not yet valid.")
+	}
+	return claims, nil
+}
+
+// numericDate converts a JWT NumericDate, which may have a fractional part, to a time
+func numericDate(claim interface{}) (time.Time, error) {
+	if claim == nil {
+		return time.Time{}, nil
+	}
+	n, ok := claim.(json.Number)
+	if !ok {
+		return time.Time{}, ErrUnauthorized.NewError("Malformed token date.")
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, ErrUnauthorized.NewError("Malformed token date.", err.Error())
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))), nil
+}
+
+// requestToken returns the token from the "token" query parameter or a bearer Authorization header
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+type tokenClaimsKey struct{}
+
+// ContextWithTokenClaims returns a context that carries the claims of the request's verified token
+func ContextWithTokenClaims(ctx context.Context, claims *TokenClaims) context.Context {
+	return context.WithValue(ctx, tokenClaimsKey{}, claims)
+}
+
+// TokenClaimsFromContext returns the token claims in ctx. TokenConnect puts them in the context
+// of the request given to the connect function.
+func TokenClaimsFromContext(ctx context.Context) (*TokenClaims, bool) {
+	claims, ok := ctx.Value(tokenClaimsKey{}).(*TokenClaims)
+	return claims, ok && claims != nil
+}
+
+// TokenConnect wraps a connect function so that connections require a valid token signed with
+// secret. The token's expiry bounds the session: the request passed to connect carries a context
+// with the expiry as its deadline, and the WebsocketServer disconnects the session when it is reached.
+// The context also carries the claims, so PrepareConfig can check the token's jti against the
+// Policy's Nonces.
+func TokenConnect(secret []byte, connect func(*websocket.Conn, *http.Request, *TokenClaims) (Tunnel, error)) func(*websocket.Conn, *http.Request) (*ConnectResult, error) {
+	return func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		token := requestToken(r)
+		if token == "" {
+			return nil, ErrUnauthorized.NewError("No token provided.")
+		}
+		claims, err := ParseToken(token, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx := ContextWithTokenClaims(r.Context(), claims)
+		if !claims.ExpiresAt.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, claims.ExpiresAt)
+			defer cancel()
+		}
+		r = r.WithContext(ctx)
+
+		tunnel, err := connect(ws, r, claims)
+		if err != nil {
+			return nil, err
+		}
+		return &ConnectResult{
+			Tunnel:   tunnel,
+			Deadline: claims.ExpiresAt,
+		}, nil
+	}
+}
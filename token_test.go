@@ -0,0 +1,136 @@
+package guac
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// signToken creates an HS256 JWT with the given claims
+func signToken(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func TestParseToken(t *testing.T) {
+	secret := []byte("secret")
+	exp := time.Now().Add(time.Hour)
+
+	claims, err := ParseToken(signToken(t, secret, map[string]interface{}{
+		"sub":  "alice",
+		"jti":  "n1",
+		"exp":  unixSeconds(exp),
+		"host": "10.0.0.1",
+	}), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "alice" {
+		t.Error("Unexpected subject", claims.Subject)
+	}
+	if claims.ID != "n1" {
+		t.Error("Unexpected ID", claims.ID)
+	}
+	if d := claims.ExpiresAt.Sub(exp); d > time.Millisecond || d < -time.Millisecond {
+		t.Error("Unexpected expiry", claims.ExpiresAt, exp)
+	}
+	if claims.Claims["host"] != "10.0.0.1" {
+		t.Error("Unexpected claims", claims.Claims)
+	}
+
+	for name, token := range map[string]string{
+		"WrongSecret": signToken(t, []byte("other"), map[string]interface{}{"sub": "alice"}),
+		"Expired":     signToken(t, secret, map[string]interface{}{"exp": unixSeconds(time.Now().Add(-time.Second))}),
+		"NotBefore":   signToken(t, secret, map[string]interface{}{"nbf": unixSeconds(time.Now().Add(time.Hour))}),
+		"Malformed":   "abc",
+		"AlgNone": base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`)) + ".",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseToken(token, secret); err == nil || err.(*ErrGuac).Kind != ErrUnauthorized {
+				t.Error("Expected unauthorized, got", err)
+			}
+		})
+	}
+}
+
+func TestTokenConnect_Expiry(t *testing.T) {
+	secret := []byte("secret")
+	tunnel, guacd := newFakeGuacd(t)
+
+	var deadline time.Time
+	var contextClaims *TokenClaims
+	wsServer := NewWebsocketServerResult(TokenConnect(secret, func(ws *websocket.Conn, r *http.Request, claims *TokenClaims) (Tunnel, error) {
+		deadline, _ = r.Context().Deadline()
+		contextClaims, _ = TokenClaimsFromContext(r.Context())
+		return tunnel, nil
+	}), nopLogger())
+	url, done := serveWebsocket(t, wsServer)
+
+	// connecting without a token closes the websocket straight away
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ws.ReadMessage(); err == nil {
+		t.Fatal("Expected a connection without a token to fail")
+	}
+	waitDone(t, done)
+
+	exp := time.Now().Add(200 * time.Millisecond)
+	token := signToken(t, secret, map[string]interface{}{"sub": "alice", "exp": unixSeconds(exp)})
+	ws, _, err = websocket.DefaultDialer.Dial(url+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Before(exp) {
+		t.Error("Session ended before the token expired")
+	}
+	if !strings.HasPrefix(string(msg), "5.error,16.Session expired.,3.522;") {
+		t.Error("Unexpected message", string(msg))
+	}
+
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, SessionTimeout.GetWebSocketCode()) {
+		t.Error("Expected close frame, got", err)
+	}
+
+	if got := <-guacd.Received; got != "10.disconnect;" {
+		t.Error("Expected guacd to be sent a disconnect, got", got)
+	}
+	waitDone(t, done)
+
+	if _, ok := <-guacd.Received; ok {
+		t.Error("Expected the guacd connection to be closed")
+	}
+	if d := deadline.Sub(exp); d > time.Millisecond || d < -time.Millisecond {
+		t.Error("Expected connect context to have the token deadline, got", deadline)
+	}
+	if contextClaims == nil || contextClaims.Subject != "alice" {
+		t.Error("Expected connect context to have the token claims, got", contextClaims)
+	}
+}
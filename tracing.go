@@ -0,0 +1,62 @@
+package guac
+
+import "context"
+
+// Span names recorded by the package
+const (
+	SpanConnect   = "guac.connect"
+	SpanHandshake = "guac.handshake"
+	SpanSession   = "guac.session"
+)
+
+// Attribute is a key/value pair recorded on a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Tracer starts spans. It has the same shape as an OpenTelemetry tracer so tracing stays opt-in
+// and the package doesn't depend on OpenTelemetry: an adapter only needs to call
+// trace.Tracer.Start and convert attributes with attribute.String/Int64.
+type Tracer interface {
+	// Start creates a span and a context containing it
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a single traced operation
+type Span interface {
+	// SetAttributes records attributes on the span
+	SetAttributes(attrs ...Attribute)
+	// RecordError records an error that occurred during the span
+	RecordError(err error)
+	// End completes the span
+	End()
+}
+
+type tracerKey struct{}
+
+// ContextWithTracer returns a context that carries the tracer, so functions like
+// Stream.HandshakeContext can record their spans under the span in ctx.
+func ContextWithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// tracerFromContext returns the tracer in ctx or one that does nothing
+func tracerFromContext(ctx context.Context) Tracer {
+	if tracer, ok := ctx.Value(tracerKey{}).(Tracer); ok && tracer != nil {
+		return tracer
+	}
+	return nopTracer{}
+}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(...Attribute) {}
+func (nopSpan) RecordError(error)          {}
+func (nopSpan) End()                       {}
@@ -0,0 +1,196 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type recordedSpan struct {
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+type spanKey struct{}
+
+// recordingTracer keeps every span started so tests can assert on them
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &recordedSpan{name: name, attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	r.Lock()
+	r.spans = append(r.spans, span)
+	r.Unlock()
+	s := &recordingSpan{tracer: r, span: span}
+	s.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, span), s
+}
+
+func (r *recordingTracer) find(name string) *recordedSpan {
+	r.Lock()
+	defer r.Unlock()
+	for _, span := range r.spans {
+		if span.name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	span   *recordedSpan
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	for _, attr := range attrs {
+		s.span.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.span.err = err
+}
+
+func (s *recordingSpan) End() {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.span.ended = true
+}
+
+func TestWebsocketServer_Tracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		config := NewGuacamoleConfiguration()
+		config.Protocol = "rdp"
+		stream := NewStream(client, time.Minute)
+		if err := stream.HandshakeContext(r.Context(), config); err != nil {
+			return nil, err
+		}
+		return NewSimpleTunnel(stream), nil
+	}, nopLogger())
+	wsServer.Tracer = tracer
+	url, done := serveWebsocket(t, wsServer)
+
+	handshook := make(chan error, 1)
+	go func() {
+		_, err := serveHandshake(guacd, "$abc", "hostname")
+		handshook <- err
+	}()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if err = <-handshook; err != nil {
+		t.Fatal(err)
+	}
+
+	// guacd sends a frame and the client sends a key press
+	if _, err = guacd.Write([]byte("4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err = guacd.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// ensure the write to guacd is counted, then guacd ends the session
+	time.Sleep(10 * time.Millisecond)
+	_ = guacd.Close()
+	waitDone(t, done)
+
+	connect := tracer.find(SpanConnect)
+	if connect == nil || !connect.ended || connect.err != nil || connect.attrs["guac.connection_id"] != "$abc" {
+		t.Errorf("Unexpected connect span %+v", connect)
+	}
+	handshake := tracer.find(SpanHandshake)
+	if handshake == nil || !handshake.ended || handshake.parent != SpanConnect ||
+		handshake.attrs["guac.protocol"] != "rdp" || handshake.attrs["guac.connection_id"] != "$abc" {
+		t.Errorf("Unexpected handshake span %+v", handshake)
+	}
+	session := tracer.find(SpanSession)
+	if session == nil || !session.ended || session.err != nil || session.attrs["guac.connection_id"] != "$abc" ||
+		session.attrs["guac.bytes_to_client"] != int64(11) || session.attrs["guac.bytes_to_guacd"] != int64(15) ||
+		session.attrs["guac.close_reason"] != "guacd" {
+		t.Errorf("Unexpected session span %+v", session)
+	}
+}
+
+func TestWebsocketServer_Tracer_SessionError(t *testing.T) {
+	tracer := &recordingTracer{}
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.Filters = []InstructionFilter{failingFilter}
+	wsServer.Tracer = tracer
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	// the filter rejects the key press, which ends the session with an error
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, done)
+
+	session := tracer.find(SpanSession)
+	if session == nil || !session.ended || session.err == nil || session.attrs["guac.close_reason"] != "error" {
+		t.Errorf("Expected the session span to record the error, got %+v", session)
+	}
+}
+
+func TestStream_HandshakeContext_Error(t *testing.T) {
+	tracer := &recordingTracer{}
+	client, guacd := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+
+	go func() {
+		buf := make([]byte, 100)
+		_, _ = guacd.Read(buf)
+		_, _ = guacd.Write([]byte("5.error,11.No protocol,3.256;"))
+	}()
+
+	err := NewStream(client, time.Minute).HandshakeContext(ContextWithTracer(context.Background(), tracer), NewGuacamoleConfiguration())
+	if err == nil {
+		t.Fatal("Expected handshake to fail")
+	}
+	handshake := tracer.find(SpanHandshake)
+	if handshake == nil || !handshake.ended || !errors.Is(handshake.err, err) {
+		t.Errorf("Unexpected handshake span %+v", handshake)
+	}
+}
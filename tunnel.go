@@ -1,8 +1,11 @@
 package guac
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"strconv"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
@@ -50,6 +53,23 @@ type Tunnel interface {
 	Close() error
 }
 
+// StreamController is implemented by tunnels that can list and abort the transfers open on them,
+// which is useful for admin tooling dealing with stuck uploads and downloads.
+type StreamController interface {
+	// OpenStreams returns the file, clipboard, pipe and argv streams currently in progress
+	OpenStreams() []StreamInfo
+	// CancelStream aborts the stream with the given index
+	CancelStream(index int) error
+}
+
+// InputSender is implemented by tunnels that can send keys and mouse events to the remote
+// themselves, alongside the client's input, for automation and testing
+type InputSender interface {
+	SendKey(keysym int, pressed bool) error
+	SendMouse(x, y int, buttons int) error
+	SendText(text string) error
+}
+
 // Base Tunnel implementation which synchronizes access to the underlying reader and writer with locks
 type SimpleTunnel struct {
 	stream *Stream
@@ -100,7 +120,7 @@ func (t *SimpleTunnel) ReleaseWriter() {
 
 // ConnectionID returns the underlying Guacamole connection ID
 func (t *SimpleTunnel) ConnectionID() string {
-	return t.stream.ConnectionID
+	return t.stream.connectionID()
 }
 
 // HasQueuedWriterThreads returns true if more than one goroutine is trying to write
@@ -124,3 +144,94 @@ func (t *SimpleTunnel) Close() (err error) {
 func (t *SimpleTunnel) GetUUID() string {
 	return t.uuid.String()
 }
+
+// OpenStreams returns the transfers currently in progress on the tunnel
+func (t *SimpleTunnel) OpenStreams() []StreamInfo {
+	return t.stream.OpenStreams()
+}
+
+// CancelStream aborts the transfer with the given index, telling both guacd and the client, see
+// Stream.CancelStream. It doesn't need the writer lock, so it can be used while a websocket holds
+// the writer for the life of the connection.
+func (t *SimpleTunnel) CancelStream(index int) error {
+	return t.stream.CancelStream(index)
+}
+
+// Screenshot captures the drawing instructions of the next frame on the tunnel, see
+// Stream.Screenshot. Like CancelStream it doesn't need the writer lock.
+func (t *SimpleTunnel) Screenshot(ctx context.Context) ([]*Instruction, error) {
+	return t.stream.Screenshot(ctx)
+}
+
+// ReplayDisplayState writes the display drawn so far to a late viewer, see
+// Stream.RetainDisplayState
+func (t *SimpleTunnel) ReplayDisplayState(ws MessageWriter) error {
+	return t.stream.ReplayDisplayState(ws)
+}
+
+// SendMouse moves the mouse to x, y with the given buttons pressed, a mask where 1 is left,
+// 2 middle, 4 right, 8 scroll up and 16 scroll down. Like CancelStream it doesn't need the writer
+// lock, instructions are written whole so they don't interleave with the client's.
+func (t *SimpleTunnel) SendMouse(x, y int, buttons int) error {
+	_, err := t.stream.Write(NewInstruction("mouse", strconv.Itoa(x), strconv.Itoa(y), strconv.Itoa(buttons)).Bytes())
+	return err
+}
+
+// SendKey presses or releases the key with the given X11 keysym
+func (t *SimpleTunnel) SendKey(keysym int, pressed bool) error {
+	state := "0"
+	if pressed {
+		state = "1"
+	}
+	_, err := t.stream.Write(NewInstruction("key", strconv.Itoa(keysym), state).Bytes())
+	return err
+}
+
+// SendText types text by pressing and releasing the key of each character in turn. The keys are
+// written at once, so the client's own input can't come between them. Newlines, including "\r\n",
+// and tabs press Return and Tab, DEL presses Delete, and C1 control characters, which have no key,
+// are skipped.
+func (t *SimpleTunnel) SendText(text string) error {
+	if !utf8.ValidString(text) {
+		return ErrClient.NewError("Text is not valid UTF-8.")
+	}
+	var keys []byte
+	var previous rune
+	for _, r := range text {
+		crlf := r == '\n' && previous == '\r'
+		previous = r
+		keysym, ok := textKeysym(r)
+		if !ok || crlf {
+			continue
+		}
+		keys = append(keys, NewInstruction("key", strconv.Itoa(keysym), "1").Bytes()...)
+		keys = append(keys, NewInstruction("key", strconv.Itoa(keysym), "0").Bytes()...)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := t.stream.Write(keys)
+	return err
+}
+
+// textKeysym returns the X11 keysym that types r, as guacamole-common-js maps characters, or false
+// if no key types it
+func textKeysym(r rune) (int, bool) {
+	switch {
+	case r == '\n' || r == '\r':
+		return 0xff0d, true
+	case r == 0x7f:
+		// Delete, as 0xff7f is Num_Lock
+		return 0xffff, true
+	case r >= 0x80 && r < 0xa0:
+		// C1 controls, which would be keypad keysyms
+		return 0, false
+	case r < 0x20:
+		// control characters, including tab
+		return 0xff00 | int(r), true
+	case r < 0x100:
+		// Latin-1 keysyms are the code point
+		return int(r), true
+	}
+	return 0x01000000 | int(r), true
+}
@@ -0,0 +1,21 @@
+package guac
+
+// TunnelChain wraps base in each decorator in turn, so the first decorator is closest to guacd
+// and the last is the tunnel the WebsocketServer uses. A decorator usually embeds the Tunnel it
+// is given and overrides AcquireReader or AcquireWriter.
+//
+// Order matters because data crosses the decorators in opposite directions:
+//   - instructions from guacd pass through the decorators first to last, so a recorder listed
+//     before a filter records what guacd sent, and one listed after records what the client saw
+//   - instructions from the client pass through them last to first, so anything listed before a
+//     filter, such as byte stats, only sees what the filter let through
+//
+// Optional interfaces of base, like StreamController, are hidden by decorators that embed the
+// Tunnel interface.
+func TunnelChain(base Tunnel, decorators ...func(Tunnel) Tunnel) Tunnel {
+	tunnel := base
+	for _, decorate := range decorators {
+		tunnel = decorate(tunnel)
+	}
+	return tunnel
+}
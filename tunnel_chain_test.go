@@ -0,0 +1,150 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// statsTunnel counts the bytes passing through it
+type statsTunnel struct {
+	Tunnel
+	read, written int
+}
+
+type statsReader struct {
+	InstructionReader
+	t *statsTunnel
+}
+
+func (r statsReader) ReadSome() ([]byte, error) {
+	ins, err := r.InstructionReader.ReadSome()
+	r.t.read += len(ins)
+	return ins, err
+}
+
+type statsWriter struct {
+	io.Writer
+	t *statsTunnel
+}
+
+func (w statsWriter) Write(data []byte) (int, error) {
+	w.t.written += len(data)
+	return w.Writer.Write(data)
+}
+
+func (t *statsTunnel) AcquireReader() InstructionReader {
+	return statsReader{t.Tunnel.AcquireReader(), t}
+}
+
+func (t *statsTunnel) AcquireWriter() io.Writer {
+	return statsWriter{t.Tunnel.AcquireWriter(), t}
+}
+
+// recordingTunnel records the instructions read through it
+type recordingTunnel struct {
+	Tunnel
+	recording bytes.Buffer
+}
+
+type recordingReader struct {
+	InstructionReader
+	t *recordingTunnel
+}
+
+func (r recordingReader) ReadSome() ([]byte, error) {
+	ins, err := r.InstructionReader.ReadSome()
+	r.t.recording.Write(ins)
+	return ins, err
+}
+
+func (t *recordingTunnel) AcquireReader() InstructionReader {
+	return recordingReader{t.Tunnel.AcquireReader(), t}
+}
+
+// nopFilterTunnel drops nop instructions from guacd and mouse instructions from the client
+type nopFilterTunnel struct {
+	Tunnel
+}
+
+type nopFilterReader struct {
+	InstructionReader
+}
+
+func (r nopFilterReader) ReadSome() ([]byte, error) {
+	for {
+		ins, err := r.InstructionReader.ReadSome()
+		if err != nil || !bytes.HasPrefix(ins, []byte("3.nop;")) {
+			return ins, err
+		}
+	}
+}
+
+type mouseFilterWriter struct {
+	io.Writer
+}
+
+func (w mouseFilterWriter) Write(data []byte) (int, error) {
+	if bytes.HasPrefix(data, []byte("5.mouse,")) {
+		return len(data), nil
+	}
+	return w.Writer.Write(data)
+}
+
+func (t nopFilterTunnel) AcquireReader() InstructionReader {
+	return nopFilterReader{t.Tunnel.AcquireReader()}
+}
+
+func (t nopFilterTunnel) AcquireWriter() io.Writer {
+	return mouseFilterWriter{t.Tunnel.AcquireWriter()}
+}
+
+func TestTunnelChain(t *testing.T) {
+	base, guacd := newFakeGuacd(t)
+
+	stats := &statsTunnel{}
+	recorder := &recordingTunnel{}
+	tunnel := TunnelChain(base,
+		func(t Tunnel) Tunnel { stats.Tunnel = t; return stats },
+		func(t Tunnel) Tunnel { recorder.Tunnel = t; return recorder },
+		func(t Tunnel) Tunnel { return nopFilterTunnel{t} },
+	)
+	if tunnel.ConnectionID() != "$fake" {
+		t.Error("Expected the chain to keep the base connection ID, got", tunnel.ConnectionID())
+	}
+
+	// the filter drops the mouse before stats counts it
+	writer := tunnel.AcquireWriter()
+	for _, ins := range []string{"5.mouse,1.1,1.2;", "3.key,2.65,1.1;"} {
+		if _, err := writer.Write([]byte(ins)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if received := <-guacd.Received; received != "3.key,2.65,1.1;" {
+		t.Error("Unexpected instruction", received)
+	}
+	if stats.written != len("3.key,2.65,1.1;") {
+		t.Error("Expected stats to count only what was written to guacd, got", stats.written)
+	}
+
+	// stats and the recording see the nop from guacd, the tunnel's reader doesn't
+	go func() {
+		_, _ = guacd.Write([]byte("3.nop;4.sync,3.100;"))
+	}()
+	ins, err := tunnel.AcquireReader().ReadSome()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ins) != "4.sync,3.100;" {
+		t.Error("Expected the nop to be filtered, got", string(ins))
+	}
+	if recorder.recording.String() != "3.nop;4.sync,3.100;" {
+		t.Error("Unexpected recording", recorder.recording.String())
+	}
+	if stats.read != len("3.nop;4.sync,3.100;") {
+		t.Error("Expected stats to count everything read from guacd, got", stats.read)
+	}
+	if tunnel.GetUUID() != base.GetUUID() {
+		t.Error("Expected the chain to keep the base UUID")
+	}
+}
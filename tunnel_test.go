@@ -0,0 +1,95 @@
+package guac
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimpleTunnel_SendInput(t *testing.T) {
+	conn := &fakeConn{}
+	tunnel := NewSimpleTunnel(NewStream(conn, time.Minute))
+
+	// the client's websocket holds the writer for the whole session
+	_ = tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	if err := tunnel.SendMouse(100, 250, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.SendMouse(100, 250, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.SendKey(0xff0d, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.SendKey(0xff0d, false); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "5.mouse,3.100,3.250,1.1;5.mouse,3.100,3.250,1.0;3.key,5.65293,1.1;3.key,5.65293,1.0;"
+	if string(conn.Written) != expected {
+		t.Error("Unexpected instructions", string(conn.Written))
+	}
+}
+
+func TestSimpleTunnel_SendText(t *testing.T) {
+	conn := &fakeConn{}
+	var tunnel InputSender = NewSimpleTunnel(NewStream(conn, time.Minute))
+	_ = tunnel.(Tunnel).AcquireWriter()
+	defer tunnel.(Tunnel).ReleaseWriter()
+
+	if err := tunnel.SendText("aé€\n"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "3.key,2.97,1.1;3.key,2.97,1.0;" +
+		"3.key,3.233,1.1;3.key,3.233,1.0;" +
+		"3.key,8.16785580,1.1;3.key,8.16785580,1.0;" +
+		"3.key,5.65293,1.1;3.key,5.65293,1.0;"
+	if string(conn.Written) != expected {
+		t.Error("Unexpected instructions", string(conn.Written))
+	}
+
+	if err := tunnel.SendText("\xff"); err == nil {
+		t.Error("Expected invalid UTF-8 to be refused")
+	}
+	if err := tunnel.SendText(""); err != nil || string(conn.Written) != expected {
+		t.Error("Expected no text to send nothing", err)
+	}
+}
+
+func TestTextKeysym(t *testing.T) {
+	tests := map[rune]int{'A': 0x41, ' ': 0x20, '\t': 0xff09, '\r': 0xff0d, '\n': 0xff0d, 0x7f: 0xffff, 'ÿ': 0xff, 'Ā': 0x1000100}
+	for r, expect := range tests {
+		if got, ok := textKeysym(r); !ok || got != expect {
+			t.Errorf("%q: expected %#x, got %#x", r, expect, got)
+		}
+	}
+	for _, r := range []rune{0x80, 0x8d, 0x9f} {
+		if got, ok := textKeysym(r); ok {
+			t.Errorf("%q: expected no key, got %#x", r, got)
+		}
+	}
+}
+
+func TestSimpleTunnel_SendTextControls(t *testing.T) {
+	for name, test := range map[string]struct {
+		text     string
+		expected string
+	}{
+		"CRLF":   {"\r\n", "3.key,5.65293,1.1;3.key,5.65293,1.0;"},
+		"LFLF":   {"\n\n", "3.key,5.65293,1.1;3.key,5.65293,1.0;3.key,5.65293,1.1;3.key,5.65293,1.0;"},
+		"Delete": {"\x7f", "3.key,5.65535,1.1;3.key,5.65535,1.0;"},
+		"C1":     {"a\u0085", "3.key,2.97,1.1;3.key,2.97,1.0;"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := &fakeConn{}
+			tunnel := NewSimpleTunnel(NewStream(conn, time.Minute))
+			if err := tunnel.SendText(test.text); err != nil {
+				t.Fatal(err)
+			}
+			if string(conn.Written) != test.expected {
+				t.Error("Unexpected instructions", string(conn.Written))
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package guac
+
+import "sync"
+
+// userSessions counts the active sessions of each user, for MaxSessionsPerUser
+type userSessions struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+// acquire counts a session for the user unless it already has max, which is unlimited if it
+// isn't positive
+func (u *userSessions) acquire(user string, max int) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if max > 0 && u.counts[user] >= max {
+		return false
+	}
+	if u.counts == nil {
+		u.counts = map[string]int{}
+	}
+	u.counts[user]++
+	return true
+}
+
+// release stops counting a session acquire counted
+func (u *userSessions) release(user string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.counts[user] <= 1 {
+		delete(u.counts, user)
+		return
+	}
+	u.counts[user]--
+}
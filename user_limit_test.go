@@ -0,0 +1,74 @@
+package guac
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_MaxSessionsPerUser(t *testing.T) {
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return &ConnectResult{Tunnel: tunnel, User: r.URL.Query().Get("user")}, nil
+	}, nopLogger())
+	wsServer.MaxSessionsPerUser = 2
+	metrics := NewMetrics()
+	wsServer.Metrics = metrics
+	url, done := serveWebsocket(t, wsServer)
+
+	dial := func(user string) *websocket.Conn {
+		t.Helper()
+		ws, _, err := websocket.DefaultDialer.Dial(url+"?user="+user, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = ws.Close() })
+		return ws
+	}
+	// refused reads the error a session refused for its user is sent
+	refused := func(ws *websocket.Conn) bool {
+		t.Helper()
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return false
+		}
+		ins, err := Parse(msg)
+		return err == nil && ins.Opcode == "error" && len(ins.Args) == 2 &&
+			ins.Args[1] == strconv.Itoa(ClientTooMany.GetGuacamoleStatusCode())
+	}
+	// active waits for the server to count the session
+	active := func(n int) {
+		t.Helper()
+		for i := 0; i < 1000 && wsServer.Stats().ActiveConnections != n; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got := wsServer.Stats().ActiveConnections; got != n {
+			t.Fatalf("Expected %d sessions, got %d", n, got)
+		}
+	}
+
+	first := dial("alice")
+	dial("alice")
+	active(2)
+	if !refused(dial("alice")) {
+		t.Fatal("Expected a third session for the user to be refused")
+	}
+	waitDone(t, done)
+	if failures := metrics.ConnectFailures()[ClientTooMany]; failures != 1 {
+		t.Error("Expected the refusal to be counted, got", failures)
+	}
+
+	// other users have their own limit
+	dial("bob")
+	active(3)
+
+	// and the user can connect again once one of theirs disconnects
+	_ = first.Close()
+	waitDone(t, done)
+	active(2)
+	dial("alice")
+	active(3)
+}
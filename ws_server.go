@@ -2,18 +2,34 @@ package guac
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 )
 
-// WebsocketServer implements a websocket-based connection to guacd.
+// WebsocketServer implements a websocket-based connection to guacd. Its fields must be set
+// before it serves, but the settings in ServerConfig can be changed later with ApplyConfig.
+//
+// A session that connected to guacd ends in a fixed order: a RecordingTunnel's recording is
+// flushed, guacd is sent a disconnect unless it ended the session, the tunnel's writer and reader
+// are released, the tunnel is closed, then the websocket, and only then are the session's
+// callbacks, SessionStore, metrics and span told, so they see its final state.
 type WebsocketServer struct {
 	connect   func(*http.Request) (Tunnel, error)
 	connectWs func(*websocket.Conn, *http.Request) (Tunnel, error)
 
+	connectResult func(*websocket.Conn, *http.Request) (*ConnectResult, error)
+
 	// OnConnect is an optional callback called when a websocket connects.
 	// Deprecated: use OnConnectWs
 	OnConnect func(string, *http.Request)
@@ -25,6 +41,258 @@ type WebsocketServer struct {
 	OnConnectWs func(string, *websocket.Conn, *http.Request)
 	// OnDisconnectWs is an optional callback called when the websocket disconnects.
 	OnDisconnectWs func(string, *websocket.Conn, *http.Request, Tunnel)
+	// SessionStore optionally keeps track of the sessions: each is added once it connects and
+	// deleted when it disconnects, alongside the callbacks, so a store doesn't need wiring into
+	// OnConnect and OnDisconnect. A store that is a SessionAdder can refuse a session, which
+	// closes the connection, and one that is a SessionToucher is touched while each session is
+	// connected.
+	SessionStore SessionStore
+	// OnDisconnectReason is an optional callback called when the websocket disconnects, with the
+	// reason the session ended.
+	OnDisconnectReason func(string, *websocket.Conn, *http.Request, Tunnel, CloseReason)
+	// OnDisconnectWsReason is an optional callback called when the websocket disconnects, with
+	// the close frame and error that ended the session as well as the reason.
+	OnDisconnectWsReason func(string, *websocket.Conn, *http.Request, Tunnel, DisconnectReason)
+	// OnDisconnectStats is an optional callback called when the websocket disconnects, with the
+	// traffic of the session. TunnelStats returns the same while it is active.
+	OnDisconnectStats func(string, *websocket.Conn, *http.Request, Tunnel, ConnectionStats)
+
+	// AcceptClient optionally inspects the capabilities the client announced before guacd is
+	// connected, see ClientCapabilities. An error refuses the client, with the error's status if
+	// it is an *ErrGuac, and it can adjust them, such as to drop formats it doesn't want used.
+	// The connect function finds them in its request's context with
+	// ClientCapabilitiesFromContext, whether or not AcceptClient is set.
+	AcceptClient func(capabilities *ClientCapabilities, r *http.Request) error
+
+	// Health is an optional guacd health state. While it reports guacd as unhealthy, new
+	// connections are refused with 503 before the websocket is upgraded.
+	Health HealthReporter
+
+	// Tracer optionally records guac.connect, guac.handshake and guac.session spans. The request
+	// passed to the connect function carries the tracer in its context, so passing that context to
+	// Stream.HandshakeContext records the handshake under the connect span.
+	Tracer Tracer
+
+	// MaxHandshakeDuration optionally bounds the whole connect, from dialing guacd until it is
+	// ready. It is applied as a deadline on the context of the request passed to the connect
+	// function, which is honored by DialGuacd, ConnectGuacd and Stream.HandshakeContext.
+	MaxHandshakeDuration time.Duration
+
+	// ReadBufferSize and WriteBufferSize optionally override the sizes of the websocket buffers,
+	// which default to MaxGuacMessage for reads and twice that for writes. Messages larger than a
+	// buffer still work, but are read or written in several pieces, so the write buffer should be
+	// at least MaxGuacMessage. Large-screen sessions that send more per frame benefit from a
+	// bigger write buffer, at the cost of memory for every connection.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// EnableCompression negotiates permessage-deflate with clients that support it. Frames that
+	// mostly carry PNG, JPEG or WebP data, which is already compressed, are sent uncompressed.
+	// Text and drawing instructions, and base64 blobs of uncompressed data, shrink several times
+	// over, which helps clients on slow links, at the cost of deflating every buffered message of
+	// up to MaxGuacMessage bytes on the server. See BenchmarkGuacdToWs_Compression.
+	EnableCompression bool
+	// CompressionLevel optionally sets the deflate level, from 1 (flate.BestSpeed), the default,
+	// to 9 (flate.BestCompression). Higher levels save little on guac traffic for a lot more CPU.
+	CompressionLevel int
+
+	// Limiter optionally throttles clients opening connections, such as with a
+	// TokenBucketLimiter per client IP. Requests it refuses get 429 before anything else is done.
+	Limiter ConnectionLimiter
+
+	// MaxConnections optionally limits how many websockets the server handles at once, including
+	// those still connecting to guacd. Further requests are refused with 503 before the websocket
+	// is upgraded.
+	MaxConnections int
+
+	// MaxSessionsPerUser optionally limits how many sessions each user, the User of the
+	// ConnectResult, has at once. Further sessions are refused with CLIENT_TOO_MANY once
+	// connected, as the user is only known then, and counted as connect failures in Metrics.
+	// Sessions without a User aren't limited.
+	MaxSessionsPerUser int
+
+	// MaxConcurrentHandshakes optionally limits how many connects, and so guacd dials and
+	// handshakes, run at once. Further connects wait for a slot, which smooths the load on guacd
+	// when many clients reconnect together. It doesn't limit the number of sessions. The limit is
+	// sized once, when the first connection starts, and must not be changed after that. It isn't
+	// part of ServerConfig, so ApplyConfig can't change it.
+	MaxConcurrentHandshakes int
+	// HandshakeQueueTimeout optionally bounds how long a connect waits for a handshake slot. When
+	// it expires the client is disconnected with SERVER_BUSY. Zero waits until the client leaves.
+	HandshakeQueueTimeout time.Duration
+
+	// Filters optionally inspect, rewrite or drop each instruction sent between the browser and
+	// guacd, in order. Instructions are only parsed when there are filters.
+	Filters []InstructionFilter
+	// ContextFilters run after Filters, and are also given the session's context so they can
+	// read the values set at connect in ConnectResult.Context
+	ContextFilters []ContextFilter
+	// FilterErrorPolicy decides whether a filter error disconnects the session, the default, or
+	// is logged and ignored
+	FilterErrorPolicy FilterErrorPolicy
+	// FilterBudget optionally bounds how long a filter or the Authorizer should take on one
+	// instruction, as a slow one holds up everything else on the session. A call that takes
+	// longer is logged, and FilterBudgetPolicy decides whether the filter is then skipped or the
+	// session disconnected. A call that never returns can't be interrupted.
+	FilterBudget       time.Duration
+	FilterBudgetPolicy FilterBudgetPolicy
+	// Authorizer optionally decides whether each instruction is forwarded, dropped or ends the
+	// session, before the Filters see it
+	Authorizer Authorizer
+	// Interceptor optionally observes and rewrites each instruction after the filters, seeing
+	// each clipboard whole, see InstructionInterceptor
+	Interceptor InstructionInterceptor
+
+	// Metrics optionally receives measurements of the traffic, such as the size of each instruction
+	Metrics MetricsCollector
+
+	// MaxInboundMessageBytes limits the size of a websocket message from a client. Larger messages
+	// close the connection with 1009 (message too big). Zero uses DefaultMaxInboundMessageBytes and
+	// a negative value removes the limit.
+	MaxInboundMessageBytes int64
+
+	// MaxOutboundClipboard optionally limits the size in bytes of a clipboard guacd sends the
+	// client, when something huge is copied on the remote, to spare the browser the memory.
+	// OutboundClipboardPolicy decides whether a larger clipboard is truncated, the default, or
+	// dropped, and OnOversizedClipboard is called with its mimetype and size so far.
+	MaxOutboundClipboard    int
+	OutboundClipboardPolicy ClipboardPolicy
+	OnOversizedClipboard    func(connectionID string, mimetype string, size int)
+
+	// SendConnectionID sends the client the tunnel UUID as soon as it is connected, as the
+	// internal instruction "0.,<uuid>;" that guacamole-common-js reads it from, followed by the
+	// guacd connection ID as "0.,12.connectionid,<connection id>;", so client code can store the
+	// ID to reconnect or share the session.
+	SendConnectionID bool
+
+	// MaxBufferLatency optionally bounds how long data from guacd waits to be sent. Instructions
+	// are batched while guacd has more data buffered, and if the rest of that data is slow to
+	// arrive what is batched is sent anyway once it has waited this long.
+	MaxBufferLatency time.Duration
+
+	// CoalesceLayers drops drawing instructions from guacd that are made redundant before they are
+	// sent, when an opaque fill of a whole layer follows them in the same batch. It saves bandwidth
+	// on screens that redraw quickly and only drops what can't affect the display.
+	CoalesceLayers bool
+
+	// CoalesceSyncs sends only the latest sync of each batch of instructions from guacd. The
+	// frames in the batch are rendered together and acknowledged once, with the latest timestamp,
+	// which cuts the syncs the client handles and sends back when guacd is producing frames faster
+	// than they are sent.
+	CoalesceSyncs bool
+
+	// BufferPool supplies the buffer each session batches instructions from guacd in, and takes
+	// it back when the session ends. DefaultBufferPool is used if it is nil.
+	BufferPool *BufferPool
+	// SizeBuffers optionally chooses the buffers of each connection from its request, such as
+	// bigger ones for high resolution sessions, see ResolutionBuffers. It is called before the
+	// upgrade, as the websocket buffers are allocated then, so the connect function can only
+	// choose the BufferPool, with ConnectResult.BufferPool.
+	SizeBuffers func(r *http.Request) BufferSizes
+
+	// CheckOrigin optionally decides whether a websocket may be opened from the page that sent
+	// the request, to stop other sites connecting with the user's cookies. When it is nil only
+	// same-origin requests, and requests without an Origin header, are accepted. See
+	// AllowOrigins. Rejected requests get 403.
+	CheckOrigin func(*http.Request) bool
+
+	// PingInterval optionally sends the client a websocket ping this often, to notice clients
+	// that have gone away without closing the connection, such as a frozen tab or a dropped
+	// network. A client that doesn't answer within PongTimeout is disconnected and its guacd
+	// connection closed. PongTimeout defaults to PingInterval.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// IdleTimeout, if set, ends sessions in which the user sends no input for this long, so a
+	// session left open doesn't hold guacd and the remote forever. Only input such as keys, mouse
+	// and clipboard counts, not screen updates or the client's replies to them. The client is sent
+	// a close frame with the reason "Idle timeout.".
+	IdleTimeout time.Duration
+
+	// AbsorbNops stops the nop instructions clients send as keepalives at the server instead of
+	// forwarding them to guacd. The absorbed nops count as input for IdleTimeout, so with both
+	// set a session times out when the client stops responding rather than when the user is idle.
+	AbsorbNops bool
+
+	// AwaitClientReady holds guacd's output, instead of losing it to a client that is still
+	// setting up, until the client sends the internal instruction "0.,5.ready;" or, if
+	// ClientReadyOpcode is set, an instruction with that opcode. Once more than ClientReadyLimit
+	// bytes, DefaultClientReadyLimit if zero, are held they are sent whether or not it is ready.
+	AwaitClientReady  bool
+	ClientReadyOpcode string
+	ClientReadyLimit  int
+
+	// OnPingRTT is an optional callback called with the round trip time of each keepalive ping,
+	// the network latency to the client. It is also given to Metrics if it is a PingRTTCollector,
+	// and the latest is in the SessionRecord.
+	OnPingRTT func(connectionID string, rtt time.Duration)
+
+	// OnFirstFrame is an optional callback called when the first drawing instruction, such as an
+	// img, is sent to the client, with how long it was since guacd was ready. It is also given to
+	// Metrics if it is a FirstFrameCollector.
+	OnFirstFrame func(connectionID string, elapsed time.Duration)
+
+	// DisconnectWait optionally gives guacd time to clean up the remote session when the client
+	// sends disconnect. The disconnect is forwarded and the tunnel left open until guacd closes
+	// it, or for at most DisconnectWait, even if the client closes the websocket straight away.
+	// Some protocols leave the remote session behind if guacd's connection is closed before it
+	// has logged off.
+	DisconnectWait time.Duration
+
+	// LogUpgradeHeaders logs the headers of each upgrade request at trace level, to debug clients
+	// that fail to connect. Credentials such as Authorization and Cookie are redacted.
+	LogUpgradeHeaders bool
+
+	// LogRepeatWindow optionally limits how often a connection logs the same warning or error. A
+	// message repeated within the window is suppressed and counted, and the count is logged with
+	// the message next time it is logged or as "N similar messages suppressed" when the
+	// connection closes.
+	LogRepeatWindow time.Duration
+
+	// LogSampler optionally creates a zerolog.Sampler for the logger of each connection, so busy
+	// connections don't flood the logs with repeated messages. Each connection gets its own
+	// sampler, and returning nil leaves a connection unsampled. Use zerolog.LevelSampler to sample
+	// only the noisy levels, for example
+	//
+	//	func() zerolog.Sampler {
+	//		return zerolog.LevelSampler{WarnSampler: &zerolog.BurstSampler{Burst: 5, Period: time.Second}}
+	//	}
+	//
+	// keeps errors while limiting warnings to 5 a second.
+	LogSampler func() zerolog.Sampler
+
+	// OnThumbnail is an optional sink for periodic thumbnails of the sessions whose connect
+	// function set ConnectResult.Thumbnails, such as for an admin's grid of active sessions. One
+	// is sent every ThumbnailInterval, ThumbnailWidth pixels wide, DefaultThumbnailWidth if zero.
+	// They are drawn from the images guacd sends, apart from the session, so the user isn't held
+	// up, and are approximate, see Thumbnail.
+	OnThumbnail       func(Thumbnail)
+	ThumbnailInterval time.Duration
+	ThumbnailWidth    int
+
+	// OnSessionRecord is an optional sink called with a SessionRecord when each session ends, see
+	// ChannelSink to send them to a channel
+	OnSessionRecord func(SessionRecord)
+
+	// OnError is an optional callback called when a websocket upgrade fails, when connecting to
+	// guacd fails, and when a session ends abnormally, for alerting. The error is a *SessionError
+	// whose Stage tells these apart.
+	OnError func(*http.Request, error)
+
+	// activeConnections counts the requests being served, for MaxConnections
+	activeConnections int64
+
+	handshakeSlots chan struct{}
+	handshakeOnce  sync.Once
+
+	// config holds the settings once ApplyConfig is called
+	config atomic.Pointer[ServerConfig]
+
+	sessions sessionRegistry
+	counters serverCounters
+	users    userSessions
+
+	// onTeardown is called as each stage of ending a session starts, for tests
+	onTeardown func(teardownStage)
 
 	// logger is an optional logger to use for logging. If not set, the package-level s.logger will be used.
 	logger *zerolog.Logger
@@ -39,12 +307,14 @@ func NewWebsocketServer(connect func(*http.Request) (Tunnel, error), logger *zer
 	}
 
 	return &WebsocketServer{
-		connect: connect,
-		logger:  serverLogger,
+		connect:  connect,
+		logger:   serverLogger,
+		counters: serverCounters{started: time.Now()},
 	}
 }
 
 // NewWebsocketServerWs creates a new server with a connect method that takes a websocket.
+// The connect method must not read from the websocket, the server reads it for the whole session.
 func NewWebsocketServerWs(connect func(*websocket.Conn, *http.Request) (Tunnel, error), logger *zerolog.Logger) *WebsocketServer {
 	serverLogger := &globalLogger
 
@@ -55,6 +325,23 @@ func NewWebsocketServerWs(connect func(*websocket.Conn, *http.Request) (Tunnel,
 	return &WebsocketServer{
 		connectWs: connect,
 		logger:    serverLogger,
+		counters:  serverCounters{started: time.Now()},
+	}
+}
+
+// NewWebsocketServerResult creates a new server with a connect method that takes a websocket and
+// can return more details about the session than the Tunnel.
+func NewWebsocketServerResult(connect func(*websocket.Conn, *http.Request) (*ConnectResult, error), logger *zerolog.Logger) *WebsocketServer {
+	serverLogger := &globalLogger
+
+	if logger != nil {
+		serverLogger = logger
+	}
+
+	return &WebsocketServer{
+		connectResult: connect,
+		logger:        serverLogger,
+		counters:      serverCounters{started: time.Now()},
 	}
 }
 
@@ -63,55 +350,216 @@ const (
 	websocketWriteBufferSize = MaxGuacMessage * 2
 )
 
+// DefaultMaxInboundMessageBytes is the largest websocket message accepted from a client unless
+// WebsocketServer.MaxInboundMessageBytes is set. Clients send input events and blobs which are
+// far smaller.
+const DefaultMaxInboundMessageBytes = MaxGuacMessage * 4
+
 func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  websocketReadBufferSize,
-		WriteBufferSize: websocketWriteBufferSize,
-		CheckOrigin: func(r *http.Request) bool {
-			return true // TODO
-		},
+	if s.Limiter != nil && !s.Limiter.Allow(r) {
+		s.logger.Warn().Str("remote_addr", r.RemoteAddr).Msg("connection rate limited, rejecting connection")
+		s.reject(w, ClientTooMany, http.StatusTooManyRequests, "Too many connection attempts.")
+		s.reportError(r, StageRateLimit, ErrClientTooMany.NewError("Too many connection attempts.", r.RemoteAddr))
+		return
+	}
+
+	if s.Health != nil && !s.Health.Healthy() {
+		s.logger.Warn().Str("remote_addr", r.RemoteAddr).Msg("guacd is unhealthy, rejecting connection")
+		s.reject(w, UpstreamUnavailable, http.StatusServiceUnavailable, "guacd is unavailable.")
+		s.reportError(r, StageConnect, ErrUpstreamUnavailable.NewError("guacd is unavailable.", "health check failed"))
+		return
+	}
+
+	// the settings are read once, so ApplyConfig doesn't change them during the connection
+	config := s.Config()
+
+	if !s.sessions.enter() {
+		s.logger.Warn().Str("remote_addr", r.RemoteAddr).Msg("server is shutting down, rejecting connection")
+		s.reject(w, ServerBusy, http.StatusServiceUnavailable, "Server is shutting down.")
+		return
+	}
+	defer s.sessions.leave()
+
+	if n := atomic.AddInt64(&s.activeConnections, 1); config.MaxConnections > 0 && n > int64(config.MaxConnections) {
+		atomic.AddInt64(&s.activeConnections, -1)
+		s.logger.Warn().Str("remote_addr", r.RemoteAddr).Int("max_connections", config.MaxConnections).Msg("too many connections, rejecting connection")
+		s.reject(w, ServerBusy, http.StatusServiceUnavailable, "Too many connections.")
+		return
+	}
+	defer atomic.AddInt64(&s.activeConnections, -1)
+
+	if config.LogUpgradeHeaders {
+		s.logger.Trace().Str("remote_addr", r.RemoteAddr).Dict("headers", sanitizedHeaders(r.Header)).Msg("upgrading websocket")
+	}
+
+	originAllowed := true
+	sizes := s.bufferSizes(&config, r)
+	upgrader := config.upgrader()
+	upgrader.ReadBufferSize = sizes.Read
+	upgrader.WriteBufferSize = sizes.Write
+	upgrader.CheckOrigin = func(r *http.Request) bool {
+		originAllowed = s.allowOrigin(r)
+		return originAllowed
 	}
 	protocol := r.Header.Get("Sec-Websocket-Protocol")
 	ws, err := upgrader.Upgrade(w, r, http.Header{
 		"Sec-Websocket-Protocol": {protocol},
 	})
 	if err != nil {
-		s.logger.Error().Err(err).Msg("failed to upgrade websocket")
+		// the upgrader has answered 403, and the rejection is already logged
+		if originAllowed {
+			s.logger.Error().Err(err).Msg("failed to upgrade websocket")
+		}
+		s.reportError(r, StageUpgrade, err)
 		return
 	}
-	defer func() {
-		if err = ws.Close(); err != nil {
-			s.logger.Trace().Err(err).Msg("Error closing websocket")
+	switch {
+	case config.MaxInboundMessageBytes == 0:
+		ws.SetReadLimit(DefaultMaxInboundMessageBytes)
+	case config.MaxInboundMessageBytes > 0:
+		ws.SetReadLimit(config.MaxInboundMessageBytes)
+	}
+	if config.EnableCompression {
+		ws.EnableWriteCompression(true)
+		if config.CompressionLevel != 0 {
+			if err = ws.SetCompressionLevel(config.CompressionLevel); err != nil {
+				s.logger.Warn().Err(err).Int("level", config.CompressionLevel).Msg("invalid compression level, using the default")
+			}
 		}
-	}()
+	}
+	sess := &wsSession{
+		ws:          ws,
+		request:     r,
+		logger:      s.logger,
+		compression: config.EnableCompression,
+		guacdClosed: make(chan struct{}),
+	}
+	defer sess.closeWs()
+	defer sess.recoverPanic()
+
+	ctx := r.Context()
+	if s.Tracer != nil {
+		ctx = ContextWithTracer(ctx, s.Tracer)
+	}
+	tracer := tracerFromContext(ctx)
+
+	capabilities := ParseClientCapabilities(r)
+	if s.AcceptClient != nil {
+		if err = s.AcceptClient(capabilities, r); err != nil {
+			s.logger.Warn().Err(err).Str("remote_addr", r.RemoteAddr).Msg("client refused")
+			sess.terminate(CloseReasonError, errorStatus(err), "Client not supported.")
+			s.reportError(r, StageConnect, err)
+			return
+		}
+	}
+	ctx = ContextWithClientCapabilities(ctx, capabilities)
+
+	// the request context isn't cancelled when a hijacked connection closes, so watch the
+	// websocket to abandon the connect if the client leaves
+	clientCtx, clientGone := context.WithCancel(ctx)
+	defer clientGone()
+	if config.PingInterval > 0 {
+		window := config.PingInterval + config.pongTimeout()
+		ws.SetPongHandler(func(data string) error {
+			return sess.pong(window, data)
+		})
+	}
+	wsIn := newWsReader(ws, clientGone)
+	go wsIn.readTask()
+	defer wsIn.stop()
+
+	release, err := s.acquireHandshake(clientCtx, config.HandshakeQueueTimeout)
+	if err != nil {
+		s.logger.Warn().Err(err).Str("remote_addr", r.RemoteAddr).Msg("no handshake slot available")
+		atomic.AddInt64(&s.counters.handshakeFailures, 1)
+		sess.terminate(CloseReasonError, ServerBusy, "Too many connections in progress.")
+		s.reportError(r, StageConnect, err)
+		return
+	}
 
 	s.logger.Trace().Msg("connecting to tunnel")
-	var tunnel Tunnel
-	var e error
-	if s.connect != nil {
-		tunnel, e = s.connect(r)
-	} else {
-		tunnel, e = s.connectWs(ws, r)
+	connectCtx, connectSpan := tracer.Start(clientCtx, SpanConnect, Attribute{Key: "net.peer.addr", Value: r.RemoteAddr})
+	if config.MaxHandshakeDuration > 0 {
+		var cancel context.CancelFunc
+		connectCtx, cancel = context.WithTimeout(connectCtx, config.MaxHandshakeDuration)
+		defer cancel()
 	}
+	result, e := s.doConnect(ws, r.WithContext(connectCtx))
+	release()
 	if e != nil {
+		connectSpan.RecordError(e)
+		connectSpan.End()
+		atomic.AddInt64(&s.counters.handshakeFailures, 1)
+		if s.Metrics != nil {
+			s.Metrics.ObserveConnectFailure(errorStatus(e))
+		}
+		s.reportError(r, StageConnect, e)
 		return
 	}
-	defer func() {
-		if err = tunnel.Close(); err != nil {
-			s.logger.Trace().Err(err).Msg("Error closing tunnel")
-		}
-	}()
+	connectSpan.SetAttributes(Attribute{Key: "guac.connection_id", Value: result.Tunnel.ConnectionID()})
+	connectSpan.End()
+	tunnel := result.Tunnel
+	sess.tunnel = tunnel
+	sess.labels = result.Labels
+	sessionCtx := ctx
+	if result.Context != nil {
+		// the values outlive the connect, whatever the context was derived from
+		sessionCtx = context.WithoutCancel(result.Context)
+		r = r.WithContext(sessionCtx)
+		sess.request = r
+	}
+	defer sess.closeTunnel()
 	s.logger.Trace().Msg("connected to tunnel")
 
+	if result.User != "" {
+		if !s.users.acquire(result.User, config.MaxSessionsPerUser) {
+			err = ErrClientTooMany.NewError("Too many sessions for the user.", result.User)
+			s.logger.Warn().Str("user", result.User).Int("max_sessions_per_user", config.MaxSessionsPerUser).Msg("too many sessions for the user, rejecting connection")
+			if s.Metrics != nil {
+				s.Metrics.ObserveConnectFailure(ClientTooMany)
+			}
+			sess.terminate(CloseReasonError, ClientTooMany, "Too many sessions for this user.")
+			s.reportError(r, StageConnect, err)
+			return
+		}
+		defer s.users.release(result.User)
+	}
+
 	id := tunnel.ConnectionID()
+	sess.id = id
 
-	// Enhance logger with connection ID context
-	s.logger.UpdateContext(func(c zerolog.Context) zerolog.Context {
-		return c.Str("connection_id", id)
-	})
+	// Enhance logger with connection ID context, without changing the server's logger which is
+	// shared by every connection
+	logger := s.logger.With().Str("connection_id", id).Logger()
+	if s.LogSampler != nil {
+		if sampler := s.LogSampler(); sampler != nil {
+			logger = logger.Sample(sampler)
+		}
+	}
+	if config.LogRepeatWindow > 0 {
+		limiter := newLogLimiter(logger, config.LogRepeatWindow)
+		logger = logger.Hook(limiter)
+		defer limiter.flush()
+	}
+	sess.logger = &logger
 
-	s.logger.Trace().Str("connection_id", id).Str("remote_addr", r.RemoteAddr).Msg("websocket connection established")
+	logger.Trace().Str("remote_addr", r.RemoteAddr).Msg("websocket connection established")
+
+	if adder, ok := s.SessionStore.(SessionAdder); ok {
+		if err = adder.TryAdd(id, r); err != nil {
+			logger.Warn().Err(err).Msg("session store refused the session, rejecting connection")
+			if s.Metrics != nil {
+				s.Metrics.ObserveConnectFailure(errorStatus(err))
+			}
+			sess.terminate(CloseReasonError, errorStatus(err), "Connection already in use.")
+			s.reportError(r, StageConnect, err)
+			return
+		}
+	} else if s.SessionStore != nil {
+		s.SessionStore.Add(id, r)
+	}
 
+	sess.started = time.Now()
 	if s.OnConnect != nil {
 		s.OnConnect(id, r)
 	}
@@ -119,22 +567,376 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.OnConnectWs(id, ws, r)
 	}
 
-	writer := tunnel.AcquireWriter()
+	writer := countingWriter{Writer: tunnel.AcquireWriter(), n: &sess.bytesToGuacd}
 	reader := tunnel.AcquireReader()
+	sess.writer = writer
 
+	// from here the session ends with the teardown, which runs after the other defers
+	end := &teardown{sess: sess, hook: s.onTeardown}
+	defer end.run()
+
+	_, sessionSpan := tracer.Start(ctx, SpanSession, Attribute{Key: "guac.connection_id", Value: id})
+	end.summarize(func() {
+		sessionSpan.SetAttributes(
+			Attribute{Key: "guac.bytes_to_guacd", Value: atomic.LoadInt64(&sess.bytesToGuacd)},
+			Attribute{Key: "guac.bytes_to_client", Value: atomic.LoadInt64(&sess.bytesToClient)},
+			Attribute{Key: "guac.close_reason", Value: sess.getCloseReason().String()},
+		)
+		if err := sess.failure(); err != nil {
+			sessionSpan.RecordError(err)
+		}
+		sessionSpan.End()
+	})
+
+	if s.SessionStore != nil {
+		end.summarize(func() { s.SessionStore.Delete(id, r, tunnel) })
+	}
 	if s.OnDisconnect != nil {
-		defer s.OnDisconnect(id, r, tunnel)
+		end.summarize(func() { s.OnDisconnect(id, r, tunnel) })
 	}
 	if s.OnDisconnectWs != nil {
-		defer s.OnDisconnectWs(id, ws, r, tunnel)
+		end.summarize(func() { s.OnDisconnectWs(id, ws, r, tunnel) })
+	}
+	if s.OnDisconnectReason != nil {
+		end.summarize(func() {
+			s.OnDisconnectReason(id, ws, r, tunnel, sess.getCloseReason())
+		})
+	}
+	if s.OnDisconnectWsReason != nil {
+		end.summarize(func() {
+			s.OnDisconnectWsReason(id, ws, r, tunnel, sess.disconnectReason())
+		})
+	}
+	if s.OnDisconnectStats != nil {
+		end.summarize(func() {
+			s.OnDisconnectStats(id, ws, r, tunnel, sess.stats())
+		})
+	}
+	end.summarize(func() { logger.Trace().Msg("websocket connection closed") })
+
+	if !s.sessions.add(sess) {
+		// Shutdown started while this session was connecting
+		sess.terminate(CloseReasonAdmin, ServerBusy, "Server is shutting down.")
+		return
+	}
+	end.summarize(func() { s.endSession(sess) })
+	atomic.AddInt64(&s.counters.connections, 1)
+
+	if !result.Deadline.IsZero() {
+		deadline := time.AfterFunc(time.Until(result.Deadline), func() {
+			sess.terminate(CloseReasonTimeout, SessionTimeout, "Session expired.")
+		})
+		defer deadline.Stop()
+	}
+
+	if config.PingInterval > 0 {
+		stopKeepalive := make(chan struct{})
+		defer close(stopKeepalive)
+		observe := func(rtt time.Duration) {
+			if collector, ok := s.Metrics.(PingRTTCollector); ok {
+				collector.ObservePingRTT(rtt)
+			}
+			if s.OnPingRTT != nil {
+				s.OnPingRTT(id, rtt)
+			}
+		}
+		go sess.keepalive(config.PingInterval, config.pongTimeout(), observe, clientCtx.Done(), stopKeepalive)
+	}
+
+	if config.IdleTimeout > 0 {
+		stopIdle := make(chan struct{})
+		defer close(stopIdle)
+		go sess.watchIdle(config.IdleTimeout, stopIdle)
+	}
+
+	if toucher, ok := s.SessionStore.(SessionToucher); ok && toucher.TouchInterval() > 0 {
+		stopTouch := make(chan struct{})
+		defer close(stopTouch)
+		go touchSession(toucher, id, toucher.TouchInterval(), stopTouch)
+	}
+
+	var thumbnails *thumbnailer
+	if result.Thumbnails && s.OnThumbnail != nil && config.ThumbnailInterval > 0 {
+		thumbnails = newThumbnailer(id, config.ThumbnailWidth, s.OnThumbnail)
+		stopThumbnails := make(chan struct{})
+		defer close(stopThumbnails)
+		go thumbnails.run(config.ThumbnailInterval, stopThumbnails)
 	}
-	defer s.logger.Trace().Str("connection_id", id).Msg("websocket connection closed")
 
-	defer tunnel.ReleaseWriter()
-	defer tunnel.ReleaseReader()
+	if config.SendConnectionID {
+		uuid := NewInstruction(InternalDataOpcode, tunnel.GetUUID())
+		connectionID := NewInstruction(InternalDataOpcode, "connectionid", id)
+		if err = sess.WriteMessage(websocket.TextMessage, append(uuid.Bytes(), connectionID.Bytes()...)); err != nil {
+			logger.Warn().Err(err).Msg("failed to send connection ID")
+			return
+		}
+	}
 
-	go wsToGuacd(s.logger, ws, writer)
-	guacdToWs(s.logger, ws, reader)
+	opts := pumpOptions{
+		filters:        newFilterChain(sessionFilters(sessionCtx, s.Filters, s.ContextFilters, result.Filters), config.FilterErrorPolicy, &logger),
+		metrics:        s.Metrics,
+		maxLatency:     config.MaxBufferLatency,
+		coalesceLayers: config.CoalesceLayers,
+		coalesceSyncs:  config.CoalesceSyncs,
+		counts:         &sess.counts,
+		buffers:        sizes.Pool,
+		thumbnails:     thumbnails,
+	}
+	if result.BufferPool != nil {
+		opts.buffers = result.BufferPool
+	}
+	if result.Metrics != nil {
+		opts.metrics = result.Metrics
+	}
+	if s.Authorizer != nil {
+		opts.filters = opts.filters.authorize(s.Authorizer, id, &logger)
+		opts.filters.denied = func() {
+			sess.terminate(CloseReasonError, ClientForbidden, "Instruction not authorized.")
+		}
+	}
+	if config.DisconnectWait > 0 {
+		opts.disconnected = func() {
+			sess.setCloseReason(CloseReasonClient)
+			sess.awaitGuacdClose(config.DisconnectWait)
+		}
+	}
+	if config.IdleTimeout > 0 {
+		opts.input = sess.markInput
+	}
+	opts.absorbNops = config.AbsorbNops
+	if config.AwaitClientReady {
+		opts.ready = newReadyGate(config.ClientReadyOpcode)
+		opts.readyLimit = config.ClientReadyLimit
+		if opts.readyLimit == 0 {
+			opts.readyLimit = DefaultClientReadyLimit
+		}
+	}
+	if result.ReadOnly {
+		opts.blocked = result.blockedOpcodes()
+	}
+	interceptor := s.Interceptor
+	if result.Interceptor != nil {
+		interceptor = result.Interceptor
+	}
+	opts.inbound = newInterception(interceptor, Inbound, &logger)
+	opts.outbound = newInterception(interceptor, Outbound, &logger)
+	opts.clipboard = newClipboardLimit(config.MaxOutboundClipboard, config.OutboundClipboardPolicy, func(mimetype string, size int) {
+		logger.Warn().Str("mimetype", mimetype).Int("size", size).Int("max", config.MaxOutboundClipboard).
+			Stringer("policy", config.OutboundClipboardPolicy).Msg("clipboard from guacd is over the limit")
+		if s.OnOversizedClipboard != nil {
+			s.OnOversizedClipboard(id, mimetype, size)
+		}
+	})
+	opts.stopped = func(err error, abnormal bool) {
+		sess.setCloseError(err, abnormal)
+		var closeErr *websocket.CloseError
+		switch {
+		case errors.As(err, &closeErr):
+			sess.setCloseFrame(closeErr.Code, closeErr.Text)
+		case err == websocket.ErrReadLimit:
+			// gorilla sent the close frame
+			sess.setCloseFrame(websocket.CloseMessageTooBig, "")
+		}
+	}
+	if s.OnError != nil {
+		opts.failed = func(err error) {
+			s.reportError(r, StageTransport, err)
+		}
+	}
+	opts.traffic, _ = opts.metrics.(TrafficCollector)
+	frames, _ := s.Metrics.(FirstFrameCollector)
+	if frames != nil || s.OnFirstFrame != nil {
+		opts.firstFrame = &firstFrame{ready: sess.started, report: func(elapsed time.Duration) {
+			if frames != nil {
+				frames.ObserveFirstFrame(elapsed)
+			}
+			if s.OnFirstFrame != nil {
+				s.OnFirstFrame(id, elapsed)
+			}
+		}}
+	}
+	if collector, ok := opts.metrics.(ConnectionCollector); ok {
+		collector.ObserveConnectionOpened()
+		start := time.Now()
+		end.summarize(func() { collector.ObserveConnectionClosed(time.Since(start)) })
+	}
+	if opts.filters != nil {
+		opts.filters.fail = func(error) {
+			sess.terminate(CloseReasonError, ServerError, "Instruction filter failed.")
+		}
+		opts.filters.limit(config.FilterBudget, config.FilterBudgetPolicy)
+	}
+
+	if s.OnSessionRecord != nil {
+		start := time.Now()
+		end.summarize(func() {
+			s.OnSessionRecord(SessionRecord{
+				ConnectionID:         id,
+				Protocol:             result.Protocol,
+				Host:                 result.Host,
+				Labels:               result.Labels,
+				RemoteAddr:           r.RemoteAddr,
+				Start:                start,
+				Duration:             time.Since(start),
+				BytesToGuacd:         atomic.LoadInt64(&sess.bytesToGuacd),
+				BytesToClient:        atomic.LoadInt64(&sess.bytesToClient),
+				InstructionsToGuacd:  atomic.LoadInt64(&opts.counts.instructionsToGuacd),
+				InstructionsToClient: atomic.LoadInt64(&opts.counts.instructionsToClient),
+				PeakBuffer:           atomic.LoadInt64(&opts.counts.peakBuffer),
+				PingRTT:              sess.PingRTT(),
+				CloseReason:          sess.getCloseReason(),
+			})
+		})
+	}
+
+	// when either pump stops the other is stopped too, rather than left waiting for its side to
+	// fail. The tunnel has no read deadline, so closing it is what unblocks guacdToWs.
+	pumpCtx, stopPumps := context.WithCancel(ctx)
+	stopClosing := context.AfterFunc(pumpCtx, end.stopGuacd)
+	// wsToGuacd is waited for, so it no longer writes or counts when the teardown runs. Once
+	// guacdToWs is done the tunnel is left to the teardown, and the client side stops on the
+	// context, or when its write to guacd completes or times out.
+	inputDone := make(chan struct{})
+	defer func() {
+		stopClosing()
+		stopPumps()
+		<-inputDone
+	}()
+
+	go func() {
+		defer close(inputDone)
+		defer stopPumps()
+		defer sess.recoverPanic()
+		sess.setCloseReason(wsToGuacd(pumpCtx, &logger, wsIn, writer, opts))
+	}()
+	sess.setCloseReason(guacdToWs(pumpCtx, &logger, sess, reader, opts))
+	sess.drainGuacd(reader)
+}
+
+// acquireHandshake waits for a handshake slot when MaxConcurrentHandshakes is set, sizing the
+// slots from it on the first call. The returned function gives the slot back.
+func (s *WebsocketServer) acquireHandshake(ctx context.Context, queueTimeout time.Duration) (func(), error) {
+	if s.MaxConcurrentHandshakes <= 0 {
+		return func() {}, nil
+	}
+	s.handshakeOnce.Do(func() {
+		s.handshakeSlots = make(chan struct{}, s.MaxConcurrentHandshakes)
+	})
+
+	var timeout <-chan time.Time
+	if queueTimeout > 0 {
+		timer := time.NewTimer(queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case s.handshakeSlots <- struct{}{}:
+		return func() { <-s.handshakeSlots }, nil
+	case <-timeout:
+		return nil, ErrServerBusy.NewError("Timed out waiting for a handshake slot.")
+	case <-ctx.Done():
+		return nil, ErrResourceClosed.NewError("Client left while waiting for a handshake slot.")
+	}
+}
+
+// DisconnectByLabel disconnects every active session with the given label, such as all sessions
+// of a user whose account was disabled. It returns the number of sessions disconnected.
+func (s *WebsocketServer) DisconnectByLabel(key, value string) int {
+	matched := s.sessions.find(func(sess *wsSession) bool {
+		v, ok := sess.labels[key]
+		return ok && v == value
+	})
+	for _, sess := range matched {
+		sess.terminate(CloseReasonAdmin, SessionClosed, "Session closed by administrator.")
+	}
+	return len(matched)
+}
+
+// NotifyAndDisconnect warns every session with the given connection ID that it is about to be
+// disconnected, waits for the grace period and then disconnects it. The notice is an internal
+// instruction ("0.,6.notice,<message>,<grace in ms>;") which client code can show as an overlay;
+// the disconnect itself carries the message in a Guacamole error instruction. If ctx is done
+// during the grace period the sessions are left connected and ctx.Err() is returned, so an admin
+// request that is cancelled cancels the disconnect; use context.WithoutCancel to disconnect
+// whatever happens to the caller.
+func (s *WebsocketServer) NotifyAndDisconnect(ctx context.Context, connectionID, message string, grace time.Duration) error {
+	matched := s.sessions.find(func(sess *wsSession) bool {
+		return sess.id == connectionID
+	})
+	if len(matched) == 0 {
+		return ErrResourceNotFound.NewError("No such connection.", connectionID)
+	}
+
+	notice := NewInstruction(InternalDataOpcode, "notice", message, strconv.FormatInt(grace.Milliseconds(), 10))
+	for _, sess := range matched {
+		if err := sess.WriteMessage(websocket.TextMessage, notice.Bytes()); err != nil {
+			sess.logger.Debug().Err(err).Str("connection_id", connectionID).Msg("failed to send disconnect notice")
+		}
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, sess := range matched {
+		sess.terminate(CloseReasonAdmin, SessionClosed, message)
+	}
+	return nil
+}
+
+// doConnect calls whichever connect function the server was created with
+func (s *WebsocketServer) doConnect(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+	if s.connectResult != nil {
+		result, err := s.connectResult(ws, r)
+		if err == nil && (result == nil || result.Tunnel == nil) {
+			err = ErrServer.NewError("connect returned no tunnel")
+		}
+		return result, err
+	}
+
+	var tunnel Tunnel
+	var err error
+	if s.connect != nil {
+		tunnel, err = s.connect(r)
+	} else {
+		tunnel, err = s.connectWs(ws, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ConnectResult{Tunnel: tunnel}, nil
+}
+
+// redactedHeaders are request headers carrying credentials
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// sanitizedHeaders returns the request headers for logging with credentials redacted
+func sanitizedHeaders(header http.Header) *zerolog.Event {
+	dict := zerolog.Dict()
+	for name, values := range header {
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			dict.Str(name, "[REDACTED]")
+		} else {
+			dict.Strs(name, values)
+		}
+	}
+	return dict
+}
+
+// reject refuses a request before the websocket is upgraded
+func (s *WebsocketServer) reject(w http.ResponseWriter, guacStatus Status, httpCode int, message string) {
+	w.Header().Set("Guacamole-Status-Code", fmt.Sprintf("%v", guacStatus.GetGuacamoleStatusCode()))
+	w.Header().Set("Guacamole-Error-Message", message)
+	http.Error(w, message, httpCode)
 }
 
 // MessageReader wraps a websocket connection and only permits Reading
@@ -143,24 +945,160 @@ type MessageReader interface {
 	ReadMessage() (int, []byte, error)
 }
 
-func wsToGuacd(logger *zerolog.Logger, ws MessageReader, guacd io.Writer) {
+// contextMessageReader is a MessageReader that can stop waiting for a message once a context is done
+type contextMessageReader interface {
+	ReadMessageContext(ctx context.Context) (int, []byte, error)
+}
+
+// readMessage reads the next message from ws, giving up once ctx is done if ws supports it
+func readMessage(ctx context.Context, ws MessageReader) (int, []byte, error) {
+	if reader, ok := ws.(contextMessageReader); ok {
+		return reader.ReadMessageContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	return ws.ReadMessage()
+}
+
+// pumpOptions are the per-session features applied by the pumps
+type pumpOptions struct {
+	// filters is nil when the server has no filters
+	filters *filterChain
+	metrics MetricsCollector
+	// maxLatency bounds how long data from guacd is buffered, zero doesn't bound it
+	maxLatency time.Duration
+	// coalesceLayers drops drawing instructions superseded within a message
+	coalesceLayers bool
+	// coalesceSyncs drops all but the latest sync within a message
+	coalesceSyncs bool
+	// counts are the session's instructions, which aren't counted if it is nil
+	counts *sessionCounts
+	// buffers supplies the buffer of guacdToWs, which allocates its own if it is nil
+	buffers *BufferPool
+	// stopped is called, when it is set, with the error that stopped a pump and whether it
+	// stopped abnormally, and failed too when it did
+	stopped func(err error, abnormal bool)
+	failed  func(err error)
+	// input is called, when it is set, for each message from the client with user input
+	input func()
+	// absorbNops drops the client's nops, counting them as input
+	absorbNops bool
+	// ready holds what guacd sends, up to readyLimit bytes, until the client is ready. It is nil
+	// when output isn't held.
+	ready      *readyGate
+	readyLimit int
+	// blocked are the opcodes dropped from the client of a read-only session, nil for others
+	blocked map[string]bool
+	// clipboard limits the clipboards guacd sends, nil when they aren't limited
+	clipboard *clipboardLimit
+	// inbound and outbound run each direction through the interceptor, nil when there is none
+	inbound  *interception
+	outbound *interception
+	// thumbnails observes what guacd draws, nil when the session has no thumbnails
+	thumbnails *thumbnailer
+	// traffic is metrics if it is a TrafficCollector
+	traffic TrafficCollector
+	// firstFrame reports the first drawing instruction sent to the client, when it is set
+	firstFrame *firstFrame
+	// disconnected is called, when it is set, once a disconnect from the client is forwarded to
+	// guacd. The client is no longer read.
+	disconnected func()
+}
+
+// wsToGuacd copies messages from the client to guacd and returns why it stopped. It stops with
+// CloseReasonUnknown when ctx is done, as the reason is whatever ended the other pump.
+func wsToGuacd(ctx context.Context, logger *zerolog.Logger, ws MessageReader, guacd io.Writer, opts pumpOptions) CloseReason {
 	for {
-		_, data, err := ws.ReadMessage()
+		_, data, err := readMessage(ctx, ws)
+		if err != nil && ctx.Err() != nil {
+			logger.Trace().Msg("[Browser -> guacd] Stopped as guacd side ended")
+			return CloseReasonUnknown
+		}
+		if err == websocket.ErrReadLimit {
+			// the websocket has already been closed with 1009, so end the session in guacd too
+			logger.Warn().Err(err).Msg("[Browser -> guacd] Message from browser too large")
+			opts.stop(ctx, err, true)
+			if _, err = guacd.Write(NewInstruction("disconnect").Bytes()); err != nil {
+				logger.Trace().Err(err).Msg("Failed writing disconnect to guacd")
+			}
+			return CloseReasonError
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// only the keepalive sets a read deadline
+			logger.Warn().Err(err).Msg("[Browser -> guacd] Browser stopped answering pings")
+			opts.stop(ctx, err, true)
+			return CloseReasonTimeout
+		}
 		if err != nil {
 			logger.Trace().Err(err).Msg("Error reading message from ws")
 			logger.Warn().Err(err).Msg("[Browser -> guacd] Browser disconnected or error reading from WebSocket")
-			return
+			opts.stop(ctx, err, websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived))
+			return CloseReasonClient
 		}
 
+		if opts.ready != nil {
+			opts.ready.observe(data)
+		}
 		if bytes.HasPrefix(data, internalOpcodeIns) {
 			// messages starting with the InternalDataOpcode are never sent to guacd
 			continue
 		}
+		// input a filter drops still shows the user is there
+		if opts.input != nil && hasUserInput(data) {
+			opts.input()
+		}
+		if opts.absorbNops {
+			var absorbed bool
+			if data, absorbed = withoutOpcodes(data, nopOpcodes); absorbed && opts.input != nil {
+				opts.input()
+			}
+			if len(data) == 0 {
+				continue
+			}
+		}
+
+		if opts.blocked != nil {
+			var invalid bool
+			if data, invalid = withoutBlocked(data, opts.blocked); invalid {
+				logger.Warn().Msg("[Browser -> guacd] Dropped input from read-only client that could not be parsed")
+			}
+			if len(data) == 0 {
+				continue
+			}
+		}
+
+		if data, err = opts.filters.apply(data, Inbound); err != nil {
+			logger.Warn().Err(err).Msg("[Browser -> guacd] Instruction rejected by filter")
+			opts.stop(ctx, err, true)
+			return CloseReasonError
+		}
+		if data = opts.inbound.apply(data); len(data) == 0 {
+			continue
+		}
+		if opts.metrics != nil {
+			observeInstructionSizes(opts.metrics, Inbound, data)
+		}
+		if opts.traffic != nil {
+			observeOpcodes(opts.traffic, Inbound, data)
+		}
 
 		if _, err = guacd.Write(data); err != nil {
 			logger.Trace().Err(err).Msg("Failed writing to guacd")
 			logger.Error().Err(err).Msg("[Browser -> guacd] Failed to write to guacd (guacd may have disconnected)")
-			return
+			opts.stop(ctx, err, true)
+			return CloseReasonGuacd
+		}
+		if opts.traffic != nil {
+			opts.traffic.ObserveBytes(Inbound, len(data))
+		}
+		if opts.counts != nil {
+			countInstructions(&opts.counts.instructionsToGuacd, data)
+		}
+		if opts.disconnected != nil && hasOpcode(data, disconnectOpcode) {
+			opts.disconnected()
+			return CloseReasonClient
 		}
 	}
 }
@@ -171,14 +1109,44 @@ type MessageWriter interface {
 	WriteMessage(int, []byte) error
 }
 
-func guacdToWs(logger *zerolog.Logger, ws MessageWriter, guacd InstructionReader) {
-	buf := bytes.NewBuffer(make([]byte, 0, MaxGuacMessage*2))
+// guacdToWs copies instructions from guacd to the client and returns why it stopped. Once ctx is
+// done, a failed read from guacd is expected and it stops with CloseReasonUnknown.
+func guacdToWs(ctx context.Context, logger *zerolog.Logger, ws MessageWriter, guacd InstructionReader, opts pumpOptions) CloseReason {
+	out := newOutboundBuffer(logger, ws, opts.maxLatency, opts.buffers)
+	if opts.coalesceLayers {
+		out.layers = newLayerCoalescer()
+	}
+	out.coalesceSyncs = opts.coalesceSyncs
+	out.counts = opts.counts
+	out.traffic = opts.traffic
+	out.firstFrame = opts.firstFrame
+	defer out.stop()
+	if opts.ready != nil {
+		out.holdLimit = opts.readyLimit
+		out.held = true
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-opts.ready.ready:
+				if err := out.release(); err != nil {
+					logger.Debug().Err(err).Msg("[guacd -> Browser] Failed to send held output once the client was ready")
+				}
+			case <-done:
+			}
+		}()
+	}
 
 	for {
 		ins, err := guacd.ReadSome()
+		if err != nil && ctx.Err() != nil {
+			logger.Trace().Msg("[guacd -> Browser] Stopped as browser side ended")
+			return CloseReasonUnknown
+		}
 		if err != nil {
 			logger.Warn().Err(err).Msg("[guacd -> Browser] guacd disconnected or error reading from guacd")
-			return
+			opts.stop(ctx, err, !guacdClosed(err))
+			return CloseReasonGuacd
 		}
 
 		if bytes.HasPrefix(ins, internalOpcodeIns) {
@@ -186,22 +1154,203 @@ func guacdToWs(logger *zerolog.Logger, ws MessageWriter, guacd InstructionReader
 			continue
 		}
 
-		if _, err = buf.Write(ins); err != nil {
-			logger.Error().Err(err).Msg("[guacd -> Browser] Failed to buffer message from guacd")
-			return
+		if ins, err = opts.filters.apply(ins, Outbound); err != nil {
+			logger.Warn().Err(err).Msg("[guacd -> Browser] Instruction rejected by filter")
+			opts.stop(ctx, err, true)
+			return CloseReasonError
 		}
+		ins = opts.outbound.apply(opts.clipboard.apply(ins))
+		if opts.thumbnails != nil {
+			opts.thumbnails.observe(ins)
+		}
+		if opts.metrics != nil && len(ins) > 0 {
+			opts.metrics.ObserveInstructionSize(Outbound, len(ins))
+		}
+		if opts.traffic != nil {
+			observeOpcodes(opts.traffic, Outbound, ins)
+		}
+
+		// empty instructions, whether read from guacd or left by a filter, are never buffered
+		// and an empty buffer is never sent, as some clients mishandle empty frames
+		size := out.add(ins)
 
 		// if the buffer has more data in it or we've reached the max buffer size, send the data and reset
-		if !guacd.Available() || buf.Len() >= MaxGuacMessage {
-			if err = ws.WriteMessage(1, buf.Bytes()); err != nil {
+		if size > 0 && (!guacd.Available() || size >= MaxGuacMessage) {
+			if err = out.flush(); err != nil {
 				if err == websocket.ErrCloseSent {
 					logger.Debug().Msg("[guacd -> Browser] websocket already closed (clean close)")
-					return
+					opts.stop(ctx, err, false)
+					return CloseReasonClient
 				}
 				logger.Warn().Err(err).Msg("[guacd -> Browser] Failed to write to WebSocket (browser may have disconnected)")
+				opts.stop(ctx, err, true)
+				return CloseReasonClient
+			}
+		}
+	}
+}
+
+// outboundBuffer batches instructions from guacd into websocket messages. With a max latency,
+// data that isn't flushed in time because guacd is slow to finish an instruction is flushed
+// from a timer, so it is locked.
+type outboundBuffer struct {
+	sync.Mutex
+	logger *zerolog.Logger
+	buf    *bytes.Buffer
+	ws     MessageWriter
+	// buffers takes buf back when the pump returns, if buf came from a pool
+	buffers *BufferPool
+
+	// when compressing, frames that are mostly compressed images are sent as they are
+	images     *imageFrameDetector
+	compressor compressingWriter
+
+	// layers drops superseded drawing instructions when coalescing is enabled
+	layers *layerCoalescer
+	// coalesceSyncs sends only the latest sync of each batch
+	coalesceSyncs bool
+	// counts records the instructions sent and the largest message, when it is set
+	counts *sessionCounts
+	// traffic counts the bytes sent, when it is set
+	traffic TrafficCollector
+	// firstFrame is reported once a message with a drawing instruction is sent, then cleared
+	firstFrame *firstFrame
+
+	maxLatency time.Duration
+	timer      *time.Timer
+
+	// held keeps everything buffered until the client is ready, or until more than holdLimit
+	// bytes are
+	held      bool
+	holdLimit int
+}
+
+// newOutboundBuffer creates the buffer of a session, taking it from buffers if it is set
+func newOutboundBuffer(logger *zerolog.Logger, ws MessageWriter, maxLatency time.Duration, buffers *BufferPool) *outboundBuffer {
+	out := &outboundBuffer{
+		logger:     logger,
+		ws:         ws,
+		buffers:    buffers,
+		maxLatency: maxLatency,
+	}
+	if buffers != nil {
+		out.buf = buffers.Get()
+	} else {
+		out.buf = bytes.NewBuffer(make([]byte, 0, MaxGuacMessage*2))
+	}
+	if compressor, ok := ws.(compressingWriter); ok && compressor.compressionEnabled() {
+		out.compressor = compressor
+		out.images = newImageFrameDetector()
+	}
+	return out
+}
+
+// add buffers an instruction, unless it is empty, and returns the number of bytes buffered
+func (b *outboundBuffer) add(ins []byte) int {
+	b.Lock()
+	defer b.Unlock()
+	if len(ins) == 0 {
+		return b.buf.Len()
+	}
+	b.buf.Write(ins)
+	if b.images != nil {
+		b.images.observe(ins)
+	}
+	if b.maxLatency > 0 && b.timer == nil {
+		var timer *time.Timer
+		timer = time.AfterFunc(b.maxLatency, func() {
+			b.Lock()
+			defer b.Unlock()
+			if b.timer != timer {
+				// flushed since
 				return
 			}
-			buf.Reset()
+			if err := b.flushLocked(); err != nil {
+				b.logger.Debug().Err(err).Msg("[guacd -> Browser] Failed to flush buffer after max latency")
+			}
+		})
+		b.timer = timer
+	}
+	return b.buf.Len()
+}
+
+// flush sends the buffered instructions as one message
+func (b *outboundBuffer) flush() error {
+	b.Lock()
+	defer b.Unlock()
+	return b.flushLocked()
+}
+
+func (b *outboundBuffer) flushLocked() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	if b.held {
+		if b.buf.Len() <= b.holdLimit {
+			return nil
 		}
+		b.logger.Warn().Int("held", b.buf.Len()).Msg("[guacd -> Browser] Client is not ready, sending its output anyway")
+		b.held = false
+	}
+
+	data := b.buf.Bytes()
+	if b.layers != nil {
+		data = b.layers.coalesce(data)
+	}
+	if b.coalesceSyncs {
+		data = coalesceSyncs(data)
+	}
+	if b.counts != nil {
+		b.counts.observeBuffer(len(data))
+	}
+
+	var err error
+	if b.images != nil {
+		err = b.compressor.writeMessageCompressed(1, data, !b.images.dominant(len(data)))
+		b.images.reset()
+	} else {
+		err = b.ws.WriteMessage(1, data)
+	}
+	if err == nil && b.traffic != nil {
+		b.traffic.ObserveBytes(Outbound, len(data))
+	}
+	if err == nil && b.counts != nil {
+		countInstructions(&b.counts.instructionsToClient, data)
+	}
+	if err == nil && b.firstFrame != nil && b.firstFrame.observe(data) {
+		b.firstFrame = nil
+	}
+	b.buf.Reset()
+	return err
+}
+
+// release sends everything held for the client, and stops holding
+func (b *outboundBuffer) release() error {
+	b.Lock()
+	defer b.Unlock()
+	b.held = false
+	if b.buf == nil {
+		// the pump already returned
+		return nil
+	}
+	return b.flushLocked()
+}
+
+// stop cancels a pending flush when the pump returns, and gives the buffer back to its pool
+// along with anything left unsent
+func (b *outboundBuffer) stop() {
+	b.Lock()
+	defer b.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if b.buffers != nil {
+		b.buffers.Put(b.buf)
+		b.buf = nil
 	}
 }
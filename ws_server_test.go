@@ -2,10 +2,20 @@ package guac
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
 )
 
 func TestWebsocketServer_guacdToWs(t *testing.T) {
@@ -25,7 +35,7 @@ func TestWebsocketServer_guacdToWs(t *testing.T) {
 	}
 	guac := NewStream(conn, time.Minute)
 
-	guacdToWs(&globalLogger, msgWriter, guac)
+	guacdToWs(context.Background(), &globalLogger, msgWriter, guac, pumpOptions{})
 
 	if len(msgWriter.Messages) != 1 {
 		t.Error("Expected 1 got", len(msgWriter.Messages))
@@ -41,7 +51,8 @@ type fakeMessageWriter struct {
 }
 
 func (f *fakeMessageWriter) WriteMessage(n int, buf []byte) error {
-	f.Messages = append(f.Messages, buf)
+	// like a websocket, buf is only valid during the call
+	f.Messages = append(f.Messages, append([]byte(nil), buf...))
 	return nil
 }
 
@@ -85,3 +96,563 @@ func (f *fakeTunnel) GetUUID() string {
 func (f *fakeTunnel) Close() error {
 	return nil
 }
+
+// nopLogger returns a logger for servers under test, so goroutines that outlive a test don't race
+// with tests replacing the package logger
+func nopLogger() *zerolog.Logger {
+	logger := zerolog.Nop()
+	return &logger
+}
+
+// serveWebsocket starts an HTTP server for the websocket server. It returns the websocket URL
+// and a channel that receives each time ServeHTTP returns, since hijacked connections
+// outlive the test server.
+func serveWebsocket(t *testing.T, s *WebsocketServer) (string, <-chan struct{}) {
+	done := make(chan struct{}, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(w, r)
+		done <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), done
+}
+
+// waitDone waits for ServeHTTP to return
+func waitDone(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for ServeHTTP to return")
+	}
+}
+
+// fakeGuacd is the guacd end of a tunnel connected over a pipe. Everything written to the
+// tunnel is delivered to Received, which is closed when the tunnel is closed.
+type fakeGuacd struct {
+	net.Conn
+	Received chan string
+}
+
+// newFakeGuacd creates a tunnel with the connection ID "$fake" that stays open until either end is closed
+func newFakeGuacd(t *testing.T) (*SimpleTunnel, *fakeGuacd) {
+	client, conn := net.Pipe()
+	guacd := &fakeGuacd{
+		Conn:     conn,
+		Received: make(chan string, 100),
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		defer close(guacd.Received)
+		buf := make([]byte, MaxGuacMessage)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			guacd.Received <- string(buf[:n])
+		}
+	}()
+	stream := NewStream(client, time.Minute)
+	stream.ConnectionID = "$fake"
+	return NewSimpleTunnel(stream), guacd
+}
+
+func TestWebsocketServer_MaxHandshakeDuration(t *testing.T) {
+	addr, closed := slowGuacd(t, 60*time.Millisecond)
+
+	connectErr := make(chan error, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		stream, err := ConnectGuacd(r.Context(), addr, NewGuacamoleConfiguration())
+		connectErr <- err
+		if err != nil {
+			return nil, err
+		}
+		return NewSimpleTunnel(stream), nil
+	}, nopLogger())
+	wsServer.MaxHandshakeDuration = 100 * time.Millisecond
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	if err = <-connectErr; err == nil || err.(*ErrGuac).Kind != ErrUpstreamTimeout {
+		t.Error("Expected upstream timeout, got", err)
+	}
+	<-closed
+	waitDone(t, done)
+}
+
+func TestWebsocketServer_MaxConcurrentHandshakes(t *testing.T) {
+	const clients = 5
+	var active, maxActive, connects int32
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&connects, 1)
+		return nil, ErrUpstreamUnavailable.NewError("test")
+	}, nopLogger())
+	wsServer.MaxConcurrentHandshakes = 2
+	url, done := serveWebsocket(t, wsServer)
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer func() { _ = ws.Close() }()
+			_, _, _ = ws.ReadMessage()
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < clients; i++ {
+		waitDone(t, done)
+	}
+
+	if n := atomic.LoadInt32(&connects); n != clients {
+		t.Error("Expected", clients, "connects, got", n)
+	}
+	if n := atomic.LoadInt32(&maxActive); n > 2 {
+		t.Error("Expected at most 2 concurrent handshakes, got", n)
+	}
+}
+
+func TestWebsocketServer_HandshakeQueueTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		started <- struct{}{}
+		<-unblock
+		return nil, ErrUpstreamUnavailable.NewError("test")
+	}, nopLogger())
+	wsServer.MaxConcurrentHandshakes = 1
+	wsServer.HandshakeQueueTimeout = 50 * time.Millisecond
+	url, done := serveWebsocket(t, wsServer)
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = first.Close() }()
+	<-started
+
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = second.Close() }()
+
+	_, msg, err := second.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := Parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.Opcode != "error" || ins.Args[1] != strconv.Itoa(ServerBusy.GetGuacamoleStatusCode()) {
+		t.Error("Expected SERVER_BUSY error, got", ins)
+	}
+	waitDone(t, done)
+
+	close(unblock)
+	waitDone(t, done)
+}
+
+func TestWebsocketServer_MaxInboundMessageBytes(t *testing.T) {
+	guacds := make(chan *fakeGuacd, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		guacds <- guacd
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.MaxInboundMessageBytes = 64
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	guacd := <-guacds
+
+	// within the limit is forwarded
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-guacd.Received; received != "3.key,2.65,1.1;" {
+		t.Error("Unexpected instruction", received)
+	}
+
+	blob := "4.blob,1.1,100." + strings.Repeat("A", 100) + ";"
+	if err = ws.WriteMessage(websocket.TextMessage, []byte(blob)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Error("Expected close frame, got", err)
+	}
+	if received := <-guacd.Received; received != "10.disconnect;" {
+		t.Error("Expected guacd to be disconnected, got", received)
+	}
+
+	_ = guacd.Close()
+	waitDone(t, done)
+}
+
+// jsInternalData reads a message as guacamole-common-js does, which only takes the tunnel UUID
+// from an internal instruction with exactly one argument, and returns the UUID and the
+// connection ID of a "connectionid" internal instruction
+func jsInternalData(t *testing.T, msg []byte) (uuid, connectionID string) {
+	for rest := msg; len(rest) > 0; {
+		n, err := scanInstruction(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ins, err := Parse(rest[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+		if ins.Opcode != InternalDataOpcode {
+			continue
+		}
+		if len(ins.Args) == 1 && uuid == "" {
+			uuid = ins.Args[0]
+		} else if len(ins.Args) == 2 && ins.Args[0] == "connectionid" {
+			connectionID = ins.Args[1]
+		}
+	}
+	return uuid, connectionID
+}
+
+func TestWebsocketServer_SendConnectionID(t *testing.T) {
+	tunnels := make(chan *SimpleTunnel, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		t.Cleanup(func() { _ = guacd.Close() })
+		tunnels <- tunnel
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.SendConnectionID = true
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := <-tunnels
+
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, connectionID := jsInternalData(t, msg)
+	if uuid != tunnel.GetUUID() {
+		t.Error("Expected the client to read the tunnel UUID, got", uuid, string(msg))
+	}
+	if connectionID != "$fake" {
+		t.Error("Expected the connection ID instruction, got", string(msg))
+	}
+
+	_ = tunnel.Close()
+	_ = ws.Close()
+	waitDone(t, done)
+}
+
+// tricklingReader reports more data available, but delivers the second instruction late
+type tricklingReader struct {
+	instructions []string
+	delay        time.Duration
+	reads        int
+}
+
+func (r *tricklingReader) ReadSome() ([]byte, error) {
+	if r.reads >= len(r.instructions) {
+		return nil, io.EOF
+	}
+	if r.reads > 0 {
+		time.Sleep(r.delay)
+	}
+	r.reads++
+	return []byte(r.instructions[r.reads-1]), nil
+}
+
+func (r *tricklingReader) Available() bool {
+	return r.reads < len(r.instructions)
+}
+
+func (r *tricklingReader) Flush() {}
+
+// chanMessageWriter delivers messages to a channel as they are written
+type chanMessageWriter chan string
+
+func (c chanMessageWriter) WriteMessage(n int, buf []byte) error {
+	c <- string(buf)
+	return nil
+}
+
+func TestGuacdToWs_MaxBufferLatency(t *testing.T) {
+	reader := &tricklingReader{
+		instructions: []string{"4.sync,3.100;", "4.sync,3.200;"},
+		delay:        500 * time.Millisecond,
+	}
+	writer := make(chanMessageWriter, 10)
+	start := time.Now()
+	go guacdToWs(context.Background(), nopLogger(), writer, reader, pumpOptions{maxLatency: 20 * time.Millisecond})
+
+	if msg := <-writer; msg != "4.sync,3.100;" {
+		t.Error("Unexpected message", msg)
+	}
+	if elapsed := time.Since(start); elapsed >= reader.delay {
+		t.Error("Expected the buffer to be flushed before the next instruction arrived, took", elapsed)
+	}
+	if msg := <-writer; msg != "4.sync,3.200;" {
+		t.Error("Unexpected message", msg)
+	}
+}
+
+func TestWebsocketServer_LogUpgradeHeaders(t *testing.T) {
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs).Level(zerolog.TraceLevel)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return nil, ErrUpstreamUnavailable.NewError("test")
+	}, &logger)
+	wsServer.LogUpgradeHeaders = true
+	wsServer.CheckOrigin = AllowOrigins("https://example.com")
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Origin":          {"https://example.com"},
+		"Authorization":   {"Bearer secret-token"},
+		"Cookie":          {"session=secret-cookie"},
+		"X-Forwarded-For": {"10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	waitDone(t, done)
+
+	log := logs.String()
+	if strings.Contains(log, "secret-token") || strings.Contains(log, "secret-cookie") {
+		t.Error("Expected credentials to be redacted, got", log)
+	}
+	for _, expected := range []string{`"Authorization":"[REDACTED]"`, `"Cookie":"[REDACTED]"`, "https://example.com", "10.0.0.1"} {
+		if !strings.Contains(log, expected) {
+			t.Error("Expected log to contain", expected, "got", log)
+		}
+	}
+}
+
+// sliceReader returns its instructions in order, with more available until the last one
+type sliceReader struct {
+	instructions []string
+}
+
+func (r *sliceReader) ReadSome() ([]byte, error) {
+	if len(r.instructions) == 0 {
+		return nil, io.EOF
+	}
+	ins := r.instructions[0]
+	r.instructions = r.instructions[1:]
+	return []byte(ins), nil
+}
+
+func (r *sliceReader) Available() bool {
+	return len(r.instructions) > 0
+}
+
+func (r *sliceReader) Flush() {}
+
+func TestGuacdToWs_EmptyInstructions(t *testing.T) {
+	dropSync := func(ins *Instruction, dir Direction) (*Instruction, error) {
+		if ins.Opcode == "sync" {
+			return nil, nil
+		}
+		return ins, nil
+	}
+	opts := pumpOptions{filters: newFilterChain([]InstructionFilter{dropSync}, FailClosed, nopLogger())}
+
+	for _, instructions := range [][]string{
+		{"", "", ""},
+		{"4.sync,3.100;"},
+		{"3.nop;", "", ""},
+		{"", "3.nop;", "4.sync,3.100;"},
+	} {
+		writer := &fakeMessageWriter{}
+		guacdToWs(context.Background(), nopLogger(), writer, &sliceReader{instructions: instructions}, opts)
+
+		for _, msg := range writer.Messages {
+			if len(msg) == 0 {
+				t.Error("Empty frame written for", instructions)
+			}
+		}
+		sent := string(bytes.Join(writer.Messages, nil))
+		if expected := strings.Count(strings.Join(instructions, ""), "3.nop;"); strings.Count(sent, "3.nop;") != expected {
+			t.Error("Expected", expected, "nop instructions for", instructions, "got", sent)
+		}
+	}
+}
+
+func TestWebsocketServer_ClientLeavesDuringConnect(t *testing.T) {
+	const delay = 500 * time.Millisecond
+	addr, closed := slowGuacd(t, delay)
+
+	dialing := make(chan struct{})
+	connectErr := make(chan error, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		close(dialing)
+		stream, err := ConnectGuacd(r.Context(), addr, NewGuacamoleConfiguration())
+		connectErr <- err
+		if err != nil {
+			return nil, err
+		}
+		return NewSimpleTunnel(stream), nil
+	}, nopLogger())
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-dialing
+	start := time.Now()
+	_ = ws.Close()
+
+	if err = <-connectErr; err == nil || err.(*ErrGuac).Kind != ErrResourceClosed {
+		t.Error("Expected the connect to be cancelled, got", err)
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Error("Expected the connect to be abandoned before guacd answered, took", elapsed)
+	}
+	waitDone(t, done)
+	<-closed
+}
+
+func TestWebsocketServer_BufferSizes(t *testing.T) {
+	wsServer := NewWebsocketServer(nil, nopLogger())
+	config := wsServer.Config()
+	upgrader := config.upgrader()
+	if upgrader.ReadBufferSize != websocketReadBufferSize || upgrader.WriteBufferSize != websocketWriteBufferSize {
+		t.Error("Expected the default buffer sizes, got", upgrader.ReadBufferSize, upgrader.WriteBufferSize)
+	}
+
+	wsServer.ReadBufferSize = 4096
+	wsServer.WriteBufferSize = 64 * 1024
+	config = wsServer.Config()
+	upgrader = config.upgrader()
+	if upgrader.ReadBufferSize != 4096 || upgrader.WriteBufferSize != 64*1024 {
+		t.Error("Expected the configured buffer sizes, got", upgrader.ReadBufferSize, upgrader.WriteBufferSize)
+	}
+}
+
+func TestWebsocketServer_MaxConnections(t *testing.T) {
+	const max = 3
+	connected := make(chan *fakeGuacd, max+1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		connected <- guacd
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.MaxConnections = max
+	url, done := serveWebsocket(t, wsServer)
+
+	var clients []*websocket.Conn
+	var guacds []*fakeGuacd
+	for i := 0; i < max; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = ws.Close() }()
+		clients = append(clients, ws)
+		guacds = append(guacds, <-connected)
+	}
+	if n := wsServer.ActiveConnections(); n != max {
+		t.Error("Expected", max, "active connections, got", n)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Expected connection over the limit to be refused with 503, got", err)
+	}
+	if status := resp.Header.Get("Guacamole-Status-Code"); status != strconv.Itoa(ServerBusy.GetGuacamoleStatusCode()) {
+		t.Error("Expected SERVER_BUSY, got", status)
+	}
+	waitDone(t, done)
+
+	// a slot frees up once a session ends
+	_ = clients[0].Close()
+	_ = guacds[0].Close()
+	waitDone(t, done)
+	if n := wsServer.ActiveConnections(); n != max-1 {
+		t.Error("Expected", max-1, "active connections, got", n)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal("Expected a connection once a slot is free, got", err)
+	}
+	_ = ws.Close()
+	_ = (<-connected).Close()
+}
+
+func TestWebsocketServer_ClientCloseStopsGuacdPump(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	reasons := make(chan CloseReason, 1)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.OnDisconnectReason = func(id string, ws *websocket.Conn, r *http.Request, tunnel Tunnel, reason CloseReason) {
+		reasons <- reason
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+
+	// guacd stays connected and quiet, but the session still ends
+	waitDone(t, done)
+	for range guacd.Received {
+	}
+	if reason := <-reasons; reason != CloseReasonClient {
+		t.Error("Expected the client to be blamed, got", reason)
+	}
+}
+
+func TestWsToGuacd_ContextDone(t *testing.T) {
+	// nothing is ever read from the websocket
+	wsIn := newWsReader(nil, func() {})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	stopped := make(chan CloseReason, 1)
+	go func() {
+		stopped <- wsToGuacd(ctx, nopLogger(), wsIn, io.Discard, pumpOptions{})
+	}()
+	select {
+	case reason := <-stopped:
+		if reason != CloseReasonUnknown {
+			t.Error("Expected the other pump's reason to stand, got", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected wsToGuacd to stop once the context is done")
+	}
+}
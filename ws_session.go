@@ -0,0 +1,412 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// ConnectResult is returned by connect functions that need more than a Tunnel to set up a session.
+type ConnectResult struct {
+	// Tunnel is the connection to guacd
+	Tunnel Tunnel
+	// Deadline is an optional time at which the session is disconnected, for example when the
+	// token that authorized it expires
+	Deadline time.Time
+	// Labels are optional key/value pairs describing the session, such as the user it belongs
+	// to, which can be used to find it later
+	Labels map[string]string
+	// User optionally identifies who the session belongs to, for the server's
+	// MaxSessionsPerUser
+	User string
+	// Protocol and Host optionally describe the remote the session connected to, for its
+	// SessionRecord
+	Protocol string
+	Host     string
+	// Metrics optionally receives the measurements of this session instead of the server's
+	// Metrics, for example to keep those of each guacd cluster apart
+	Metrics MetricsCollector
+	// BufferPool optionally supplies the buffer this session batches instructions from guacd
+	// in, instead of the server's, for example a pool of bigger buffers for a large screen
+	BufferPool *BufferPool
+	// ReadOnly drops the client's input before it reaches guacd, for viewers who watch a session
+	// without controlling it. Everything guacd sends still reaches them.
+	ReadOnly bool
+	// BlockedOpcodes are the instructions dropped from a ReadOnly client, ReadOnlyOpcodes if nil
+	BlockedOpcodes []string
+	// Filters optionally run after the server's Filters and ContextFilters for this session, such
+	// as to block the clipboard of some users
+	Filters []InstructionFilter
+	// Interceptor optionally replaces the server's Interceptor for this session
+	Interceptor InstructionInterceptor
+	// Thumbnails opts the session in to the server's OnThumbnail
+	Thumbnails bool
+	// Context optionally carries values for the session, such as the user and their policy,
+	// usually derived from the request's context with context.WithValue. ContextFilters are
+	// given it, and callbacks receive it as the context of their request. Only its values are
+	// used, not its cancellation.
+	Context context.Context
+}
+
+// ReadOnlyOpcodes are the instructions dropped from a ReadOnly client by default: its input, its
+// screen size, and the streams it would open to upload clipboard contents or files
+var ReadOnlyOpcodes = []string{"key", "mouse", "touch", "size", "clipboard", "file", "pipe"}
+
+// blockedOpcodes returns the set of opcodes dropped from a ReadOnly client
+func (r *ConnectResult) blockedOpcodes() map[string]bool {
+	opcodes := r.BlockedOpcodes
+	if opcodes == nil {
+		opcodes = ReadOnlyOpcodes
+	}
+	blocked := make(map[string]bool, len(opcodes))
+	for _, opcode := range opcodes {
+		blocked[opcode] = true
+	}
+	return blocked
+}
+
+// wsSession is a single websocket connection proxied to guacd by the WebsocketServer.
+// Messages written to the websocket are serialized so they can be sent from outside the
+// guacd to websocket pump, and either side can be closed from any goroutine.
+type wsSession struct {
+	id      string
+	ws      *websocket.Conn
+	request *http.Request
+	tunnel  Tunnel
+	writer  io.Writer
+	logger  *zerolog.Logger
+	labels  map[string]string
+
+	// compression is true if messages are compressed when the client negotiated it
+	compression bool
+
+	bytesToGuacd  int64
+	bytesToClient int64
+	// counts are the instructions sent each way, and started when guacd was connected
+	counts  sessionCounts
+	started time.Time
+
+	// closeReason is the first reason recorded for the session ending
+	closeReason int32
+	// closeCode, closeText and closeErr are the first close frame and error recorded, and
+	// closeFailed is set when that error ended the session abnormally
+	closeLock   sync.Mutex
+	closeCode   int
+	closeText   string
+	closeErr    error
+	closeFailed bool
+
+	// disconnecting is set once the client's disconnect is forwarded and guacd is given time to
+	// close, and guacdClosed is closed when the guacd to websocket pump is done with guacd
+	disconnecting int32
+	guacdClosed   chan struct{}
+	// disconnectSent is set once guacd is sent a disconnect, and tunnelClosed once the tunnel is
+	// closed
+	disconnectSent int32
+	tunnelClosed   int32
+
+	// lastPong is when the client last answered a keepalive ping, in Unix nanoseconds
+	lastPong int64
+	// pingRTT is the round trip time of the latest ping, and unreportedRTT the same until the
+	// keepalive has passed it on
+	pingRTT       int64
+	unreportedRTT int64
+
+	// lastInput is when the user last sent input, in Unix nanoseconds
+	lastInput int64
+
+	writeLock  sync.Mutex
+	tunnelOnce sync.Once
+	wsOnce     sync.Once
+}
+
+// WriteMessage writes a message to the websocket
+func (c *wsSession) WriteMessage(messageType int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.ws.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.bytesToClient, int64(len(data)))
+	return nil
+}
+
+func (c *wsSession) compressionEnabled() bool {
+	return c.compression
+}
+
+func (c *wsSession) writeMessageCompressed(messageType int, data []byte, compress bool) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.ws.EnableWriteCompression(compress)
+	defer c.ws.EnableWriteCompression(c.compression)
+	if err := c.ws.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.bytesToClient, int64(len(data)))
+	return nil
+}
+
+// wsReader reads the websocket for the whole session, from before the connect to guacd starts,
+// so a client that leaves during the connect is noticed and the connect abandoned. Messages read
+// before the pumps start are queued for them. Nothing else may read the websocket.
+type wsReader struct {
+	ws       *websocket.Conn
+	messages chan wsMessage
+	done     chan struct{}
+	// gone is called once the websocket can't be read, because the client left or sent something invalid
+	gone func()
+}
+
+type wsMessage struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+func newWsReader(ws *websocket.Conn, gone func()) *wsReader {
+	return &wsReader{
+		ws:       ws,
+		messages: make(chan wsMessage, 16),
+		done:     make(chan struct{}),
+		gone:     gone,
+	}
+}
+
+func (r *wsReader) readTask() {
+	for {
+		messageType, data, err := r.ws.ReadMessage()
+		if err != nil {
+			r.gone()
+		}
+		select {
+		case r.messages <- wsMessage{messageType, data, err}:
+		case <-r.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadMessage returns the next message read from the websocket
+func (r *wsReader) ReadMessage() (int, []byte, error) {
+	return r.ReadMessageContext(context.Background())
+}
+
+// ReadMessageContext returns the next message read from the websocket, or ctx.Err() if ctx is
+// done first
+func (r *wsReader) ReadMessageContext(ctx context.Context) (int, []byte, error) {
+	select {
+	case msg := <-r.messages:
+		return msg.messageType, msg.data, msg.err
+	case <-r.done:
+		return 0, nil, websocket.ErrCloseSent
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// stop ends the read task once the session is over
+func (r *wsReader) stop() {
+	close(r.done)
+}
+
+// countingWriter counts the bytes successfully written to guacd
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(data []byte) (int, error) {
+	n, err := w.Writer.Write(data)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// setCloseReason records why the session is ending, unless a reason was already recorded
+func (c *wsSession) setCloseReason(reason CloseReason) {
+	atomic.CompareAndSwapInt32(&c.closeReason, int32(CloseReasonUnknown), int32(reason))
+}
+
+// getCloseReason returns why the session ended
+func (c *wsSession) getCloseReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&c.closeReason))
+}
+
+// setCloseFrame records the close frame that ended the session, unless one was already recorded
+func (c *wsSession) setCloseFrame(code int, text string) {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if c.closeCode == 0 {
+		c.closeCode = code
+		c.closeText = text
+	}
+}
+
+// setCloseError records the error that ended the session and whether it ended abnormally,
+// unless an error was already recorded
+func (c *wsSession) setCloseError(err error, failed bool) {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if c.closeErr == nil {
+		c.closeErr = err
+		c.closeFailed = failed
+	}
+}
+
+// failure returns the error that ended the session, or nil if it ended cleanly
+func (c *wsSession) failure() error {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if !c.closeFailed {
+		return nil
+	}
+	return c.closeErr
+}
+
+// disconnectReason returns how the session ended
+func (c *wsSession) disconnectReason() DisconnectReason {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	return DisconnectReason{
+		Reason: c.getCloseReason(),
+		Code:   c.closeCode,
+		Text:   c.closeText,
+		Err:    c.closeErr,
+	}
+}
+
+// terminate ends the session from outside the pumps. The client is sent a Guacamole error
+// instruction and a close frame, guacd is sent a disconnect, and both connections are closed
+// which makes the pumps return.
+func (c *wsSession) terminate(reason CloseReason, status Status, message string) {
+	c.setCloseReason(reason)
+	c.logger.Info().Str("connection_id", c.id).Str("reason", message).Msg("terminating websocket connection")
+
+	errorIns := NewInstruction("error", message, strconv.Itoa(status.GetGuacamoleStatusCode()))
+	if err := c.WriteMessage(websocket.TextMessage, errorIns.Bytes()); err != nil {
+		c.logger.Trace().Err(err).Msg("Error sending error instruction")
+	}
+	c.disconnectGuacd()
+	c.setCloseFrame(status.GetWebSocketCode(), message)
+	c.setCloseError(&ErrGuac{error: errors.New(message), Status: status, Kind: ErrSessionClosed}, reason != CloseReasonAdmin)
+	closeMsg := websocket.FormatCloseMessage(status.GetWebSocketCode(), message)
+	if err := c.ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second)); err != nil {
+		c.logger.Trace().Err(err).Msg("Error sending close frame")
+	}
+
+	c.closeTunnel()
+	c.closeWs()
+}
+
+// recoverPanic ends the session when a pump or a callback panics, instead of letting the panic
+// crash the server. It must be deferred.
+func (c *wsSession) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	c.logger.Error().Str("connection_id", c.id).Interface("panic", r).Bytes("stack", debug.Stack()).Msg("recovered from panic in websocket connection")
+	c.terminate(CloseReasonError, ServerError, "Internal server error.")
+}
+
+// closeTunnel closes the tunnel once
+func (c *wsSession) closeTunnel() {
+	c.tunnelOnce.Do(func() {
+		if c.tunnel == nil {
+			return
+		}
+		atomic.StoreInt32(&c.tunnelClosed, 1)
+		if err := c.tunnel.Close(); err != nil {
+			c.logger.Trace().Err(err).Msg("Error closing tunnel")
+		}
+	})
+}
+
+// closeWs closes the websocket once
+func (c *wsSession) closeWs() {
+	c.wsOnce.Do(func() {
+		if err := c.ws.Close(); err != nil {
+			c.logger.Trace().Err(err).Msg("Error closing websocket")
+		}
+	})
+}
+
+// sessionRegistry tracks the sessions active on a WebsocketServer
+type sessionRegistry struct {
+	sync.RWMutex
+	sessions map[*wsSession]struct{}
+	// closed is set by Shutdown, after which no sessions are added
+	closed bool
+	// removed is signalled when a session is removed while closed
+	removed chan struct{}
+	// handlers counts the ServeHTTP calls that got past the closed check, including those still
+	// connecting that have no session yet
+	handlers sync.WaitGroup
+}
+
+// enter counts a ServeHTTP call, returning false if the server is shutting down. A call that
+// entered must call leave when it returns.
+func (g *sessionRegistry) enter() bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.closed {
+		return false
+	}
+	g.handlers.Add(1)
+	return true
+}
+
+// leave marks a ServeHTTP call counted by enter as returned
+func (g *sessionRegistry) leave() {
+	g.handlers.Done()
+}
+
+// add registers a session, returning false if the server is shutting down
+func (g *sessionRegistry) add(sess *wsSession) bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.closed {
+		return false
+	}
+	if g.sessions == nil {
+		g.sessions = map[*wsSession]struct{}{}
+	}
+	g.sessions[sess] = struct{}{}
+	return true
+}
+
+// remove unregisters a session, the registry must be locked
+func (g *sessionRegistry) remove(sess *wsSession) {
+	delete(g.sessions, sess)
+	if g.removed != nil {
+		select {
+		case g.removed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// find returns the sessions matching the predicate
+func (g *sessionRegistry) find(match func(*wsSession) bool) []*wsSession {
+	g.RLock()
+	defer g.RUnlock()
+	var ret []*wsSession
+	for sess := range g.sessions {
+		if match(sess) {
+			ret = append(ret, sess)
+		}
+	}
+	return ret
+}
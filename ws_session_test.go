@@ -0,0 +1,261 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_DisconnectByLabel(t *testing.T) {
+	users := []string{"alice", "bob", "alice"}
+	connected := make(chan struct{}, len(users))
+
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return &ConnectResult{
+			Tunnel: tunnel,
+			Labels: map[string]string{"user": r.URL.Query().Get("user")},
+		}, nil
+	}, nopLogger())
+	wsServer.OnConnectWs = func(string, *websocket.Conn, *http.Request) {
+		connected <- struct{}{}
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	clients := make([]*websocket.Conn, len(users))
+	for i, user := range users {
+		ws, _, err := websocket.DefaultDialer.Dial(url+"?user="+user, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = ws.Close() }()
+		clients[i] = ws
+		<-connected
+	}
+
+	if n := wsServer.DisconnectByLabel("user", "carol"); n != 0 {
+		t.Error("Expected no sessions for carol, got", n)
+	}
+	if n := wsServer.DisconnectByLabel("user", "alice"); n != 2 {
+		t.Error("Expected 2 sessions for alice, got", n)
+	}
+
+	for _, i := range []int{0, 2} {
+		_, msg, err := clients[i].ReadMessage()
+		if err != nil || !strings.HasPrefix(string(msg), "5.error,") {
+			t.Error("Expected an error instruction, got", string(msg), err)
+		}
+		if _, _, err = clients[i].ReadMessage(); !websocket.IsCloseError(err, SessionClosed.GetWebSocketCode()) {
+			t.Error("Expected close frame, got", err)
+		}
+		waitDone(t, done)
+	}
+
+	// bob is still connected
+	if n := len(wsServer.sessions.find(func(*wsSession) bool { return true })); n != 1 {
+		t.Error("Expected 1 active session got", n)
+	}
+	if n := wsServer.DisconnectByLabel("user", "bob"); n != 1 {
+		t.Error("Expected 1 session for bob, got", n)
+	}
+	waitDone(t, done)
+}
+
+func TestWebsocketServer_NotifyAndDisconnect(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	wsServer := NewWebsocketServerWs(func(ws *websocket.Conn, r *http.Request) (Tunnel, error) {
+		tunnel, _ := newFakeGuacd(t)
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.OnConnectWs = func(string, *websocket.Conn, *http.Request) {
+		connected <- struct{}{}
+	}
+	url, done := serveWebsocket(t, wsServer)
+
+	if err := wsServer.NotifyAndDisconnect(context.Background(), "missing", "Maintenance", 0); err == nil {
+		t.Error("Expected an unknown connection to be an error")
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	<-connected
+
+	// a cancelled wait leaves the session connected
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		cancelled <- wsServer.NotifyAndDisconnect(ctx, "$fake", "Ignored", time.Hour)
+	}()
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "0.,6.notice,7.Ignored,7.3600000;" {
+		t.Fatal("Expected the notice, got", string(msg), err)
+	}
+	cancel()
+	if err = <-cancelled; err != context.Canceled {
+		t.Error("Expected the wait to be cancelled, got", err)
+	}
+
+	const grace = 100 * time.Millisecond
+	start := time.Now()
+	go func() {
+		if err := wsServer.NotifyAndDisconnect(context.Background(), "$fake", "Maintenance", grace); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "0.,6.notice,11.Maintenance,3.100;" {
+		t.Error("Expected the notice first, got", string(msg))
+	}
+
+	_, msg, err = ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(msg), "5.error,11.Maintenance,") {
+		t.Error("Expected the disconnect after the notice, got", string(msg))
+	}
+	if elapsed := time.Since(start); elapsed < grace {
+		t.Error("Disconnected before the grace period, after", elapsed)
+	}
+	if _, _, err = ws.ReadMessage(); !websocket.IsCloseError(err, SessionClosed.GetWebSocketCode()) {
+		t.Error("Expected close frame, got", err)
+	}
+	waitDone(t, done)
+}
+
+func TestWebsocketServer_RecoverPanic(t *testing.T) {
+	tunnels := make(chan *SimpleTunnel, 2)
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel, guacd := newFakeGuacd(t)
+		t.Cleanup(func() { _ = guacd.Close() })
+		tunnels <- tunnel
+		return tunnel, nil
+	}, nopLogger())
+	wsServer.Filters = []InstructionFilter{func(ins *Instruction, dir Direction) (*Instruction, error) {
+		if ins.Opcode == "key" {
+			panic("buggy filter")
+		}
+		return ins, nil
+	}}
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	tunnel := <-tunnels
+
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := ws.ReadMessage()
+	if err != nil || !strings.HasPrefix(string(msg), "5.error,") {
+		t.Error("Expected an error instruction, got", string(msg), err)
+	}
+	if _, _, err = ws.ReadMessage(); !websocket.IsCloseError(err, ServerError.GetWebSocketCode()) {
+		t.Error("Expected close frame, got", err)
+	}
+	waitDone(t, done)
+	if _, err = tunnel.AcquireReader().ReadSome(); err == nil {
+		t.Error("Expected the tunnel to be closed")
+	}
+
+	// the server still accepts connections
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = (<-tunnels).Close()
+	_ = second.Close()
+	waitDone(t, done)
+}
+
+func TestWsToGuacd_ReadOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocked []string
+		expect  string
+	}{
+		{"default", nil, "4.sync,3.100;4.sync,3.200;"},
+		{"configured", []string{"size"}, "4.sync,3.100;3.key,2.65,1.1;5.mouse,1.1,1.2;9.clipboard,1.0,10.text/plain;4.sync,3.200;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &ConnectResult{ReadOnly: true, BlockedOpcodes: tt.blocked}
+			ws := &fakeMessageReader{messages: [][]byte{
+				[]byte("4.sync,3.100;3.key,2.65,1.1;5.mouse,1.1,1.2;"),
+				[]byte("4.size,4.1024,3.768;"),
+				[]byte("9.clipboard,1.0,10.text/plain;4.sync,3.200;"),
+			}}
+			var guacd bytes.Buffer
+			wsToGuacd(context.Background(), nopLogger(), ws, &guacd, pumpOptions{blocked: result.blockedOpcodes()})
+			if guacd.String() != tt.expect {
+				t.Errorf("Expected %q, got %q", tt.expect, guacd.String())
+			}
+		})
+	}
+}
+
+func TestWsToGuacd_ReadOnlyUnparsable(t *testing.T) {
+	result := &ConnectResult{ReadOnly: true}
+	ws := &fakeMessageReader{messages: [][]byte{
+		// a prefix the scanner can't parse
+		[]byte("x;3.key,2.65,1.1;"),
+		// guacd sizes the invalid character from its lead byte, so it reads a nop then the key
+		[]byte("3.nop,1.\xE2;4;3.key,2.65,1.1;"),
+		// an instruction left incomplete would continue into the next message in guacd
+		[]byte("4.sync,3.100;3.nop,10.abc"),
+		[]byte("4.sync,3.200;"),
+	}}
+	var guacd bytes.Buffer
+	wsToGuacd(context.Background(), nopLogger(), ws, &guacd, pumpOptions{blocked: result.blockedOpcodes()})
+	if expect := "4.sync,3.100;4.sync,3.200;"; guacd.String() != expect {
+		t.Errorf("Expected %q, got %q", expect, guacd.String())
+	}
+}
+
+func TestWebsocketServer_ReadOnly(t *testing.T) {
+	tunnel, guacd := newFakeGuacd(t)
+	wsServer := NewWebsocketServerResult(func(ws *websocket.Conn, r *http.Request) (*ConnectResult, error) {
+		return &ConnectResult{Tunnel: tunnel, ReadOnly: true}, nil
+	}, nopLogger())
+	url, done := serveWebsocket(t, wsServer)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	for _, msg := range []string{"3.key,2.65,1.1;", "5.mouse,1.1,1.2;", "4.sync,3.100;"} {
+		if err = ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if received := <-guacd.Received; received != "4.sync,3.100;" {
+		t.Errorf("Expected only the sync to reach guacd, got %q", received)
+	}
+
+	// the display still reaches the viewer
+	if _, err = guacd.Write([]byte("4.sync,3.200;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "4.sync,3.200;" {
+		t.Errorf("Expected the sync from guacd, got %q %v", msg, err)
+	}
+
+	_ = ws.Close()
+	waitDone(t, done)
+}